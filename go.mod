@@ -0,0 +1,15 @@
+module github.com/romanov9617/usb-quic
+
+go 1.25.5
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.58.0
+	golang.org/x/net v0.43.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
@@ -0,0 +1,43 @@
+// Package cmdutil holds the helpers shared by the commands under utils:
+// logging, signal handling, QUIC version lists, public key pins and pprof
+// set up the same way for all of them.
+package cmdutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NewLogHandler returns a log handler writing to w in format, "text" or
+// "json".
+func NewLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// WithSignals returns a child context that is canceled on SIGINT or SIGTERM.
+// The returned cancel function should be called to release resources.
+func WithSignals(ctx context.Context, logger *slog.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-ch
+		logger.Info("signal received, shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,52 @@
+package cmdutil
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// PinPrefix prefixes the public key pins printed by the server and accepted
+// by the client's -pin.
+const PinPrefix = "sha256:"
+
+// quicVersions maps the names accepted by -quic-versions to QUIC versions.
+var quicVersions = map[string]quic.Version{
+	"v1": quic.Version1,
+	"v2": quic.Version2,
+}
+
+// ParseQUICVersions turns a comma-separated list of QUIC version names into
+// versions, in order of preference.
+func ParseQUICVersions(list string) ([]quic.Version, error) {
+	var versions []quic.Version
+	for name := range strings.SplitSeq(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		v, ok := quicVersions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown QUIC version %q", name)
+		}
+		if !slices.Contains(versions, v) {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no QUIC versions")
+	}
+	return versions, nil
+}
+
+// SPKIPin returns the pin clients pass with -pin to accept cert by its
+// public key: the base64 SHA-256 hash of its SubjectPublicKeyInfo.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return PinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
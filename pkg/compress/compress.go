@@ -0,0 +1,228 @@
+// Package compress implements the zstd message compression the echo
+// protocol negotiates per stream, for text-heavy traffic over links short
+// of bandwidth.
+//
+// A stream that offers "compress=zstd" in its preamble, and whose server
+// accepts it, carries its messages in both directions with a small header
+// instead of a newline:
+//
+//	<kind> <length> <data>
+//
+// The kind is one byte: [KindStored] if the data is the message as is, or
+// [KindZstd] if it is the message compressed as a single zstd frame. The
+// length is the length of the data as an unsigned varint. Messages are
+// stored when compressing them does not make them smaller, so that the data
+// of a message is never longer than the message, and both it and the
+// message it decompresses to are bounded by the maximum message size of the
+// stream. Messages may hold any bytes, newlines included.
+package compress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Zstd is the name of zstd compression in the preamble.
+const Zstd = "zstd"
+
+// Kinds of the data of a message.
+const (
+	KindStored byte = 0
+	KindZstd   byte = 1
+)
+
+// maxWindow bounds the window of the zstd frames accepted, and with it the
+// memory a frame can make the decoder allocate.
+const maxWindow = 8 << 20
+
+// ErrTooLarge is the error of a message longer than the limit of the
+// stream, compressed or not.
+var ErrTooLarge = errors.New("message too large")
+
+// zstdEncoder returns the zstd encoder shared by all streams, created on
+// first use. EncodeAll is safe for concurrent use.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+// zstdDecoder returns the zstd decoder shared by all streams, created on
+// first use. DecodeAll is safe for concurrent use, and decodes no more than
+// the capacity left in its destination, which bounds a message by the limit
+// of its stream.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderMaxWindow(maxWindow), zstd.WithDecodeAllCapLimit(true))
+})
+
+// Stats count the bytes of the messages of a stream, as given to or
+// returned by a [Codec] and as carried on the stream, headers included.
+type Stats struct {
+	RawSent, WireSent         uint64
+	RawReceived, WireReceived uint64
+}
+
+// Ratio returns the compression ratio of all the messages counted by s,
+// their raw size over their size on the stream, or 0 if there were none.
+// Ratios above 1 mean that compression saved bandwidth.
+func (s Stats) Ratio() float64 {
+	wire := s.WireSent + s.WireReceived
+	if wire == 0 {
+		return 0
+	}
+	return float64(s.RawSent+s.RawReceived) / float64(wire)
+}
+
+// Add returns the sum of s and t.
+func (s Stats) Add(t Stats) Stats {
+	return Stats{
+		RawSent:      s.RawSent + t.RawSent,
+		WireSent:     s.WireSent + t.WireSent,
+		RawReceived:  s.RawReceived + t.RawReceived,
+		WireReceived: s.WireReceived + t.WireReceived,
+	}
+}
+
+// Codec compresses the messages sent on a stream and decompresses the ones
+// received, and counts their bytes. AppendMessage may run concurrently with
+// ReadMessage, and Stats with both, but neither of the first two with
+// itself.
+type Codec struct {
+	enc   *zstd.Encoder
+	dec   *zstd.Decoder
+	limit int
+	// data holds the data of the message being read, and buf the message
+	// it decompresses to, both reused from message to message.
+	data, buf []byte
+
+	rawSent, wireSent         atomic.Uint64
+	rawReceived, wireReceived atomic.Uint64
+}
+
+// NewCodec returns a codec for a stream whose messages are at most limit
+// bytes.
+func NewCodec(limit int) (*Codec, error) {
+	enc, err := zstdEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("zstd encoder: %w", err)
+	}
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("zstd decoder: %w", err)
+	}
+	return &Codec{enc: enc, dec: dec, limit: limit}, nil
+}
+
+// AppendMessage appends msg, compressed if that makes it smaller, to dst
+// with its header.
+func (c *Codec) AppendMessage(dst, msg []byte) []byte {
+	kind, data := KindStored, msg
+	if z := c.enc.EncodeAll(msg, nil); len(z) < len(msg) {
+		kind, data = KindZstd, z
+	}
+	n := len(dst)
+	dst = append(dst, kind)
+	dst = binary.AppendUvarint(dst, uint64(len(data)))
+	dst = append(dst, data...)
+	c.rawSent.Add(uint64(len(msg)))
+	c.wireSent.Add(uint64(len(dst) - n))
+	return dst
+}
+
+// ReadMessage reads the next message from br and returns it decompressed.
+// The message is only valid until the next call. It returns io.EOF if the
+// stream ends before a message, io.ErrUnexpectedEOF if it ends inside one,
+// and [ErrTooLarge] for a message longer than the limit, compressed or not.
+func (c *Codec) ReadMessage(br *bufio.Reader) ([]byte, error) {
+	kind, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if kind != KindStored && kind != KindZstd {
+		return nil, fmt.Errorf("unknown message kind %d", kind)
+	}
+	if n > uint64(c.limit) {
+		return nil, ErrTooLarge
+	}
+	if uint64(cap(c.data)) < n {
+		c.data = make([]byte, n)
+	}
+	data := c.data[:n]
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	c.wireReceived.Add(uint64(1+uvarintLen(n)) + n)
+
+	msg := data
+	if kind == KindZstd {
+		if msg, err = c.decompress(data); err != nil {
+			return nil, err
+		}
+	}
+	c.rawReceived.Add(uint64(len(msg)))
+	return msg, nil
+}
+
+// decompress decompresses the zstd frame data into the buffer of c. The
+// buffer only grows to the content size the frame declares, so that small
+// messages do not cost a buffer of the limit.
+func (c *Codec) decompress(data []byte) ([]byte, error) {
+	size := c.limit
+	var h zstd.Header
+	if h.Decode(data) == nil && h.HasFCS {
+		if h.FrameContentSize > uint64(c.limit) {
+			return nil, ErrTooLarge
+		}
+		size = int(h.FrameContentSize)
+	}
+	if cap(c.buf) < size {
+		c.buf = make([]byte, 0, size)
+	}
+	msg, err := c.dec.DecodeAll(data, c.buf[:0:size])
+	switch {
+	case errors.Is(err, zstd.ErrDecoderSizeExceeded) && size == c.limit:
+		return nil, ErrTooLarge
+	case err != nil:
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return msg, nil
+}
+
+// Limit returns the maximum message size of c.
+func (c *Codec) Limit() int { return c.limit }
+
+// Stats returns the bytes counted so far.
+func (c *Codec) Stats() Stats {
+	return Stats{
+		RawSent:      c.rawSent.Load(),
+		WireSent:     c.wireSent.Load(),
+		RawReceived:  c.rawReceived.Load(),
+		WireReceived: c.wireReceived.Load(),
+	}
+}
+
+// uvarintLen returns the length of x as an unsigned varint.
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// unexpectedEOF turns io.EOF inside a message into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
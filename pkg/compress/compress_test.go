@@ -0,0 +1,49 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// FuzzReadMessage checks that no message read, however corrupt the stream,
+// is longer than the limit, and that every message read survives a round
+// trip through another codec.
+func FuzzReadMessage(f *testing.F) {
+	c, err := NewCodec(1 << 10)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(c.AppendMessage(nil, []byte("hello")), uint16(1<<10))
+	f.Add(c.AppendMessage(nil, []byte(strings.Repeat("hello ", 100))), uint16(1<<10))
+	// A zstd frame decompressing to more than the limit.
+	f.Add(c.AppendMessage(nil, []byte(strings.Repeat("hello ", 100))), uint16(100))
+	f.Add([]byte{KindZstd, 0xff, 0xff, 0xff, 0xff, 0x0f}, uint16(1<<10))
+	f.Add([]byte{7, 1, 'x'}, uint16(1<<10))
+	f.Fuzz(func(t *testing.T, data []byte, limit uint16) {
+		c, err := NewCodec(int(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := NewCodec(int(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(bytes.NewReader(data))
+		for {
+			msg, err := c.ReadMessage(br)
+			if err != nil {
+				return
+			}
+			if len(msg) > int(limit) {
+				t.Fatalf("message of %d bytes with a limit of %d", len(msg), limit)
+			}
+			wire := peer.AppendMessage(nil, msg)
+			again, err := peer.ReadMessage(bufio.NewReader(bytes.NewReader(wire)))
+			if err != nil || !bytes.Equal(again, msg) {
+				t.Fatalf("message changed in a round trip: %q, %v, want %q", again, err, msg)
+			}
+		}
+	})
+}
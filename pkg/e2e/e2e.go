@@ -0,0 +1,174 @@
+// Package e2e implements the optional application-layer encryption of echo
+// messages, independent of the QUIC/TLS layer.
+//
+// Both peers exchange X25519 public keys in the stream preamble and derive
+// one AES-256-GCM key per direction with HKDF-SHA256. Messages are sealed with
+// a per-direction sequence number as nonce, which is sound because a QUIC
+// stream delivers messages reliably and in order. Sealed messages are base64
+// encoded so they never contain the newline that terminates messages.
+//
+// The public keys are not authenticated by themselves: anyone who can read
+// and rewrite the preamble, such as a middlebox that terminates TLS, can run
+// one exchange with each peer and read every message. Without a pre-shared
+// key the encryption therefore only hides messages from observers of the
+// decrypted QUIC stream. With a pre-shared key, which is mixed into the key
+// derivation, such a middlebox cannot derive the keys, and a peer with a
+// different key fails to open the first message.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Scheme is the preamble value prefix identifying the key exchange.
+const Scheme = "x25519"
+
+// PSKSize is the size of a pre-shared key.
+const PSKSize = 32
+
+// encoding is used for public keys and sealed messages.
+var encoding = base64.RawStdEncoding
+
+// GenerateKey returns a fresh X25519 private key.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// FormatPublicKey encodes pub as a preamble value, e.g. "x25519:<base64>".
+func FormatPublicKey(pub *ecdh.PublicKey) string {
+	return Scheme + ":" + encoding.EncodeToString(pub.Bytes())
+}
+
+// ParsePublicKey decodes a preamble value produced by [FormatPublicKey].
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	scheme, b64, ok := strings.Cut(s, ":")
+	if !ok || scheme != Scheme {
+		return nil, fmt.Errorf("unsupported key exchange %q", scheme)
+	}
+	raw, err := encoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// ReadPSK reads a pre-shared key from the file at path, which holds
+// [PSKSize] hex-encoded bytes, optionally surrounded by white space.
+func ReadPSK(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(psk) != PSKSize {
+		return nil, fmt.Errorf("%s: pre-shared key must be %d hex-encoded bytes", path, PSKSize)
+	}
+	return psk, nil
+}
+
+// Session seals outgoing and opens incoming messages of one stream. Seal
+// and Open may be called concurrently with each other, as each only uses
+// the key and sequence number of its own direction, so that one goroutine
+// can read a stream while another writes it; neither may be called
+// concurrently with itself.
+type Session struct {
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// NewSession derives the per-direction keys from priv, the peer's public key
+// and psk, the pre-shared key, which may be nil. isClient selects which
+// derived key is used for sending.
+func NewSession(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, psk []byte, isClient bool) (*Session, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("x25519: %w", err)
+	}
+	secret := append(shared, psk...)
+
+	// Bind the keys to both public keys, ordered client first.
+	clientPub, serverPub := priv.PublicKey().Bytes(), peer.Bytes()
+	if !isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+
+	c2s, err := newAEAD(secret, salt, "qecho e2e client to server")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAEAD(secret, salt, "qecho e2e server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	if isClient {
+		return &Session{seal: c2s, open: s2c}, nil
+	}
+	return &Session{seal: s2c, open: c2s}, nil
+}
+
+// newAEAD derives an AES-256-GCM instance for one direction.
+func newAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the GCM nonce for sequence number seq.
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+// Seal encrypts msg and returns its newline-free wire encoding.
+func (s *Session) Seal(msg []byte) []byte {
+	ct := s.seal.Seal(nil, nonce(s.sendSeq), msg, nil)
+	s.sendSeq++
+
+	out := make([]byte, encoding.EncodedLen(len(ct)))
+	encoding.Encode(out, ct)
+	return out
+}
+
+// Open decodes and decrypts a message produced by the peer's Seal.
+func (s *Session) Open(wire []byte) ([]byte, error) {
+	ct := make([]byte, encoding.DecodedLen(len(wire)))
+	n, err := encoding.Decode(ct, wire)
+	if err != nil {
+		return nil, fmt.Errorf("decode message: %w", err)
+	}
+
+	msg, err := s.open.Open(nil, nonce(s.recvSeq), ct[:n], nil)
+	if err != nil {
+		return nil, errors.New("message authentication failed")
+	}
+	s.recvSeq++
+	return msg, nil
+}
+
+// SealedLen returns the wire length of a sealed message of n plaintext bytes.
+func SealedLen(n int) int {
+	return encoding.EncodedLen(n + 16)
+}
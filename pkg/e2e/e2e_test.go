@@ -0,0 +1,173 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// newPair returns the client and server sessions of one exchange, bound to
+// clientPSK and serverPSK.
+func newPair(t testing.TB, clientPSK, serverPSK []byte) (client, server *Session) {
+	t.Helper()
+	cpriv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spriv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, err = NewSession(cpriv, spriv.PublicKey(), clientPSK, true); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = NewSession(spriv, cpriv.PublicKey(), serverPSK, false); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestRoundTrip(t *testing.T) {
+	psk := bytes.Repeat([]byte{7}, PSKSize)
+	for _, tc := range []struct {
+		name string
+		psk  []byte
+	}{
+		{"no psk", nil},
+		{"psk", psk},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := newPair(t, tc.psk, tc.psk)
+			for i := range 3 {
+				msg := fmt.Appendf(nil, "message %d", i)
+				wire := client.Seal(msg)
+				if len(wire) != SealedLen(len(msg)) {
+					t.Errorf("sealed length = %d, want %d", len(wire), SealedLen(len(msg)))
+				}
+				if bytes.IndexByte(wire, '\n') >= 0 {
+					t.Errorf("sealed message %q contains a newline", wire)
+				}
+				got, err := server.Open(wire)
+				if err != nil {
+					t.Fatalf("server open: %v", err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("server opened %q, want %q", got, msg)
+				}
+				if got, err = client.Open(server.Seal(msg)); err != nil || !bytes.Equal(got, msg) {
+					t.Fatalf("client opened %q, %v, want %q", got, err, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestPSKMismatch(t *testing.T) {
+	psk := bytes.Repeat([]byte{7}, PSKSize)
+	for _, tc := range []struct {
+		name                 string
+		clientPSK, serverPSK []byte
+	}{
+		{"server only", nil, psk},
+		{"client only", psk, nil},
+		{"different", psk, bytes.Repeat([]byte{8}, PSKSize)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := newPair(t, tc.clientPSK, tc.serverPSK)
+			if _, err := server.Open(client.Seal([]byte("hello"))); err == nil {
+				t.Error("message opened despite the mismatched keys")
+			}
+		})
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	client, server := newPair(t, nil, nil)
+	wire := client.Seal([]byte("once"))
+	if _, err := server.Open(wire); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Open(wire); err == nil {
+		t.Error("replayed message opened")
+	}
+}
+
+// TestSealOpenConcurrent checks, under the race detector, that a session
+// may seal and open at the same time, as the chat does.
+func TestSealOpenConcurrent(t *testing.T) {
+	client, server := newPair(t, nil, nil)
+	const n = 100
+	toServer := make(chan []byte, n)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range n {
+			toServer <- client.Seal(fmt.Appendf(nil, "up %d", i))
+		}
+		close(toServer)
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range n {
+			if _, err := client.Open(server.Seal(fmt.Appendf(nil, "down %d", i))); err != nil {
+				t.Errorf("client open %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	var i int
+	for wire := range toServer {
+		if _, err := server.Open(wire); err != nil {
+			t.Fatalf("server open %d: %v", i, err)
+		}
+		i++
+	}
+	wg.Wait()
+}
+
+// FuzzParsePublicKey checks that every key accepted formats to a value that
+// parses back to the same key.
+func FuzzParsePublicKey(f *testing.F) {
+	priv, err := GenerateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(FormatPublicKey(priv.PublicKey()))
+	f.Add(Scheme + ":")
+	f.Add("p256:AAAA")
+	f.Fuzz(func(t *testing.T, s string) {
+		pub, err := ParsePublicKey(s)
+		if err != nil {
+			return
+		}
+		again, err := ParsePublicKey(FormatPublicKey(pub))
+		if err != nil {
+			t.Fatalf("formatted key does not parse: %v", err)
+		}
+		if !again.Equal(pub) {
+			t.Fatalf("key changed in a round trip")
+		}
+	})
+}
+
+// FuzzOpen checks that no forged message authenticates, and that failing
+// to open one leaves the session in step with its peer.
+func FuzzOpen(f *testing.F) {
+	client, _ := newPair(f, nil, nil)
+	f.Add(client.Seal([]byte("hello")))
+	f.Add([]byte(""))
+	f.Add([]byte("not base64!"))
+	f.Fuzz(func(t *testing.T, wire []byte) {
+		client, server := newPair(t, nil, nil)
+		if _, err := server.Open(wire); err == nil {
+			t.Fatalf("forged message %q opened", wire)
+		}
+		msg := []byte("hello")
+		got, err := server.Open(client.Seal(msg))
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("opened %q, %v after a forgery, want %q", got, err, msg)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package echoclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// frameHeaderLen is the length of the prefix of a message in binary
+// framing, see [ALPNBinary]. It must match the server's.
+const frameHeaderLen = 4
+
+// maxFrameLen bounds messages with binary framing when no maximum message
+// size is offered, so that their lengths fit the prefix and an int on every
+// platform.
+const maxFrameLen = math.MaxInt32
+
+// appendFrame appends msg to b with the length prefix of binary framing.
+func appendFrame(b, msg []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readFrameHeader reads the length prefix of the next message with binary
+// framing from r and returns the length. Longer messages than limit fail
+// with a [MessageTooLargeError] before they are read.
+func readFrameHeader(r io.Reader, limit int) (int, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, asMessageTooLarge(err, limit)
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if uint64(size) > uint64(limit) {
+		return 0, &MessageTooLargeError{Size: int(min(uint64(size), math.MaxInt32)), Limit: limit}
+	}
+	return int(size), nil
+}
+
+// frameError converts the failure to read the rest of a message with
+// binary framing of the given limit: a stream that ends inside the message
+// fails with [io.ErrUnexpectedEOF].
+func frameError(err error, limit int) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return asMessageTooLarge(err, limit)
+}
@@ -0,0 +1,317 @@
+package echoclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/priority"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation identifier of the echo
+// protocol.
+const ALPN = "quic-echo"
+
+// ALPNBinary is the ALPN identifier of the echo protocol with binary
+// framing: every message is prefixed with its length, a 4-byte big-endian
+// integer, instead of ending with a newline, so that it may hold any bytes.
+const ALPNBinary = "quic-echo-bin"
+
+// GoAwayCode is the application error code the server closes connections
+// with when it shuts down.
+const GoAwayCode = errcode.ShuttingDown
+
+// AuthFailedCode is the application error code the server closes a
+// connection with when it fails to authenticate.
+const AuthFailedCode = errcode.AuthFailed
+
+// IdleStreamCode is the stream error code the server resets idle streams
+// with.
+const IdleStreamCode = errcode.StreamIdle
+
+// Options configures [Dial].
+type Options struct {
+	// TLSConfig is used for the handshake. NextProtos defaults to [ALPN],
+	// or [ALPNBinary] with Binary.
+	TLSConfig *tls.Config
+	// QUICConfig is passed to quic-go unchanged and may be nil.
+	QUICConfig *quic.Config
+	// Early makes Dial return before the handshake completes, so that data
+	// is sent as 0-RTT if a resumed session allows it.
+	Early bool
+	// FailAtStreamLimit makes opening a stream fail with a
+	// [quic.StreamLimitReachedError] while the server's stream limit is
+	// reached, instead of waiting for the server to raise it.
+	FailAtStreamLimit bool
+	// Token, if not empty, authenticates the connection to a server that
+	// requires it: it is sent as the first line of the first stream.
+	Token string
+	// ConnectionIDLength is the length of the connection IDs the client
+	// chooses, or 0 for quic-go's default of 4 bytes.
+	ConnectionIDLength int
+	// StreamOptions configures the stream [Client.Send] opens.
+	StreamOptions StreamOptions
+	// Binary selects binary framing, see [ALPNBinary], for all streams of
+	// the client, as if set in their [StreamOptions].
+	Binary bool
+}
+
+// ErrNoDatagrams reports that a connection cannot carry datagrams because
+// the client or the server did not enable them.
+var ErrNoDatagrams = errors.New("datagrams not supported on the connection")
+
+// Client is a connection to an echo server.
+type Client struct {
+	conn        *quic.Conn
+	failAtLimit bool
+	binary      bool
+	// sched orders the writes of the streams by their priority.
+	sched *priority.Scheduler
+
+	// authMu serializes opening streams until the token has gone out on
+	// the first one.
+	authMu   sync.Mutex
+	token    string
+	authSent bool
+
+	// bidiOpened and uniOpened count the streams opened on the connection.
+	bidiOpened atomic.Int64
+	uniOpened  atomic.Int64
+
+	// uniWaiters maps the IDs of outstanding unidirectional echo requests
+	// to the channels their replies are delivered on.
+	uniOnce    sync.Once
+	uniMu      sync.Mutex
+	uniWaiters map[quic.StreamID]chan uniReply
+
+	// sendMu serializes [Client.Send] on sendSt, its stream, opened with
+	// sendOpts on first use.
+	sendMu   sync.Mutex
+	sendSt   *Stream
+	sendOpts StreamOptions
+}
+
+// Dial connects to the echo server at addr, racing its addresses like
+// [DialAddr], configured by opts, which apply in order.
+func Dial(ctx context.Context, addr string, opt ...Option) (*Client, error) {
+	opts := collectOptions(opt)
+	conn, err := dialAddr(ctx, addr, opts.tlsConfig(), opts.QUICConfig, opts.Early, opts.ConnectionIDLength)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	return newClient(conn, opts), nil
+}
+
+// DialTransport connects to the echo server at addr over tr, instead of
+// over UDP sockets of its own like [Dial], e.g. over a connection of package
+// memtransport in tests. [Options.ConnectionIDLength] does not apply; the
+// transport's does.
+func DialTransport(ctx context.Context, tr *quic.Transport, addr net.Addr, opt ...Option) (*Client, error) {
+	opts := collectOptions(opt)
+	var conn *quic.Conn
+	var err error
+	if opts.Early {
+		conn, err = tr.DialEarly(ctx, addr, opts.tlsConfig(), opts.QUICConfig)
+	} else {
+		conn, err = tr.Dial(ctx, addr, opts.tlsConfig(), opts.QUICConfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	return newClient(conn, opts), nil
+}
+
+// newClient returns a Client on conn, configured by opts.
+func newClient(conn *quic.Conn, opts Options) *Client {
+	return &Client{
+		conn:        conn,
+		failAtLimit: opts.FailAtStreamLimit,
+		binary:      opts.Binary,
+		sched:       priority.NewScheduler(),
+		token:       opts.Token,
+		uniWaiters:  make(map[quic.StreamID]chan uniReply),
+		sendOpts:    opts.StreamOptions,
+	}
+}
+
+// Conn returns the underlying QUIC connection.
+func (c *Client) Conn() *quic.Conn { return c.conn }
+
+// OpenStream opens a new stream and negotiates it according to opts. If the
+// server rejects the 0-RTT data of an early connection, the stream is opened
+// again once the handshake completes.
+func (c *Client) OpenStream(ctx context.Context, opts StreamOptions) (*Stream, error) {
+	st, err := c.openStream(ctx, opts)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if _, err := c.conn.NextConnection(ctx); err != nil {
+			return nil, err
+		}
+		st, err = c.openStream(ctx, opts)
+	}
+	return st, err
+}
+
+// openStream opens a new stream and negotiates it according to opts.
+func (c *Client) openStream(ctx context.Context, opts StreamOptions) (*Stream, error) {
+	qst, err := c.openAuthStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts.Binary = opts.Binary || c.binary
+
+	st, err := newStream(ctx, qst, opts, c.sched)
+	if err != nil {
+		qst.CancelRead(0)
+		qst.CancelWrite(0)
+		return nil, err
+	}
+	return st, nil
+}
+
+// openAuthStream opens a new stream. If the token has not been sent yet,
+// it is sent first on the new stream.
+func (c *Client) openAuthStream(ctx context.Context) (*quic.Stream, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	var qst *quic.Stream
+	var err error
+	if c.failAtLimit {
+		qst, err = c.conn.OpenStream()
+	} else {
+		qst, err = c.conn.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.bidiOpened.Add(1)
+	if c.token != "" && !c.authSent {
+		if _, err := io.WriteString(qst, c.token+"\n"); err != nil {
+			qst.CancelRead(0)
+			qst.CancelWrite(0)
+			return nil, fmt.Errorf("send token: %w", err)
+		}
+		c.authSent = true
+	}
+	return qst, nil
+}
+
+// Authenticate sends the token on a stream of its own unless it went out on
+// an earlier stream already. Streams opened with [Client.OpenStream] carry
+// the token themselves; Authenticate is for connections used otherwise, for
+// example only for unidirectional streams or datagrams.
+func (c *Client) Authenticate(ctx context.Context) error {
+	c.authMu.Lock()
+	sent := c.token == "" || c.authSent
+	c.authMu.Unlock()
+	if sent {
+		return nil
+	}
+	qst, err := c.openAuthStream(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	qst.CancelRead(0)
+	return qst.Close()
+}
+
+// Send sends msg on a stream of the client and returns its echo. The stream
+// is opened with [Options.StreamOptions] on the first call and kept for the
+// next ones, which wait for each other. If a call fails, the stream is
+// abandoned, so that the next call opens a new one instead of reading a late
+// echo.
+func (c *Client) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendSt == nil {
+		st, err := c.OpenStream(ctx, c.sendOpts)
+		if err != nil {
+			return nil, fmt.Errorf("open stream: %w", err)
+		}
+		c.sendSt = st
+	}
+	var echo bytes.Buffer
+	err := c.sendSt.Send(ctx, msg)
+	if err == nil {
+		_, err = c.sendSt.Receive(ctx, &echo)
+	}
+	if err != nil {
+		c.sendSt.QUICStream().CancelRead(0)
+		c.sendSt.QUICStream().CancelWrite(0)
+		c.sendSt = nil
+		return nil, err
+	}
+	return echo.Bytes(), nil
+}
+
+// SendDatagram sends msg in a datagram and returns the next datagram
+// received, its echo unless the datagram or its echo was lost and a late
+// echo of an earlier one arrived instead. Datagrams must be enabled in
+// [Options.QUICConfig]; without them on both ends it fails with
+// [ErrNoDatagrams]. It must not be called while datagrams are received
+// otherwise.
+func (c *Client) SendDatagram(ctx context.Context, msg []byte) ([]byte, error) {
+	if !c.conn.ConnectionState().SupportsDatagrams {
+		return nil, ErrNoDatagrams
+	}
+	if err := c.conn.SendDatagram(msg); err != nil {
+		return nil, fmt.Errorf("send datagram: %w", err)
+	}
+	echo, err := c.conn.ReceiveDatagram(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("receive datagram: %w", err)
+	}
+	return echo, nil
+}
+
+// StreamsOpened returns the number of bidirectional and unidirectional
+// streams opened on the connection so far, including the stream that
+// carried the token.
+func (c *Client) StreamsOpened() (bidi, uni int64) {
+	return c.bidiOpened.Load(), c.uniOpened.Load()
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.CloseWithError(errcode.NoError, "bye")
+}
+
+// IsGoAway reports whether err is the connection close the server sends when
+// it shuts down, and returns the reason it gave.
+func IsGoAway(err error) (string, bool) {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == GoAwayCode {
+		return appErr.ErrorMessage, true
+	}
+	return "", false
+}
+
+// IsStreamLimit reports whether err is due to the server's stream limit being
+// reached; see [Options.FailAtStreamLimit].
+func IsStreamLimit(err error) bool {
+	var le *quic.StreamLimitReachedError
+	return errors.As(err, &le)
+}
+
+// IsAuthFailed reports whether err is the connection close the server sends
+// when the connection fails to authenticate.
+func IsAuthFailed(err error) bool {
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == AuthFailedCode
+}
+
+// IsIdleReset reports whether err is the reset the server sends for a stream
+// that was idle for too long. A new stream can be opened in its place.
+func IsIdleReset(err error) bool {
+	var se *quic.StreamError
+	return errors.As(err, &se) && se.Remote && se.ErrorCode == IdleStreamCode
+}
@@ -0,0 +1,185 @@
+package echoclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// attemptDelay is the Connection Attempt Delay of RFC 8305: how long a
+// connection attempt runs alone before the next address is tried next to
+// it.
+const attemptDelay = 250 * time.Millisecond
+
+// DialAddr connects to the QUIC server at addr, a host and port, like
+// [quic.DialAddr], but with Happy Eyeballs (RFC 8305): the host is resolved
+// to its IPv6 and IPv4 addresses, which are tried alternately, starting with
+// IPv6. Every attempt gets a head start of 250ms, less if it fails, before
+// the next one starts in parallel, and the first handshake to complete wins.
+// Each attempt dials from a UDP socket of its own, of the address's family,
+// that is closed with the connection.
+func DialAddr(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	return dialAddr(ctx, addr, tlsConf, conf, false, 0)
+}
+
+// dialAddr is [DialAddr], returning early if early is set, with connection
+// IDs of connIDLen bytes.
+func dialAddr(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config, early bool, connIDLen int) (*quic.Conn, error) {
+	targets, host, err := resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf.ServerName == "" {
+		// quic-go would take it from the IP address dialed.
+		tlsConf = tlsConf.Clone()
+		tlsConf.ServerName = host
+	}
+	return raceDial(ctx, targets, func(ctx context.Context, to netip.AddrPort) (*quic.Conn, error) {
+		return dialOne(ctx, to, tlsConf, conf, early, connIDLen)
+	})
+}
+
+// resolveAddr resolves addr, a host and port, to the addresses to try in
+// the order of RFC 8305, and returns them with the host.
+func resolveAddr(ctx context.Context, addr string) ([]netip.AddrPort, string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", portStr)
+	if err != nil {
+		return nil, "", err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, "", err
+	}
+	var v6, v4 []netip.AddrPort
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, netip.AddrPortFrom(ip, uint16(port)))
+		} else {
+			v6 = append(v6, netip.AddrPortFrom(ip, uint16(port)))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, "", fmt.Errorf("no addresses for %s", host)
+	}
+	targets := make([]netip.AddrPort, 0, len(ips))
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			targets = append(targets, v6[i])
+		}
+		if i < len(v4) {
+			targets = append(targets, v4[i])
+		}
+	}
+	return targets, host, nil
+}
+
+// dialOne dials to from a new UDP socket, which is closed once the
+// connection is.
+func dialOne(ctx context.Context, to netip.AddrPort, tlsConf *tls.Config, conf *quic.Config, early bool, connIDLen int) (*quic.Conn, error) {
+	network := "udp6"
+	if to.Addr().Is4() {
+		network = "udp4"
+	}
+	udpConn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn, ConnectionIDLength: connIDLen}
+	var conn *quic.Conn
+	if early {
+		conn, err = tr.DialEarly(ctx, net.UDPAddrFromAddrPort(to), tlsConf, conf)
+	} else {
+		conn, err = tr.Dial(ctx, net.UDPAddrFromAddrPort(to), tlsConf, conf)
+	}
+	if err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		_ = tr.Close()
+	}()
+	return conn, nil
+}
+
+// dialResult is the outcome of a connection attempt.
+type dialResult struct {
+	conn *quic.Conn
+	err  error
+}
+
+// raceDial runs dial for targets, in order and staggered by attemptDelay,
+// and returns the first connection established. The attempts still running
+// then are canceled, and connections they established anyway are closed.
+// If all attempts fail, their errors are returned joined.
+func raceDial(ctx context.Context, targets []netip.AddrPort, dial func(context.Context, netip.AddrPort) (*quic.Conn, error)) (*quic.Conn, error) {
+	if len(targets) == 1 {
+		return dial(ctx, targets[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Buffered for all attempts, so that the losers never block.
+	results := make(chan dialResult, len(targets))
+	next, running := 0, 0
+	start := func() {
+		to := targets[next]
+		next++
+		running++
+		go func() {
+			conn, err := dial(ctx, to)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", to, err)
+			}
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	var errs []error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				go closeLosers(results, running)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(targets) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if next < len(targets) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// closeLosers closes the connections of the n attempts still running when
+// another one won the race, should they be established.
+func closeLosers(results <-chan dialResult, n int) {
+	for range n {
+		if r := <-results; r.err == nil {
+			_ = r.conn.CloseWithError(errcode.NoError, "")
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Package echoclient implements the client side of the QUIC echo protocol.
+//
+// [Dial] connects to an echo server, configured by [Options] or the With
+// functions. [Client.Send] echoes a message on a stream of the client,
+// [Client.SendDatagram] in a datagram, and [Client.Stats] reports the state
+// of the connection, so that Go programs and tests can drive a server:
+//
+//	client, err := echoclient.Dial(ctx, "localhost:4242",
+//		echoclient.WithTLSConfig(&tls.Config{RootCAs: roots}))
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	echo, err := client.Send(ctx, []byte("hello"))
+//
+// [Client.OpenStream] opens streams of its own for more control. A [Pool]
+// keeps several connections warm for services with more traffic than one
+// connection carries, and replaces those that die. A [Multipath] uses
+// connections to several addresses of the same server at once, such as a
+// UDP and a USB path.
+//
+// A [Stream] wraps a QUIC stream, negotiates the per-stream preamble and
+// exchanges newline-terminated messages with the echo server. Registered
+// [Interceptors] observe and may transform every message and error. With
+// [StreamOptions.Encrypt] messages are additionally sealed end to end, see
+// package e2e, and with [StreamOptions.Compress] compressed with zstd if the
+// server agrees, see package compress. With [Options.Binary] the connection negotiates [ALPNBinary]
+// instead, and messages are length-prefixed, so that they may hold any
+// bytes, newlines included. [StreamOptions.Priority] keeps the streams of a
+// client that carry bulk data from delaying those that carry control
+// messages.
+//
+// The I/O of the methods that take a context is bounded by its deadline, if
+// it has one, so that a server or link that stops answering fails them with
+// an error matching [os.ErrDeadlineExceeded] instead of blocking them.
+package echoclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/compress"
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/priority"
+)
+
+// StreamOptions configures a [Stream].
+type StreamOptions struct {
+	// MaxMsg is the maximum message size in bytes offered to the server,
+	// or 0 for no preference.
+	MaxMsg int
+	// Encrypt requests end-to-end encryption of messages.
+	Encrypt bool
+	// E2EPSK, if not nil, is the pre-shared key the end-to-end keys are
+	// bound to, see package e2e. The server must use the same key, or the
+	// first message fails to authenticate.
+	E2EPSK []byte
+	// Interceptors, if non-nil, are run on every message and error.
+	Interceptors *Interceptors
+	// First, if not nil, is a message sent right behind the preamble
+	// instead of after the server's reply to it, so that it goes out in
+	// the same flight: in the 0-RTT data of an early connection. Its echo
+	// is the first one received. It is checked against MaxMsg, as the
+	// server's limit is not known yet. With Encrypt it is sent once the key
+	// exchange completes, and with Compress once the server agreed to it or
+	// not.
+	First []byte
+	// Binary selects binary framing, for a stream of a connection that
+	// negotiated [ALPNBinary]. There is no preamble then: MaxMsg is not
+	// offered to the server but bounds the messages sent and received, and
+	// Encrypt is not supported.
+	Binary bool
+	// Compress offers zstd compression of the messages, which may then hold
+	// any bytes, newlines included. The server may decline it, see
+	// [Stream.Compressed]. It cannot be combined with Encrypt or Binary.
+	Compress bool
+	// Priority orders the writes of the stream among the other streams of
+	// its [Client], see package priority, and is offered to the server, so
+	// that it writes the echoes at the same priority. Streams not opened
+	// by a Client, and those with binary framing on the server's side,
+	// are not prioritized.
+	Priority priority.Level
+}
+
+// Stream is a negotiated echo stream carrying newline-terminated messages,
+// length-prefixed ones with binary framing, or ones with a compression
+// header. It is not safe for concurrent use.
+type Stream struct {
+	st *quic.Stream
+	// w is st, with its writes scheduled at the priority of the stream.
+	w      io.Writer
+	r      *bufio.Reader
+	maxMsg int
+	ic     *Interceptors
+	sess   *e2e.Session
+	binary bool
+	codec  *compress.Codec
+}
+
+// NewStream negotiates the preamble on st according to opts.
+func NewStream(ctx context.Context, st *quic.Stream, opts StreamOptions) (*Stream, error) {
+	return newStream(ctx, st, opts, nil)
+}
+
+// newStream is [NewStream] with the writes of st scheduled by sched, the
+// scheduler of its connection, if it is not nil.
+func newStream(ctx context.Context, st *quic.Stream, opts StreamOptions, sched *priority.Scheduler) (*Stream, error) {
+	s := &Stream{st: st, w: sched.Writer(st, opts.Priority), r: bufio.NewReader(st), ic: opts.Interceptors}
+	defer applyDeadline(ctx, st)()
+	if opts.Binary {
+		return s, s.startBinary(ctx, opts)
+	}
+
+	if opts.Compress && opts.Encrypt {
+		return nil, s.ic.notifyError(ctx, OpNegotiate, errors.New("compression is not supported with end-to-end encryption"))
+	}
+	priv, err := sendPreamble(st, opts)
+	if err != nil {
+		return nil, s.ic.notifyError(ctx, OpNegotiate, err)
+	}
+	// How to send First is only known from the reply with Encrypt and
+	// Compress.
+	early := opts.First != nil && !opts.Encrypt && !opts.Compress
+	if early {
+		// The server's limit is only known from its reply: the offer
+		// stands in for it.
+		s.maxMsg = opts.MaxMsg
+		if s.maxMsg <= 0 {
+			s.maxMsg = math.MaxInt
+		}
+		if err := s.send(ctx, opts.First); err != nil {
+			return nil, err
+		}
+	}
+	limit, sess, zstd, err := readPreamble(s.r, opts.MaxMsg, priv, opts.E2EPSK)
+	if err != nil {
+		return nil, s.ic.notifyError(ctx, OpNegotiate, err)
+	}
+	s.maxMsg = limit
+	s.sess = sess
+	// A server that does not know compression may still echo the offer:
+	// its echoes are then compressed messages too.
+	if zstd && opts.Compress {
+		if s.codec, err = compress.NewCodec(limit); err != nil {
+			return nil, s.ic.notifyError(ctx, OpNegotiate, err)
+		}
+	}
+	if opts.First != nil && !early {
+		if err := s.send(ctx, opts.First); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// startBinary sets s up for binary framing according to opts, which
+// exchanges no preamble, and sends opts.First if it is set.
+func (s *Stream) startBinary(ctx context.Context, opts StreamOptions) error {
+	if opts.Encrypt {
+		return s.ic.notifyError(ctx, OpNegotiate, errors.New("end-to-end encryption is not supported with binary framing"))
+	}
+	if opts.Compress {
+		return s.ic.notifyError(ctx, OpNegotiate, errors.New("compression is not supported with binary framing"))
+	}
+	s.binary = true
+	s.maxMsg = maxFrameLen
+	if opts.MaxMsg > 0 {
+		s.maxMsg = min(opts.MaxMsg, maxFrameLen)
+	}
+	if opts.First != nil {
+		return s.send(ctx, opts.First)
+	}
+	return nil
+}
+
+// MaxMsg returns the negotiated maximum message size in bytes. With
+// encryption it limits the sealed wire form, see [e2e.SealedLen].
+func (s *Stream) MaxMsg() int { return s.maxMsg }
+
+// Encrypted reports whether messages are encrypted end to end.
+func (s *Stream) Encrypted() bool { return s.sess != nil }
+
+// Compressed reports whether messages are compressed.
+func (s *Stream) Compressed() bool { return s.codec != nil }
+
+// Compression returns the bytes of the messages sent and received so far,
+// raw and as carried on the stream, if messages are compressed.
+func (s *Stream) Compression() compress.Stats {
+	if s.codec == nil {
+		return compress.Stats{}
+	}
+	return s.codec.Stats()
+}
+
+// QUICStream returns the underlying QUIC stream.
+func (s *Stream) QUICStream() *quic.Stream { return s.st }
+
+// Send runs the send interceptors over msg and writes the result as one
+// message. Messages larger than [Stream.MaxMsg] are rejected with a
+// [MessageTooLargeError] without being sent.
+func (s *Stream) Send(ctx context.Context, msg []byte) error {
+	defer applyDeadline(ctx, s.st)()
+	return s.send(ctx, msg)
+}
+
+// send is [Stream.Send] without the deadline of ctx.
+func (s *Stream) send(ctx context.Context, msg []byte) error {
+	out, err := s.ic.interceptSend(ctx, msg)
+	if err != nil {
+		return s.ic.notifyError(ctx, OpSend, fmt.Errorf("send interceptor: %w", err))
+	}
+	if s.sess == nil && !s.binary && s.codec == nil && bytes.IndexByte(out, '\n') >= 0 {
+		return s.ic.notifyError(ctx, OpSend, errors.New("message contains a newline"))
+	}
+	size := len(out)
+	if s.sess != nil {
+		size = e2e.SealedLen(size)
+	}
+	if size > s.maxMsg {
+		return s.ic.notifyError(ctx, OpSend, &MessageTooLargeError{Size: size, Limit: s.maxMsg})
+	}
+	if s.sess != nil {
+		out = s.sess.Seal(out)
+	}
+
+	var buf []byte
+	switch {
+	case s.binary:
+		buf = appendFrame(make([]byte, 0, frameHeaderLen+len(out)), out)
+	case s.codec != nil:
+		buf = s.codec.AppendMessage(nil, out)
+	default:
+		buf = make([]byte, 0, len(out)+1)
+		buf = append(append(buf, out...), '\n')
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return s.ic.notifyError(ctx, OpSend, err)
+	}
+	return nil
+}
+
+// Receive reads the next echoed message and writes it to w, returning the
+// number of bytes written. Without receive interceptors, encryption or
+// compression the message is streamed to w as it arrives; otherwise it is
+// buffered (up to the negotiated maximum) so it can be decrypted or
+// decompressed and the interceptors see it whole.
+func (s *Stream) Receive(ctx context.Context, w io.Writer) (int, error) {
+	defer applyDeadline(ctx, s.st)()
+	if s.binary {
+		return s.receiveFrame(ctx, w)
+	}
+	if s.codec != nil {
+		return s.receiveCompressed(ctx, w)
+	}
+	if s.sess == nil && !s.ic.hasReceive() {
+		n, err := streamLine(s.r, w, s.maxMsg)
+		return n, s.ic.notifyError(ctx, OpReceive, err)
+	}
+
+	line, err := readLine(s.r, s.maxMsg)
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, err)
+	}
+	msg := []byte(line)
+	if s.sess != nil {
+		if msg, err = s.sess.Open(msg); err != nil {
+			return 0, s.ic.notifyError(ctx, OpReceive, fmt.Errorf("e2e: %w", err))
+		}
+	}
+	msg, err = s.ic.interceptReceive(ctx, msg)
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, fmt.Errorf("receive interceptor: %w", err))
+	}
+	n, err := w.Write(msg)
+	return n, s.ic.notifyError(ctx, OpReceive, err)
+}
+
+// receiveFrame is [Stream.Receive] with binary framing.
+func (s *Stream) receiveFrame(ctx context.Context, w io.Writer) (int, error) {
+	size, err := readFrameHeader(s.r, s.maxMsg)
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, err)
+	}
+	if !s.ic.hasReceive() {
+		n, err := io.CopyN(w, s.r, int64(size))
+		if err != nil {
+			err = frameError(err, s.maxMsg)
+		}
+		return int(n), s.ic.notifyError(ctx, OpReceive, err)
+	}
+
+	// Read as it arrives, so that the length claimed costs no more memory
+	// than the data received.
+	msg, err := io.ReadAll(io.LimitReader(s.r, int64(size)))
+	if err == nil && len(msg) < size {
+		err = io.EOF
+	}
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, frameError(err, s.maxMsg))
+	}
+	msg, err = s.ic.interceptReceive(ctx, msg)
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, fmt.Errorf("receive interceptor: %w", err))
+	}
+	n, err := w.Write(msg)
+	return n, s.ic.notifyError(ctx, OpReceive, err)
+}
+
+// receiveCompressed is [Stream.Receive] with compression.
+func (s *Stream) receiveCompressed(ctx context.Context, w io.Writer) (int, error) {
+	msg, err := s.codec.ReadMessage(s.r)
+	if errors.Is(err, compress.ErrTooLarge) {
+		err = &MessageTooLargeError{Size: -1, Limit: s.maxMsg}
+	}
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, asMessageTooLarge(err, s.maxMsg))
+	}
+	msg, err = s.ic.interceptReceive(ctx, msg)
+	if err != nil {
+		return 0, s.ic.notifyError(ctx, OpReceive, fmt.Errorf("receive interceptor: %w", err))
+	}
+	n, err := w.Write(msg)
+	return n, s.ic.notifyError(ctx, OpReceive, err)
+}
+
+// Close closes the send direction of the stream.
+func (s *Stream) Close() error {
+	return s.st.Close()
+}
+
+// applyDeadline sets the deadline of ctx, if it has one, on st until the
+// returned function is called.
+func applyDeadline(ctx context.Context, st *quic.Stream) func() {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return func() {}
+	}
+	_ = st.SetDeadline(d)
+	return func() { _ = st.SetDeadline(time.Time{}) }
+}
@@ -0,0 +1,203 @@
+package echoclient_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/echoserver"
+	"github.com/romanov9617/usb-quic/pkg/memtransport"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// testTLS returns the TLS configurations of a server with a fresh
+// self-signed certificate for "localhost" and of a client that trusts it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		NextProtos:   []string{echoserver.ALPN},
+	}
+	client = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	return server, client
+}
+
+// startServer serves an echo handler configured by opts on the server end
+// of a memtransport pair, impaired by imp in both directions, until the
+// test ends, and returns a client connected to it.
+func startServer(t *testing.T, opts echoserver.Options, imp memtransport.Impairment) *echoclient.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	clientConn, serverConn := memtransport.Pair("client", "server")
+	clientConn.SetImpairment(imp)
+	serverConn.SetImpairment(imp)
+	serverTLS, clientTLS := testTLS(t)
+	quicConf := &quic.Config{EnableDatagrams: true}
+
+	serverTr := &quic.Transport{Conn: serverConn}
+	ln, err := serverTr.Listen(serverTLS, quicConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &streamserver.Server{
+		Handler:         echoserver.New(opts),
+		Logger:          slog.New(slog.DiscardHandler),
+		ShutdownTimeout: time.Second,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, ln) }()
+
+	clientTr := &quic.Transport{Conn: clientConn}
+	client, err := echoclient.DialTransport(ctx, clientTr, serverConn.LocalAddr(),
+		echoclient.WithTLSConfig(clientTLS), echoclient.WithQUICConfig(quicConf))
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		cancel()
+		if err := <-served; err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("serve: %v", err)
+		}
+		_ = clientTr.Close()
+		_ = serverTr.Close()
+	})
+	return client
+}
+
+func TestEchoOverMemtransport(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		imp  memtransport.Impairment
+	}{
+		{"clean", memtransport.Impairment{}},
+		{"lossy", memtransport.Impairment{Latency: 5 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := startServer(t, echoserver.Options{MaxMsg: 1 << 10}, tc.imp)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			for _, msg := range []string{"hello", strings.Repeat("x", 1<<10)} {
+				echo, err := client.Send(ctx, []byte(msg))
+				if err != nil {
+					t.Fatalf("send %d bytes: %v", len(msg), err)
+				}
+				if string(echo) != msg {
+					t.Fatalf("echo of %d bytes is %q", len(msg), echo)
+				}
+			}
+			if _, err := client.Send(ctx, []byte(strings.Repeat("x", 1<<10+1))); err == nil {
+				t.Error("message over the limit echoed")
+			}
+			if st := client.Stats(); st.ALPN != echoserver.ALPN || !st.Datagrams {
+				t.Errorf("stats = %+v, want ALPN %s with datagrams", st, echoserver.ALPN)
+			}
+		})
+	}
+}
+
+func TestEncryptedStreamOverMemtransport(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		impair *echoserver.Impairment
+	}{
+		{"clean", nil},
+		// Dropping would desynchronize the sequence numbers.
+		{"drop all", &echoserver.Impairment{DropRate: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := echoserver.Options{MaxMsg: 1 << 10, RequireE2E: true, Impair: tc.impair}
+			client := startServer(t, opts, memtransport.Impairment{})
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			st, err := client.OpenStream(ctx, echoclient.StreamOptions{Encrypt: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			if !st.Encrypted() {
+				t.Fatal("stream not encrypted")
+			}
+			for _, msg := range []string{"one", "two"} {
+				if err := st.Send(ctx, []byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				var echo bytes.Buffer
+				if _, err := st.Receive(ctx, &echo); err != nil {
+					t.Fatal(err)
+				}
+				if echo.String() != msg {
+					t.Fatalf("echo %q, want %q", echo.String(), msg)
+				}
+			}
+		})
+	}
+}
+
+func TestDatagramOverMemtransport(t *testing.T) {
+	client := startServer(t, echoserver.Options{}, memtransport.Impairment{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	echo, err := client.SendDatagram(ctx, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "ping" {
+		t.Fatalf("datagram echo %q, want %q", echo, "ping")
+	}
+}
+
+func TestUniOverMemtransport(t *testing.T) {
+	client := startServer(t, echoserver.Options{MaxMsg: 1 << 10}, memtransport.Impairment{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	msg := strings.Repeat("u", 1<<10)
+	echo, err := client.EchoUni(ctx, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != msg {
+		t.Fatalf("uni echo of %d bytes is %d bytes", len(msg), len(echo))
+	}
+	var tooLarge *echoclient.MessageTooLargeError
+	if _, err := client.EchoUni(ctx, []byte(msg+"u")); !errors.As(err, &tooLarge) || tooLarge.Limit != 1<<10 {
+		t.Errorf("uni payload over the limit: err = %v, want the limit of %d bytes", err, 1<<10)
+	}
+}
@@ -0,0 +1,122 @@
+package echoclient
+
+import (
+	"context"
+	"sync"
+)
+
+// Op identifies the stream operation an interceptor is called for.
+type Op string
+
+// Operations reported to an [ErrorInterceptor].
+const (
+	OpNegotiate Op = "negotiate"
+	OpSend      Op = "send"
+	OpReceive   Op = "receive"
+)
+
+// SendInterceptor is called with every message before it is written to the
+// stream and returns the bytes to send in its place. It may record, measure or
+// transform the message; a non-nil error aborts the send. The returned message
+// must not contain a newline, which terminates messages on the wire.
+type SendInterceptor func(ctx context.Context, msg []byte) ([]byte, error)
+
+// ReceiveInterceptor is called with every complete echoed message before it
+// is delivered and returns the bytes to deliver in its place.
+type ReceiveInterceptor func(ctx context.Context, msg []byte) ([]byte, error)
+
+// ErrorInterceptor is called with every error a [Stream] operation returns.
+type ErrorInterceptor func(ctx context.Context, op Op, err error)
+
+// Interceptors holds hooks that a [Stream] runs on the traffic it carries,
+// so embedders can add transcript encryption, metrics or payload
+// transformation without changing the library. Hooks of the same kind run in
+// registration order. The zero value is ready to use and safe for concurrent use.
+type Interceptors struct {
+	mu      sync.RWMutex
+	send    []SendInterceptor
+	receive []ReceiveInterceptor
+	errs    []ErrorInterceptor
+}
+
+// OnSend registers f to run on every outgoing message.
+func (ic *Interceptors) OnSend(f SendInterceptor) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.send = append(ic.send, f)
+}
+
+// OnReceive registers f to run on every echoed message.
+func (ic *Interceptors) OnReceive(f ReceiveInterceptor) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.receive = append(ic.receive, f)
+}
+
+// OnError registers f to observe every error returned by a stream operation.
+func (ic *Interceptors) OnError(f ErrorInterceptor) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.errs = append(ic.errs, f)
+}
+
+// hasReceive reports whether any receive interceptors are registered.
+func (ic *Interceptors) hasReceive() bool {
+	if ic == nil {
+		return false
+	}
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	return len(ic.receive) > 0
+}
+
+// interceptSend runs the send chain over msg.
+func (ic *Interceptors) interceptSend(ctx context.Context, msg []byte) ([]byte, error) {
+	if ic == nil {
+		return msg, nil
+	}
+	ic.mu.RLock()
+	chain := ic.send
+	ic.mu.RUnlock()
+
+	for _, f := range chain {
+		var err error
+		if msg, err = f(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// interceptReceive runs the receive chain over msg.
+func (ic *Interceptors) interceptReceive(ctx context.Context, msg []byte) ([]byte, error) {
+	if ic == nil {
+		return msg, nil
+	}
+	ic.mu.RLock()
+	chain := ic.receive
+	ic.mu.RUnlock()
+
+	for _, f := range chain {
+		var err error
+		if msg, err = f(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// notifyError passes err to the error hooks and returns it unchanged.
+func (ic *Interceptors) notifyError(ctx context.Context, op Op, err error) error {
+	if ic == nil || err == nil {
+		return err
+	}
+	ic.mu.RLock()
+	chain := ic.errs
+	ic.mu.RUnlock()
+
+	for _, f := range chain {
+		f(ctx, op, err)
+	}
+	return err
+}
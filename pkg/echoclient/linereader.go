@@ -0,0 +1,67 @@
+package echoclient
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// readLine reads one newline-terminated line of at most limit bytes,
+// excluding the newline, and returns it without the terminator. Longer lines
+// fail with a [MessageTooLargeError] instead of being buffered.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		n := len(line)
+		if n > 0 && line[n-1] == '\n' {
+			n--
+		}
+		if n > limit {
+			return "", &MessageTooLargeError{Size: -1, Limit: limit}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", asMessageTooLarge(err, limit)
+		}
+		return string(line[:n]), nil
+	}
+}
+
+// streamLine copies one newline-terminated line from r to w as it arrives,
+// without the terminator, and returns the number of bytes written. Memory use
+// is bounded by r's buffer regardless of the line length. Lines longer than
+// limit bytes fail with a [MessageTooLargeError] once the limit is crossed;
+// the bytes up to the limit have been written to w by then.
+func streamLine(r *bufio.Reader, w io.Writer, limit int) (int, error) {
+	written := 0
+	for {
+		chunk, err := r.ReadSlice('\n')
+		complete := err == nil
+		if complete {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		if over := written + len(chunk) - limit; over > 0 {
+			n, _ := w.Write(chunk[:len(chunk)-over])
+			return written + n, &MessageTooLargeError{Size: -1, Limit: limit}
+		}
+		n, werr := w.Write(chunk)
+		written += n
+		if werr != nil {
+			return written, werr
+		}
+
+		switch {
+		case complete:
+			return written, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		default:
+			return written, asMessageTooLarge(err, limit)
+		}
+	}
+}
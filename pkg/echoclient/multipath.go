@@ -0,0 +1,213 @@
+package echoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PathPolicy is how a [Multipath] spreads messages over its paths.
+type PathPolicy string
+
+// Path policies.
+const (
+	// LowestRTT sends every message on the path with the lowest smoothed
+	// RTT.
+	LowestRTT PathPolicy = "lowest-rtt"
+	// Redundant sends every message on all paths and returns the first
+	// echo, so that a loss or stall on one path costs nothing.
+	Redundant PathPolicy = "redundant"
+	// Aggregate sends every message on the path with the fewest messages
+	// in flight, the lowest RTT first among equals, so that concurrent
+	// senders use the capacity of all paths.
+	Aggregate PathPolicy = "aggregate"
+)
+
+// ParsePathPolicy returns the policy named s.
+func ParsePathPolicy(s string) (PathPolicy, error) {
+	switch p := PathPolicy(s); p {
+	case LowestRTT, Redundant, Aggregate:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown path policy %q: want %s, %s or %s", s, LowestRTT, Redundant, Aggregate)
+}
+
+// ErrNoPath reports that none of the paths of a [Multipath] is connected.
+var ErrNoPath = errors.New("no path connected")
+
+// Multipath uses several paths to the same echo server at once, such as a
+// UDP endpoint and a bridged USB one, instead of failing over from one to
+// the other. quic-go does not implement the QUIC multipath extension, so
+// every path is a connection of its own, and a message travels on one or
+// all of them as its [PathPolicy] decides. Paths that fail are not dialed
+// again. It is safe for concurrent use.
+type Multipath struct {
+	policy PathPolicy
+	paths  []*path
+}
+
+// path is one of the connections of a Multipath.
+type path struct {
+	addr string
+	// client is nil if dialing failed with err.
+	client *Client
+	err    error
+
+	inFlight atomic.Int64
+	echoed   atomic.Uint64
+}
+
+// PathInfo is a snapshot of a path of a [Multipath].
+type PathInfo struct {
+	Addr string
+	// Err is why the path is not connected, or nil if it is.
+	Err         error
+	SmoothedRTT time.Duration
+	// InFlight counts the messages sent and not yet echoed on the path,
+	// and Echoed those echoed so far.
+	InFlight int64
+	Echoed   uint64
+}
+
+// DialMultipath connects to the echo server at each of addrs at once,
+// configured by opts like [Dial], and spreads messages over the connections
+// by policy. It fails only if none of them connects; see
+// [Multipath.Paths] for those that did not.
+func DialMultipath(ctx context.Context, addrs []string, policy PathPolicy, opt ...Option) (*Multipath, error) {
+	m := &Multipath{policy: policy, paths: make([]*path, len(addrs))}
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Dial(ctx, addr, opt...)
+			m.paths[i] = &path{addr: addr, client: c, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, p := range m.paths {
+		if p.err != nil {
+			errs = append(errs, p.err)
+		}
+	}
+	if len(errs) == len(addrs) {
+		return nil, errors.Join(errs...)
+	}
+	return m, nil
+}
+
+// Send sends msg on the paths the policy picks and returns the first echo
+// and the address of the path it came back on.
+func (m *Multipath) Send(ctx context.Context, msg []byte) ([]byte, string, error) {
+	paths := m.connected()
+	if len(paths) == 0 {
+		return nil, "", ErrNoPath
+	}
+	if m.policy == Redundant {
+		return m.sendAll(ctx, paths, msg)
+	}
+
+	best := paths[0]
+	for _, p := range paths[1:] {
+		if m.better(p, best) {
+			best = p
+		}
+	}
+	echo, err := best.send(ctx, msg)
+	return echo, best.addr, err
+}
+
+// better reports whether p is to be picked over q under the policy.
+func (m *Multipath) better(p, q *path) bool {
+	if m.policy == Aggregate {
+		if pi, qi := p.inFlight.Load(), q.inFlight.Load(); pi != qi {
+			return pi < qi
+		}
+	}
+	return p.rtt() < q.rtt()
+}
+
+// sendAll sends msg on all of paths and returns the first echo. The paths
+// that are slower still receive theirs.
+func (m *Multipath) sendAll(ctx context.Context, paths []*path, msg []byte) ([]byte, string, error) {
+	type result struct {
+		echo []byte
+		addr string
+		err  error
+	}
+	results := make(chan result, len(paths))
+	for _, p := range paths {
+		go func() {
+			echo, err := p.send(ctx, msg)
+			results <- result{echo, p.addr, err}
+		}()
+	}
+	var errs []error
+	for range paths {
+		r := <-results
+		if r.err == nil {
+			return r.echo, r.addr, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.addr, r.err))
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// connected returns the paths whose connection is open.
+func (m *Multipath) connected() []*path {
+	var paths []*path
+	for _, p := range m.paths {
+		if p.client != nil && p.client.Conn().Context().Err() == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Paths returns a snapshot of every path, in the order of the addresses
+// dialed.
+func (m *Multipath) Paths() []PathInfo {
+	infos := make([]PathInfo, 0, len(m.paths))
+	for _, p := range m.paths {
+		info := PathInfo{Addr: p.addr, Err: p.err, InFlight: p.inFlight.Load(), Echoed: p.echoed.Load()}
+		if p.client != nil {
+			info.Err = context.Cause(p.client.Conn().Context())
+			info.SmoothedRTT = p.rtt()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Close closes the connections of all paths.
+func (m *Multipath) Close() error {
+	var errs []error
+	for _, p := range m.paths {
+		if p.client != nil {
+			errs = append(errs, p.client.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send sends msg on p with [Client.Send] and counts it.
+func (p *path) send(ctx context.Context, msg []byte) ([]byte, error) {
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	echo, err := p.client.Send(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	p.echoed.Add(1)
+	return echo, nil
+}
+
+// rtt returns the smoothed RTT of the connection of p.
+func (p *path) rtt() time.Duration {
+	return p.client.Conn().ConnectionStats().SmoothedRTT
+}
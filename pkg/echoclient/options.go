@@ -0,0 +1,88 @@
+package echoclient
+
+import (
+	"crypto/tls"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// An Option configures [Dial]. [Options] is one, setting all of them at
+// once, and the With functions return ones that set a single field.
+type Option interface {
+	apply(*Options)
+}
+
+// apply implements Option.
+func (o Options) apply(dst *Options) { *dst = o }
+
+// collectOptions applies opts, in order, to the zero Options.
+func collectOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// tlsConfig returns o.TLSConfig, offering [ALPN], or [ALPNBinary] with
+// binary framing, unless it offers other protocols.
+func (o Options) tlsConfig() *tls.Config {
+	tlsConf := o.TLSConfig
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf = tlsConf.Clone()
+		tlsConf.NextProtos = []string{ALPN}
+		if o.Binary {
+			tlsConf.NextProtos = []string{ALPNBinary}
+		}
+	}
+	return tlsConf
+}
+
+// optionFunc is an Option that sets fields of Options.
+type optionFunc func(*Options)
+
+// apply implements Option.
+func (f optionFunc) apply(o *Options) { f(o) }
+
+// WithTLSConfig sets [Options.TLSConfig].
+func WithTLSConfig(conf *tls.Config) Option {
+	return optionFunc(func(o *Options) { o.TLSConfig = conf })
+}
+
+// WithQUICConfig sets [Options.QUICConfig].
+func WithQUICConfig(conf *quic.Config) Option {
+	return optionFunc(func(o *Options) { o.QUICConfig = conf })
+}
+
+// WithEarly sets [Options.Early].
+func WithEarly() Option {
+	return optionFunc(func(o *Options) { o.Early = true })
+}
+
+// WithFailAtStreamLimit sets [Options.FailAtStreamLimit].
+func WithFailAtStreamLimit() Option {
+	return optionFunc(func(o *Options) { o.FailAtStreamLimit = true })
+}
+
+// WithToken sets [Options.Token].
+func WithToken(token string) Option {
+	return optionFunc(func(o *Options) { o.Token = token })
+}
+
+// WithConnectionIDLength sets [Options.ConnectionIDLength].
+func WithConnectionIDLength(n int) Option {
+	return optionFunc(func(o *Options) { o.ConnectionIDLength = n })
+}
+
+// WithBinary sets [Options.Binary].
+func WithBinary() Option {
+	return optionFunc(func(o *Options) { o.Binary = true })
+}
+
+// WithStreamOptions sets [Options.StreamOptions].
+func WithStreamOptions(opts StreamOptions) Option {
+	return optionFunc(func(o *Options) { o.StreamOptions = opts })
+}
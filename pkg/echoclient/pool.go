@@ -0,0 +1,237 @@
+package echoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// Defaults of a [Pool].
+const (
+	// poolKeepAlive and poolIdleTimeout are the keep-alive period and idle
+	// timeout of pool connections whose QUICConfig sets none, so that idle
+	// ones stay warm and a dead link is noticed within the idle timeout.
+	poolKeepAlive   = 5 * time.Second
+	poolIdleTimeout = 15 * time.Second
+	// poolRedialDelay and poolRedialMaxDelay bound the exponentially
+	// growing delay between attempts to replace a dead connection.
+	poolRedialDelay    = 100 * time.Millisecond
+	poolRedialMaxDelay = 10 * time.Second
+)
+
+// ErrPoolClosed reports the use of a closed [Pool].
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool keeps a number of connections to an echo server warm and spreads
+// streams and messages over them round-robin. Their keep-alives detect a
+// dead link through the idle timeout, and a connection on which an
+// operation of the pool times out is retired at once. A connection that is
+// closed for any reason is replaced in the background, retrying with a
+// growing delay until the server is back. A Pool is safe for concurrent use.
+type Pool struct {
+	addr string
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	next   atomic.Uint64
+
+	mu      sync.Mutex
+	clients []*Client
+	// ready is closed, and replaced, when a connection is added.
+	ready chan struct{}
+}
+
+// NewPool dials size connections to the echo server at addr, configured
+// by opts like [Dial], in parallel. Unless [Options.QUICConfig] sets them,
+// their keep-alive period is 5s and their idle timeout 15s. It fails only if
+// no connection can be established; the others are retried in the
+// background.
+func NewPool(ctx context.Context, addr string, size int, opts ...Option) (*Pool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid pool size %d", size)
+	}
+	p := &Pool{addr: addr, opts: collectOptions(opts), clients: make([]*Client, size), ready: make(chan struct{})}
+	quicConf := &quic.Config{}
+	if p.opts.QUICConfig != nil {
+		quicConf = p.opts.QUICConfig.Clone()
+	}
+	if quicConf.KeepAlivePeriod == 0 {
+		quicConf.KeepAlivePeriod = poolKeepAlive
+	}
+	if quicConf.MaxIdleTimeout == 0 {
+		quicConf.MaxIdleTimeout = poolIdleTimeout
+	}
+	p.opts.QUICConfig = quicConf
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	errs := make([]error, size)
+	var wg sync.WaitGroup
+	for i := range size {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.clients[i], errs[i] = Dial(ctx, addr, p.opts)
+		}()
+	}
+	wg.Wait()
+	if p.Len() == 0 {
+		p.cancel()
+		return nil, errors.Join(errs...)
+	}
+	for i := range size {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.maintain(i, p.clients[i])
+		}()
+	}
+	return p, nil
+}
+
+// maintain replaces the connection of slot i, client or none, whenever it
+// is closed, until the pool is.
+func (p *Pool) maintain(i int, client *Client) {
+	for {
+		if client != nil {
+			select {
+			case <-client.Conn().Context().Done():
+			case <-p.ctx.Done():
+				return
+			}
+			p.set(i, nil)
+		}
+		delay := poolRedialDelay
+		for {
+			var err error
+			if client, err = Dial(p.ctx, p.addr, p.opts); err == nil {
+				break
+			}
+			select {
+			case <-time.After(delay):
+			case <-p.ctx.Done():
+				return
+			}
+			delay = min(2*delay, poolRedialMaxDelay)
+		}
+		if !p.set(i, client) {
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+// set puts client in slot i, or empties it if client is nil, and reports
+// whether the pool is still open.
+func (p *Pool) set(i int, client *Client) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+	p.clients[i] = client
+	if client != nil {
+		close(p.ready)
+		p.ready = make(chan struct{})
+	}
+	return true
+}
+
+// Client returns the next live connection of the pool, round-robin,
+// waiting for one to be replaced if none is alive.
+func (p *Pool) Client(ctx context.Context) (*Client, error) {
+	for {
+		p.mu.Lock()
+		if p.ctx.Err() != nil {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		n := uint64(len(p.clients))
+		start := p.next.Add(1)
+		for k := range n {
+			if c := p.clients[(start+k)%n]; c != nil && c.Conn().Context().Err() == nil {
+				p.mu.Unlock()
+				return c, nil
+			}
+		}
+		ready := p.ready
+		p.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-p.ctx.Done():
+			return nil, ErrPoolClosed
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no live connection: %w", ctx.Err())
+		}
+	}
+}
+
+// OpenStream opens a stream on the next live connection, see
+// [Client.OpenStream].
+func (p *Pool) OpenStream(ctx context.Context, opts StreamOptions) (*Stream, error) {
+	c, err := p.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.OpenStream(ctx, opts)
+	p.check(c, err)
+	return st, err
+}
+
+// Send echoes msg on the next live connection, see [Client.Send].
+func (p *Pool) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	c, err := p.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	echo, err := c.Send(ctx, msg)
+	p.check(c, err)
+	return echo, err
+}
+
+// check retires c if err reports that an operation on it timed out, as the
+// server or the link may be gone without c having noticed yet.
+func (p *Pool) check(c *Client, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		_ = c.conn.CloseWithError(errcode.NoError, "timed out")
+	}
+}
+
+// Len returns the number of live connections.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for _, c := range p.clients {
+		if c != nil && c.Conn().Context().Err() == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes the connections of the pool and stops replacing them.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.cancel()
+	clients := p.clients
+	p.mu.Unlock()
+	p.wg.Wait()
+	var errs []error
+	for _, c := range clients {
+		if c != nil {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,138 @@
+package echoclient
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/compress"
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/priority"
+)
+
+// preambleMagic starts the first line of a stream that carries negotiation
+// parameters. It must match the server's.
+const preambleMagic = "QECHO/1"
+
+// maxPreambleLen bounds the size of the server's preamble reply.
+const maxPreambleLen = 512
+
+// MsgTooLargeCode is the stream error code the server uses when a line
+// exceeds the negotiated maximum message size.
+const MsgTooLargeCode = errcode.MsgTooLarge
+
+// MessageTooLargeError reports a message that exceeds the negotiated limit.
+type MessageTooLargeError struct {
+	Size  int // size of the offending message, or -1 if unknown
+	Limit int
+}
+
+// Error implements error.
+func (e *MessageTooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("message exceeds max size of %d bytes", e.Limit)
+	}
+	return fmt.Sprintf("message of %d bytes exceeds max size of %d bytes", e.Size, e.Limit)
+}
+
+// sendPreamble sends the stream preamble offering the maximum message size
+// of opts (0 for no preference), zstd compression with Compress and the
+// priority, unless it is [priority.Normal]. With Encrypt, it also offers an
+// end-to-end key exchange and returns the private key for [readPreamble].
+func sendPreamble(w io.Writer, opts StreamOptions) (*ecdh.PrivateKey, error) {
+	hello := fmt.Sprintf("%s max-msg=%d", preambleMagic, opts.MaxMsg)
+
+	var priv *ecdh.PrivateKey
+	if opts.Encrypt {
+		var err error
+		if priv, err = e2e.GenerateKey(); err != nil {
+			return nil, fmt.Errorf("generate e2e key: %w", err)
+		}
+		hello += " e2e=" + e2e.FormatPublicKey(priv.PublicKey())
+	}
+	if opts.Compress {
+		hello += " compress=" + compress.Zstd
+	}
+	if opts.Priority != priority.Normal {
+		hello += fmt.Sprintf(" prio=%d", opts.Priority)
+	}
+
+	if _, err := io.WriteString(w, hello+"\n"); err != nil {
+		return nil, fmt.Errorf("write preamble: %w", err)
+	}
+	return priv, nil
+}
+
+// readPreamble reads the server's reply to the preamble sent by
+// [sendPreamble] offering maxMsg and returns the maximum message size the
+// server agreed to. If priv is not nil, it also completes the end-to-end
+// key exchange, with the pre-shared key psk if it is not nil, and returns
+// the session. zstd reports whether the server agreed to zstd compression.
+func readPreamble(r *bufio.Reader, maxMsg int, priv *ecdh.PrivateKey, psk []byte) (limit int, sess *e2e.Session, zstd bool, err error) {
+	line, err := readLine(r, maxPreambleLen)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("read preamble: %w", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != preambleMagic {
+		return 0, nil, false, fmt.Errorf("unexpected preamble reply %q", line)
+	}
+
+	limit = maxMsg
+	var peerKey string
+	for _, f := range fields[1:] {
+		key, val, _ := strings.Cut(f, "=")
+		switch key {
+		case "max-msg":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return 0, nil, false, fmt.Errorf("invalid max-msg %q in preamble reply", val)
+			}
+			if limit <= 0 || n < limit {
+				limit = n
+			}
+		case "e2e":
+			peerKey = val
+		case "compress":
+			zstd = val == compress.Zstd
+		}
+	}
+
+	if priv == nil {
+		return limit, nil, zstd, nil
+	}
+	if peerKey == "" {
+		return 0, nil, false, errors.New("server does not support end-to-end encryption")
+	}
+	pub, err := e2e.ParsePublicKey(peerKey)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("server e2e key: %w", err)
+	}
+	// A server that merely echoes the preamble returns our own key.
+	if pub.Equal(priv.PublicKey()) {
+		return 0, nil, false, errors.New("server does not support end-to-end encryption")
+	}
+	sess, err = e2e.NewSession(priv, pub, psk, true)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return limit, sess, false, nil
+}
+
+// asMessageTooLarge converts a stream reset by the server for an oversized
+// message into a [MessageTooLargeError]. Other errors are returned unchanged.
+func asMessageTooLarge(err error, limit int) error {
+	var se *quic.StreamError
+	if errors.As(err, &se) && se.Remote && se.ErrorCode == MsgTooLargeCode {
+		return &MessageTooLargeError{Size: -1, Limit: limit}
+	}
+	return err
+}
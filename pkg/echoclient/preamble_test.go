@@ -0,0 +1,106 @@
+package echoclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+)
+
+// FuzzReadPreamble checks that a reply is never taken for a limit larger
+// than the one offered, and that end-to-end encryption is only ever agreed
+// to with a key that is not the client's own.
+func FuzzReadPreamble(f *testing.F) {
+	priv, err := e2e.GenerateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	peer, err := e2e.GenerateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte("QECHO/1 max-msg=1024\n"), 4096, false)
+	f.Add([]byte("QECHO/1 max-msg=0\n"), 0, false)
+	f.Add([]byte("QECHO/1 max-msg=512 compress=zstd prio=3\n"), 0, false)
+	f.Add([]byte("QECHO/1 max-msg=512 e2e="+e2e.FormatPublicKey(peer.PublicKey())+"\n"), 1024, true)
+	f.Add([]byte("QECHO/1 max-msg=512 e2e="+e2e.FormatPublicKey(priv.PublicKey())+"\n"), 1024, true)
+	f.Fuzz(func(t *testing.T, reply []byte, maxMsg int, encrypt bool) {
+		key := priv
+		if !encrypt {
+			key = nil
+		}
+		limit, sess, _, err := readPreamble(bufio.NewReader(bytes.NewReader(reply)), maxMsg, key, nil)
+		if err != nil {
+			return
+		}
+		if maxMsg > 0 && (limit <= 0 || limit > maxMsg) {
+			t.Fatalf("limit %d with %d offered", limit, maxMsg)
+		}
+		if (sess != nil) != encrypt {
+			t.Fatalf("session %v with encrypt %t", sess != nil, encrypt)
+		}
+		var peerKey string
+		first, _, _ := bytes.Cut(reply, []byte("\n"))
+		for _, f := range strings.Fields(string(first)) {
+			if v, ok := strings.CutPrefix(f, "e2e="); ok {
+				peerKey = v
+			}
+		}
+		if encrypt && peerKey == e2e.FormatPublicKey(priv.PublicKey()) {
+			t.Fatalf("encryption agreed to with the client's own key")
+		}
+	})
+}
+
+// FuzzReadLine checks that lines are returned whole and within the limit,
+// however small the reader's buffer, and that longer ones fail with a
+// [MessageTooLargeError].
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("hello\nworld\n"), uint16(5))
+	f.Add([]byte("hello"), uint16(5))
+	f.Add([]byte(strings.Repeat("x", 100)+"\n"), uint16(40))
+	f.Fuzz(func(t *testing.T, data []byte, limit uint16) {
+		// The smallest buffer bufio allows makes long lines span reads.
+		r := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		rest := data
+		for {
+			line, err := readLine(r, int(limit))
+			if err != nil {
+				var tooLarge *MessageTooLargeError
+				if !errors.Is(err, io.EOF) && !errors.As(err, &tooLarge) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			want, tail, found := bytes.Cut(rest, []byte("\n"))
+			if !found || line != string(want) || len(line) > int(limit) {
+				t.Fatalf("read line %q, want %q within %d bytes", line, want, limit)
+			}
+			rest = tail
+		}
+	})
+}
+
+// FuzzParseUniHeader checks that every reply header accepted names the
+// stream and limit that a header written for them names.
+func FuzzParseUniHeader(f *testing.F) {
+	f.Add(uniMagic + " id=2\n")
+	f.Add(uniMagic + " id=2 max-msg=1024\n")
+	f.Add(uniMagic + " foo=bar id=-4\n")
+	f.Add(uniMagic + " id=x\n")
+	f.Fuzz(func(t *testing.T, line string) {
+		id, maxMsg, ok := parseUniHeader(line)
+		if !ok {
+			return
+		}
+		againID, againMax, ok := parseUniHeader(fmt.Sprintf("%s id=%d max-msg=%d\n", uniMagic, id, maxMsg))
+		if !ok || againID != id || againMax != maxMsg {
+			t.Fatalf("header for stream %d, limit %d parsed as %d, %d, %t", id, maxMsg, againID, againMax, ok)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package echoclient
+
+import (
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// Stats are the state and statistics of the connection of a [Client].
+type Stats struct {
+	Version quic.Version
+	ALPN    string
+	// Resumed reports whether the TLS session was resumed, and Used0RTT
+	// whether the server accepted 0-RTT data.
+	Resumed  bool
+	Used0RTT bool
+	// Datagrams reports whether both ends support datagrams.
+	Datagrams bool
+
+	MinRTT      time.Duration
+	SmoothedRTT time.Duration
+	LatestRTT   time.Duration
+	RTTVar      time.Duration
+
+	BytesSent       uint64
+	BytesReceived   uint64
+	BytesLost       uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	PacketsLost     uint64
+
+	// BidiStreams and UniStreams are the streams opened so far, see
+	// [Client.StreamsOpened].
+	BidiStreams int64
+	UniStreams  int64
+}
+
+// Stats returns the current state and statistics of the connection.
+func (c *Client) Stats() Stats {
+	cs, st := c.conn.ConnectionState(), c.conn.ConnectionStats()
+	bidi, uni := c.StreamsOpened()
+	return Stats{
+		Version:   cs.Version,
+		ALPN:      cs.TLS.NegotiatedProtocol,
+		Resumed:   cs.TLS.DidResume,
+		Used0RTT:  cs.Used0RTT,
+		Datagrams: cs.SupportsDatagrams,
+
+		MinRTT:      st.MinRTT,
+		SmoothedRTT: st.SmoothedRTT,
+		LatestRTT:   st.LatestRTT,
+		RTTVar:      st.MeanDeviation,
+
+		BytesSent:       st.BytesSent,
+		BytesReceived:   st.BytesReceived,
+		BytesLost:       st.BytesLost,
+		PacketsSent:     st.PacketsSent,
+		PacketsReceived: st.PacketsReceived,
+		PacketsLost:     st.PacketsLost,
+
+		BidiStreams: bidi,
+		UniStreams:  uni,
+	}
+}
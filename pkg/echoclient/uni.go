@@ -0,0 +1,157 @@
+package echoclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// uniMagic starts the header of the server's unidirectional reply stream.
+// It must match the server's.
+const uniMagic = "QECHO-UNI/1"
+
+// uniReply is an echo stream from the server, positioned after its header,
+// and the maximum message size the header states, or 0 if it states none.
+type uniReply struct {
+	st     *quic.ReceiveStream
+	r      *bufio.Reader
+	maxMsg int
+}
+
+// EchoUni sends payload on a new unidirectional stream and returns the echo
+// the server sends back on a unidirectional stream of its own. Concurrent
+// calls are safe; replies are matched to requests by stream ID. A payload
+// larger than the server accepts fails with a [MessageTooLargeError].
+func (c *Client) EchoUni(ctx context.Context, payload []byte) ([]byte, error) {
+	c.uniOnce.Do(func() { go c.acceptUni() })
+	if err := c.Authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	var st *quic.SendStream
+	var err error
+	if c.failAtLimit {
+		st, err = c.conn.OpenUniStream()
+	} else {
+		st, err = c.conn.OpenUniStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	c.uniOpened.Add(1)
+
+	ch := make(chan uniReply, 1)
+	c.uniMu.Lock()
+	c.uniWaiters[st.StreamID()] = ch
+	c.uniMu.Unlock()
+	defer func() {
+		c.uniMu.Lock()
+		delete(c.uniWaiters, st.StreamID())
+		c.uniMu.Unlock()
+	}()
+
+	deadline, bounded := ctx.Deadline()
+	if bounded {
+		_ = st.SetWriteDeadline(deadline)
+	}
+	if _, err := st.Write(payload); err != nil {
+		st.CancelWrite(0)
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	if err := st.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+
+	var reply uniReply
+	select {
+	case reply = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if reply.maxMsg > 0 && len(payload) > reply.maxMsg {
+		reply.st.CancelRead(0)
+		return nil, &MessageTooLargeError{Size: len(payload), Limit: reply.maxMsg}
+	}
+	if bounded {
+		_ = reply.st.SetReadDeadline(deadline)
+	}
+	// The echo can't be longer than what was sent; read one byte more to notice.
+	echo, err := io.ReadAll(io.LimitReader(reply.r, int64(len(payload))+1))
+	reply.st.CancelRead(0)
+	if err != nil {
+		return nil, fmt.Errorf("read echo: %w", err)
+	}
+	return echo, nil
+}
+
+// acceptUni accepts the server's reply streams for the lifetime of the
+// connection and hands each to the [Client.EchoUni] call waiting for it.
+func (c *Client) acceptUni() {
+	ctx := c.conn.Context()
+	for {
+		st, err := c.conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+		go c.dispatchUni(st)
+	}
+}
+
+// dispatchUni reads the header of st and delivers it to its waiter.
+// Streams with a bad header or no waiter are discarded.
+func (c *Client) dispatchUni(st *quic.ReceiveStream) {
+	r := bufio.NewReaderSize(st, maxPreambleLen)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		st.CancelRead(0)
+		return
+	}
+	id, maxMsg, ok := parseUniHeader(string(line))
+	if !ok {
+		st.CancelRead(0)
+		return
+	}
+
+	c.uniMu.Lock()
+	ch, ok := c.uniWaiters[id]
+	c.uniMu.Unlock()
+	if !ok {
+		st.CancelRead(0)
+		return
+	}
+	ch <- uniReply{st: st, r: r, maxMsg: maxMsg}
+}
+
+// parseUniHeader parses a reply header such as "QECHO-UNI/1 id=2
+// max-msg=1024" and returns the ID of the client stream it answers and the
+// maximum message size, 0 if the header has none.
+func parseUniHeader(line string) (id quic.StreamID, maxMsg int, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != uniMagic {
+		return 0, 0, false
+	}
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "id":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			id, ok = quic.StreamID(n), true
+		case "max-msg":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return 0, 0, false
+			}
+			maxMsg = n
+		}
+	}
+	return id, maxMsg, ok
+}
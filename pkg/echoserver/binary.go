@@ -0,0 +1,48 @@
+package echoserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+// frameHeaderLen is the length of the prefix of a message in binary
+// framing, see [ALPNBinary]. It must match the client's.
+const frameHeaderLen = 4
+
+// echoFrames echoes the length-prefixed messages read from r to dst until
+// EOF, one write per message, prefix included. A message longer than limit
+// fails with a [messageTooLargeError] before it is read, and a stream that
+// ends inside a message fails with [io.ErrUnexpectedEOF].
+func echoFrames(dst io.Writer, r io.Reader, limit int) (int64, error) {
+	var buf []byte
+	var n int64
+	for {
+		var hdr [frameHeaderLen]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if uint64(size) > uint64(limit) {
+			return n, &messageTooLargeError{limit: limit}
+		}
+
+		buf = slices.Grow(buf[:0], frameHeaderLen+int(size))[:frameHeaderLen+int(size)]
+		copy(buf, hdr[:])
+		if _, err := io.ReadFull(r, buf[frameHeaderLen:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		nw, err := dst.Write(buf)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+	}
+}
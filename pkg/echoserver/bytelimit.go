@@ -0,0 +1,84 @@
+package echoserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// ByteLimitCode is the stream error code used to reset a stream whose echo
+// would exceed the per-stream or per-connection byte limit.
+const ByteLimitCode = errcode.ByteLimit
+
+// byteLimitError reports which byte limit an echo ran into.
+type byteLimitError struct {
+	scope string // "stream" or "connection"
+	limit int64
+}
+
+// Error implements error.
+func (e *byteLimitError) Error() string {
+	return fmt.Sprintf("%s byte limit of %d exceeded", e.scope, e.limit)
+}
+
+// byteLimitWriter counts the bytes written to w against a per-stream and a
+// shared per-connection budget. A write that would exceed either budget is
+// rejected whole with a [byteLimitError]. A zero limit means unlimited.
+type byteLimitWriter struct {
+	w io.Writer
+
+	maxStream int64
+	sent      int64
+
+	maxConn  int64
+	connSent *atomic.Int64
+}
+
+// Write implements io.Writer.
+func (bw *byteLimitWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if bw.maxStream > 0 && bw.sent+n > bw.maxStream {
+		return 0, &byteLimitError{scope: "stream", limit: bw.maxStream}
+	}
+	if bw.maxConn > 0 {
+		if bw.connSent.Add(n) > bw.maxConn {
+			bw.connSent.Add(-n)
+			return 0, &byteLimitError{scope: "connection", limit: bw.maxConn}
+		}
+	}
+
+	nw, err := bw.w.Write(p)
+	bw.sent += int64(nw)
+	if bw.maxConn > 0 && nw < len(p) {
+		bw.connSent.Add(int64(nw) - n)
+	}
+	return nw, err
+}
+
+// limitWriter wraps w, a stream of conn, with the byte limits of opts. It
+// returns w unchanged if no limit is set.
+func (h *Handler) limitWriter(opts *Options, conn *quic.Conn, w io.Writer) io.Writer {
+	if opts.MaxStreamBytes <= 0 && opts.MaxConnBytes <= 0 {
+		return w
+	}
+	bw := &byteLimitWriter{w: w, maxStream: opts.MaxStreamBytes, maxConn: opts.MaxConnBytes}
+	if bw.maxConn > 0 {
+		bw.connSent = h.connBytes(conn)
+	}
+	return bw
+}
+
+// connBytes returns the counter of bytes echoed on conn, creating it on first
+// use. The counter is forgotten once conn is closed.
+func (h *Handler) connBytes(conn *quic.Conn) *atomic.Int64 {
+	v, loaded := h.connSent.LoadOrStore(conn, new(atomic.Int64))
+	if !loaded {
+		context.AfterFunc(conn.Context(), func() { h.connSent.Delete(conn) })
+	}
+	return v.(*atomic.Int64)
+}
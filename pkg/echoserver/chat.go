@@ -0,0 +1,228 @@
+package echoserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// ChatOverflowCode is the stream error code used to reset a chat stream that
+// falls too far behind the broadcast.
+const ChatOverflowCode = errcode.ChatOverflow
+
+// chatQueueLen is the number of broadcast lines queued per member before it
+// is considered too slow and dropped.
+const chatQueueLen = 256
+
+// errChatOverflow reports a member dropped from the chat for falling behind.
+var errChatOverflow = errors.New("chat queue overflow")
+
+// Chat is a [streamserver.StreamHandler] that speaks the echo protocol but
+// broadcasts every line received on any of its streams to all of them,
+// including the sender, prefixed with a tag naming the sender. Tagged lines
+// must fit the maximum message size negotiated by the sender, and are skipped
+// for members that negotiated a smaller one. It takes its options from an
+// echo [Handler], so that they can be changed at runtime in the same way.
+type Chat struct {
+	h *Handler
+
+	mu      sync.Mutex
+	members map[*chatMember]struct{}
+}
+
+// chatMember is a stream taking part in the chat.
+type chatMember struct {
+	st    *quic.Stream
+	tag   []byte
+	limit int
+	sess  *e2e.Session
+
+	// out queues the newline-terminated lines to deliver to the member. It
+	// is closed once the member has left.
+	out        chan []byte
+	overflowed atomic.Bool
+	// skipped counts the lines too long for the member.
+	skipped atomic.Int64
+}
+
+// NewChat returns a chat with the options of h.
+func NewChat(h *Handler) *Chat {
+	return &Chat{h: h, members: make(map[*chatMember]struct{})}
+}
+
+// Members returns the number of streams currently in the chat.
+func (c *Chat) Members() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.members)
+}
+
+// Serve implements [streamserver.StreamHandler]. It negotiates the preamble
+// as the echo handler does, then relays the lines read from st to all
+// members until EOF, while delivering the lines of all members to st.
+// Members that cannot keep up are reset with [ChatOverflowCode].
+func (c *Chat) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	// Chat broadcasts lines, which does not go with compression, and is
+	// not recorded, as it cannot be replayed as an echo.
+	s, err := c.h.open(ctx, conn, st, false, false)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	m := &chatMember{
+		st:    st,
+		tag:   fmt.Appendf(nil, "[%s/%d] ", conn.RemoteAddr(), st.StreamID()),
+		limit: s.neg.limit,
+		sess:  s.neg.sess,
+		out:   make(chan []byte, chatQueueLen),
+	}
+	s.l.Info("joined chat", "members", c.join(m))
+
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- c.deliver(m, c.h.echoWriter(s.opts, conn, s.out, false))
+	}()
+
+	lines, rerr := c.relay(m, io.MultiReader(bytes.NewReader(s.neg.pending), s.br))
+	c.leave(m)
+	werr := <-delivered
+	s.l = s.l.With("skipped", m.skipped.Load())
+
+	err = errors.Join(rerr, werr)
+	if m.overflowed.Load() {
+		err = errChatOverflow
+	}
+	return s.finish("chat", "left chat", "lines", int64(lines), err)
+}
+
+// relay reads lines from r until EOF and broadcasts each of them, tagged as
+// sent by m. It returns the number of lines relayed.
+func (c *Chat) relay(m *chatMember, r io.Reader) (int, error) {
+	// Room must be left for the tag, and sealed lines are longer than the
+	// messages they carry.
+	limit := max(m.limit-len(m.tag), 0)
+	size := limit
+	if m.sess != nil {
+		size = e2e.SealedLen(limit)
+	}
+	lr := bufio.NewReaderSize(r, size+1)
+
+	var n int
+	for {
+		line, rerr := lr.ReadSlice('\n')
+		if errors.Is(rerr, bufio.ErrBufferFull) || len(bytes.TrimSuffix(line, []byte("\n"))) > size {
+			return n, &messageTooLargeError{limit: limit}
+		}
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			return n, rerr
+		}
+		if len(line) == 0 {
+			return n, nil
+		}
+
+		msg := bytes.TrimSuffix(line, []byte("\n"))
+		if m.sess != nil {
+			var err error
+			if msg, err = m.sess.Open(msg); err != nil {
+				return n, fmt.Errorf("e2e: %w", err)
+			}
+		}
+		if len(msg) > limit {
+			return n, &messageTooLargeError{limit: limit}
+		}
+		c.broadcast(slices.Concat(m.tag, msg, []byte("\n")))
+		n++
+
+		if rerr != nil {
+			return n, nil
+		}
+	}
+}
+
+// deliver writes the lines queued for m to w, sealing them if m negotiated
+// end-to-end encryption, until m leaves the chat. Lines longer than the
+// limit of m are skipped. If a write fails, m leaves the chat and stops
+// reading.
+func (c *Chat) deliver(m *chatMember, w io.Writer) error {
+	for msg := range m.out {
+		if len(msg)-1 > m.limit {
+			m.skipped.Add(1)
+			continue
+		}
+		if m.sess != nil {
+			msg = append(m.sess.Seal(msg[:len(msg)-1]), '\n')
+		}
+		if _, err := w.Write(msg); err != nil {
+			c.leave(m)
+			m.st.CancelRead(0)
+			for range m.out {
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcast queues msg for all members. Members whose queue is full are
+// dropped from the chat and their streams reset.
+func (c *Chat) broadcast(msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for m := range c.members {
+		select {
+		case m.out <- msg:
+		default:
+			m.overflowed.Store(true)
+			c.leaveLocked(m)
+			m.st.CancelRead(ChatOverflowCode)
+			m.st.CancelWrite(ChatOverflowCode)
+		}
+	}
+}
+
+// join adds m to the chat and returns the number of members.
+func (c *Chat) join(m *chatMember) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members[m] = struct{}{}
+	return len(c.members)
+}
+
+// leave removes m from the chat. It is safe to call more than once.
+func (c *Chat) leave(m *chatMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leaveLocked(m)
+}
+
+// leaveLocked is leave with c.mu held.
+func (c *Chat) leaveLocked(m *chatMember) {
+	if _, ok := c.members[m]; ok {
+		delete(c.members, m)
+		close(m.out)
+	}
+}
+
+// ServeDatagrams implements [streamserver.DatagramHandler]. Datagrams are
+// echoed to their sender only, as by [Handler.ServeDatagrams].
+func (c *Chat) ServeDatagrams(ctx context.Context, conn *quic.Conn) error {
+	return c.h.ServeDatagrams(ctx, conn)
+}
+
+// ServeUni implements [streamserver.UniStreamHandler]. Unidirectional streams
+// are echoed to their sender only, as by [Handler.ServeUni].
+func (c *Chat) ServeUni(ctx context.Context, conn *quic.Conn, st *quic.ReceiveStream) error {
+	return c.h.ServeUni(ctx, conn, st)
+}
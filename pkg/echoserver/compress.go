@@ -0,0 +1,60 @@
+package echoserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/romanov9617/usb-quic/pkg/compress"
+)
+
+// Compression returns the bytes of the messages of the compressed streams
+// served so far, raw and as carried on the streams, once their echo is
+// done.
+func (h *Handler) Compression() compress.Stats {
+	h.compressMu.Lock()
+	defer h.compressMu.Unlock()
+	return h.compressed
+}
+
+// addCompression adds the bytes of a compressed stream, s, to the totals
+// of h and logs its compression ratio to l.
+func (h *Handler) addCompression(s compress.Stats, l *slog.Logger) {
+	h.compressMu.Lock()
+	h.compressed = h.compressed.Add(s)
+	h.compressMu.Unlock()
+	l.Info("compression",
+		"raw_in", s.RawReceived, "wire_in", s.WireReceived,
+		"raw_out", s.RawSent, "wire_out", s.WireSent,
+		"ratio", fmt.Sprintf("%.2f", s.Ratio()))
+}
+
+// echoCompressed echoes the compressed messages read from br to dst until
+// EOF, one write per message, compressing every echo anew with codec.
+// Messages longer than the limit of codec fail with a
+// [messageTooLargeError], and a stream that ends inside a message fails
+// with [io.ErrUnexpectedEOF].
+func echoCompressed(dst io.Writer, br *bufio.Reader, codec *compress.Codec) (int64, error) {
+	var buf []byte
+	var n int64
+	for {
+		msg, err := codec.ReadMessage(br)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if errors.Is(err, compress.ErrTooLarge) {
+			return n, &messageTooLargeError{limit: codec.Limit()}
+		}
+		if err != nil {
+			return n, err
+		}
+		buf = codec.AppendMessage(buf[:0], msg)
+		nw, err := dst.Write(buf)
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package echoserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// DelayModel describes artificial server processing time applied to echoes.
+// Create one with [NewDelayModel].
+type DelayModel struct {
+	// dist is one of "fixed", "uniform", "normal" or "pareto".
+	dist string
+	// base is the fixed delay, the mean (uniform, normal) or the scale (pareto).
+	base time.Duration
+	// spread is the half-width (uniform) or standard deviation (normal).
+	spread time.Duration
+	// alpha is the pareto shape; smaller values give heavier tails.
+	alpha float64
+	// jitter is the width of a uniform [0, jitter) delay added to every sample.
+	jitter time.Duration
+	// perByte scales each sample by the number of echoed bytes instead of
+	// applying it once per message.
+	perByte bool
+}
+
+// NewDelayModel validates the delay parameters and returns the model, or nil
+// if dist is empty or "none". per is "message" or "byte". jitter, if
+// positive, adds a uniform [0, jitter) delay on top of every sample.
+func NewDelayModel(dist string, base, spread, jitter time.Duration, alpha float64, per string) (*DelayModel, error) {
+	if dist == "" || dist == "none" {
+		return nil, nil
+	}
+
+	m := &DelayModel{dist: dist, base: base, spread: spread, alpha: alpha, jitter: jitter}
+	switch per {
+	case "message":
+	case "byte":
+		m.perByte = true
+	default:
+		return nil, fmt.Errorf("unknown delay unit %q (want message or byte)", per)
+	}
+
+	switch dist {
+	case "fixed", "uniform", "normal":
+	case "pareto":
+		if alpha <= 0 {
+			return nil, fmt.Errorf("pareto shape must be positive, got %v", alpha)
+		}
+		if base <= 0 {
+			return nil, fmt.Errorf("pareto scale must be positive, got %v", base)
+		}
+	default:
+		return nil, fmt.Errorf("unknown delay distribution %q (want fixed, uniform, normal or pareto)", dist)
+	}
+	if base < 0 || spread < 0 || jitter < 0 {
+		return nil, fmt.Errorf("delay, spread and jitter must not be negative")
+	}
+	return m, nil
+}
+
+// sample draws one delay from the distribution. Negative draws are clamped to zero.
+func (m *DelayModel) sample() time.Duration {
+	var d float64
+	switch m.dist {
+	case "fixed":
+		d = float64(m.base)
+	case "uniform":
+		d = float64(m.base) + (2*rand.Float64()-1)*float64(m.spread)
+	case "normal":
+		d = float64(m.base) + rand.NormFloat64()*float64(m.spread)
+	case "pareto":
+		// Inverse transform sampling: x = xm / U^(1/alpha), U in (0, 1].
+		d = float64(m.base) / math.Pow(1-rand.Float64(), 1/m.alpha)
+	}
+	if m.jitter > 0 {
+		d += rand.Float64() * float64(m.jitter)
+	}
+	return time.Duration(max(d, 0))
+}
+
+// String returns a short description for logging.
+func (m *DelayModel) String() string {
+	unit := "message"
+	if m.perByte {
+		unit = "byte"
+	}
+	return fmt.Sprintf("%s(base=%v spread=%v alpha=%v jitter=%v)/%s", m.dist, m.base, m.spread, m.alpha, m.jitter, unit)
+}
+
+// delayWriter delays writes to w according to model. In per-message mode the
+// delay is applied before the first byte of every message; in per-byte mode
+// every write is delayed by one sample times its length.
+type delayWriter struct {
+	w     io.Writer
+	model *DelayModel
+	// framed is set for binary framing and compression, where every
+	// write is a whole message, rather than a line.
+	framed bool
+
+	// midMessage is set while the bytes of a message are being written.
+	midMessage bool
+}
+
+// Write implements io.Writer.
+func (dw *delayWriter) Write(p []byte) (int, error) {
+	if dw.model.perByte {
+		time.Sleep(dw.model.sample() * time.Duration(len(p)))
+		return dw.w.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if !dw.midMessage {
+			time.Sleep(dw.model.sample())
+			dw.midMessage = true
+		}
+
+		seg := p
+		if dw.framed {
+			dw.midMessage = false
+		} else if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			seg = p[:i+1]
+			dw.midMessage = false
+		}
+		n, err := dw.w.Write(seg)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(seg):]
+	}
+	return written, nil
+}
@@ -0,0 +1,65 @@
+package echoserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+)
+
+// acceptE2E completes the key exchange for a client public key from the
+// preamble, with the pre-shared key psk if it is not nil, and returns the
+// session and the server key to send back.
+func acceptE2E(clientKey string, psk []byte) (*e2e.Session, string, error) {
+	peer, err := e2e.ParsePublicKey(clientKey)
+	if err != nil {
+		return nil, "", err
+	}
+	priv, err := e2e.GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	sess, err := e2e.NewSession(priv, peer, psk, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return sess, e2e.FormatPublicKey(priv.PublicKey()), nil
+}
+
+// echoSealed echoes end-to-end encrypted messages from br to dst until EOF:
+// every line is opened with sess and resealed for the reverse direction.
+// Lines longer than limit fail with a [messageTooLargeError].
+func echoSealed(dst io.Writer, br *bufio.Reader, sess *e2e.Session, limit int) (int64, error) {
+	lr := bufio.NewReaderSize(br, limit+1)
+
+	var n int64
+	for {
+		line, rerr := lr.ReadSlice('\n')
+		if errors.Is(rerr, bufio.ErrBufferFull) || len(bytes.TrimSuffix(line, []byte("\n"))) > limit {
+			return n, &messageTooLargeError{limit: limit}
+		}
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			return n, rerr
+		}
+		if len(line) == 0 {
+			return n, nil
+		}
+
+		msg, err := sess.Open(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			return n, fmt.Errorf("e2e: %w", err)
+		}
+		nw, err := dst.Write(append(sess.Seal(msg), '\n'))
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+
+		if rerr != nil {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Package echoserver implements the server side of the QUIC echo protocol.
+//
+// A [Handler] is a [streamserver.StreamHandler] that negotiates the optional
+// per-stream preamble, enforces the maximum message size and echoes every
+// byte back, resealing messages when end-to-end encryption is negotiated
+// (see package e2e). Connections that negotiate [ALPNBinary] exchange
+// length-prefixed messages of any bytes instead of lines, and streams that
+// negotiate zstd compression exchange compressed messages (see package
+// compress). The echoes of a stream are written at the priority its
+// preamble asks for, see package priority. QUIC datagrams are echoed as
+// well. [ListenAndServe] runs a complete echo server. A [Chat] speaks the
+// same protocol but broadcasts every line to all of its streams.
+package echoserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/compress"
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/priority"
+	"github.com/romanov9617/usb-quic/pkg/recording"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation identifier of the echo
+// protocol.
+const ALPN = "quic-echo"
+
+// ALPNBinary is the ALPN identifier of the echo protocol with binary
+// framing: every message is prefixed with its length, a 4-byte big-endian
+// integer, instead of ending with a newline, so that it may hold any bytes.
+// Its streams have no preamble and cannot be encrypted end to end.
+const ALPNBinary = "quic-echo-bin"
+
+// DefaultMaxMsg is the maximum message size of a zero [Options.MaxMsg].
+const DefaultMaxMsg = 64 << 10
+
+// Options configures a [Handler].
+type Options struct {
+	// MaxMsg is the maximum message (line) size in bytes accepted on a
+	// stream. Zero means [DefaultMaxMsg].
+	MaxMsg int
+	// RequireE2E rejects streams that do not negotiate end-to-end encryption.
+	RequireE2E bool
+	// E2EPSK, if not nil, is the pre-shared key the end-to-end keys are
+	// bound to, see package e2e. Clients must use the same key.
+	E2EPSK []byte
+	// Compress accepts zstd compression of the messages of the streams that
+	// offer it, see package compress. It is not combined with end-to-end
+	// encryption.
+	Compress bool
+	// Delay, if non-nil, delays every echo, see [NewDelayModel].
+	Delay *DelayModel
+	// Impair, if non-nil, drops or truncates echoes on purpose.
+	Impair *Impairment
+
+	// MaxStreamBytes and MaxConnBytes cap the bytes echoed per stream and
+	// per connection; a stream that would exceed either is reset with
+	// [ByteLimitCode]. Zero means unlimited.
+	MaxStreamBytes int64
+	MaxConnBytes   int64
+
+	// IdleTimeout, if positive, resets streams with [IdleStreamCode] once
+	// no data has been read from or written to them for that long.
+	IdleTimeout time.Duration
+
+	// RecordDir, if not empty, is the directory in which the bytes of every
+	// stream are recorded in both directions, one file per stream, for
+	// replay (see package recording).
+	RecordDir string
+	// RecordLimits bounds the recordings; streams recorded beyond them are
+	// only partly recorded, or not at all.
+	RecordLimits recording.Limits
+}
+
+// Handler echoes streams according to its options.
+type Handler struct {
+	opts atomic.Pointer[Options]
+
+	// connSent maps each *quic.Conn to the bytes echoed on it so far.
+	connSent sync.Map
+	// inFlight counts the bytes being echoed, see [Handler.InFlight].
+	inFlight atomic.Int64
+
+	// compressed sums the bytes of the compressed streams served, see
+	// [Handler.Compression].
+	compressMu sync.Mutex
+	compressed compress.Stats
+}
+
+// maxMsg returns the maximum message size of o.
+func (o *Options) maxMsg() int {
+	if o.MaxMsg == 0 {
+		return DefaultMaxMsg
+	}
+	return o.MaxMsg
+}
+
+// New returns an echo handler configured by opts.
+func New(opts Options) *Handler {
+	h := &Handler{}
+	h.SetOptions(opts)
+	return h
+}
+
+// SetOptions replaces the handler's options. Streams opened afterwards use
+// the new options; streams in progress keep the ones they started with.
+func (h *Handler) SetOptions(opts Options) {
+	h.opts.Store(&opts)
+}
+
+// options returns the current options.
+func (h *Handler) options() *Options {
+	return h.opts.Load()
+}
+
+// echoWriter wraps w, a stream of conn, with the byte limits, delay and
+// impairments of opts, and accounts for the bytes in flight. With framed,
+// every write to it is a whole message of binary framing or compression.
+func (h *Handler) echoWriter(opts *Options, conn *quic.Conn, w io.Writer, framed bool) io.Writer {
+	w = h.limitWriter(opts, conn, w)
+	if opts.Delay != nil {
+		w = &delayWriter{w: w, model: opts.Delay, framed: framed}
+	}
+	// Impairments go outside the delay so that dropped messages are not delayed.
+	if opts.Impair != nil {
+		w = &impairWriter{w: w, im: opts.Impair, framed: framed}
+	}
+	return inFlightWriter{w: w, total: &h.inFlight}
+}
+
+// ListenAndServe runs an echo server on addr until ctx is canceled.
+// tlsConf must offer [ALPN], [ALPNBinary] or both.
+func ListenAndServe(ctx context.Context, addr string, tlsConf *tls.Config, opts Options) error {
+	srv := &streamserver.Server{
+		Addr:       addr,
+		TLSConfig:  tlsConf,
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+		Handler:    New(opts),
+	}
+	return srv.ListenAndServe(ctx)
+}
+
+// Serve implements [streamserver.StreamHandler]. It reads from st and writes
+// back to st until EOF or an error occurs. A leading preamble is answered with
+// the negotiated parameters, and lines longer than the negotiated maximum
+// message size reset the stream. On connections that negotiated [ALPNBinary],
+// length-prefixed messages are echoed instead, limited to [Options.MaxMsg].
+// Echoes are delayed and impaired according to [Options.Delay] and
+// [Options.Impair], if set.
+func (h *Handler) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	s, err := h.open(ctx, conn, st, true, true)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	limit, sess, codec := s.neg.limit, s.neg.sess, s.neg.codec
+	opts := s.opts
+	if sess != nil && opts.Impair != nil && opts.Impair.DropRate > 0 {
+		// A dropped sealed message would leave the client's sequence
+		// number, the nonce, behind the server's, failing every message
+		// after it, so encrypted echoes are truncated but not dropped.
+		o, im := *opts, *opts.Impair
+		im.DropRate = 0
+		o.Impair = &im
+		opts = &o
+	}
+	dst := h.echoWriter(opts, conn, streamserver.Prioritize(ctx, s.out, s.neg.prio), s.framed || codec != nil)
+	var n int64
+	switch {
+	case s.framed:
+		n, err = echoFrames(dst, s.br, limit)
+	case sess != nil:
+		n, err = echoSealed(dst, s.br, sess, limit)
+	case codec != nil:
+		n, err = echoCompressed(dst, s.br, codec)
+		h.addCompression(codec.Stats(), s.l)
+	default:
+		// Echo whatever was read while looking for a preamble, then the rest of the stream.
+		n, err = copyLimited(dst, io.MultiReader(bytes.NewReader(s.neg.pending), s.br), &lineLimiter{max: limit})
+	}
+	return s.finish("copy", "echo done", "bytes", n, err)
+}
+
+// echoStream is a bidirectional stream served by a [Handler] or a [Chat],
+// as set up by [Handler.open].
+type echoStream struct {
+	st   *quic.Stream
+	l    *slog.Logger
+	opts *Options
+	// br reads what follows the preamble, and out writes to the stream,
+	// both through the idle reaper and the recording, if any.
+	br     *bufio.Reader
+	out    io.Writer
+	neg    negotiated
+	framed bool
+	start  time.Time
+
+	reaper *idleReaper
+	// stopRecording ends the recording, if any.
+	stopRecording func()
+}
+
+// open sets st up according to the current options: it resets st once idle
+// for too long, records it if record is set, and negotiates its preamble,
+// accepting compression if compression is set, unless the connection
+// negotiated [ALPNBinary]. Streams with a bad preamble, and streams without
+// end-to-end encryption if it is required, are reset and fail. The returned
+// stream must be closed.
+func (h *Handler) open(ctx context.Context, conn *quic.Conn, st *quic.Stream, record, compression bool) (*echoStream, error) {
+	l := streamserver.Logger(ctx)
+	s := &echoStream{st: st, l: l, opts: h.options(), stopRecording: func() {}}
+	opts := s.opts
+	s.reaper = newIdleReaper(opts.IdleTimeout, func() {
+		st.CancelRead(IdleStreamCode)
+		st.CancelWrite(IdleStreamCode)
+	})
+
+	src, out := s.reaper.reader(st), s.reaper.writer(st)
+	if record && opts.RecordDir != "" {
+		rec, path, err := startRecording(opts.RecordDir, opts.RecordLimits, conn, st)
+		switch {
+		case errors.Is(err, recording.ErrLimit):
+			l.Debug("stream not recorded, recording limit reached")
+		case err != nil:
+			l.Warn("stream not recorded", "err", err)
+		default:
+			s.stopRecording = func() {
+				err := rec.Close()
+				switch {
+				case errors.Is(err, recording.ErrLimit):
+					l.Info("recording cut short, recording limit reached", "path", path)
+				case err != nil:
+					l.Warn("recording failed", "path", path, "err", err)
+				}
+			}
+			src, out = rec.Reader(src), rec.Writer(out)
+			l.Debug("recording stream", "path", path)
+		}
+	}
+
+	s.start = time.Now()
+	s.br = bufio.NewReaderSize(src, maxPreambleLen)
+	s.out = out
+	s.framed = conn.ConnectionState().TLS.NegotiatedProtocol == ALPNBinary
+	// Binary streams have no preamble: the server's limit applies as is.
+	s.neg = negotiated{limit: opts.maxMsg()}
+	if !s.framed {
+		var err error
+		s.neg, err = negotiate(out, s.br, opts.maxMsg(), compression && opts.Compress, opts.E2EPSK, l)
+		if err != nil {
+			rejectBadPreamble(st, err, l)
+			s.close()
+			return nil, fmt.Errorf("negotiate: %w", err)
+		}
+	}
+	if s.neg.sess == nil && opts.RequireE2E {
+		st.CancelRead(E2ERequiredCode)
+		st.CancelWrite(E2ERequiredCode)
+		l.Warn("stream without end-to-end encryption rejected")
+		s.close()
+		return nil, errors.New("end-to-end encryption required")
+	}
+	return s, nil
+}
+
+// close stops watching s for idleness, ends its recording and closes its
+// write side.
+func (s *echoStream) close() {
+	s.reaper.stop()
+	s.stopRecording()
+	_ = s.st.Close()
+	s.l.Debug("closed")
+}
+
+// finish resets s with the stream error code err calls for, if any, and
+// logs how serving s ended, with n counted in unit: done on success, op
+// failed on other errors. It returns the error for the stream handler to
+// return.
+func (s *echoStream) finish(op, done, unit string, n int64, err error) error {
+	l, dur := s.l, time.Since(s.start)
+	if s.reaper.stop() {
+		l.Info("idle stream reset", "idle_timeout", s.opts.IdleTimeout, unit, n, "dur", dur)
+		return nil
+	}
+
+	var tooLarge *messageTooLargeError
+	if errors.As(err, &tooLarge) {
+		s.st.CancelRead(MsgTooLargeCode)
+		s.st.CancelWrite(MsgTooLargeCode)
+		l.Warn("message too large, stream reset", "limit", s.neg.limit, unit, n, "dur", dur)
+		return err
+	}
+	var overLimit *byteLimitError
+	if errors.As(err, &overLimit) {
+		s.st.CancelRead(ByteLimitCode)
+		s.st.CancelWrite(ByteLimitCode)
+		l.Warn("byte limit exceeded, stream reset", "scope", overLimit.scope, "limit", overLimit.limit, unit, n, "dur", dur)
+		return err
+	}
+	switch {
+	case errors.Is(err, errTruncated):
+		s.st.CancelRead(0)
+		l.Info("echo truncated", unit, n, "dur", dur)
+		return nil
+	case errors.Is(err, errChatOverflow):
+		l.Warn("chat member too slow, stream reset", "queue", chatQueueLen, unit, n, "dur", dur)
+		return err
+	case err != nil:
+		l.Warn(op+" failed", unit, n, "dur", dur, "err", err)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	l.Info(done, unit, n, "dur", dur)
+	return nil
+}
+
+// negotiated are the parameters of a stream, as agreed on in its preamble.
+type negotiated struct {
+	// limit is the maximum message size.
+	limit int
+	// pending are the bytes read while looking for a preamble that was not
+	// there, to be echoed as regular data.
+	pending []byte
+	// sess encrypts the messages end to end, if negotiated.
+	sess *e2e.Session
+	// codec compresses the messages, if negotiated.
+	codec *compress.Codec
+	// prio is the priority the echoes are written at.
+	prio priority.Level
+}
+
+// negotiate consumes a preamble from br if the stream starts with one and
+// replies with the effective parameters. Otherwise it returns the bytes it
+// has already read so they can be echoed as regular data. If the client
+// offered an end-to-end key, the session is set, bound to psk, and if it offered zstd
+// compression and compression is set, the codec. The priority the client
+// asked for is taken as is. Replies are written to w.
+func negotiate(w io.Writer, br *bufio.Reader, maxMsg int, compression bool, psk []byte, l *slog.Logger) (negotiated, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) && !errors.Is(err, io.EOF) {
+		return negotiated{}, err
+	}
+
+	// Only a complete first line can be a preamble.
+	p, ok, perr := parsePreamble(line)
+	if err != nil || !ok {
+		return negotiated{limit: maxMsg, pending: bytes.Clone(line)}, nil
+	}
+	if perr != nil {
+		return negotiated{}, &preambleError{fmt.Errorf("parse: %w", perr)}
+	}
+
+	neg := negotiated{limit: maxMsg, prio: p.prio}
+	if p.maxMsg > 0 {
+		neg.limit = min(neg.limit, p.maxMsg)
+	}
+	reply := preamble{maxMsg: neg.limit, prio: neg.prio}
+
+	if p.e2eKey != "" {
+		neg.sess, reply.e2eKey, err = acceptE2E(p.e2eKey, psk)
+		if err != nil {
+			return negotiated{}, &preambleError{fmt.Errorf("e2e: %w", err)}
+		}
+	}
+	// The client may offer several methods; sealed messages do not compress.
+	if compression && neg.sess == nil && slices.Contains(strings.Split(p.compress, ","), compress.Zstd) {
+		if neg.codec, err = compress.NewCodec(neg.limit); err != nil {
+			return negotiated{}, err
+		}
+		reply.compress = compress.Zstd
+	}
+
+	if _, err := io.WriteString(w, reply.String()+"\n"); err != nil {
+		return negotiated{}, fmt.Errorf("write preamble: %w", err)
+	}
+
+	l.Debug("preamble negotiated", "max_msg", neg.limit, "e2e", neg.sess != nil, "compress", reply.compress, "prio", neg.prio)
+	return neg, nil
+}
+
+// rejectBadPreamble resets st with [errcode.StreamProtocolError] if err is a
+// [preambleError].
+func rejectBadPreamble(st *quic.Stream, err error, l *slog.Logger) {
+	var pe *preambleError
+	if errors.As(err, &pe) {
+		st.CancelRead(errcode.StreamProtocolError)
+		st.CancelWrite(errcode.StreamProtocolError)
+		l.Warn("bad preamble, stream reset", "err", pe.err)
+	}
+}
+
+// copyLimited copies src to dst until EOF, failing once ll rejects a line.
+// io.EOF is expected when the peer closes its write side and is not an error.
+func copyLimited(dst io.Writer, src io.Reader, ll *lineLimiter) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			if err := ll.check(buf[:nr]); err != nil {
+				return n, err
+			}
+			nw, err := dst.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+		}
+		if errors.Is(rerr, io.EOF) {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// ServeDatagrams implements [streamserver.DatagramHandler]. It sends every
+// datagram received on conn straight back until conn is closed, subject to
+// [Options.Impair]. Datagrams that no longer fit into a packet are dropped,
+// as an unreliable path may.
+func (h *Handler) ServeDatagrams(ctx context.Context, conn *quic.Conn) error {
+	l := streamserver.Logger(ctx).With("component", "datagram")
+
+	var n, dropped int
+	defer func() {
+		if n > 0 {
+			l.Info("datagram echo done", "datagrams", n, "dropped", dropped)
+		}
+	}()
+	for {
+		p, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return fmt.Errorf("receive datagram: %w", err)
+		}
+		n++
+		if im := h.options().Impair; im != nil {
+			if im.drop() {
+				dropped++
+				continue
+			}
+			if im.TruncateAt > 0 && int64(len(p)) > im.TruncateAt {
+				p = p[:im.TruncateAt]
+			}
+		}
+		if err := conn.SendDatagram(p); err != nil {
+			var tooLarge *quic.DatagramTooLargeError
+			if !errors.As(err, &tooLarge) {
+				return fmt.Errorf("send datagram: %w", err)
+			}
+			dropped++
+			l.Debug("datagram dropped", "bytes", len(p), "max", tooLarge.MaxDatagramPayloadSize)
+		}
+	}
+}
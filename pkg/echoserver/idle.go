@@ -0,0 +1,110 @@
+package echoserver
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// IdleStreamCode is the stream error code used to reset a stream that saw
+// no activity for longer than [Options.IdleTimeout].
+const IdleStreamCode = errcode.StreamIdle
+
+// idleReaper cancels a stream once neither side has transferred data on it
+// for a given duration, so that abandoned streams do not pin their handler
+// goroutine until the connection dies.
+type idleReaper struct {
+	timeout time.Duration
+	cancel  func()
+
+	last   atomic.Int64 // unix nanoseconds of the last activity
+	reaped atomic.Bool
+	timer  *time.Timer
+}
+
+// newIdleReaper starts watching for idleness; cancel is called once when the
+// timeout elapses without activity. It returns nil if timeout is not positive.
+func newIdleReaper(timeout time.Duration, cancel func()) *idleReaper {
+	if timeout <= 0 {
+		return nil
+	}
+	r := &idleReaper{timeout: timeout, cancel: cancel}
+	r.touch()
+	r.timer = time.AfterFunc(timeout, r.check)
+	return r
+}
+
+// touch records activity now.
+func (r *idleReaper) touch() {
+	r.last.Store(time.Now().UnixNano())
+}
+
+// check reaps the stream if it has been idle for the timeout, and otherwise
+// re-arms the timer for the remaining time.
+func (r *idleReaper) check() {
+	idle := time.Since(time.Unix(0, r.last.Load()))
+	if idle < r.timeout {
+		r.timer.Reset(r.timeout - idle)
+		return
+	}
+	r.reaped.Store(true)
+	r.cancel()
+}
+
+// stop stops watching. It reports whether the stream was reaped. It is safe
+// to call on a nil reaper.
+func (r *idleReaper) stop() bool {
+	if r == nil {
+		return false
+	}
+	r.timer.Stop()
+	return r.reaped.Load()
+}
+
+// reader returns src wrapped to record activity on every read.
+func (r *idleReaper) reader(src io.Reader) io.Reader {
+	if r == nil {
+		return src
+	}
+	return activityReader{r: src, reaper: r}
+}
+
+// writer returns w wrapped to record activity on every write.
+func (r *idleReaper) writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return activityWriter{w: w, reaper: r}
+}
+
+// activityReader touches its reaper whenever data is read.
+type activityReader struct {
+	r      io.Reader
+	reaper *idleReaper
+}
+
+// Read implements io.Reader.
+func (ar activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.reaper.touch()
+	}
+	return n, err
+}
+
+// activityWriter touches its reaper whenever data is written.
+type activityWriter struct {
+	w      io.Writer
+	reaper *idleReaper
+}
+
+// Write implements io.Writer.
+func (aw activityWriter) Write(p []byte) (int, error) {
+	n, err := aw.w.Write(p)
+	if n > 0 {
+		aw.reaper.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package echoserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// errTruncated ends an echo once [Impairment.TruncateAt] bytes were sent.
+var errTruncated = errors.New("echo truncated")
+
+// Impairment makes the echo misbehave on purpose, so that client timeout and
+// retry logic can be tested against a controlled adversarial server.
+type Impairment struct {
+	// DropRate is the probability in [0, 1] that an echoed message (a line,
+	// or a datagram) is silently dropped. Messages of end-to-end encrypted
+	// streams are never dropped, as the peers could not open any message
+	// after a missing one.
+	DropRate float64
+	// TruncateAt, if positive, ends the echo of a stream after this many
+	// bytes as if it were complete, and cuts datagrams to this length.
+	TruncateAt int64
+}
+
+// Validate reports whether the impairment parameters are in range.
+func (im *Impairment) Validate() error {
+	if im.DropRate < 0 || im.DropRate > 1 {
+		return fmt.Errorf("drop rate must be in [0, 1], got %v", im.DropRate)
+	}
+	if im.TruncateAt < 0 {
+		return fmt.Errorf("truncation offset must not be negative, got %d", im.TruncateAt)
+	}
+	return nil
+}
+
+// String returns a short description for logging.
+func (im *Impairment) String() string {
+	return fmt.Sprintf("drop=%v truncate-at=%d", im.DropRate, im.TruncateAt)
+}
+
+// drop reports whether the next message should be dropped.
+func (im *Impairment) drop() bool {
+	return im.DropRate > 0 && rand.Float64() < im.DropRate
+}
+
+// impairWriter applies an [Impairment] to the echo written to w. Dropped
+// messages are reported as written so the echo carries on with the next
+// one; once the truncation offset is reached it fails with errTruncated.
+type impairWriter struct {
+	w  io.Writer
+	im *Impairment
+	// framed is set for binary framing and compression, where every
+	// write is a whole message, rather than a line.
+	framed bool
+
+	// sent counts the bytes passed on to w.
+	sent int64
+	// midMessage is set while the bytes of a message are being written, and
+	// dropping while that message is being dropped.
+	midMessage bool
+	dropping   bool
+}
+
+// Write implements io.Writer.
+func (iw *impairWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if !iw.midMessage {
+			iw.dropping = iw.im.drop()
+			iw.midMessage = true
+		}
+
+		seg := p
+		if iw.framed {
+			iw.midMessage = false
+		} else if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			seg = p[:i+1]
+			iw.midMessage = false
+		}
+		p = p[len(seg):]
+		if iw.dropping {
+			written += len(seg)
+			continue
+		}
+
+		truncated := false
+		if t := iw.im.TruncateAt; t > 0 && iw.sent+int64(len(seg)) >= t {
+			seg, truncated = seg[:t-iw.sent], true
+		}
+		n, err := iw.w.Write(seg)
+		written += n
+		iw.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if truncated {
+			return written, errTruncated
+		}
+	}
+	return written, nil
+}
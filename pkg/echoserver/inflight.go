@@ -0,0 +1,26 @@
+package echoserver
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// InFlight returns the number of bytes currently being echoed: handed to the
+// echo but not yet written to the stream, for instance because they are held
+// back by [Options.Delay] or blocked on flow control.
+func (h *Handler) InFlight() int64 {
+	return h.inFlight.Load()
+}
+
+// inFlightWriter counts the bytes of pending writes to w in total.
+type inFlightWriter struct {
+	w     io.Writer
+	total *atomic.Int64
+}
+
+// Write implements io.Writer.
+func (fw inFlightWriter) Write(p []byte) (int, error) {
+	fw.total.Add(int64(len(p)))
+	defer fw.total.Add(-int64(len(p)))
+	return fw.w.Write(p)
+}
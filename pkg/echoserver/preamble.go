@@ -0,0 +1,145 @@
+package echoserver
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/priority"
+)
+
+// preambleMagic starts the optional first line of a stream that carries
+// negotiation parameters. It must match the client's.
+const preambleMagic = "QECHO/1"
+
+// maxPreambleLen bounds how many bytes are inspected when looking for a preamble.
+// Streams whose first line is longer are treated as plain echo data.
+const maxPreambleLen = 512
+
+// MsgTooLargeCode is the stream error code used when a line exceeds the
+// negotiated maximum message size.
+const MsgTooLargeCode = errcode.MsgTooLarge
+
+// E2ERequiredCode is the stream error code used to reject streams without
+// end-to-end encryption when it is required.
+const E2ERequiredCode = errcode.E2ERequired
+
+// preamble holds per-stream parameters exchanged before echo data.
+type preamble struct {
+	// maxMsg is the maximum message (line) length in bytes, excluding the newline.
+	// Zero means the sender has no preference.
+	maxMsg int
+	// e2eKey is the sender's end-to-end public key (see package e2e), if any.
+	e2eKey string
+	// compress is the message compression offered or accepted, if any
+	// (see package compress).
+	compress string
+	// prio is the priority the sender asks the echoes of the stream to be
+	// written at (see package priority).
+	prio priority.Level
+}
+
+// parsePreamble parses a preamble line such as "QECHO/1 max-msg=65536".
+// ok is false if line does not start with [preambleMagic].
+func parsePreamble(line []byte) (p preamble, ok bool, err error) {
+	fields := strings.Fields(string(bytes.TrimRight(line, "\r\n")))
+	if len(fields) == 0 || fields[0] != preambleMagic {
+		return preamble{}, false, nil
+	}
+
+	for _, f := range fields[1:] {
+		key, val, _ := strings.Cut(f, "=")
+		switch key {
+		case "max-msg":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return preamble{}, true, fmt.Errorf("invalid max-msg %q", val)
+			}
+			p.maxMsg = n
+		case "e2e":
+			p.e2eKey = val
+		case "compress":
+			p.compress = val
+		case "prio":
+			n, err := strconv.ParseInt(val, 10, 8)
+			if err != nil {
+				return preamble{}, true, fmt.Errorf("invalid prio %q", val)
+			}
+			p.prio = priority.Level(n)
+		default:
+			// Unknown parameters are ignored for forward compatibility.
+		}
+	}
+	return p, true, nil
+}
+
+// String encodes p as a preamble line without the trailing newline.
+func (p preamble) String() string {
+	s := fmt.Sprintf("%s max-msg=%d", preambleMagic, p.maxMsg)
+	if p.e2eKey != "" {
+		s += " e2e=" + p.e2eKey
+	}
+	if p.compress != "" {
+		s += " compress=" + p.compress
+	}
+	if p.prio != priority.Normal {
+		s += fmt.Sprintf(" prio=%d", p.prio)
+	}
+	return s
+}
+
+// messageTooLargeError reports a line that exceeds the negotiated limit.
+type messageTooLargeError struct {
+	limit int
+}
+
+// Error implements error.
+func (e *messageTooLargeError) Error() string {
+	return fmt.Sprintf("message exceeds max size of %d bytes", e.limit)
+}
+
+// preambleError reports a preamble the server cannot accept. Streams that
+// send one are reset with [errcode.StreamProtocolError].
+type preambleError struct {
+	err error
+}
+
+// Error implements error.
+func (e *preambleError) Error() string {
+	return "bad preamble: " + e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *preambleError) Unwrap() error {
+	return e.err
+}
+
+// lineLimiter tracks the length of the current line across chunks of a byte stream.
+type lineLimiter struct {
+	max int
+	cur int
+}
+
+// check advances the limiter over p and fails once any line grows past max bytes.
+func (ll *lineLimiter) check(p []byte) error {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			ll.cur += len(p)
+			break
+		}
+		if ll.cur+i > ll.max {
+			ll.cur += i
+			break
+		}
+		ll.cur = 0
+		p = p[i+1:]
+	}
+
+	if ll.cur > ll.max {
+		return &messageTooLargeError{limit: ll.max}
+	}
+	return nil
+}
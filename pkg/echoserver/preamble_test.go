@@ -0,0 +1,52 @@
+package echoserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzParsePreamble checks that every preamble accepted encodes to a line
+// that parses back to the same parameters.
+func FuzzParsePreamble(f *testing.F) {
+	f.Add([]byte("QECHO/1 max-msg=65536\n"))
+	f.Add([]byte("QECHO/1 max-msg=0 e2e=x25519:AAAA compress=zstd prio=-2\r\n"))
+	f.Add([]byte("QECHO/1 max-msg=-1\n"))
+	f.Add([]byte("hello world\n"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		p, ok, err := parsePreamble(line)
+		if !ok || err != nil {
+			return
+		}
+		again, ok, err := parsePreamble([]byte(p.String() + "\n"))
+		if !ok || err != nil {
+			t.Fatalf("preamble %q does not parse: %v", p.String(), err)
+		}
+		if again != p {
+			t.Fatalf("preamble changed in a round trip: %+v, want %+v", again, p)
+		}
+	})
+}
+
+// FuzzLineLimiter checks that the limiter fails exactly when a line of data
+// is longer than its maximum, however the data is split into chunks.
+func FuzzLineLimiter(f *testing.F) {
+	f.Add([]byte("abc\ndef\n"), uint16(3), uint16(2))
+	f.Add([]byte("abcd\n"), uint16(3), uint16(4))
+	f.Add([]byte("\n\n\nabc"), uint16(0), uint16(1))
+	f.Fuzz(func(t *testing.T, data []byte, max, split uint16) {
+		want := false
+		for line := range bytes.SplitSeq(data, []byte("\n")) {
+			want = want || len(line) > int(max)
+		}
+
+		at := int(split) % (len(data) + 1)
+		ll := &lineLimiter{max: int(max)}
+		err := ll.check(data[:at])
+		if err == nil {
+			err = ll.check(data[at:])
+		}
+		if got := err != nil; got != want {
+			t.Fatalf("limit %d split at %d: failed = %t, want %t", max, at, got, want)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package echoserver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/recording"
+)
+
+// startRecording creates a recording of st in dir, named after the current
+// time, the peer address and the stream ID, and returns it with its path.
+// The recording is bounded by lim.
+func startRecording(dir string, lim recording.Limits, conn *quic.Conn, st *quic.Stream) (*recording.Recorder, string, error) {
+	h := recording.Header{
+		ALPN:     conn.ConnectionState().TLS.NegotiatedProtocol,
+		Remote:   conn.RemoteAddr().String(),
+		StreamID: int64(st.StreamID()),
+		Start:    time.Now(),
+	}
+	remote := strings.NewReplacer(":", "_", "[", "", "]", "", "%", "_").Replace(h.Remote)
+	name := fmt.Sprintf("%s-%s-%d.qrec", h.Start.UTC().Format("20060102T150405.000000000Z"), remote, h.StreamID)
+	path := filepath.Join(dir, name)
+	rec, err := recording.Create(path, h, lim)
+	if err != nil {
+		return nil, "", fmt.Errorf("create recording: %w", err)
+	}
+	return rec, path, nil
+}
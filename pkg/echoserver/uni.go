@@ -0,0 +1,101 @@
+package echoserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// uniMagic starts the header of a server-initiated unidirectional stream that
+// carries the echo of a client unidirectional stream. It must match the
+// client's.
+const uniMagic = "QECHO-UNI/1"
+
+// ServeUni implements [streamserver.UniStreamHandler]. It opens a
+// unidirectional stream back to the client, writes a header line naming the
+// ID of st so the client can correlate the two, and then copies st's payload
+// to it unchanged. The payload is one message, limited to [Options.MaxMsg]
+// bytes, which the header states too: st is reset with [MsgTooLargeCode] if
+// the payload is larger, and the reply ends early but is not reset, as a
+// reset could overtake the header and leave the client waiting for it.
+func (h *Handler) ServeUni(ctx context.Context, conn *quic.Conn, st *quic.ReceiveStream) error {
+	l := streamserver.Logger(ctx)
+	defer l.Debug("closed")
+
+	start := time.Now()
+	out, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		st.CancelRead(0)
+		return fmt.Errorf("open reply stream: %w", err)
+	}
+
+	opts := h.options()
+	if _, err := fmt.Fprintf(out, "%s id=%d max-msg=%d\n", uniMagic, st.StreamID(), opts.maxMsg()); err != nil {
+		st.CancelRead(0)
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	reaper := newIdleReaper(opts.IdleTimeout, func() {
+		st.CancelRead(IdleStreamCode)
+		out.CancelWrite(IdleStreamCode)
+	})
+	src := &msgLimitReader{r: reaper.reader(st), max: opts.maxMsg()}
+	n, err := io.Copy(h.echoWriter(opts, conn, reaper.writer(out), false), src)
+	if reaper.stop() {
+		l.Info("idle stream reset", "idle_timeout", opts.IdleTimeout, "bytes", n)
+		return nil
+	}
+	var tooLarge *messageTooLargeError
+	if errors.As(err, &tooLarge) {
+		st.CancelRead(MsgTooLargeCode)
+		_ = out.Close()
+		l.Warn("message too large, stream reset", "limit", tooLarge.limit, "bytes", n)
+		return err
+	}
+	var overLimit *byteLimitError
+	if errors.As(err, &overLimit) {
+		st.CancelRead(ByteLimitCode)
+		out.CancelWrite(ByteLimitCode)
+		l.Warn("byte limit exceeded, stream reset", "scope", overLimit.scope, "limit", overLimit.limit, "bytes", n)
+		return err
+	}
+	if errors.Is(err, errTruncated) {
+		st.CancelRead(0)
+		err = nil
+	}
+	if err != nil {
+		st.CancelRead(0)
+		out.CancelWrite(0)
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close reply stream: %w", err)
+	}
+
+	l.Info("uni echo done", "bytes", n, "reply_stream", out.StreamID(), "dur", time.Since(start))
+	return nil
+}
+
+// msgLimitReader reads a message of at most max bytes from r, and fails with
+// a [messageTooLargeError] instead of returning the bytes past max.
+type msgLimitReader struct {
+	r    io.Reader
+	max  int
+	read int
+}
+
+// Read implements io.Reader.
+func (mr *msgLimitReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	mr.read += n
+	if mr.read > mr.max {
+		return 0, &messageTooLargeError{limit: mr.max}
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+// Package errcode defines the application error codes shared by the server
+// and the client: the codes connections are closed with and the codes
+// streams are reset with, and their human-readable descriptions.
+//
+// Connection and stream codes are separate spaces. The values are part of
+// the wire protocol and must not change.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// Codes connections are closed with.
+const (
+	// NoError is a normal close.
+	NoError quic.ApplicationErrorCode = 0x0
+	// ProtocolError closes a connection that violated the application
+	// protocol.
+	ProtocolError quic.ApplicationErrorCode = 0x1
+	// ShuttingDown closes connections when the server shuts down.
+	ShuttingDown quic.ApplicationErrorCode = 0x2
+	// LimitExceeded rejects connections beyond the server's connection
+	// limits.
+	LimitExceeded quic.ApplicationErrorCode = 0x3
+	// AdminClose closes a connection on an operator's request.
+	AdminClose quic.ApplicationErrorCode = 0x4
+	// AuthFailed closes a connection that failed to authenticate.
+	AuthFailed quic.ApplicationErrorCode = 0x5
+)
+
+// Codes streams are reset with.
+const (
+	// StreamCanceled is a plain cancellation.
+	StreamCanceled quic.StreamErrorCode = 0x0
+	// MsgTooLarge resets a stream that sent a line longer than the
+	// negotiated maximum message size.
+	MsgTooLarge quic.StreamErrorCode = 0x1
+	// E2ERequired rejects a stream without end-to-end encryption when it is
+	// required.
+	E2ERequired quic.StreamErrorCode = 0x2
+	// ByteLimit resets a stream whose echo would exceed a byte limit.
+	ByteLimit quic.StreamErrorCode = 0x3
+	// StreamIdle resets a stream that saw no activity for too long.
+	StreamIdle quic.StreamErrorCode = 0x4
+	// ChatOverflow resets a chat stream that fell too far behind.
+	ChatOverflow quic.StreamErrorCode = 0x5
+	// StreamRejected resets a stream the server has no room to serve.
+	StreamRejected quic.StreamErrorCode = 0x6
+	// FileError resets a file protocol stream whose file cannot be served.
+	FileError quic.StreamErrorCode = 0x7
+	// TunnelError resets a tunnel, proxy or reverse stream whose target
+	// cannot be reached.
+	TunnelError quic.StreamErrorCode = 0x8
+	// StreamProtocolError resets a stream that violated the application
+	// protocol, such as with a malformed preamble.
+	StreamProtocolError quic.StreamErrorCode = 0x9
+)
+
+// connReasons describes the connection close codes.
+var connReasons = map[quic.ApplicationErrorCode]string{
+	NoError:       "closed normally",
+	ProtocolError: "protocol error",
+	ShuttingDown:  "server shutting down",
+	LimitExceeded: "connection limit exceeded",
+	AdminClose:    "closed by the server operator",
+	AuthFailed:    "authentication failed",
+}
+
+// streamReasons describes the stream reset codes.
+var streamReasons = map[quic.StreamErrorCode]string{
+	StreamCanceled:      "canceled",
+	MsgTooLarge:         "message too large",
+	E2ERequired:         "end-to-end encryption required",
+	ByteLimit:           "byte limit exceeded",
+	StreamIdle:          "idle for too long",
+	ChatOverflow:        "too slow to keep up with the chat",
+	StreamRejected:      "server busy, stream rejected",
+	FileError:           "file cannot be served",
+	TunnelError:         "tunnel target unreachable",
+	StreamProtocolError: "protocol error",
+}
+
+// ConnReason returns a description of the connection close code.
+func ConnReason(code quic.ApplicationErrorCode) string {
+	if r, ok := connReasons[code]; ok {
+		return r
+	}
+	return fmt.Sprintf("unknown error %#x", uint64(code))
+}
+
+// StreamReason returns a description of the stream reset code.
+func StreamReason(code quic.StreamErrorCode) string {
+	if r, ok := streamReasons[code]; ok {
+		return r
+	}
+	return fmt.Sprintf("unknown error %#x", uint64(code))
+}
+
+// Describe explains why err ended a connection or stream, if it did: a
+// connection close or stream reset by the peer or locally, or an idle
+// timeout. It reports false for other errors.
+func Describe(err error) (string, bool) {
+	side := func(remote bool) string {
+		if remote {
+			return "by peer"
+		}
+		return "locally"
+	}
+
+	var se *quic.StreamError
+	if errors.As(err, &se) {
+		return fmt.Sprintf("stream reset %s: %s", side(se.Remote), StreamReason(se.ErrorCode)), true
+	}
+	var ae *quic.ApplicationError
+	if errors.As(err, &ae) {
+		return fmt.Sprintf("connection closed %s: %s", side(ae.Remote), ConnReason(ae.ErrorCode)), true
+	}
+	var it *quic.IdleTimeoutError
+	if errors.As(err, &it) {
+		return "connection idle for too long", true
+	}
+	return "", false
+}
@@ -0,0 +1,470 @@
+// Package mdns implements just enough multicast DNS (RFC 6762) and DNS-based
+// service discovery (RFC 6763) to advertise a server on the local network
+// and to browse for servers, without a system responder such as Avahi.
+//
+// Only IPv4 is supported. The responder answers queries for the service, its
+// instances and host addresses, and announces itself on start and with a
+// goodbye on exit. Browsing sends one-shot queries from an ephemeral port,
+// which responders answer by unicast.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// ServiceType is the DNS-SD service type of the echo server.
+const ServiceType = "_quic-echo._udp"
+
+// Record TTLs, as recommended by RFC 6762 section 10.
+const (
+	hostTTL    = 120
+	serviceTTL = 75 * 60
+	// legacyTTL caps the TTLs in answers to one-shot queries.
+	legacyTTL = 10
+)
+
+// cacheFlush is the top bit of the class of a unique record in a multicast
+// response; unicastResponse is the same bit in a question.
+const (
+	cacheFlush      = 1 << 15
+	unicastResponse = 1 << 15
+)
+
+// mdnsPort and group are where mDNS queries and responses are multicast.
+var (
+	mdnsPort = 5353
+	group    = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+)
+
+// servicesName is the DNS-SD meta-query name listing the service types.
+var servicesName = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+
+// Instance is a service instance as advertised and discovered.
+type Instance struct {
+	// Name is the instance name, e.g. "lab-pi". It may contain spaces but
+	// no dots.
+	Name string
+	// Host is the host name, without the ".local" suffix.
+	Host  string
+	Port  uint16
+	Addrs []netip.Addr
+	// Text holds the "key=value" strings of the TXT record.
+	Text []string
+}
+
+// Lookup returns the value of key in the TXT record of inst.
+func (inst Instance) Lookup(key string) (string, bool) {
+	for _, kv := range inst.Text {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// instanceName returns the DNS name of an instance of service.
+func instanceName(name, service string) (dnsmessage.Name, error) {
+	if name == "" || strings.Contains(name, ".") {
+		return dnsmessage.Name{}, fmt.Errorf("invalid instance name %q", name)
+	}
+	return dnsmessage.NewName(name + "." + service + ".local.")
+}
+
+// responder answers the queries for one instance.
+type responder struct {
+	conn *net.UDPConn
+	inst Instance
+
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+}
+
+// Advertise announces inst as an instance of service (e.g. [ServiceType]) on
+// the local network and answers queries for it until ctx is canceled. If
+// inst.Addrs is empty, the IPv4 addresses of the host's interfaces are
+// advertised.
+func Advertise(ctx context.Context, service string, inst Instance, logger *slog.Logger) error {
+	r := &responder{inst: inst}
+	var err error
+	if r.service, err = dnsmessage.NewName(service + ".local."); err != nil {
+		return fmt.Errorf("service name: %w", err)
+	}
+	if r.instance, err = instanceName(inst.Name, service); err != nil {
+		return fmt.Errorf("instance name: %w", err)
+	}
+	if r.host, err = dnsmessage.NewName(inst.Host + ".local."); err != nil {
+		return fmt.Errorf("host name: %w", err)
+	}
+	if len(r.inst.Addrs) == 0 {
+		if r.inst.Addrs, err = interfaceAddrs(); err != nil {
+			return fmt.Errorf("interface addresses: %w", err)
+		}
+	}
+
+	if r.conn, err = net.ListenMulticastUDP("udp4", nil, group); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	// ListenMulticastUDP only joins the group on the default interface.
+	pc := ipv4.NewPacketConn(r.conn)
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			_ = pc.JoinGroup(&ifi, group)
+		}
+	}
+	logger = logger.With("component", "mdns", "instance", r.instance.String())
+	logger.Info("advertising", "port", inst.Port, "addrs", r.inst.Addrs)
+
+	go r.announce(ctx, logger)
+	go func() {
+		<-ctx.Done()
+		_ = r.conn.Close()
+	}()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read: %w", err)
+		}
+		if err := r.answer(buf[:n], from); err != nil {
+			logger.Debug("query not answered", "from", from.String(), "err", err)
+		}
+	}
+}
+
+// announce multicasts the records twice, a second apart, and a goodbye with
+// TTL 0 once ctx is canceled.
+func (r *responder) announce(ctx context.Context, logger *slog.Logger) {
+	for i := range 2 {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		if err := r.send(r.response(0, nil, false, false), group); err != nil {
+			logger.Warn("announce", "err", err)
+		}
+	}
+	<-ctx.Done()
+	// The socket is closed concurrently, so send the goodbye from another.
+	c, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		return
+	}
+	defer func() { _ = c.Close() }()
+	if msg, err := r.response(0, nil, false, true).Pack(); err == nil {
+		_, _ = c.Write(msg)
+	}
+}
+
+// answer responds to the query in p from from, if it asks for any of the
+// records of r.
+func (r *responder) answer(p []byte, from *net.UDPAddr) error {
+	var m dnsmessage.Message
+	if err := m.Unpack(p); err != nil {
+		return err
+	}
+	if m.Response || m.OpCode != 0 {
+		return nil
+	}
+	// Queries not from the mDNS port are one-shot queries by simple
+	// resolvers (RFC 6762 section 6.7), answered by unicast.
+	legacy := from.Port != mdnsPort
+	unicast := legacy
+	var qs []dnsmessage.Question
+	for _, q := range m.Questions {
+		if r.matches(q) {
+			qs = append(qs, q)
+			if q.Class&unicastResponse != 0 {
+				unicast = true
+			}
+		}
+	}
+	if len(qs) == 0 {
+		return nil
+	}
+	resp := r.response(m.ID, qs, legacy, false)
+	if !legacy {
+		resp.ID, resp.Questions = 0, nil
+	}
+	if unicast {
+		return r.send(resp, from)
+	}
+	return r.send(resp, group)
+}
+
+// matches reports whether q asks for a record of r.
+func (r *responder) matches(q dnsmessage.Question) bool {
+	all := q.Type == dnsmessage.TypeALL
+	switch {
+	case strings.EqualFold(q.Name.String(), servicesName.String()):
+		return all || q.Type == dnsmessage.TypePTR
+	case strings.EqualFold(q.Name.String(), r.service.String()):
+		return all || q.Type == dnsmessage.TypePTR
+	case strings.EqualFold(q.Name.String(), r.instance.String()):
+		return all || q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT
+	case strings.EqualFold(q.Name.String(), r.host.String()):
+		return all || q.Type == dnsmessage.TypeA
+	}
+	return false
+}
+
+// response returns the response with the records of r: the service PTR as
+// answer, and the instance's SRV and TXT and the host's addresses as
+// additional records, or all of them as answers if qs is nil. A response
+// to a one-shot query echoes qs and caps the TTLs; a goodbye has TTL 0.
+func (r *responder) response(id uint16, qs []dnsmessage.Question, legacy, goodbye bool) *dnsmessage.Message {
+	ttl := func(t uint32) uint32 {
+		switch {
+		case goodbye:
+			return 0
+		case legacy:
+			return min(t, legacyTTL)
+		}
+		return t
+	}
+	// Unique records ask caches to flush older ones, except in one-shot
+	// answers, whose receivers are no mDNS caches.
+	unique := dnsmessage.ClassINET
+	if !legacy {
+		unique |= cacheFlush
+	}
+
+	srv := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: r.instance, Class: unique, TTL: ttl(hostTTL)},
+		Body:   &dnsmessage.SRVResource{Port: r.inst.Port, Target: r.host},
+	}
+	txt := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: r.instance, Class: unique, TTL: ttl(serviceTTL)},
+		Body:   &dnsmessage.TXTResource{TXT: r.inst.Text},
+	}
+	if len(r.inst.Text) == 0 {
+		// A TXT record holds at least one string (RFC 6763 section 6.1).
+		txt.Body = &dnsmessage.TXTResource{TXT: []string{""}}
+	}
+	ptr := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: r.service, Class: dnsmessage.ClassINET, TTL: ttl(serviceTTL)},
+		Body:   &dnsmessage.PTRResource{PTR: r.instance},
+	}
+	meta := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: servicesName, Class: dnsmessage.ClassINET, TTL: ttl(serviceTTL)},
+		Body:   &dnsmessage.PTRResource{PTR: r.service},
+	}
+	var addrs []dnsmessage.Resource
+	for _, a := range r.inst.Addrs {
+		if a.Is4() {
+			addrs = append(addrs, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: r.host, Class: unique, TTL: ttl(hostTTL)},
+				Body:   &dnsmessage.AResource{A: a.As4()},
+			})
+		}
+	}
+
+	m := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: qs,
+	}
+	if qs == nil {
+		m.Answers = append([]dnsmessage.Resource{ptr, srv, txt}, addrs...)
+		return m
+	}
+	for _, q := range qs {
+		switch {
+		case strings.EqualFold(q.Name.String(), servicesName.String()):
+			m.Answers = append(m.Answers, meta)
+		case strings.EqualFold(q.Name.String(), r.service.String()):
+			m.Answers = append(m.Answers, ptr)
+			m.Additionals = append(append(m.Additionals, srv, txt), addrs...)
+		case strings.EqualFold(q.Name.String(), r.instance.String()):
+			m.Answers = append(m.Answers, srv, txt)
+			m.Additionals = append(m.Additionals, addrs...)
+		default:
+			m.Answers = append(m.Answers, addrs...)
+		}
+	}
+	return m
+}
+
+// send packs m and sends it to addr.
+func (r *responder) send(m *dnsmessage.Message, addr *net.UDPAddr) error {
+	msg, err := m.Pack()
+	if err != nil {
+		return fmt.Errorf("pack: %w", err)
+	}
+	_, err = r.conn.WriteToUDP(msg, addr)
+	return err
+}
+
+// interfaceAddrs returns the IPv4 addresses of the host's interfaces that
+// are up, other than loopback addresses unless there are no others.
+func interfaceAddrs() ([]netip.Addr, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs, loopback []netip.Addr
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ias, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ia := range ias {
+			prefix, err := netip.ParsePrefix(ia.String())
+			if err != nil || !prefix.Addr().Is4() {
+				continue
+			}
+			if prefix.Addr().IsLoopback() {
+				loopback = append(loopback, prefix.Addr())
+			} else {
+				addrs = append(addrs, prefix.Addr())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = loopback
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no IPv4 address")
+	}
+	return addrs, nil
+}
+
+// Browse queries the local network for instances of service (e.g.
+// [ServiceType]) until ctx is done and returns those that answered with an
+// address, sorted by name. The query is repeated every second.
+func Browse(ctx context.Context, service string) ([]Instance, error) {
+	svc, err := dnsmessage.NewName(service + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("service name: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: svc, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack query: %w", err)
+	}
+
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			_, _ = conn.WriteToUDP(query, group)
+			select {
+			case <-ctx.Done():
+				_ = conn.SetReadDeadline(time.Now())
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	b := newBrowser(svc)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return b.instances(service), nil
+			}
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		var m dnsmessage.Message
+		if m.Unpack(buf[:n]) != nil || !m.Response {
+			continue
+		}
+		for _, rr := range slices.Concat(m.Answers, m.Additionals) {
+			b.add(rr)
+		}
+	}
+}
+
+// browser collects the records of browse responses.
+type browser struct {
+	service dnsmessage.Name
+	// names holds the instance names, keyed by their lower-case form.
+	names map[string]dnsmessage.Name
+	srvs  map[string]*dnsmessage.SRVResource
+	txts  map[string][]string
+	addrs map[string][]netip.Addr
+}
+
+// newBrowser returns a browser for the instances of service.
+func newBrowser(service dnsmessage.Name) *browser {
+	return &browser{
+		service: service,
+		names:   make(map[string]dnsmessage.Name),
+		srvs:    make(map[string]*dnsmessage.SRVResource),
+		txts:    make(map[string][]string),
+		addrs:   make(map[string][]netip.Addr),
+	}
+}
+
+// add records rr if it is relevant for browsing.
+func (b *browser) add(rr dnsmessage.Resource) {
+	name := strings.ToLower(rr.Header.Name.String())
+	switch body := rr.Body.(type) {
+	case *dnsmessage.PTRResource:
+		if name == strings.ToLower(b.service.String()) {
+			b.names[strings.ToLower(body.PTR.String())] = body.PTR
+		}
+	case *dnsmessage.SRVResource:
+		b.srvs[name] = body
+	case *dnsmessage.TXTResource:
+		b.txts[name] = body.TXT
+	case *dnsmessage.AResource:
+		if a := netip.AddrFrom4(body.A); !slices.Contains(b.addrs[name], a) {
+			b.addrs[name] = append(b.addrs[name], a)
+		}
+	}
+}
+
+// instances returns the instances of service that have an SRV record with
+// a known address, sorted by name.
+func (b *browser) instances(service string) []Instance {
+	suffix := "." + service + ".local."
+	var insts []Instance
+	for key, name := range b.names {
+		srv := b.srvs[key]
+		if srv == nil {
+			continue
+		}
+		target := strings.ToLower(srv.Target.String())
+		if len(b.addrs[target]) == 0 {
+			continue
+		}
+		insts = append(insts, Instance{
+			Name:  strings.TrimSuffix(name.String(), suffix),
+			Host:  strings.TrimSuffix(srv.Target.String(), ".local."),
+			Port:  srv.Port,
+			Addrs: b.addrs[target],
+			Text:  slices.DeleteFunc(slices.Clone(b.txts[key]), func(s string) bool { return s == "" }),
+		})
+	}
+	slices.SortFunc(insts, func(a, b Instance) int { return strings.Compare(a.Name, b.Name) })
+	return insts
+}
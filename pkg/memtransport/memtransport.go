@@ -0,0 +1,288 @@
+// Package memtransport provides pairs of in-process packet connections with
+// controllable latency, jitter and loss, so that QUIC clients and servers
+// can be run against each other hermetically, without sockets, e.g. in
+// tests:
+//
+//	client, server := memtransport.Pair("client", "server")
+//	ln, err := (&quic.Transport{Conn: server}).Listen(tlsConf, quicConf)
+//	...
+//	c, err := echoclient.DialTransport(ctx, &quic.Transport{Conn: client},
+//		server.LocalAddr(), echoclient.WithTLSConfig(clientTLS))
+//
+// Every [Conn] impairs the packets it sends as set by
+// [Conn.SetImpairment], which may change at any time. Its random decisions
+// come from a generator with a fixed seed, so that a run is reproducible.
+package memtransport
+
+import (
+	"container/heap"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueLen is the number of packets a Conn buffers for reading before it
+// drops more, like the receive buffer of a UDP socket.
+const queueLen = 1024
+
+// Addr is the address of a [Conn].
+type Addr string
+
+// Network implements net.Addr.
+func (a Addr) Network() string { return "mem" }
+
+// String implements net.Addr.
+func (a Addr) String() string { return string(a) }
+
+// Impairment is what a [Conn] does to the packets it sends.
+type Impairment struct {
+	// Latency delays every packet, and a uniformly random duration in
+	// [0, Jitter) on top, which reorders packets sent closer than Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+}
+
+// Conn is one end of a pair of connected in-process packet connections,
+// implementing [net.PacketConn]. Packets written to addresses other than
+// its peer's are dropped, like UDP datagrams sent nowhere.
+type Conn struct {
+	local Addr
+	peer  *Conn
+	in    chan packet
+	// closed is closed by Close, on both ends.
+	closed    chan struct{}
+	closeOnce *sync.Once
+
+	mu  sync.Mutex
+	imp Impairment
+	rng *rand.Rand
+	// due holds the packets sent but not yet delivered to the peer, and
+	// seq numbers them so that packets due together keep their order.
+	due  packetHeap
+	seq  uint64
+	wake chan struct{}
+
+	readDeadline time.Time
+	// deadlineChanged is closed, and replaced, when the read deadline
+	// changes, to wake blocked reads.
+	deadlineChanged chan struct{}
+}
+
+// packet is a packet in flight from one Conn to the other.
+type packet struct {
+	from Addr
+	data []byte
+	at   time.Time
+	seq  uint64
+}
+
+// Pair returns two connected Conns with addresses a and b, without
+// impairment. Closing either closes both.
+func Pair(a, b string) (*Conn, *Conn) {
+	closed, once := make(chan struct{}), new(sync.Once)
+	ca, cb := newConn(Addr(a), closed, once, 1), newConn(Addr(b), closed, once, 2)
+	ca.peer, cb.peer = cb, ca
+	go ca.deliver()
+	go cb.deliver()
+	return ca, cb
+}
+
+// newConn returns a Conn with address addr whose random numbers are seeded
+// with seed.
+func newConn(addr Addr, closed chan struct{}, once *sync.Once, seed uint64) *Conn {
+	return &Conn{
+		local:           addr,
+		in:              make(chan packet, queueLen),
+		closed:          closed,
+		closeOnce:       once,
+		rng:             rand.New(rand.NewPCG(seed, 0)),
+		wake:            make(chan struct{}, 1),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// SetImpairment sets the impairment of the packets c sends from now on.
+func (c *Conn) SetImpairment(imp Impairment) {
+	c.mu.Lock()
+	c.imp = imp
+	c.mu.Unlock()
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		var (
+			pkt packet
+			err error
+			ok  bool
+		)
+		select {
+		case pkt = <-c.in:
+			ok = true
+		case <-c.closed:
+			err = c.opError("read", net.ErrClosed)
+		case <-expired:
+			err = c.opError("read", os.ErrDeadlineExceeded)
+		case <-changed:
+			// Wait again with the new deadline.
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		switch {
+		case ok:
+			return copy(p, pkt.data), pkt.from, nil
+		case err != nil:
+			return 0, nil, err
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn. Packets go out as set by
+// SetImpairment.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	if addr.Network() != "mem" || addr.String() != string(c.peer.local) {
+		return len(p), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.imp.Loss > 0 && c.rng.Float64() < c.imp.Loss {
+		return len(p), nil
+	}
+	pkt := packet{from: c.local, data: append([]byte(nil), p...)}
+	if c.imp.Latency == 0 && c.imp.Jitter == 0 && len(c.due) == 0 {
+		c.peer.receive(pkt)
+		return len(p), nil
+	}
+	pkt.at = time.Now().Add(c.imp.Latency)
+	if c.imp.Jitter > 0 {
+		pkt.at = pkt.at.Add(time.Duration(c.rng.Int64N(int64(c.imp.Jitter))))
+	}
+	c.seq++
+	pkt.seq = c.seq
+	heap.Push(&c.due, pkt)
+	if c.due[0].seq == pkt.seq {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// deliver hands the packets c sent to its peer when they are due, until
+// the pair is closed.
+func (c *Conn) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		wait := time.Hour
+		for len(c.due) > 0 {
+			if wait = time.Until(c.due[0].at); wait > 0 {
+				break
+			}
+			c.peer.receive(heap.Pop(&c.due).(packet))
+		}
+		c.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-c.wake:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// receive queues pkt for reading, or drops it if the queue is full.
+func (c *Conn) receive(pkt packet) {
+	select {
+	case c.in <- pkt:
+	default:
+	}
+}
+
+// Close implements net.PacketConn. It closes both ends of the pair.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// SetDeadline implements net.PacketConn. Writes never block, so only the
+// read deadline applies.
+func (c *Conn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline implements net.PacketConn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn. Writes never block, so it
+// has no effect.
+func (c *Conn) SetWriteDeadline(time.Time) error { return nil }
+
+// opError wraps err like the errors of a socket.
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Source: c.local, Err: err}
+}
+
+// packetHeap is a min-heap of packets by due time, then sequence.
+type packetHeap []packet
+
+// Len implements heap.Interface.
+func (h packetHeap) Len() int { return len(h) }
+
+// Less implements heap.Interface.
+func (h packetHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+// Swap implements heap.Interface.
+func (h packetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// Push implements heap.Interface.
+func (h *packetHeap) Push(x any) { *h = append(*h, x.(packet)) }
+
+// Pop implements heap.Interface.
+func (h *packetHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,345 @@
+// Package perf defines the goodput measurement protocol shared by the server
+// and the client, in the spirit of iperf. The first bidirectional stream the
+// client opens, or the one after the token stream if the server requires
+// authentication, is the control stream. On it the client proposes the
+// parameters of the test and the server accepts or refuses them:
+//
+//	PERF <streams> <size> <duration> <phases>   "OK", or "ERR <reason>"
+//
+// The duration is in milliseconds and the phases are a comma-separated
+// list of directions, "up" (client to server) or "down" (server to client),
+// run one after another. Every phase starts with the client sending
+// "START <direction>" on the control stream and opening <streams> new
+// bidirectional streams for the data. The sender writes <size> byte
+// payloads on all of them for the duration and then ends them, and the
+// receiver reads them to the end. The receiver counts the bytes, times the
+// phase from START to the end of its last stream and reports both on the
+// control stream:
+//
+//	RESULT <direction> <bytes> <microseconds>
+//
+// The server reports the uploads and the client the downloads, so that
+// both sides log the same goodput, as measured where the data arrived.
+// Once the last result is in, the client ends the control stream.
+package perf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation identifier of the perf
+// protocol.
+const ALPN = "quic-perf"
+
+// Directions of a phase.
+const (
+	Up   = "up"
+	Down = "down"
+)
+
+// Limits of the parameters a server accepts, see [Params.Check].
+const (
+	MaxStreams  = 64
+	MaxSize     = 1 << 20
+	MaxDuration = 5 * time.Minute
+	MaxPhases   = 8
+)
+
+// Drain bounds how long a receiver waits past the duration of a phase for
+// its streams to end.
+const Drain = 5 * time.Second
+
+// maxLineLen bounds control lines.
+const maxLineLen = 256
+
+// Params are the parameters of a test.
+type Params struct {
+	// Streams is the number of parallel streams of every phase.
+	Streams int
+	// Size is the payload size of every write.
+	Size int
+	// Duration is how long the sender of a phase writes.
+	Duration time.Duration
+	// Phases are the directions of the phases, in order.
+	Phases []string
+}
+
+// Check reports whether p is within the limits of the protocol.
+func (p Params) Check() error {
+	switch {
+	case p.Streams < 1 || p.Streams > MaxStreams:
+		return fmt.Errorf("streams must be between 1 and %d", MaxStreams)
+	case p.Size < 1 || p.Size > MaxSize:
+		return fmt.Errorf("size must be between 1 and %d bytes", MaxSize)
+	case p.Duration < time.Millisecond || p.Duration > MaxDuration:
+		return fmt.Errorf("duration must be between 1ms and %s", MaxDuration)
+	case len(p.Phases) == 0 || len(p.Phases) > MaxPhases:
+		return fmt.Errorf("want between 1 and %d phases", MaxPhases)
+	}
+	for _, dir := range p.Phases {
+		if dir != Up && dir != Down {
+			return fmt.Errorf("unknown direction %q", dir)
+		}
+	}
+	return nil
+}
+
+// Result is the outcome of a phase, as measured by its receiver.
+type Result struct {
+	Dir   string
+	Bytes int64
+	Dur   time.Duration
+}
+
+// MbitPerS returns the goodput of r in megabits per second.
+func (r Result) MbitPerS() float64 {
+	if r.Dur <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / 1e6 / r.Dur.Seconds()
+}
+
+// RemoteError is a refusal reported by the server in a reply.
+type RemoteError struct {
+	Reason string
+}
+
+// Error implements error.
+func (e *RemoteError) Error() string { return "server: " + e.Reason }
+
+// WriteParams writes the parameters line of p to w.
+func WriteParams(w io.Writer, p Params) error {
+	_, err := fmt.Fprintf(w, "PERF %d %d %d %s\n", p.Streams, p.Size, p.Duration.Milliseconds(), strings.Join(p.Phases, ","))
+	return err
+}
+
+// ReadParams reads a parameters line from br. It does not check the
+// parameters against the limits, see [Params.Check].
+func ReadParams(br *bufio.Reader) (Params, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return Params{}, err
+	}
+	fields := strings.Split(line, " ")
+	if len(fields) != 5 || fields[0] != "PERF" {
+		return Params{}, fmt.Errorf("malformed parameters %.64q", line)
+	}
+	streams, err1 := strconv.Atoi(fields[1])
+	size, err2 := strconv.Atoi(fields[2])
+	dur, err3 := strconv.ParseInt(fields[3], 10, 64)
+	if errors.Join(err1, err2, err3) != nil || dur > math.MaxInt64/int64(time.Millisecond) {
+		return Params{}, fmt.Errorf("malformed parameters %.64q", line)
+	}
+	return Params{
+		Streams:  streams,
+		Size:     size,
+		Duration: time.Duration(dur) * time.Millisecond,
+		Phases:   strings.Split(fields[4], ","),
+	}, nil
+}
+
+// WriteReply writes the server's answer to the parameters to w: "OK" if
+// reason is empty, and a refusal for reason otherwise.
+func WriteReply(w io.Writer, reason string) error {
+	line := "OK\n"
+	if reason != "" {
+		// The reason must stay on one line.
+		line = "ERR " + strings.ReplaceAll(reason, "\n", " ") + "\n"
+	}
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// ReadReply reads the server's answer to the parameters from br. A refusal
+// is returned as a [*RemoteError].
+func ReadReply(br *bufio.Reader) error {
+	line, err := readLine(br)
+	if err != nil {
+		return err
+	}
+	if reason, ok := strings.CutPrefix(line, "ERR "); ok {
+		return &RemoteError{Reason: reason}
+	}
+	if line != "OK" {
+		return fmt.Errorf("malformed reply %.64q", line)
+	}
+	return nil
+}
+
+// WriteStart writes the start of a phase in direction dir to w.
+func WriteStart(w io.Writer, dir string) error {
+	_, err := fmt.Fprintf(w, "START %s\n", dir)
+	return err
+}
+
+// ReadStart reads the start of a phase from br and checks that its
+// direction is dir.
+func ReadStart(br *bufio.Reader, dir string) error {
+	line, err := readLine(br)
+	if err != nil {
+		return err
+	}
+	if line != "START "+dir {
+		return fmt.Errorf("expected START %s, got %.64q", dir, line)
+	}
+	return nil
+}
+
+// WriteResult writes r to w.
+func WriteResult(w io.Writer, r Result) error {
+	_, err := fmt.Fprintf(w, "RESULT %s %d %d\n", r.Dir, r.Bytes, r.Dur.Microseconds())
+	return err
+}
+
+// ReadResult reads the result of the phase in direction dir from br.
+func ReadResult(br *bufio.Reader, dir string) (Result, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return Result{}, err
+	}
+	fields := strings.Split(line, " ")
+	if len(fields) != 4 || fields[0] != "RESULT" || fields[1] != dir {
+		return Result{}, fmt.Errorf("malformed result %.64q", line)
+	}
+	n, err1 := strconv.ParseInt(fields[2], 10, 64)
+	us, err2 := strconv.ParseInt(fields[3], 10, 64)
+	if errors.Join(err1, err2) != nil || n < 0 || us < 0 || us > math.MaxInt64/int64(time.Microsecond) {
+		return Result{}, fmt.Errorf("malformed result %.64q", line)
+	}
+	return Result{Dir: dir, Bytes: n, Dur: time.Duration(us) * time.Microsecond}, nil
+}
+
+// readLine reads a line of at most maxLineLen bytes from br, without the
+// newline.
+func readLine(br *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		frag, err := br.ReadSlice('\n')
+		b.Write(frag)
+		if b.Len() > maxLineLen {
+			return "", errors.New("line too long")
+		}
+		if err == nil {
+			return strings.TrimSuffix(b.String(), "\n"), nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+// Send writes size byte payloads on all of sts until ctx is done, and
+// returns the number of bytes written. If wait is not nil, it is called
+// before every write, e.g. to pace the writes. Nothing is read from the
+// streams. When ctx runs past its deadline, the phase is over and the
+// streams are ended; if it is canceled, they are reset and ctx.Err() is
+// returned.
+func Send(ctx context.Context, sts []*quic.Stream, size int, wait func(ctx context.Context, n int) error) (int64, error) {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = 'a' + byte(i%26)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		for _, st := range sts {
+			_ = st.SetWriteDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int64
+		first error
+	)
+	for _, st := range sts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.CancelRead(0)
+			var n int64
+			err := func() error {
+				for {
+					if wait != nil {
+						if err := wait(ctx, len(buf)); err != nil {
+							return err
+						}
+					}
+					w, err := st.Write(buf)
+					n += int64(w)
+					if err != nil {
+						return err
+					}
+				}
+			}()
+			timedOut := errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)
+			switch {
+			case timedOut && errors.Is(ctx.Err(), context.DeadlineExceeded):
+				err = st.Close()
+			case ctx.Err() != nil:
+				st.CancelWrite(0)
+				err = ctx.Err()
+			default:
+				st.CancelWrite(0)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			total += n
+			if err != nil && first == nil {
+				first = fmt.Errorf("quic_id %d: %w", st.StreamID(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return total, first
+}
+
+// Receive reads all of sts to the end and returns the number of bytes
+// read. Nothing is written to the streams. If ctx is done first, the
+// streams are canceled and ctx.Err() is returned.
+func Receive(ctx context.Context, sts []*quic.Stream) (int64, error) {
+	stop := context.AfterFunc(ctx, func() {
+		for _, st := range sts {
+			st.CancelRead(0)
+		}
+	})
+	defer stop()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int64
+		first error
+	)
+	for _, st := range sts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = st.Close()
+			n, err := io.Copy(io.Discard, st)
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			total += n
+			if err != nil && first == nil {
+				first = fmt.Errorf("quic_id %d: %w", st.StreamID(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return total, first
+}
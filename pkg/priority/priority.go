@@ -0,0 +1,135 @@
+// Package priority orders the writes of the streams of a connection by
+// priority, so that control traffic is not starved behind bulk transfers.
+//
+// quic-go sends the data of all streams with data to send round robin and
+// has no stream priorities of its own, so a short message shares the
+// connection with every bulk stream busy at the time. A [Scheduler] makes
+// up for it in the application: the writes of its streams go out in chunks
+// of at most [Chunk] bytes, and a chunk waits while writes of a higher
+// [Level] are in progress. So that a higher stream that stalls, e.g. on
+// flow control because its peer reads nothing, cannot hold the others back
+// for good, a chunk waits at most [MaxDelay].
+package priority
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Level is the priority of a stream. Streams of higher levels write first;
+// those of the same level share the connection round robin, as they would
+// without a scheduler.
+type Level int8
+
+// Levels for common uses. Any other value of Level works as well.
+const (
+	// Bulk is for transfers that take long anyway, such as files.
+	Bulk Level = -1
+	// Normal is the level of the streams given none.
+	Normal Level = 0
+	// Control is for short messages that other traffic should not delay.
+	Control Level = 1
+)
+
+// Chunk bounds the bytes of a write that go out before it gives way to
+// writes of higher levels.
+const Chunk = 16 << 10
+
+// MaxDelay bounds how long a chunk waits for the writes of higher levels.
+const MaxDelay = 100 * time.Millisecond
+
+// Scheduler orders the writes of the streams of a connection by their
+// [Level]. It is safe for concurrent use.
+type Scheduler struct {
+	mu sync.Mutex
+	// active counts the writes in progress or waiting per level.
+	active map[Level]int
+	// changed is closed and replaced whenever a write ends.
+	changed chan struct{}
+}
+
+// NewScheduler returns a scheduler without writes.
+func NewScheduler() *Scheduler {
+	return &Scheduler{active: make(map[Level]int), changed: make(chan struct{})}
+}
+
+// Writer returns w, a stream of the connection of s, with its writes
+// scheduled at level l. A nil s returns w unchanged.
+func (s *Scheduler) Writer(w io.Writer, l Level) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &writer{s: s, w: w, level: l}
+}
+
+// acquire waits until no write of a level above l is in progress, or for
+// MaxDelay, and counts a write at l. The write counts while it waits, so
+// that lower levels give way to it, too.
+func (s *Scheduler) acquire(l Level) {
+	var timeout <-chan time.Time
+	s.mu.Lock()
+	s.active[l]++
+	for s.higher(l) {
+		changed := s.changed
+		s.mu.Unlock()
+		if timeout == nil {
+			t := time.NewTimer(MaxDelay)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		}
+		s.mu.Lock()
+	}
+	s.mu.Unlock()
+}
+
+// release ends a write at l counted by acquire.
+func (s *Scheduler) release(l Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[l]--; s.active[l] == 0 {
+		delete(s.active, l)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// higher reports whether writes of levels above l are in progress. s.mu
+// must be held.
+func (s *Scheduler) higher(l Level) bool {
+	for a := range s.active {
+		if a > l {
+			return true
+		}
+	}
+	return false
+}
+
+// writer is a stream whose writes are scheduled by s at level.
+type writer struct {
+	s     *Scheduler
+	w     io.Writer
+	level Level
+}
+
+// Write implements io.Writer, writing p in chunks of at most Chunk bytes.
+func (w *writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		c := p[:min(len(p), Chunk)]
+		w.s.acquire(w.level)
+		m, err := w.w.Write(c)
+		w.s.release(w.level)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,308 @@
+// Package recording stores the bytes exchanged on a stream, with the time at
+// which they were read or written, so that a session can be replayed later.
+//
+// A recording starts with a header line such as
+//
+//	QUIC-REC/1 alpn=quic-echo remote=127.0.0.1:50000 stream=0 start=2026-01-02T15:04:05.123456789Z
+//
+// followed by one binary record per read or write: the direction byte ('>'
+// for bytes received from the peer, '<' for bytes sent to it), the offset
+// from the start of the recording in nanoseconds as a big-endian uint64, the
+// length of the data as a big-endian uint32, and the data itself.
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Magic starts the header line of every recording.
+const Magic = "QUIC-REC/1"
+
+// maxRecordLen bounds the data of a single record read back.
+const maxRecordLen = 16 << 20
+
+// A Direction tells which way the bytes of a record went.
+type Direction byte
+
+// Directions of records, seen from the recording side.
+const (
+	Received Direction = '>'
+	Sent     Direction = '<'
+)
+
+// Header describes a recorded stream.
+type Header struct {
+	ALPN     string
+	Remote   string
+	StreamID int64
+	Start    time.Time
+}
+
+// String returns the header line without the trailing newline.
+func (h Header) String() string {
+	return fmt.Sprintf("%s alpn=%s remote=%s stream=%d start=%s",
+		Magic, h.ALPN, h.Remote, h.StreamID, h.Start.UTC().Format(time.RFC3339Nano))
+}
+
+// parseHeader parses a header line without the trailing newline.
+func parseHeader(line string) (Header, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != Magic {
+		return Header{}, errors.New("not a recording")
+	}
+	var h Header
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		var err error
+		switch k {
+		case "alpn":
+			h.ALPN = v
+		case "remote":
+			h.Remote = v
+		case "stream":
+			h.StreamID, err = strconv.ParseInt(v, 10, 64)
+		case "start":
+			h.Start, err = time.Parse(time.RFC3339Nano, v)
+		}
+		if err != nil {
+			return Header{}, fmt.Errorf("header %s: %w", k, err)
+		}
+	}
+	return h, nil
+}
+
+// ErrLimit is reported by [Recorder.Close] for a recording that was cut
+// short because it reached its [Limits].
+var ErrLimit = errors.New("recording limit reached")
+
+// Limits bounds the size of recordings. The zero value sets no bounds.
+type Limits struct {
+	// MaxBytes, if positive, bounds the size of a recording file.
+	MaxBytes int64
+	// Quota, if not nil, is the budget of bytes shared by all the
+	// recordings created with it.
+	Quota *Quota
+}
+
+// A Quota is a budget of bytes shared by recordings, such as the space they
+// may take up in a directory. It is safe for concurrent use.
+type Quota struct {
+	left atomic.Int64
+}
+
+// NewQuota returns a quota of n bytes.
+func NewQuota(n int64) *Quota {
+	q := new(Quota)
+	q.left.Store(n)
+	return q
+}
+
+// take takes n bytes from q and reports whether there were that many left.
+func (q *Quota) take(n int64) bool {
+	if q.left.Add(-n) >= 0 {
+		return true
+	}
+	q.left.Add(n)
+	return false
+}
+
+// Left returns the bytes left in q.
+func (q *Quota) Left() int64 {
+	return q.left.Load()
+}
+
+// A Record is a chunk of bytes read or written at a point of a recording.
+type Record struct {
+	Dir  Direction
+	At   time.Duration
+	Data []byte
+}
+
+// Recorder writes a recording. Its methods are safe for concurrent use.
+type Recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	lim   Limits
+	size  int64
+	err   error
+}
+
+// Create creates a recording file at path, which must not exist yet and is
+// readable by its owner only, as streams may carry secrets, and writes h to
+// it. The records are timed relative to h.Start. Once a record would exceed
+// lim, it and all later ones are dropped.
+func Create(path string, h Header, lim Limits) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), start: h.Start, lim: lim}
+	line := h.String() + "\n"
+	if !r.reserve(int64(len(line))) {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil, ErrLimit
+	}
+	if _, err := r.w.WriteString(line); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// reserve accounts for n more bytes of the recording and reports whether
+// they are within its limits.
+func (r *Recorder) reserve(n int64) bool {
+	if r.lim.MaxBytes > 0 && r.size+n > r.lim.MaxBytes {
+		return false
+	}
+	if r.lim.Quota != nil && !r.lim.Quota.take(n) {
+		return false
+	}
+	r.size += n
+	return true
+}
+
+// Reader returns src wrapped to record everything read from it as received.
+func (r *Recorder) Reader(src io.Reader) io.Reader {
+	return recordReader{r: src, rec: r}
+}
+
+// Writer returns w wrapped to record everything written to it as sent.
+func (r *Recorder) Writer(w io.Writer) io.Writer {
+	return recordWriter{w: w, rec: r}
+}
+
+// record appends a record of p. The first error is kept and reported by
+// [Recorder.Close]; later records are dropped.
+func (r *Recorder) record(dir Direction, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if !r.reserve(int64(13 + len(p))) {
+		r.err = ErrLimit
+		return
+	}
+	var hdr [13]byte
+	hdr[0] = byte(dir)
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Since(r.start)))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(p)))
+	if _, err := r.w.Write(hdr[:]); err != nil {
+		r.err = err
+		return
+	}
+	if _, err := r.w.Write(p); err != nil {
+		r.err = err
+	}
+}
+
+// Close flushes and closes the recording. It returns the first error that
+// occurred while recording, if any, or [ErrLimit] if it was cut short; the
+// records up to the limit are kept then.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.err
+	if err == nil || errors.Is(err, ErrLimit) {
+		err = errors.Join(err, r.w.Flush())
+	}
+	return errors.Join(err, r.f.Close())
+}
+
+// recordReader records the bytes read through it.
+type recordReader struct {
+	r   io.Reader
+	rec *Recorder
+}
+
+// Read implements [io.Reader].
+func (rr recordReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.rec.record(Received, p[:n])
+	return n, err
+}
+
+// recordWriter records the bytes written through it.
+type recordWriter struct {
+	w   io.Writer
+	rec *Recorder
+}
+
+// Write implements [io.Writer].
+func (rw recordWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	rw.rec.record(Sent, p[:n])
+	return n, err
+}
+
+// Reader reads back a recording.
+type Reader struct {
+	Header Header
+
+	r *bufio.Reader
+}
+
+// NewReader reads the header of the recording in r and returns a reader for
+// its records.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	h, err := parseHeader(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Header: h, r: br}, nil
+}
+
+// Next returns the next record. It returns [io.EOF] after the last one.
+func (rd *Reader) Next() (Record, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(rd.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, errors.New("truncated record header")
+		}
+		return Record{}, err
+	}
+	dir := Direction(hdr[0])
+	if dir != Received && dir != Sent {
+		return Record{}, fmt.Errorf("unknown record direction %q", hdr[0])
+	}
+	n := binary.BigEndian.Uint32(hdr[9:])
+	if n > maxRecordLen {
+		return Record{}, fmt.Errorf("record of %d bytes too large", n)
+	}
+	// The data is read as it comes rather than into a buffer of the length
+	// claimed, so that a corrupt length costs no more than the file holds.
+	data, err := io.ReadAll(io.LimitReader(rd.r, int64(n)))
+	if err == nil && len(data) < int(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Record{}, fmt.Errorf("truncated record: %w", err)
+	}
+	return Record{
+		Dir:  dir,
+		At:   time.Duration(binary.BigEndian.Uint64(hdr[1:])),
+		Data: data,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// appendRecord appends a record of data to b as [Recorder] writes it.
+func appendRecord(b []byte, dir Direction, at time.Duration, data []byte) []byte {
+	b = append(b, byte(dir))
+	b = binary.BigEndian.AppendUint64(b, uint64(at))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// FuzzReaderNext checks that reading a recording, however corrupt, yields
+// no more data than the file holds and no record of an unknown direction.
+func FuzzReaderNext(f *testing.F) {
+	header := Header{ALPN: "quic-echo", Remote: "127.0.0.1:50000", Start: time.Unix(0, 0)}.String() + "\n"
+	valid := appendRecord([]byte(header), Received, time.Millisecond, []byte("hello\n"))
+	valid = appendRecord(valid, Sent, 2*time.Millisecond, []byte("hello\n"))
+	f.Add(valid)
+	f.Add(valid[:len(valid)-3])
+	// A record claiming far more data than follows.
+	f.Add(appendRecord([]byte(header), Sent, 0, nil)[:len(header)+9])
+	f.Add(append(appendRecord([]byte(header), Sent, 0, nil)[:len(header)+9], 0xff, 0xff, 0xff, 0x00))
+	f.Add([]byte("QUIC-REC/1 stream=x\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rd, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// The records follow the header line.
+		body := len(data) - bytes.IndexByte(data, '\n') - 1
+		var n int
+		for {
+			rec, err := rd.Next()
+			if err != nil {
+				// Only a recording that ends between records ends cleanly.
+				if errors.Is(err, io.EOF) && n != body {
+					t.Fatalf("io.EOF after %d of %d bytes of records", n, body)
+				}
+				return
+			}
+			if rec.Dir != Received && rec.Dir != Sent {
+				t.Fatalf("record of direction %q", rec.Dir)
+			}
+			if n += 13 + len(rec.Data); n > body {
+				t.Fatalf("records of %d bytes from %d bytes of records", n, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// ErrClosed is returned by calls on a [Client] whose stream has ended.
+var ErrClosed = errors.New("rpc stream closed")
+
+// Client calls methods over a stream of a connection that negotiated
+// [ALPN]. It is safe for concurrent use: concurrent calls are pipelined on
+// the stream and answered in any order.
+type Client struct {
+	st *quic.Stream
+	// wmu serializes the writes of requests.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *Response
+	closed  bool
+	// err is why the stream can no longer be read, set before done is
+	// closed.
+	err  error
+	done chan struct{}
+}
+
+// NewClient returns a client that calls methods over st, and starts
+// reading the responses.
+func NewClient(st *quic.Stream) *Client {
+	c := &Client{st: st, pending: make(map[uint64]chan *Response), done: make(chan struct{})}
+	go c.readResponses()
+	return c
+}
+
+// Call calls method with req, the encoded request message of the method,
+// and returns the encoded reply message. A failure reported by the server
+// is returned as an [*Error]. If ctx is done first, the reply is dropped
+// when it arrives.
+func (c *Client) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	ch := make(chan *Response, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	msg := (&Request{ID: id, Method: method, Payload: req}).Marshal(nil)
+	c.wmu.Lock()
+	err := WriteMessage(c.st, msg)
+	c.wmu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	var resp *Response
+	select {
+	case resp = <-ch:
+	case <-c.done:
+		// The response may have come in just before the stream ended.
+		select {
+		case resp = <-ch:
+		default:
+			return nil, c.err
+		}
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+	if resp.Error != "" {
+		return nil, &Error{Method: method, Reason: resp.Error}
+	}
+	return resp.Payload, nil
+}
+
+// forget drops the pending call with id.
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// Close ends the stream: no more calls can be made, but the pending ones
+// are still answered.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.st.Close()
+}
+
+// readResponses hands the responses read from the stream to their calls
+// until it ends, and then fails the calls still pending.
+func (c *Client) readResponses() {
+	br := bufio.NewReader(c.st)
+	var err error
+	for {
+		var msg []byte
+		if msg, err = ReadMessage(br); err != nil {
+			break
+		}
+		var resp Response
+		if err = resp.Unmarshal(msg); err != nil {
+			break
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		// Responses to calls given up on are dropped.
+		if ok {
+			ch <- &resp
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = ErrClosed
+	} else {
+		c.st.CancelRead(0)
+		err = fmt.Errorf("read response: %w", err)
+	}
+	c.mu.Lock()
+	c.closed = true
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+}
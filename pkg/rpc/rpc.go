@@ -0,0 +1,243 @@
+// Package rpc is a small request-response layer over QUIC streams, with
+// messages encoded as protobuf, see rpc.proto for the schema. It is meant as
+// a template for services built on this transport: register handlers on a
+// [Server], serve it as a stream handler and call them with a [Client].
+//
+// Every bidirectional stream the client opens carries a sequence of calls.
+// The client writes Request messages, each with an ID unique among its
+// pending calls on the stream, a method named "<Service>.<Method>" and the
+// encoded request message of the method. The server answers every request
+// with a Response of the same ID, carrying the encoded reply message or an
+// error. The server handles the requests of a stream concurrently, so the
+// responses may come in any order; ending the stream means no more calls,
+// and the server ends its side once it has answered them all.
+//
+// On the stream, every message is preceded by its length as a varint, the
+// usual delimited encoding of protobuf messages. Messages longer than
+// [MaxMessage] reset the stream.
+//
+// The messages are encoded by hand with protowire rather than generated
+// code, so that building the package needs no protoc. Services on top of it
+// may use generated messages for their payloads just as well; the example
+// [Echo] and [Stats] services show the hand-written kind.
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation identifier of the rpc
+// protocol.
+const ALPN = "quic-rpc"
+
+// MaxMessage bounds the encoded Request and Response messages.
+const MaxMessage = 1 << 20
+
+// Request is a call of a method.
+type Request struct {
+	ID      uint64
+	Method  string
+	Payload []byte
+}
+
+// Response answers the [Request] with the same ID. Error is empty on
+// success.
+type Response struct {
+	ID      uint64
+	Payload []byte
+	Error   string
+}
+
+// ErrTooLarge is the error of messages longer than [MaxMessage].
+var ErrTooLarge = errors.New("message too large")
+
+// Error is the failure of a call reported by the server.
+type Error struct {
+	Method string
+	Reason string
+}
+
+// Error implements error.
+func (e *Error) Error() string { return e.Method + ": server: " + e.Reason }
+
+// Field numbers of the messages, see rpc.proto.
+const (
+	fieldID      protowire.Number = 1
+	fieldMethod  protowire.Number = 2
+	fieldPayload protowire.Number = 3
+
+	fieldRespPayload protowire.Number = 2
+	fieldRespError   protowire.Number = 3
+)
+
+// Marshal appends the protobuf encoding of r to b.
+func (r *Request) Marshal(b []byte) []byte {
+	b = appendUint(b, fieldID, r.ID)
+	b = appendString(b, fieldMethod, r.Method)
+	return appendBytes(b, fieldPayload, r.Payload)
+}
+
+// Unmarshal decodes r from its protobuf encoding b. The payload aliases b.
+func (r *Request) Unmarshal(b []byte) error {
+	*r = Request{}
+	return decode(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == fieldID && typ == protowire.VarintType:
+			return consumeUint(b, &r.ID)
+		case num == fieldMethod && typ == protowire.BytesType:
+			return consumeString(b, &r.Method)
+		case num == fieldPayload && typ == protowire.BytesType:
+			return consumeBytes(b, &r.Payload)
+		}
+		return -1, nil
+	})
+}
+
+// Marshal appends the protobuf encoding of r to b.
+func (r *Response) Marshal(b []byte) []byte {
+	b = appendUint(b, fieldID, r.ID)
+	b = appendBytes(b, fieldRespPayload, r.Payload)
+	return appendString(b, fieldRespError, r.Error)
+}
+
+// Unmarshal decodes r from its protobuf encoding b. The payload aliases b.
+func (r *Response) Unmarshal(b []byte) error {
+	*r = Response{}
+	return decode(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == fieldID && typ == protowire.VarintType:
+			return consumeUint(b, &r.ID)
+		case num == fieldRespPayload && typ == protowire.BytesType:
+			return consumeBytes(b, &r.Payload)
+		case num == fieldRespError && typ == protowire.BytesType:
+			return consumeString(b, &r.Error)
+		}
+		return -1, nil
+	})
+}
+
+// WriteMessage writes the encoded message msg to w, preceded by its length.
+// Messages longer than [MaxMessage] fail with [ErrTooLarge].
+func WriteMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMessage {
+		return fmt.Errorf("message of %d bytes: %w", len(msg), ErrTooLarge)
+	}
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(msg))
+	buf = protowire.AppendVarint(buf, uint64(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// ReadMessage reads the next encoded message from br. It returns io.EOF if
+// the stream ends before a message, io.ErrUnexpectedEOF if it ends inside
+// one, and [ErrTooLarge] for a message longer than [MaxMessage], before
+// reading it.
+func ReadMessage(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxMessage {
+		return nil, fmt.Errorf("message of %d bytes: %w", n, ErrTooLarge)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// decode calls field for every field of the protobuf message b with the
+// field's number, wire type and the bytes after its tag. field returns how
+// many of them the value took, or -1 for a field it does not know, which is
+// skipped, so that messages may grow new fields.
+func decode(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("malformed message: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("malformed message: %w", protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendUint appends the field num with the varint v to b, unless v is
+// zero, the default that proto3 leaves out.
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBytes appends the field num with the bytes v to b, unless v is
+// empty.
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendString appends the field num with the string v to b, unless v is
+// empty.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// consumeUint decodes the varint at the start of b into v and returns its
+// length.
+func consumeUint(b []byte, v *uint64) (int, error) {
+	x, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, fmt.Errorf("malformed message: %w", protowire.ParseError(n))
+	}
+	*v = x
+	return n, nil
+}
+
+// consumeBytes decodes the length-prefixed bytes at the start of b into v,
+// which aliases b, and returns their length with the prefix.
+func consumeBytes(b []byte, v *[]byte) (int, error) {
+	x, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, fmt.Errorf("malformed message: %w", protowire.ParseError(n))
+	}
+	*v = x
+	return n, nil
+}
+
+// consumeString is [consumeBytes] for a string.
+func consumeString(b []byte, v *string) (int, error) {
+	var x []byte
+	n, err := consumeBytes(b, &x)
+	*v = string(x)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// FuzzReadMessage checks that no message read is longer than [MaxMessage]
+// or than the stream holds, and that every one survives a round trip.
+func FuzzReadMessage(f *testing.F) {
+	var buf bytes.Buffer
+	req := Request{ID: 1, Method: "Echo.Echo", Payload: []byte("hello")}
+	if err := WriteMessage(&buf, req.Marshal(nil)); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add(protowire.AppendVarint(nil, MaxMessage+1))
+	f.Add(protowire.AppendVarint(nil, 1<<62))
+	f.Add([]byte{0x05, 'a'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		br := bufio.NewReader(bytes.NewReader(data))
+		var n int
+		for {
+			msg, err := ReadMessage(br)
+			if err != nil {
+				return
+			}
+			if n += len(msg); len(msg) > MaxMessage || n > len(data) {
+				t.Fatalf("message of %d bytes from %d bytes", len(msg), len(data))
+			}
+			var buf bytes.Buffer
+			if err := WriteMessage(&buf, msg); err != nil {
+				t.Fatalf("write message: %v", err)
+			}
+			again, err := ReadMessage(bufio.NewReader(&buf))
+			if err != nil || !bytes.Equal(again, msg) {
+				t.Fatalf("message changed in a round trip: %q, %v, want %q", again, err, msg)
+			}
+		}
+	})
+}
+
+// FuzzUnmarshal checks that every request and response decoded encodes to
+// a message that decodes to the same value.
+func FuzzUnmarshal(f *testing.F) {
+	req := Request{ID: 1, Method: "Echo.Echo", Payload: []byte("hello")}
+	f.Add(req.Marshal(nil))
+	resp := Response{ID: 1, Error: "no such method"}
+	f.Add(resp.Marshal(nil))
+	// An unknown field, which is skipped, and a truncated one.
+	f.Add(protowire.AppendTag(protowire.AppendVarint(nil, 0), 9, protowire.VarintType))
+	f.Add([]byte{0x12, 0x05, 'a'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var req Request
+		if err := req.Unmarshal(b); err == nil {
+			var again Request
+			if err := again.Unmarshal(req.Marshal(nil)); err != nil {
+				t.Fatalf("marshaled request does not unmarshal: %v", err)
+			}
+			if again.ID != req.ID || again.Method != req.Method || !bytes.Equal(again.Payload, req.Payload) {
+				t.Fatalf("request changed in a round trip: %+v, want %+v", again, req)
+			}
+		}
+		var resp Response
+		if err := resp.Unmarshal(b); err == nil {
+			var again Response
+			if err := again.Unmarshal(resp.Marshal(nil)); err != nil {
+				t.Fatalf("marshaled response does not unmarshal: %v", err)
+			}
+			if again.ID != resp.ID || again.Error != resp.Error || !bytes.Equal(again.Payload, resp.Payload) {
+				t.Fatalf("response changed in a round trip: %+v, want %+v", again, resp)
+			}
+		}
+	})
+}
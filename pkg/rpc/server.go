@@ -0,0 +1,151 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// maxInFlight bounds the calls of a stream handled at once. Further
+// requests are not read until one of them is answered.
+const maxInFlight = 16
+
+// Handler handles the calls of a method: it decodes req, the encoded
+// request message of the method, and returns the encoded reply message.
+// conn is the connection of the call. An error fails the call; its text is
+// reported to the caller.
+type Handler func(ctx context.Context, conn *quic.Conn, req []byte) ([]byte, error)
+
+// Server dispatches calls to the handlers registered for their methods. It
+// serves the streams of connections that negotiated [ALPN] as a
+// [streamserver.StreamHandler].
+type Server struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServer returns a server without methods.
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]Handler)}
+}
+
+// Handle registers h for method, replacing any previous handler.
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// Methods returns the registered methods, sorted.
+func (s *Server) Methods() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Sorted(maps.Keys(s.handlers))
+}
+
+// handler returns the handler of method, or nil.
+func (s *Server) handler(method string) Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.handlers[method]
+}
+
+// Serve implements [streamserver.StreamHandler]. It answers the calls on st
+// until the client ends it, handling up to maxInFlight of them at once. A
+// malformed or oversized request resets the stream.
+func (s *Server) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	l := streamserver.Logger(ctx)
+	defer l.Debug("closed")
+
+	var (
+		wg   sync.WaitGroup
+		wmu  sync.Mutex
+		werr error
+	)
+	sem := make(chan struct{}, maxInFlight)
+	br := bufio.NewReader(st)
+	start := time.Now()
+	calls := 0
+	var err error
+	for {
+		var msg []byte
+		if msg, err = ReadMessage(br); err != nil {
+			break
+		}
+		var req Request
+		if err = req.Unmarshal(msg); err != nil {
+			break
+		}
+		calls++
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			began := time.Now()
+			resp := s.call(ctx, conn, &req)
+			b := resp.Marshal(nil)
+			if len(b) > MaxMessage {
+				// Fail the call rather than the stream.
+				resp = &Response{ID: req.ID, Error: fmt.Sprintf("reply of %d bytes: %s", len(b), ErrTooLarge)}
+				b = resp.Marshal(nil)
+			}
+			l.Debug("call", "id", req.ID, "method", req.Method, "dur", time.Since(began), "err", resp.Error)
+
+			wmu.Lock()
+			defer wmu.Unlock()
+			if werr == nil {
+				werr = WriteMessage(st, b)
+			}
+		}()
+	}
+	wg.Wait()
+	dur := time.Since(start)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		_ = st.Close()
+	case conn.Context().Err() != nil:
+		// Closing the connection is a way to end the calls, too.
+		l.Info("rpc done", "calls", calls, "dur", dur)
+		return nil
+	case errors.Is(err, ErrTooLarge):
+		st.CancelRead(errcode.MsgTooLarge)
+		st.CancelWrite(errcode.MsgTooLarge)
+		l.Warn("request too large, stream reset", "calls", calls, "dur", dur)
+		return fmt.Errorf("read request: %w", err)
+	default:
+		st.CancelRead(errcode.StreamProtocolError)
+		st.CancelWrite(errcode.StreamProtocolError)
+		return fmt.Errorf("read request: %w", err)
+	}
+	if werr != nil {
+		return fmt.Errorf("send response: %w", werr)
+	}
+	l.Info("rpc done", "calls", calls, "dur", dur)
+	return nil
+}
+
+// call runs the handler of req and returns its response.
+func (s *Server) call(ctx context.Context, conn *quic.Conn, req *Request) *Response {
+	h := s.handler(req.Method)
+	if h == nil {
+		return &Response{ID: req.ID, Error: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+	reply, err := h(ctx, conn, req.Payload)
+	if err != nil {
+		return &Response{ID: req.ID, Error: err.Error()}
+	}
+	return &Response{ID: req.ID, Payload: reply}
+}
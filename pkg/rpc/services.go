@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Methods of the example services, see rpc.proto.
+const (
+	MethodEcho  = "Echo.Echo"
+	MethodStats = "Stats.Get"
+)
+
+// fieldMessage is the field number of the message of EchoRequest and
+// EchoReply.
+const fieldMessage protowire.Number = 1
+
+// RegisterEcho registers the example Echo service on s, which returns the
+// message it is sent.
+func RegisterEcho(s *Server) {
+	s.Handle(MethodEcho, func(_ context.Context, _ *quic.Conn, req []byte) ([]byte, error) {
+		msg, err := unmarshalEcho(req)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(nil, fieldMessage, msg), nil
+	})
+}
+
+// Echo calls the Echo service through c and returns the echo of msg.
+func Echo(ctx context.Context, c *Client, msg []byte) ([]byte, error) {
+	reply, err := c.Call(ctx, MethodEcho, appendBytes(nil, fieldMessage, msg))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalEcho(reply)
+}
+
+// unmarshalEcho decodes the message of an EchoRequest or EchoReply.
+func unmarshalEcho(b []byte) ([]byte, error) {
+	var msg []byte
+	err := decode(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == fieldMessage && typ == protowire.BytesType {
+			return consumeBytes(b, &msg)
+		}
+		return -1, nil
+	})
+	return msg, err
+}
+
+// Stats is the server's view of a connection, the reply of the example
+// Stats service.
+type Stats struct {
+	RemoteAddr    string
+	SmoothedRTT   time.Duration
+	MinRTT        time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+	PacketsSent   uint64
+	PacketsLost   uint64
+}
+
+// Field numbers of StatsReply.
+const (
+	fieldRemoteAddr protowire.Number = iota + 1
+	fieldSmoothedRTT
+	fieldMinRTT
+	fieldBytesSent
+	fieldBytesReceived
+	fieldPacketsSent
+	fieldPacketsLost
+)
+
+// Marshal appends the protobuf encoding of s, a StatsReply, to b.
+func (s *Stats) Marshal(b []byte) []byte {
+	b = appendString(b, fieldRemoteAddr, s.RemoteAddr)
+	b = appendUint(b, fieldSmoothedRTT, uint64(s.SmoothedRTT.Microseconds()))
+	b = appendUint(b, fieldMinRTT, uint64(s.MinRTT.Microseconds()))
+	b = appendUint(b, fieldBytesSent, s.BytesSent)
+	b = appendUint(b, fieldBytesReceived, s.BytesReceived)
+	b = appendUint(b, fieldPacketsSent, s.PacketsSent)
+	return appendUint(b, fieldPacketsLost, s.PacketsLost)
+}
+
+// Unmarshal decodes s from the protobuf encoding b of a StatsReply.
+func (s *Stats) Unmarshal(b []byte) error {
+	*s = Stats{}
+	var srtt, minRTT uint64
+	uints := map[protowire.Number]*uint64{
+		fieldSmoothedRTT:   &srtt,
+		fieldMinRTT:        &minRTT,
+		fieldBytesSent:     &s.BytesSent,
+		fieldBytesReceived: &s.BytesReceived,
+		fieldPacketsSent:   &s.PacketsSent,
+		fieldPacketsLost:   &s.PacketsLost,
+	}
+	err := decode(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if v, ok := uints[num]; ok && typ == protowire.VarintType {
+			return consumeUint(b, v)
+		}
+		if num == fieldRemoteAddr && typ == protowire.BytesType {
+			return consumeString(b, &s.RemoteAddr)
+		}
+		return -1, nil
+	})
+	s.SmoothedRTT, s.MinRTT = micros(srtt), micros(minRTT)
+	return err
+}
+
+// micros returns us microseconds as a duration, saturating at the longest
+// one.
+func micros(us uint64) time.Duration {
+	if us > math.MaxInt64/uint64(time.Microsecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// RegisterStats registers the example Stats service on s, which reports the
+// server's view of the calling connection.
+func RegisterStats(s *Server) {
+	s.Handle(MethodStats, func(_ context.Context, conn *quic.Conn, _ []byte) ([]byte, error) {
+		cs := conn.ConnectionStats()
+		st := Stats{
+			RemoteAddr:    conn.RemoteAddr().String(),
+			SmoothedRTT:   cs.SmoothedRTT,
+			MinRTT:        cs.MinRTT,
+			BytesSent:     cs.BytesSent,
+			BytesReceived: cs.BytesReceived,
+			PacketsSent:   cs.PacketsSent,
+			PacketsLost:   cs.PacketsLost,
+		}
+		return st.Marshal(nil), nil
+	})
+}
+
+// GetStats calls the Stats service through c.
+func GetStats(ctx context.Context, c *Client) (Stats, error) {
+	var s Stats
+	reply, err := c.Call(ctx, MethodStats, nil)
+	if err != nil {
+		return s, err
+	}
+	err = s.Unmarshal(reply)
+	return s, err
+}
@@ -0,0 +1,72 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// maxTokenLen bounds the token line a connection authenticates with.
+const maxTokenLen = 4096
+
+// An Authenticator decides which connections must authenticate and checks
+// the tokens they present; see [Server.Auth].
+type Authenticator interface {
+	// Required reports whether conn must authenticate.
+	Required(conn *quic.Conn) bool
+	// Check returns an error if token does not authenticate conn.
+	Check(conn *quic.Conn, token string) error
+}
+
+// authenticate accepts the first stream of conn and checks the token on its
+// first line with s.Auth. It returns the stream, positioned after the token,
+// to be served as usual.
+func (s *Server) authenticate(ctx context.Context, conn *quic.Conn) (*quic.Stream, error) {
+	if s.AuthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.AuthTimeout)
+		defer cancel()
+	}
+
+	st, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("accept stream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = st.SetReadDeadline(deadline)
+		defer func() { _ = st.SetReadDeadline(time.Time{}) }()
+	}
+	token, err := readTokenLine(st)
+	if err != nil {
+		st.CancelRead(0)
+		st.CancelWrite(0)
+		return nil, fmt.Errorf("read token: %w", err)
+	}
+	if err := s.Auth.Check(conn, token); err != nil {
+		st.CancelRead(0)
+		st.CancelWrite(0)
+		return nil, err
+	}
+	return st, nil
+}
+
+// readTokenLine reads a newline-terminated line from r one byte at a time, so
+// that nothing past it is consumed, and returns it without the newline.
+func readTokenLine(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 64)
+	var b [1]byte
+	for len(buf) <= maxTokenLen {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", errors.New("token line too long")
+}
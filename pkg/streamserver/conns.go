@@ -0,0 +1,149 @@
+package streamserver
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// ConnInfo is a snapshot of a connection being served.
+type ConnInfo struct {
+	// ID is the server-assigned connection ID, as logged in "conn_id".
+	ID     uint64
+	Remote string
+	ALPN   string
+	Since  time.Time
+	// TotalStreams counts the streams served on the connection so far.
+	TotalStreams uint64
+	// Streams lists the streams in flight.
+	Streams []StreamInfo
+	// Stats are the transport statistics of the connection.
+	Stats quic.ConnectionStats
+}
+
+// StreamInfo is a snapshot of a stream being served.
+type StreamInfo struct {
+	// ID is the server-assigned stream ID, as logged in "stream_id".
+	ID uint64
+	// QUICID is the QUIC stream ID.
+	QUICID quic.StreamID
+	Uni    bool
+	Since  time.Time
+}
+
+// Stats are server-wide counters.
+type Stats struct {
+	ActiveConns int
+	// TotalConns counts accepted connections, including those refused by
+	// the Admit hook.
+	TotalConns    uint64
+	ActiveStreams int
+	TotalStreams  uint64
+
+	// BusyWorkers and QueuedStreams are the streams being served by and
+	// waiting for a worker, and RejectedStreams counts the streams reset for
+	// lack of room; see [Server.Workers]. They are zero without workers.
+	BusyWorkers     int
+	QueuedStreams   int
+	RejectedStreams uint64
+}
+
+// trackedConn is the registry entry of a connection being served.
+type trackedConn struct {
+	id    uint64
+	conn  *quic.Conn
+	since time.Time
+	total atomic.Uint64
+
+	mu      sync.Mutex
+	streams map[uint64]StreamInfo
+}
+
+// track registers conn under id until the returned func is called.
+func (s *Server) track(id uint64, conn *quic.Conn) (*trackedConn, func()) {
+	tc := &trackedConn{id: id, conn: conn, since: time.Now(), streams: make(map[uint64]StreamInfo)}
+	s.tracked.Store(id, tc)
+	return tc, func() { s.tracked.Delete(id) }
+}
+
+// addStream registers a stream in flight until the returned func is called.
+func (tc *trackedConn) addStream(si StreamInfo) func() {
+	tc.total.Add(1)
+	tc.mu.Lock()
+	tc.streams[si.ID] = si
+	tc.mu.Unlock()
+	return func() {
+		tc.mu.Lock()
+		delete(tc.streams, si.ID)
+		tc.mu.Unlock()
+	}
+}
+
+// info returns a snapshot of tc.
+func (tc *trackedConn) info() ConnInfo {
+	ci := ConnInfo{
+		ID:           tc.id,
+		Remote:       tc.conn.RemoteAddr().String(),
+		ALPN:         tc.conn.ConnectionState().TLS.NegotiatedProtocol,
+		Since:        tc.since,
+		TotalStreams: tc.total.Load(),
+		Stats:        tc.conn.ConnectionStats(),
+	}
+	tc.mu.Lock()
+	for _, si := range tc.streams {
+		ci.Streams = append(ci.Streams, si)
+	}
+	tc.mu.Unlock()
+	slices.SortFunc(ci.Streams, func(a, b StreamInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return ci
+}
+
+// Conns returns a snapshot of the connections being served, ordered by ID.
+func (s *Server) Conns() []ConnInfo {
+	var conns []ConnInfo
+	s.tracked.Range(func(_, v any) bool {
+		conns = append(conns, v.(*trackedConn).info())
+		return true
+	})
+	slices.SortFunc(conns, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return conns
+}
+
+// Stats returns the server-wide counters.
+func (s *Server) Stats() Stats {
+	st := Stats{
+		ActiveConns:  s.ActiveConns(),
+		TotalConns:   s.connSeq.Load(),
+		TotalStreams: s.streamSeq.Load(),
+	}
+	if p := s.pool.Load(); p != nil {
+		st.BusyWorkers = int(p.busy.Load())
+		st.QueuedStreams = p.queued()
+		st.RejectedStreams = p.rejected.Load()
+	}
+	s.tracked.Range(func(_, v any) bool {
+		tc := v.(*trackedConn)
+		tc.mu.Lock()
+		st.ActiveStreams += len(tc.streams)
+		tc.mu.Unlock()
+		return true
+	})
+	return st
+}
+
+// CloseConn closes the connection with the given ID with code and reason. It
+// reports whether such a connection was being served.
+func (s *Server) CloseConn(id uint64, code quic.ApplicationErrorCode, reason string) bool {
+	v, ok := s.tracked.Load(id)
+	if !ok {
+		return false
+	}
+	tc := v.(*trackedConn)
+	s.logger().Info("closing connection on request", "component", "conn", "conn_id", id, "code", code, "reason", reason)
+	_ = tc.conn.CloseWithError(code, reason)
+	return true
+}
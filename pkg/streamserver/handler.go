@@ -0,0 +1,174 @@
+package streamserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/priority"
+)
+
+// A StreamHandler serves a single bidirectional stream accepted on conn.
+//
+// Serve runs in its own goroutine. It owns st and should close or cancel it
+// before returning. ctx is canceled when conn is closed and carries a logger
+// scoped to the stream, see [Logger], and the write scheduler of conn, see
+// [Prioritize].
+type StreamHandler interface {
+	Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error
+}
+
+// StreamHandlerFunc adapts an ordinary function to a [StreamHandler].
+type StreamHandlerFunc func(ctx context.Context, conn *quic.Conn, st *quic.Stream) error
+
+// Serve calls f(ctx, conn, st).
+func (f StreamHandlerFunc) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	return f(ctx, conn, st)
+}
+
+// A DatagramHandler is a [StreamHandler] that also serves QUIC datagrams
+// (RFC 9221). ServeDatagrams is started once per connection whose peer
+// supports datagrams and runs until conn is closed; ctx carries a logger
+// scoped to the connection.
+type DatagramHandler interface {
+	StreamHandler
+	ServeDatagrams(ctx context.Context, conn *quic.Conn) error
+}
+
+// A UniStreamHandler is a [StreamHandler] that also serves unidirectional
+// streams opened by the peer. ServeUni is called like [StreamHandler.Serve],
+// once per accepted unidirectional stream.
+type UniStreamHandler interface {
+	StreamHandler
+	ServeUni(ctx context.Context, conn *quic.Conn, st *quic.ReceiveStream) error
+}
+
+// A ConnHandler serves whole connections rather than single streams, for
+// protocols such as HTTP/3 that accept and manage streams themselves.
+//
+// ServeConn runs in the connection's goroutine until it is done with conn.
+// ctx is canceled when the server shuts down and carries a logger scoped to
+// the connection and its write scheduler, see [Prioritize]; the handler
+// should then finish in-flight work and return.
+// The [Server] closes conn once ServeConn returns, or once the drain period
+// has elapsed after shutdown.
+type ConnHandler interface {
+	ServeConn(ctx context.Context, conn *quic.Conn) error
+}
+
+// ProtocolMux is a [StreamHandler] that dispatches streams by the ALPN
+// protocol negotiated on their connection. Protocols registered with
+// [ProtocolMux.HandleConn] take over their connections instead.
+type ProtocolMux struct {
+	handlers map[string]StreamHandler
+	conns    map[string]ConnHandler
+	protos   []string
+}
+
+// NewProtocolMux returns an empty mux.
+func NewProtocolMux() *ProtocolMux {
+	return &ProtocolMux{
+		handlers: make(map[string]StreamHandler),
+		conns:    make(map[string]ConnHandler),
+	}
+}
+
+// Handle registers h for the ALPN protocol proto, replacing any previous
+// handler for it.
+func (m *ProtocolMux) Handle(proto string, h StreamHandler) {
+	m.register(proto)
+	delete(m.conns, proto)
+	m.handlers[proto] = h
+}
+
+// HandleConn registers h to serve the connections that negotiate the ALPN
+// protocol proto, replacing any previous handler for it.
+func (m *ProtocolMux) HandleConn(proto string, h ConnHandler) {
+	m.register(proto)
+	delete(m.handlers, proto)
+	m.conns[proto] = h
+}
+
+// register adds proto to the registered protocols unless it is already
+// there.
+func (m *ProtocolMux) register(proto string) {
+	if !slices.Contains(m.protos, proto) {
+		m.protos = append(m.protos, proto)
+	}
+}
+
+// Protocols returns the registered ALPN protocols in registration order,
+// suitable for [crypto/tls.Config] NextProtos.
+func (m *ProtocolMux) Protocols() []string {
+	return append([]string(nil), m.protos...)
+}
+
+// Serve implements [StreamHandler].
+func (m *ProtocolMux) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	proto := conn.ConnectionState().TLS.NegotiatedProtocol
+	h, ok := m.handlers[proto]
+	if !ok {
+		st.CancelRead(0)
+		st.CancelWrite(0)
+		return fmt.Errorf("no handler for alpn %q", proto)
+	}
+	return h.Serve(ctx, conn, st)
+}
+
+// ServeDatagrams implements [DatagramHandler]. It serves datagrams with the
+// handler registered for the connection's ALPN if that handler implements
+// [DatagramHandler], and otherwise ignores them.
+func (m *ProtocolMux) ServeDatagrams(ctx context.Context, conn *quic.Conn) error {
+	dh, ok := m.handlers[conn.ConnectionState().TLS.NegotiatedProtocol].(DatagramHandler)
+	if !ok {
+		return nil
+	}
+	return dh.ServeDatagrams(ctx, conn)
+}
+
+// ServeUni implements [UniStreamHandler]. It serves st with the handler
+// registered for the connection's ALPN if that handler implements
+// [UniStreamHandler], and otherwise stops reading it.
+func (m *ProtocolMux) ServeUni(ctx context.Context, conn *quic.Conn, st *quic.ReceiveStream) error {
+	proto := conn.ConnectionState().TLS.NegotiatedProtocol
+	uh, ok := m.handlers[proto].(UniStreamHandler)
+	if !ok {
+		st.CancelRead(0)
+		return fmt.Errorf("no unidirectional stream handler for alpn %q", proto)
+	}
+	return uh.ServeUni(ctx, conn, st)
+}
+
+// loggerKey is the context key for the connection- or stream-scoped logger.
+type loggerKey struct{}
+
+// Logger returns the logger the [Server] attached to a handler's context,
+// or [slog.Default] if there is none.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// schedulerKey is the context key for the write scheduler of a connection.
+type schedulerKey struct{}
+
+// withScheduler returns ctx with a new write scheduler for a connection.
+func withScheduler(ctx context.Context) context.Context {
+	return context.WithValue(ctx, schedulerKey{}, priority.NewScheduler())
+}
+
+// Prioritize returns w, a stream of the connection of a handler's context,
+// with its writes scheduled at level l, see package priority. Only the
+// streams prioritized this way take part: the writes of the others neither
+// wait nor hold back any. Without a connection in ctx, w is returned
+// unchanged.
+func Prioritize(ctx context.Context, w io.Writer, l priority.Level) io.Writer {
+	s, _ := ctx.Value(schedulerKey{}).(*priority.Scheduler)
+	return s.Writer(w, l)
+}
@@ -0,0 +1,105 @@
+package streamserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// A QueuePolicy decides what happens to a stream that arrives while all
+// workers are busy and the queue is full; see [Server.Workers].
+type QueuePolicy int
+
+const (
+	// QueueReject resets the stream with [Server.RejectCode].
+	QueueReject QueuePolicy = iota
+	// QueueWait stops accepting streams on the connection until the queue
+	// has room, so that the peer is held back by its stream limit. Only
+	// the stream accept loop of that connection blocks; connections are
+	// still accepted, and other connections' streams get their turn as
+	// workers become free.
+	QueueWait
+)
+
+// workerPool serves streams with a fixed number of goroutines. Streams
+// waiting for a worker are queued up to a fixed length.
+type workerPool struct {
+	// slots holds a token for every job queued or running, so that the
+	// number of both is bounded by its capacity.
+	slots    chan struct{}
+	jobs     chan func()
+	busy     atomic.Int64
+	rejected atomic.Uint64
+
+	// mu guards stopped, so that no job is queued once jobs is closed.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newWorkerPool starts workers goroutines that run the jobs submitted to the
+// returned pool, queuing up to queueLen of them, until the pool is stopped.
+func newWorkerPool(workers, queueLen int) *workerPool {
+	p := &workerPool{
+		slots: make(chan struct{}, workers+queueLen),
+		jobs:  make(chan func(), workers+queueLen),
+	}
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// work runs jobs as they are submitted until the pool is stopped and its
+// queue is empty.
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		p.busy.Add(1)
+		job()
+		p.busy.Add(-1)
+		<-p.slots
+	}
+}
+
+// submit queues job. If the queue is full, it waits for room until ctx is
+// canceled under [QueueWait] and gives up at once under [QueueReject]. It
+// reports whether job was queued, which it never is once p is stopped.
+func (p *workerPool) submit(ctx context.Context, job func(), policy QueuePolicy) bool {
+	if policy == QueueWait {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	} else {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.rejected.Add(1)
+			return false
+		}
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		<-p.slots
+		return false
+	}
+	// Holding a slot guarantees room in jobs.
+	p.jobs <- job
+	return true
+}
+
+// stop lets the workers exit once they have run the jobs queued so far.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.jobs)
+	}
+}
+
+// queued returns the number of jobs waiting for a worker.
+func (p *workerPool) queued() int {
+	return max(len(p.slots)-int(p.busy.Load()), 0)
+}
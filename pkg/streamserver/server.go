@@ -0,0 +1,447 @@
+// Package streamserver runs a QUIC server that hands every accepted stream
+// to a [StreamHandler], much like net/http does for requests.
+//
+// A [Server] owns the accept loops and the connection lifecycle: admission,
+// per-connection and per-stream structured logging, and a graceful shutdown
+// that lets in-flight streams drain before connections are closed. Streams
+// are served on a goroutine each, or by a bounded pool of workers. What
+// happens on a stream is entirely up to the handler.
+package streamserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// Listener is a source of QUIC connections: a [quic.Listener], or a
+// [quic.EarlyListener] whose connections may carry 0-RTT data.
+type Listener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+	Addr() net.Addr
+	Close() error
+}
+
+// Server accepts QUIC connections and serves their streams with Handler.
+// The zero value is not usable; at least Handler must be set.
+type Server struct {
+	// Addr is the UDP address ListenAndServe listens on.
+	Addr string
+	// TLSConfig and QUICConfig are passed to the listener by ListenAndServe.
+	TLSConfig  *tls.Config
+	QUICConfig *quic.Config
+
+	// Handler serves every accepted stream. If it is a [ConnHandler] or a
+	// [ProtocolMux] with a [ConnHandler] for a connection's protocol, that
+	// handler serves the whole connection instead.
+	Handler StreamHandler
+
+	// Admit, if non-nil, is called for every accepted connection before its
+	// streams are served. A connection is dropped if ok is false; Admit must
+	// then close it itself. Otherwise release, if non-nil, is called once
+	// the connection is done.
+	Admit func(conn *quic.Conn) (release func(), ok bool)
+
+	// Auth, if non-nil, makes the connections it requires authenticate
+	// before any of their streams or datagrams are served: the first line of
+	// the peer's first stream must be a token Auth accepts. The rest of that
+	// stream is then served as usual. A connection that presents no valid
+	// token within AuthTimeout is closed with AuthFailedCode.
+	Auth           Authenticator
+	AuthTimeout    time.Duration
+	AuthFailedCode quic.ApplicationErrorCode
+
+	// CloseAttrs, if non-nil, returns extra attributes, such as transport
+	// counters, for the record logged when a connection closes.
+	CloseAttrs func(conn *quic.Conn) []any
+
+	// Logger receives server, connection and stream events. Nil means
+	// [slog.Default].
+	Logger *slog.Logger
+
+	// DrainPeriod is how long in-flight streams may run after shutdown starts.
+	DrainPeriod time.Duration
+	// ShutdownTimeout bounds how long shutdown waits for connection handlers.
+	ShutdownTimeout time.Duration
+	// GoAwayCode is the application error code connections are closed with
+	// on shutdown.
+	GoAwayCode quic.ApplicationErrorCode
+
+	// Workers, if positive, bounds the number of streams served at a time
+	// across all connections and listeners. Streams beyond that wait in a
+	// queue of up to QueueLen streams; once it is full, QueuePolicy applies.
+	// Zero serves every stream on a goroutine of its own. The workers run
+	// while any Serve call does. Connections taken over by a [ConnHandler]
+	// serve their streams themselves, outside of the pool.
+	Workers     int
+	QueueLen    int
+	QueuePolicy QueuePolicy
+	// RejectCode is the stream error code streams are reset with when
+	// there is no room for them under [QueueReject].
+	RejectCode quic.StreamErrorCode
+
+	// serving counts the Serve calls in progress; the last one to return
+	// stops pool.
+	serveMu   sync.Mutex
+	serving   int
+	pool      atomic.Pointer[workerPool]
+	connSeq   atomic.Uint64
+	streamSeq atomic.Uint64
+	active    atomic.Int64
+	tracked   sync.Map // conn ID -> *trackedConn
+}
+
+// ActiveConns returns the number of connections currently being served.
+func (s *Server) ActiveConns() int {
+	return int(s.active.Load())
+}
+
+// ListenAndServe listens on Addr and calls [Server.Serve]. If QUICConfig
+// allows 0-RTT, connections are served before their handshake completes.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	var ln Listener
+	var err error
+	if s.QUICConfig != nil && s.QUICConfig.Allow0RTT {
+		ln, err = quic.ListenAddrEarly(s.Addr, s.TLSConfig, s.QUICConfig)
+	} else {
+		ln, err = quic.ListenAddr(s.Addr, s.TLSConfig, s.QUICConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", s.Addr, err)
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts incoming QUIC connections on ln until ctx is canceled or an
+// error occurs. Once ctx is canceled it closes ln and drains existing
+// connections for up to ShutdownTimeout.
+//
+// Serve may be called concurrently for several listeners; their connections
+// share the server's handler, counters and registry. Logs are tagged with
+// the listener address. Each call drains the connections it accepted.
+func (s *Server) Serve(ctx context.Context, ln Listener) error {
+	if s.Handler == nil {
+		return errors.New("streamserver: nil Handler")
+	}
+	logger := s.logger().With("listener", ln.Addr().String())
+	// conns is local to the call, so that no connection is added to it
+	// once it is waited for.
+	var conns sync.WaitGroup
+	s.startServing()
+	defer s.stopServing()
+
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			// Context cancellation is a graceful shutdown path.
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				logger.Info("accept loop stopped by context", "err", err)
+				return s.shutdown(ln, &conns, logger)
+			}
+			return fmt.Errorf("accept conn: %w", err)
+		}
+
+		connID := s.connSeq.Add(1)
+		l := logger.With(
+			"component", "conn",
+			"conn_id", connID,
+			"remote", conn.RemoteAddr().String(),
+		)
+
+		var release func()
+		if s.Admit != nil {
+			var ok bool
+			if release, ok = s.Admit(conn); !ok {
+				continue
+			}
+		}
+
+		l.Info("accepted", "quic_version", conn.ConnectionState().Version.String())
+		conns.Add(1)
+		s.active.Add(1)
+		tc, untrack := s.track(connID, conn)
+		go func() {
+			defer conns.Done()
+			defer s.active.Add(-1)
+			defer untrack()
+			if release != nil {
+				defer release()
+			}
+			if err := s.handleConn(ctx, tc, l); err != nil {
+				l.Warn("connection handler ended with error", "err", err)
+			}
+		}()
+	}
+}
+
+// handleConn accepts streams from conn and serves each with s.Handler, and
+// unidirectional streams and datagrams too if the handler supports them.
+// When ctx is canceled it stops accepting streams, gives in-flight streams the
+// drain period to finish, and closes the connection with GoAwayCode.
+func (s *Server) handleConn(ctx context.Context, tc *trackedConn, l *slog.Logger) error {
+	conn := tc.conn
+	var streams sync.WaitGroup
+	code, reason := quic.ApplicationErrorCode(0), "server closing"
+	defer func() {
+		attrs := []any{"code", code}
+		if s.CloseAttrs != nil {
+			attrs = append(attrs, s.CloseAttrs(conn)...)
+		}
+		l.Info("closing", attrs...)
+		_ = conn.CloseWithError(code, reason)
+	}()
+
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != "" {
+		l = l.With("alpn", proto)
+	}
+
+	// first is the stream that carried the token, to be served first.
+	var first *quic.Stream
+	if s.Auth != nil && s.Auth.Required(conn) {
+		st, err := s.authenticate(ctx, conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				code, reason = s.GoAwayCode, "server shutting down"
+				return nil
+			}
+			l.Warn("authentication failed", "err", err)
+			code, reason = s.AuthFailedCode, "unauthorized"
+			return nil
+		}
+		l.Debug("authenticated")
+		first = st
+	}
+
+	if ch := s.connHandler(conn); ch != nil {
+		// A connection handler has no use for the rest of the token
+		// stream.
+		if first != nil {
+			first.CancelRead(0)
+			_ = first.Close()
+		}
+		if s.serveConn(ctx, ch, conn, l) {
+			code, reason = s.GoAwayCode, "server shutting down"
+		}
+		return nil
+	}
+
+	// cctx is the context of the handlers of conn.
+	cctx := withScheduler(conn.Context())
+	if dh, ok := s.Handler.(DatagramHandler); ok && conn.ConnectionState().SupportsDatagrams {
+		dctx := context.WithValue(cctx, loggerKey{}, l)
+		go func() {
+			if err := dh.ServeDatagrams(dctx, conn); err != nil && dctx.Err() == nil {
+				l.Warn("datagram handler ended with error", "err", err)
+			}
+		}()
+	}
+
+	if uh, ok := s.Handler.(UniStreamHandler); ok {
+		go s.acceptUni(ctx, tc, uh, &streams, l)
+	}
+
+	for {
+		var st *quic.Stream
+		var err error
+		if first != nil {
+			st, first = first, nil
+		} else {
+			st, err = conn.AcceptStream(ctx)
+		}
+		if err != nil {
+			// Client close or context cancellation commonly ends the stream loop.
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				l.Info("accept stream stopped by context, draining", "err", err, "drain_period", s.DrainPeriod)
+				if !waitTimeout(&streams, s.DrainPeriod) {
+					l.Warn("drain period elapsed with streams in flight")
+				}
+				code, reason = s.GoAwayCode, "server shutting down"
+				return nil
+			}
+			return fmt.Errorf("accept stream: %w", err)
+		}
+
+		streamID := s.streamSeq.Add(1)
+		sl := l.With("component", "stream", "stream_id", streamID, "quic_id", st.StreamID())
+		sctx := context.WithValue(cctx, loggerKey{}, sl)
+
+		sl.Debug("opened")
+		streams.Add(1)
+		done := tc.addStream(StreamInfo{ID: streamID, QUICID: st.StreamID(), Since: time.Now()})
+		ok := s.dispatch(ctx, func() {
+			defer streams.Done()
+			defer done()
+			if err := s.Handler.Serve(sctx, conn, st); err != nil {
+				sl.Warn("stream handler ended with error", "err", err)
+			}
+		})
+		if !ok {
+			streams.Done()
+			done()
+			st.CancelRead(s.RejectCode)
+			st.CancelWrite(s.RejectCode)
+			sl.Warn("stream rejected, no worker available", "workers", s.Workers, "queue_len", s.QueueLen)
+		}
+	}
+}
+
+// connHandler returns the handler that takes over conn, or nil if its
+// streams are to be served one by one.
+func (s *Server) connHandler(conn *quic.Conn) ConnHandler {
+	switch h := s.Handler.(type) {
+	case *ProtocolMux:
+		return h.conns[conn.ConnectionState().TLS.NegotiatedProtocol]
+	case ConnHandler:
+		return h
+	}
+	return nil
+}
+
+// serveConn serves conn with ch until ch returns. If ctx is canceled first,
+// ch gets the drain period to finish. It reports whether ctx was canceled.
+func (s *Server) serveConn(ctx context.Context, ch ConnHandler, conn *quic.Conn, l *slog.Logger) bool {
+	done := make(chan error, 1)
+	go func() { done <- ch.ServeConn(context.WithValue(withScheduler(ctx), loggerKey{}, l), conn) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		l.Info("connection handler stopped by context, draining", "drain_period", s.DrainPeriod)
+		t := time.NewTimer(s.DrainPeriod)
+		defer t.Stop()
+		select {
+		case err = <-done:
+		case <-t.C:
+			l.Warn("drain period elapsed with connection handler running")
+		}
+	}
+	if err != nil {
+		l.Warn("connection handler ended with error", "err", err)
+	}
+	return ctx.Err() != nil
+}
+
+// acceptUni accepts unidirectional streams from conn and serves each with uh
+// until ctx is canceled or conn is closed. Served streams are tracked in
+// streams so that they take part in draining.
+func (s *Server) acceptUni(ctx context.Context, tc *trackedConn, uh UniStreamHandler, streams *sync.WaitGroup, l *slog.Logger) {
+	conn := tc.conn
+	for {
+		st, err := conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+
+		streamID := s.streamSeq.Add(1)
+		sl := l.With("component", "stream", "stream_id", streamID, "quic_id", st.StreamID(), "uni", true)
+		sctx := context.WithValue(conn.Context(), loggerKey{}, sl)
+
+		sl.Debug("opened")
+		streams.Add(1)
+		done := tc.addStream(StreamInfo{ID: streamID, QUICID: st.StreamID(), Uni: true, Since: time.Now()})
+		ok := s.dispatch(ctx, func() {
+			defer streams.Done()
+			defer done()
+			if err := uh.ServeUni(sctx, conn, st); err != nil {
+				sl.Warn("stream handler ended with error", "err", err)
+			}
+		})
+		if !ok {
+			streams.Done()
+			done()
+			st.CancelRead(s.RejectCode)
+			sl.Warn("stream rejected, no worker available", "workers", s.Workers, "queue_len", s.QueueLen)
+		}
+	}
+}
+
+// dispatch runs serve on a worker if s.Workers is set, and on a goroutine of
+// its own otherwise. It reports whether serve will run; if not, the stream
+// was rejected under s.QueuePolicy, ctx was canceled while waiting or the
+// server has shut down.
+func (s *Server) dispatch(ctx context.Context, serve func()) bool {
+	if s.Workers <= 0 {
+		go serve()
+		return true
+	}
+	// Without a pool, the server has shut down.
+	p := s.pool.Load()
+	if p == nil {
+		return false
+	}
+	return p.submit(ctx, serve, s.QueuePolicy)
+}
+
+// startServing accounts for a Serve call and starts the worker pool, if
+// there are workers and it is not running yet.
+func (s *Server) startServing() {
+	s.serveMu.Lock()
+	defer s.serveMu.Unlock()
+	s.serving++
+	if s.Workers > 0 && s.pool.Load() == nil {
+		s.pool.Store(newWorkerPool(s.Workers, s.QueueLen))
+	}
+}
+
+// stopServing ends a Serve call and stops the worker pool after the last
+// one. Streams of connections still open are rejected from then on.
+func (s *Server) stopServing() {
+	s.serveMu.Lock()
+	defer s.serveMu.Unlock()
+	if s.serving--; s.serving == 0 {
+		if p := s.pool.Swap(nil); p != nil {
+			p.stop()
+		}
+	}
+}
+
+// shutdown closes ln so that no new connections are accepted and waits up to
+// the shutdown timeout for the connection handlers in conns to drain.
+func (s *Server) shutdown(ln Listener, conns *sync.WaitGroup, logger *slog.Logger) error {
+	logger.Info("shutting down", "timeout", s.ShutdownTimeout)
+	if err := ln.Close(); err != nil {
+		logger.Warn("close listener", "err", err)
+	}
+
+	if !waitTimeout(conns, s.ShutdownTimeout) {
+		logger.Warn("shutdown timeout elapsed with connections still open")
+		return nil
+	}
+	logger.Info("all connections drained")
+	return nil
+}
+
+// logger returns s.Logger or the default logger.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// waitTimeout waits for wg for at most d and reports whether it completed.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
@@ -0,0 +1,236 @@
+// Package transfer defines the file transfer protocol shared by the server
+// and the client. Every bidirectional stream carries one transfer, started
+// by a request line and answered with a reply line:
+//
+//	PUT <name> <size> <sha256>   "READY <offset>", then the client sends the
+//	                             file from offset on; "OK" once it is stored
+//	GET <name> [<offset>]        "OK <size> <sha256>" followed by the file
+//	                             from offset on
+//
+// Transfers resume after a disconnect: the offset of a PUT is the number of
+// bytes the server kept from an interrupted upload of the same content, and
+// a client resuming a download asks for the bytes it does not hold yet. The
+// SHA-256 digest always covers the whole file, and neither side keeps a
+// file whose digest does not match.
+//
+// Sizes and offsets are decimal and digests are lowercase hex. Failures are
+// answered with "ERR <reason>". Names are plain file names within the
+// server's transfer directory, without path separators.
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ALPN is the Application-Layer Protocol Negotiation identifier of the
+// transfer protocol.
+const ALPN = "quic-transfer"
+
+// Request operations.
+const (
+	OpPut = "PUT"
+	OpGet = "GET"
+)
+
+// maxLineLen bounds request and reply lines.
+const maxLineLen = 1024
+
+// Request is the first line of a transfer stream.
+type Request struct {
+	Op   string
+	Name string
+	// Size and Sum describe the file of a PUT.
+	Size int64
+	Sum  []byte
+	// Offset is where a GET resumes.
+	Offset int64
+}
+
+// Reply is the server's answer to a request.
+type Reply struct {
+	// Err is the reason of a failure, empty on success.
+	Err string
+	// Size and Sum describe the file of a GET.
+	Size int64
+	Sum  []byte
+}
+
+// RemoteError is a failure reported by the peer in a reply.
+type RemoteError struct {
+	Reason string
+}
+
+// Error implements error.
+func (e *RemoteError) Error() string { return "server: " + e.Reason }
+
+// CheckName reports whether name is a valid file name for a transfer.
+func CheckName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid file name %q", name)
+	case strings.ContainsAny(name, "/\\ \r\n\x00"):
+		return fmt.Errorf("file name %q must not contain separators or spaces", name)
+	}
+	return nil
+}
+
+// WriteRequest writes r to w.
+func WriteRequest(w io.Writer, r Request) error {
+	var line string
+	switch r.Op {
+	case OpPut:
+		line = fmt.Sprintf("%s %s %d %x\n", r.Op, r.Name, r.Size, r.Sum)
+	case OpGet:
+		line = fmt.Sprintf("%s %s\n", r.Op, r.Name)
+		if r.Offset > 0 {
+			line = fmt.Sprintf("%s %s %d\n", r.Op, r.Name, r.Offset)
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// ReadRequest reads and validates a request line from br.
+func ReadRequest(br *bufio.Reader) (Request, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return Request{}, err
+	}
+	fields := strings.Split(line, " ")
+	r := Request{Op: fields[0]}
+	switch {
+	case r.Op == OpGet && (len(fields) == 2 || len(fields) == 3):
+		r.Name = fields[1]
+		if len(fields) == 3 {
+			if r.Offset, err = parseSize(fields[2]); err != nil {
+				return Request{}, err
+			}
+		}
+	case r.Op == OpPut && len(fields) == 4:
+		r.Name = fields[1]
+		if r.Size, r.Sum, err = parseFile(fields[2], fields[3]); err != nil {
+			return Request{}, err
+		}
+	default:
+		return Request{}, fmt.Errorf("malformed request %.64q", line)
+	}
+	if err := CheckName(r.Name); err != nil {
+		return Request{}, err
+	}
+	return r, nil
+}
+
+// WriteReply writes r to w.
+func WriteReply(w io.Writer, r Reply) error {
+	line := "OK\n"
+	switch {
+	case r.Err != "":
+		// The reason must stay on one line.
+		line = "ERR " + strings.ReplaceAll(r.Err, "\n", " ") + "\n"
+	case r.Sum != nil:
+		line = fmt.Sprintf("OK %d %x\n", r.Size, r.Sum)
+	}
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// ReadReply reads a reply line from br. A failure reported by the server is
+// returned as a [*RemoteError]. With withFile, the reply must describe a
+// file, as the reply to a GET does.
+func ReadReply(br *bufio.Reader, withFile bool) (Reply, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return Reply{}, err
+	}
+	if reason, ok := strings.CutPrefix(line, "ERR "); ok {
+		return Reply{}, &RemoteError{Reason: reason}
+	}
+	fields := strings.Split(line, " ")
+	switch {
+	case fields[0] != "OK":
+	case !withFile && len(fields) == 1:
+		return Reply{}, nil
+	case withFile && len(fields) == 3:
+		size, sum, err := parseFile(fields[1], fields[2])
+		if err != nil {
+			return Reply{}, err
+		}
+		return Reply{Size: size, Sum: sum}, nil
+	}
+	return Reply{}, fmt.Errorf("malformed reply %.64q", line)
+}
+
+// WriteReady writes the server's answer to a PUT that it is ready to
+// receive the file from offset on.
+func WriteReady(w io.Writer, offset int64) error {
+	_, err := fmt.Fprintf(w, "READY %d\n", offset)
+	return err
+}
+
+// ReadReady reads the server's answer to a PUT from br and returns the
+// offset to send the file from. A failure reported by the server is
+// returned as a [*RemoteError].
+func ReadReady(br *bufio.Reader) (int64, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return 0, err
+	}
+	if reason, ok := strings.CutPrefix(line, "ERR "); ok {
+		return 0, &RemoteError{Reason: reason}
+	}
+	offset, ok := strings.CutPrefix(line, "READY ")
+	if !ok {
+		return 0, fmt.Errorf("malformed reply %.64q", line)
+	}
+	return parseSize(offset)
+}
+
+// readLine reads a line of at most maxLineLen bytes from br, without the
+// newline.
+func readLine(br *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		frag, err := br.ReadSlice('\n')
+		b.Write(frag)
+		if b.Len() > maxLineLen {
+			return "", errors.New("line too long")
+		}
+		if err == nil {
+			return strings.TrimSuffix(b.String(), "\n"), nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+// parseFile parses the size and digest fields of a request or reply.
+func parseFile(size, sum string) (int64, []byte, error) {
+	n, err := parseSize(size)
+	if err != nil {
+		return 0, nil, err
+	}
+	digest, err := hex.DecodeString(sum)
+	if err != nil || len(digest) != sha256.Size {
+		return 0, nil, fmt.Errorf("invalid sha256 %.80q", sum)
+	}
+	return n, digest, nil
+}
+
+// parseSize parses a size or offset field.
+func parseSize(field string) (int64, error) {
+	n, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %.32q", field)
+	}
+	return n, nil
+}
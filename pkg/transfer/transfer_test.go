@@ -0,0 +1,71 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// FuzzReadRequest checks that every request accepted names a valid file and
+// writes to a line that reads back to the same request.
+func FuzzReadRequest(f *testing.F) {
+	sum := sha256.Sum256([]byte("hello"))
+	f.Add([]byte(fmt.Sprintf("PUT hello.txt 5 %x\n", sum)))
+	f.Add([]byte("GET hello.txt\n"))
+	f.Add([]byte("GET hello.txt 3\n"))
+	f.Add([]byte("GET ../etc/passwd\n"))
+	f.Add([]byte("PUT x -1 00\n"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		r, err := ReadRequest(bufio.NewReader(bytes.NewReader(line)))
+		if err != nil {
+			return
+		}
+		if err := CheckName(r.Name); err != nil {
+			t.Fatalf("request for invalid name accepted: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := WriteRequest(&buf, r); err != nil {
+			t.Fatalf("write request: %v", err)
+		}
+		again, err := ReadRequest(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("written request %q does not read: %v", buf.String(), err)
+		}
+		if again.Op != r.Op || again.Name != r.Name || again.Size != r.Size || !bytes.Equal(again.Sum, r.Sum) || again.Offset != r.Offset {
+			t.Fatalf("request changed in a round trip: %+v, want %+v", again, r)
+		}
+	})
+}
+
+// FuzzReadReply checks that every reply accepted writes to a line that reads
+// back to the same reply.
+func FuzzReadReply(f *testing.F) {
+	sum := sha256.Sum256([]byte("hello"))
+	f.Add([]byte(fmt.Sprintf("OK 5 %x\n", sum)), true)
+	f.Add([]byte("OK\n"), false)
+	f.Add([]byte("ERR no such file\n"), true)
+	f.Add([]byte("OK "+strings.Repeat("9", 30)+"\n"), true)
+	f.Fuzz(func(t *testing.T, line []byte, withFile bool) {
+		r, err := ReadReply(bufio.NewReader(bytes.NewReader(line)), withFile)
+		if err != nil {
+			return
+		}
+		if withFile != (r.Sum != nil) {
+			t.Fatalf("reply %+v with file %t", r, withFile)
+		}
+		var buf bytes.Buffer
+		if err := WriteReply(&buf, r); err != nil {
+			t.Fatalf("write reply: %v", err)
+		}
+		again, err := ReadReply(bufio.NewReader(&buf), withFile)
+		if err != nil {
+			t.Fatalf("written reply %q does not read: %v", buf.String(), err)
+		}
+		if again.Size != r.Size || !bytes.Equal(again.Sum, r.Sum) {
+			t.Fatalf("reply changed in a round trip: %+v, want %+v", again, r)
+		}
+	})
+}
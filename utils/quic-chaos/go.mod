@@ -0,0 +1,3 @@
+module quic_chaos
+
+go 1.25.5
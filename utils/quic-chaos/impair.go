@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultQueue is the most bytes a rate-limited direction queues before it
+// drops packets, if its impairment sets no queue.
+const defaultQueue = 64 * 1024
+
+// impairment is what the relay does to the packets of one direction, as set
+// by -impair, -up and -down.
+type impairment struct {
+	// loss is the probability that a packet is dropped.
+	loss float64
+	// delay is added to every packet, and a uniformly random duration in
+	// [0, jitter) on top, which reorders packets closer than jitter.
+	delay  time.Duration
+	jitter time.Duration
+	// reorder is the probability that a packet is held back by gap, so that
+	// the packets behind it overtake it.
+	reorder float64
+	gap     time.Duration
+	// dup is the probability that a packet is sent twice.
+	dup float64
+	// rate caps the direction at this many bytes per second, or 0 for no
+	// cap. Packets beyond queue bytes waiting for it are dropped.
+	rate  int64
+	queue int64
+}
+
+// parseImpairment parses a comma-separated list of key=value settings, e.g.
+// "loss=1%,delay=20ms,jitter=5ms,rate=1M". Later settings override earlier
+// ones, so that a direction can adjust the settings of both.
+func parseImpairment(spec string) (impairment, error) {
+	imp := impairment{gap: 10 * time.Millisecond, queue: defaultQueue}
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			return imp, fmt.Errorf("setting %q: want key=value", kv)
+		}
+		var err error
+		switch key {
+		case "loss":
+			imp.loss, err = parseProbability(val)
+		case "delay":
+			imp.delay, err = parseDuration(val)
+		case "jitter":
+			imp.jitter, err = parseDuration(val)
+		case "reorder":
+			imp.reorder, err = parseProbability(val)
+		case "gap":
+			imp.gap, err = parseDuration(val)
+		case "dup":
+			imp.dup, err = parseProbability(val)
+		case "rate":
+			imp.rate, err = parseBytes(val)
+		case "queue":
+			imp.queue, err = parseBytes(val)
+		default:
+			return imp, fmt.Errorf("unknown setting %q: want loss, delay, jitter, reorder, gap, dup, rate or queue", key)
+		}
+		if err != nil {
+			return imp, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return imp, nil
+}
+
+// String describes imp in the syntax of parseImpairment, leaving out the
+// settings that do nothing.
+func (imp impairment) String() string {
+	var s []string
+	if imp.loss > 0 {
+		s = append(s, "loss="+formatProbability(imp.loss))
+	}
+	if imp.delay > 0 {
+		s = append(s, "delay="+imp.delay.String())
+	}
+	if imp.jitter > 0 {
+		s = append(s, "jitter="+imp.jitter.String())
+	}
+	if imp.reorder > 0 {
+		s = append(s, "reorder="+formatProbability(imp.reorder), "gap="+imp.gap.String())
+	}
+	if imp.dup > 0 {
+		s = append(s, "dup="+formatProbability(imp.dup))
+	}
+	if imp.rate > 0 {
+		s = append(s, fmt.Sprintf("rate=%d", imp.rate), fmt.Sprintf("queue=%d", imp.queue))
+	}
+	if s == nil {
+		return "none"
+	}
+	return strings.Join(s, ",")
+}
+
+// parseProbability parses a probability given as a fraction, e.g. 0.01, or
+// a percentage, e.g. 1%.
+func parseProbability(s string) (float64, error) {
+	pct := strings.HasSuffix(s, "%")
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid probability %q", s)
+	}
+	if pct {
+		p /= 100
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability %q out of range", s)
+	}
+	return p, nil
+}
+
+// formatProbability formats p as a percentage.
+func formatProbability(p float64) string {
+	return strconv.FormatFloat(p*100, 'g', -1, 64) + "%"
+}
+
+// parseDuration parses a non-negative duration.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
+
+// parseBytes parses a number of bytes with an optional k, M or G suffix for
+// powers of 1000.
+func parseBytes(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1000
+	case strings.HasSuffix(s, "M"):
+		mult = 1000 * 1000
+	case strings.HasSuffix(s, "G"):
+		mult = 1000 * 1000 * 1000
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: want bytes, e.g. 500k", s)
+	}
+	return n * mult, nil
+}
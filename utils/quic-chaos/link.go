@@ -0,0 +1,189 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// link carries the packets of one direction through its impairment: it
+// drops, duplicates and delays them, and sends them when they are due, in
+// the order they are due.
+type link struct {
+	name string
+	imp  impairment
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// due holds the packets waiting to be sent, earliest first, and seq
+	// numbers them so that packets due at the same time keep their order.
+	due heapQueue
+	seq uint64
+	// busyUntil is when the packets queued for the rate cap have gone out.
+	busyUntil time.Time
+	// wake is signaled when a packet is queued ahead of the others.
+	wake chan struct{}
+
+	stats linkStats
+}
+
+// linkStats counts what a link did to its packets.
+type linkStats struct {
+	packets, bytes        atomic.Uint64
+	lost, queueDropped    atomic.Uint64
+	duplicated, reordered atomic.Uint64
+}
+
+// newLink returns a link applying imp, drawing its random numbers from a
+// generator seeded with seed.
+func newLink(name string, imp impairment, seed uint64) *link {
+	return &link{
+		name: name,
+		imp:  imp,
+		rng:  rand.New(rand.NewPCG(seed, 0)),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// submit passes p through the link, to be written with send when it is
+// due. p must not be modified afterwards.
+func (l *link) submit(p []byte, send func([]byte)) {
+	l.stats.packets.Add(1)
+	l.stats.bytes.Add(uint64(len(p)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.imp.loss > 0 && l.rng.Float64() < l.imp.loss {
+		l.stats.lost.Add(1)
+		return
+	}
+	copies := 1
+	if l.imp.dup > 0 && l.rng.Float64() < l.imp.dup {
+		l.stats.duplicated.Add(1)
+		copies = 2
+	}
+	now := time.Now()
+	for range copies {
+		depart := now
+		if l.imp.rate > 0 {
+			// The rate cap is a queue drained at rate: a packet leaves once
+			// the ones before it have, and is dropped if the queue is full.
+			depart = maxTime(now, l.busyUntil)
+			if backlog := int64(depart.Sub(now).Seconds() * float64(l.imp.rate)); backlog+int64(len(p)) > l.imp.queue {
+				l.stats.queueDropped.Add(1)
+				continue
+			}
+			l.busyUntil = depart.Add(time.Duration(float64(len(p)) / float64(l.imp.rate) * float64(time.Second)))
+		}
+		at := depart.Add(l.imp.delay)
+		if l.imp.jitter > 0 {
+			at = at.Add(time.Duration(l.rng.Int64N(int64(l.imp.jitter))))
+		}
+		if l.imp.reorder > 0 && l.rng.Float64() < l.imp.reorder {
+			l.stats.reordered.Add(1)
+			at = at.Add(l.imp.gap)
+		}
+		l.seq++
+		heap.Push(&l.due, &pending{at: at, seq: l.seq, data: p, send: send})
+		if l.due[0].seq == l.seq {
+			select {
+			case l.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// run sends the packets of the link when they are due, until ctx is done.
+func (l *link) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		var wait time.Duration
+		var next *pending
+		if len(l.due) > 0 {
+			if wait = time.Until(l.due[0].at); wait <= 0 {
+				next = heap.Pop(&l.due).(*pending)
+			}
+		} else {
+			wait = time.Hour
+		}
+		l.mu.Unlock()
+		if next != nil {
+			next.send(next.data)
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logStats logs what l did to its packets so far.
+func (l *link) logStats(logger *slog.Logger) {
+	logger.Info("link stats",
+		"component", "link",
+		"direction", l.name,
+		"packets", l.stats.packets.Load(),
+		"bytes", l.stats.bytes.Load(),
+		"lost", l.stats.lost.Load(),
+		"queue_dropped", l.stats.queueDropped.Load(),
+		"duplicated", l.stats.duplicated.Load(),
+		"reordered", l.stats.reordered.Load(),
+	)
+}
+
+// pending is a packet waiting in a link until it is due at at.
+type pending struct {
+	at   time.Time
+	seq  uint64
+	data []byte
+	send func([]byte)
+}
+
+// heapQueue is a min-heap of pending packets by due time, then sequence.
+type heapQueue []*pending
+
+// Len implements heap.Interface.
+func (q heapQueue) Len() int { return len(q) }
+
+// Less implements heap.Interface.
+func (q heapQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+// Swap implements heap.Interface.
+func (q heapQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+// Push implements heap.Interface.
+func (q *heapQueue) Push(x any) { *q = append(*q, x.(*pending)) }
+
+// Pop implements heap.Interface.
+func (q *heapQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
+
+// maxTime returns the later of a and b.
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,232 @@
+// Command quic-chaos is a UDP relay that sits between a QUIC client and
+// server and impairs the packets passing through it, so that loss recovery,
+// congestion control and migration can be tested on a bad link without the
+// privileges tc/netem needs.
+//
+// Clients send to -listen, and the relay forwards their datagrams to
+// -target from a socket of its own per client address, like a NAT, so that
+// a client that migrates shows up at the server from a new address too.
+// Sessions expire after -session-timeout without traffic.
+//
+// -impair sets the impairment of both directions as a comma-separated list
+// of settings, and -up (client to server) and -down (server to client) add
+// to or override it per direction:
+//
+//	loss=1%       drop packets with this probability
+//	delay=20ms    delay every packet by this much
+//	jitter=5ms    and by a random duration up to this much on top
+//	reorder=2%    hold packets back by gap with this probability, so that
+//	gap=10ms      the ones behind them overtake them
+//	dup=1%        send packets twice with this probability
+//	rate=1M       cap the direction at this many bytes per second,
+//	queue=64k     dropping packets beyond this many bytes queued for it
+//
+// Probabilities are fractions or percentages, and sizes take k, M and G
+// suffixes for powers of 1000. -seed makes the random decisions
+// reproducible. What the relay did to the packets of each direction is
+// logged every -stats-interval and at exit.
+//
+// -rebind simulates NAT rebinding: that often, the relay moves every
+// session to a new socket and closes the old one, so that the server sees
+// the client's packets come from a new port, and from the next address of
+// -rebind-addrs if it is set, and must validate the new path to keep the
+// connection. The first reply on the new path is logged with how long it
+// took.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// config holds command-line configuration for the relay.
+type config struct {
+	listen         string
+	target         string
+	impair         string
+	up             string
+	down           string
+	seed           uint64
+	sessionTimeout time.Duration
+	rebind         time.Duration
+	rebindAddrs    string
+	statsInterval  time.Duration
+
+	logLevel  slog.Level
+	logFormat string
+}
+
+// main parses flags, configures logging, and runs the relay.
+// It exits with a non-zero status on fatal errors.
+func main() {
+	cfg := parseFlags()
+
+	h, err := newLogHandler(os.Stdout, cfg.logFormat, &slog.HandlerOptions{Level: cfg.logLevel})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := slog.New(h)
+	slog.SetDefault(logger)
+
+	if err := run(context.Background(), logger, cfg); err != nil {
+		logger.Error("fatal", "err", err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses command-line flags and returns the resulting config.
+func parseFlags() config {
+	var cfg config
+
+	flag.StringVar(&cfg.listen, "listen", "127.0.0.1:4343", "UDP address to accept clients on")
+	flag.StringVar(&cfg.target, "target", "127.0.0.1:4242", "UDP address of the QUIC server to relay to")
+	flag.StringVar(&cfg.impair, "impair", "", "Impairment of both directions, e.g. loss=1%,delay=20ms,jitter=5ms,reorder=2%,gap=10ms,dup=1%,rate=1M,queue=64k")
+	flag.StringVar(&cfg.up, "up", "", "Impairment of the client to server direction, on top of -impair")
+	flag.StringVar(&cfg.down, "down", "", "Impairment of the server to client direction, on top of -impair")
+	flag.Uint64Var(&cfg.seed, "seed", 0, "Seed of the random decisions, for reproducible runs (0 = random)")
+	flag.DurationVar(&cfg.sessionTimeout, "session-timeout", 2*time.Minute, "Forget a client address after this long without traffic")
+	flag.DurationVar(&cfg.rebind, "rebind", 0, "Move every session to a new source port this often, like a NAT rebinding, to test the server's path validation (0 = never)")
+	flag.StringVar(&cfg.rebindAddrs, "rebind-addrs", "", "Comma-separated local IP addresses that -rebind takes turns sending from, to change the source address too, e.g. 127.0.0.2,127.0.0.3")
+	flag.DurationVar(&cfg.statsInterval, "stats-interval", 10*time.Second, "Log what was done to the packets of each direction this often (0 = only at exit)")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.logFormat, "log-format", "text", "Log format: text or json")
+
+	flag.Parse()
+	return cfg
+}
+
+// run relays between cfg.listen and cfg.target until ctx is canceled or a
+// signal arrives.
+func run(ctx context.Context, logger *slog.Logger, cfg config) error {
+	up, err := parseImpairment(cfg.impair + "," + cfg.up)
+	if err != nil {
+		return fmt.Errorf("up impairment: %w", err)
+	}
+	down, err := parseImpairment(cfg.impair + "," + cfg.down)
+	if err != nil {
+		return fmt.Errorf("down impairment: %w", err)
+	}
+	if cfg.sessionTimeout <= 0 {
+		return errors.New("-session-timeout must be positive")
+	}
+	if cfg.statsInterval < 0 {
+		return errors.New("-stats-interval must not be negative")
+	}
+	if cfg.rebind < 0 {
+		return errors.New("-rebind must not be negative")
+	}
+	var rebindAddrs []netip.Addr
+	for _, s := range strings.Split(cfg.rebindAddrs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return fmt.Errorf("-rebind-addrs: %w", err)
+		}
+		rebindAddrs = append(rebindAddrs, addr)
+	}
+	target, err := net.ResolveUDPAddr("udp", cfg.target)
+	if err != nil {
+		return fmt.Errorf("resolve target: %w", err)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.listen)
+	if err != nil {
+		return fmt.Errorf("resolve listen address: %w", err)
+	}
+	ln, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", cfg.listen, err)
+	}
+
+	ctx, cancel := withSignals(ctx, logger)
+	defer cancel()
+
+	seed := cfg.seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	r := &relay{
+		ln:       ln,
+		target:   target,
+		up:       newLink("up", up, seed),
+		down:     newLink("down", down, seed+1),
+		timeout:  cfg.sessionTimeout,
+		logger:   logger.With("component", "relay"),
+		sessions: make(map[netip.AddrPort]*session),
+
+		rebind:      cfg.rebind,
+		rebindAddrs: rebindAddrs,
+	}
+	for _, l := range []*link{r.up, r.down} {
+		go l.run(ctx)
+	}
+	if cfg.statsInterval > 0 {
+		go logStats(ctx, logger, cfg.statsInterval, r)
+	}
+	logger.Info("relaying", "listen", ln.LocalAddr().String(), "target", target.String(), "up", up.String(), "down", down.String(), "seed", seed)
+
+	err = r.serve(ctx)
+	r.up.logStats(logger)
+	r.down.logStats(logger)
+	r.logStats(logger)
+	return err
+}
+
+// logStats logs the statistics of the links of r, and its rebinds, every
+// interval until ctx is done.
+func logStats(ctx context.Context, logger *slog.Logger, interval time.Duration, r *relay) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			r.up.logStats(logger)
+			r.down.logStats(logger)
+			r.logStats(logger)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newLogHandler returns a log handler writing to w in format, "text" or
+// "json".
+func newLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// withSignals returns a context that is canceled on SIGINT or SIGTERM.
+func withSignals(ctx context.Context, logger *slog.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-ch
+		logger.Info("signal received, shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxPacket is the largest UDP payload the relay reads.
+const maxPacket = 64 * 1024
+
+// relay forwards the datagrams of every client to the target from a socket
+// of its own, like a NAT, passing them through the up link, and the replies
+// back through the down link. With rebind set, it moves every session to a
+// new socket that often, like a NAT that rebinds.
+type relay struct {
+	ln      *net.UDPConn
+	target  *net.UDPAddr
+	up      *link
+	down    *link
+	timeout time.Duration
+	logger  *slog.Logger
+	// rebind is the period of rebinding, or 0 for none, and rebindAddrs
+	// the local addresses the sockets of a session take turns binding to,
+	// or none for the default.
+	rebind      time.Duration
+	rebindAddrs []netip.Addr
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*session
+	wg       sync.WaitGroup
+
+	// rebinds counts the sessions moved to a new socket, and answered those
+	// the target replied to on the new one.
+	rebinds, answered atomic.Uint64
+}
+
+// session is the mapping of a client address to the socket its datagrams
+// go to the target from.
+type session struct {
+	client netip.AddrPort
+	// last is when a datagram last passed in either direction, in Unix
+	// nanoseconds.
+	last atomic.Int64
+
+	mu   sync.Mutex
+	conn *net.UDPConn
+	// binds counts the sockets of the session, to cycle through the
+	// rebind addresses, and reboundAt is when the current one replaced
+	// the one before, zero until the target answers on it.
+	binds     int
+	reboundAt time.Time
+}
+
+// current returns the socket of s.
+func (s *session) current() *net.UDPConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// serve relays datagrams until ctx is done or the listener fails.
+func (r *relay) serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = r.ln.Close()
+	}()
+	defer r.closeSessions()
+	if r.rebind > 0 {
+		go r.rebindLoop(ctx)
+	}
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := r.ln.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s, err := r.session(ctx, from)
+		if err != nil {
+			r.logger.Warn("open session failed", "client", from.String(), "err", err)
+			continue
+		}
+		s.last.Store(time.Now().UnixNano())
+		r.up.submit(append([]byte(nil), buf[:n]...), func(p []byte) {
+			_, _ = s.current().Write(p)
+		})
+	}
+}
+
+// session returns the session of client, opening it for its first datagram.
+func (r *relay) session(ctx context.Context, client netip.AddrPort) (*session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.sessions[client]; s != nil {
+		return s, nil
+	}
+	s := &session{client: client}
+	// serveSession measures idleness from last as soon as it starts.
+	s.last.Store(time.Now().UnixNano())
+	conn, err := r.dial(s)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	r.sessions[client] = s
+	r.logger.Info("session opened", "client", client.String(), "via", conn.LocalAddr().String())
+	r.serveSocket(ctx, s, conn)
+	return s, nil
+}
+
+// dial opens the next socket of s to the target, from the next rebind
+// address if there are any. s.mu must be held or s not shared yet.
+func (r *relay) dial(s *session) (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	if len(r.rebindAddrs) > 0 {
+		laddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(r.rebindAddrs[s.binds%len(r.rebindAddrs)], 0))
+	}
+	s.binds++
+	return net.DialUDP("udp", laddr, r.target)
+}
+
+// serveSocket starts relaying the target's datagrams from conn, a socket of
+// s, to its client.
+func (r *relay) serveSocket(ctx context.Context, s *session, conn *net.UDPConn) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.serveSession(ctx, s, conn)
+	}()
+}
+
+// serveSession relays the target's datagrams from conn to the client of s
+// until the session is idle for the session timeout or closed, or conn is
+// replaced by a rebind.
+func (r *relay) serveSession(ctx context.Context, s *session, conn *net.UDPConn) {
+	defer func() {
+		_ = conn.Close()
+		if s.current() != conn {
+			return
+		}
+		r.mu.Lock()
+		delete(r.sessions, s.client)
+		r.mu.Unlock()
+	}()
+	buf := make([]byte, maxPacket)
+	for {
+		idle := time.Since(time.Unix(0, s.last.Load()))
+		if idle >= r.timeout {
+			r.logger.Info("session expired", "client", s.client.String(), "idle", idle.Round(time.Second))
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(r.timeout - idle))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var nerr net.Error
+			// The target refusing a datagram, e.g. while it restarts, does
+			// not end the session.
+			if errors.As(err, &nerr) && nerr.Timeout() || errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				r.logger.Warn("session failed", "client", s.client.String(), "err", err)
+			}
+			return
+		}
+		s.last.Store(time.Now().UnixNano())
+		r.noteAnswer(s, conn)
+		r.down.submit(append([]byte(nil), buf[:n]...), func(p []byte) {
+			_, _ = r.ln.WriteToUDPAddrPort(p, s.client)
+		})
+	}
+}
+
+// rebindLoop rebinds every session each rebind period until ctx is done.
+func (r *relay) rebindLoop(ctx context.Context) {
+	tick := time.NewTicker(r.rebind)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		r.mu.Lock()
+		sessions := make([]*session, 0, len(r.sessions))
+		for _, s := range r.sessions {
+			sessions = append(sessions, s)
+		}
+		r.mu.Unlock()
+		for _, s := range sessions {
+			r.rebindSession(ctx, s)
+		}
+	}
+}
+
+// rebindSession moves s to a new socket, so that the target sees the
+// client's packets come from a new address, and closes the old one, so that
+// what the target still sends there is lost as behind a NAT.
+func (r *relay) rebindSession(ctx context.Context, s *session) {
+	if ctx.Err() != nil {
+		return
+	}
+	s.mu.Lock()
+	conn, err := r.dial(s)
+	if err != nil {
+		s.mu.Unlock()
+		r.logger.Warn("rebind failed", "client", s.client.String(), "err", err)
+		return
+	}
+	old, unanswered := s.conn, s.reboundAt
+	s.conn, s.reboundAt = conn, time.Now()
+	s.mu.Unlock()
+	r.rebinds.Add(1)
+	if !unanswered.IsZero() {
+		r.logger.Warn("target never answered on the last path", "client", s.client.String(), "path", old.LocalAddr().String(), "since", time.Since(unanswered).Round(time.Millisecond))
+	}
+	r.logger.Info("session rebound", "client", s.client.String(), "from", old.LocalAddr().String(), "to", conn.LocalAddr().String())
+	r.serveSocket(ctx, s, conn)
+	_ = old.Close()
+}
+
+// noteAnswer logs the first datagram from the target on conn, the socket
+// of s since a rebind: the target validated the new path.
+func (r *relay) noteAnswer(s *session, conn *net.UDPConn) {
+	s.mu.Lock()
+	at := s.reboundAt
+	if conn != s.conn {
+		at = time.Time{}
+	} else {
+		s.reboundAt = time.Time{}
+	}
+	s.mu.Unlock()
+	if at.IsZero() {
+		return
+	}
+	r.answered.Add(1)
+	r.logger.Info("target answered on the new path", "client", s.client.String(), "after", time.Since(at).Round(time.Microsecond))
+}
+
+// logStats logs the rebinds so far.
+func (r *relay) logStats(logger *slog.Logger) {
+	if r.rebind > 0 {
+		logger.Info("rebind stats", "component", "relay", "rebinds", r.rebinds.Load(), "answered", r.answered.Load())
+	}
+}
+
+// closeSessions closes every session and waits for them to end.
+func (r *relay) closeSessions() {
+	r.mu.Lock()
+	for _, s := range r.sessions {
+		_ = s.current().Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// Directions accepted by -bench-direction.
+const (
+	benchUp   = "up"
+	benchDown = "down"
+	benchBidi = "bidi"
+)
+
+// benchDrain bounds the wait for the server to read the rest of an upload
+// once a run ends.
+const benchDrain = 5 * time.Second
+
+// benchALPNs maps the benchmark directions to the server protocols that
+// carry them: uploads go to discard, downloads come from chargen.
+var benchALPNs = map[string]string{
+	benchUp:   pipeALPNs["discard"],
+	benchDown: pipeALPNs["chargen"],
+}
+
+// benchRun is the traffic of one direction of -bench, on a connection of
+// its own.
+type benchRun struct {
+	dir     string
+	conn    *quic.Conn
+	streams []*quic.Stream
+	bytes   atomic.Int64
+	dur     time.Duration
+	err     error
+	// pace paces uploads to -rate.
+	pace *pacer
+}
+
+// runBench measures the goodput the link to addr sustains for
+// cfg.benchDuration, sending or receiving cfg.benchSize byte payloads on
+// cfg.benchStreams parallel streams in the direction cfg.benchDirection. It
+// reports the goodput of every direction and the CPU time the client used.
+// If token is not empty, it is sent on the first stream of every connection
+// to authenticate.
+func runBench(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token string, cfg config) error {
+	l := logger.With("component", "bench")
+	var dirs []string
+	switch cfg.benchDirection {
+	case benchUp, benchDown:
+		dirs = []string{cfg.benchDirection}
+	case benchBidi:
+		dirs = []string{benchUp, benchDown}
+	default:
+		return fmt.Errorf("-bench-direction must be up, down or bidi, got %q", cfg.benchDirection)
+	}
+
+	runs := make([]*benchRun, len(dirs))
+	for i, dir := range dirs {
+		r, err := openBench(ctx, addr, tlsConf, quicConf, token, dir, cfg.benchStreams)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		defer func() { _ = r.conn.CloseWithError(errcode.NoError, "bye") }()
+		r.pace = cfg.pace
+		runs[i] = r
+	}
+	l.Info("starting benchmark", "direction", cfg.benchDirection, "streams", cfg.benchStreams, "size", cfg.benchSize, "duration", cfg.benchDuration)
+
+	// The deadline unblocks every stream at the end of the run, or as soon
+	// as the client is interrupted.
+	bctx, cancel := context.WithTimeout(ctx, cfg.benchDuration)
+	defer cancel()
+	stop := context.AfterFunc(bctx, func() {
+		for _, r := range runs {
+			for _, st := range r.streams {
+				_ = st.SetDeadline(time.Now())
+			}
+		}
+	})
+	defer stop()
+
+	cpu0, cpuOK := cpuTime()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, r := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.err = r.run(bctx, cfg.benchSize)
+			r.dur = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	dur := time.Since(start)
+	cpu1, _ := cpuTime()
+	cpu := cpu1 - cpu0
+	// Compared to one core; several cores in use show as more than 100%.
+	cpuPct := 100 * cpu.Seconds() / dur.Seconds()
+
+	var failed error
+	for _, r := range runs {
+		n := r.bytes.Load()
+		mbps := float64(n) * 8 / 1e6 / r.dur.Seconds()
+		if cfg.output == outputJSON {
+			rec := opRecord{Op: "bench", StreamID: -1, Direction: r.dir, Bytes: n, DurMs: ms(r.dur), MbitPerS: mbps}
+			if cpuOK {
+				rec.CPUPct = cpuPct
+			}
+			if r.err != nil {
+				rec.Error = r.err.Error()
+			}
+			printRecord(rec)
+		}
+		if r.err != nil {
+			l.Warn("bench failed", "direction", r.dir, "err", r.err)
+			if failed == nil {
+				failed = r.err
+			}
+			continue
+		}
+		l.Info("bench results",
+			"direction", r.dir,
+			"streams", len(r.streams),
+			"bytes", n,
+			"dur", r.dur,
+			"mbit_per_s", fmt.Sprintf("%.2f", mbps),
+		)
+	}
+	if cpuOK {
+		l.Info("bench cpu", "cpu_time", cpu.Round(time.Millisecond), "cpu_pct", fmt.Sprintf("%.1f", cpuPct))
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return failed
+}
+
+// openBench connects to addr with the server protocol of direction dir and
+// opens n streams on the connection, sending token on the first one if it
+// is not empty. Download streams are closed for writing right away, which
+// also announces them to the server.
+func openBench(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, dir string, n int) (r *benchRun, err error) {
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, benchALPNs[dir]), quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = conn.CloseWithError(errcode.NoError, "bye")
+		}
+	}()
+	r = &benchRun{dir: dir, conn: conn}
+	for i := range n {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("open stream: %w", err)
+		}
+		if i == 0 && token != "" {
+			if _, err := io.WriteString(st, token+"\n"); err != nil {
+				return nil, fmt.Errorf("send token: %w", err)
+			}
+		}
+		if dir == benchDown {
+			if err := st.Close(); err != nil {
+				return nil, fmt.Errorf("close stream: %w", err)
+			}
+		}
+		r.streams = append(r.streams, st)
+	}
+	return r, nil
+}
+
+// run moves size byte payloads on all streams of r until ctx is done,
+// counting the bytes. It returns the first error other than the end of the
+// run.
+func (r *benchRun) run(ctx context.Context, size int) error {
+	errs := make([]error, len(r.streams))
+	var wg sync.WaitGroup
+	for i, st := range r.streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.stream(ctx, st, size)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream writes payloads to st or reads them from it, by the direction of
+// r, until ctx is done. The stream is ended when it returns.
+func (r *benchRun) stream(ctx context.Context, st *quic.Stream, size int) error {
+	buf := make([]byte, size)
+	if r.dir == benchUp {
+		for i := range buf {
+			buf[i] = 'a' + byte(i%26)
+		}
+	} else {
+		// Stopping to read is how chargen ends.
+		defer st.CancelRead(0)
+	}
+	for {
+		var n int
+		var err error
+		if r.dir == benchUp {
+			if err = r.pace.wait(ctx, len(buf)); err == nil {
+				n, err = st.Write(buf)
+			}
+		} else {
+			n, err = st.Read(buf)
+		}
+		r.bytes.Add(int64(n))
+		switch {
+		case err == nil:
+			continue
+		case ctx.Err() == nil:
+			st.CancelWrite(0)
+			if echoclient.IsAuthFailed(err) {
+				return errAuthRejected
+			}
+			return fmt.Errorf("quic_id %d: %w", st.StreamID(), err)
+		case r.dir == benchUp && errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return finishUpload(st)
+		default:
+			st.CancelWrite(0)
+			return nil
+		}
+	}
+}
+
+// finishUpload ends the upload on st and waits up to benchDrain for the
+// server to have read all of it, which it tells by ending the stream, so
+// that only bytes that arrived count.
+func finishUpload(st *quic.Stream) error {
+	if err := st.Close(); err != nil {
+		return fmt.Errorf("quic_id %d: close stream: %w", st.StreamID(), err)
+	}
+	_ = st.SetReadDeadline(time.Now().Add(benchDrain))
+	if _, err := io.Copy(io.Discard, st); err != nil {
+		st.CancelWrite(0)
+		return fmt.Errorf("quic_id %d: wait for the server to read the upload: %w", st.StreamID(), err)
+	}
+	return nil
+}
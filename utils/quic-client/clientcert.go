@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// TLS alerts a server sends when it rejects the client certificate, as QUIC
+// CRYPTO_ERROR codes (0x100 + alert, RFC 9001 section 4.8).
+const (
+	alertBadCertificate      = 0x100 + 42
+	alertUnsupportedCert     = 0x100 + 43
+	alertCertificateRevoked  = 0x100 + 44
+	alertCertificateExpired  = 0x100 + 45
+	alertCertificateUnknown  = 0x100 + 46
+	alertUnknownCA           = 0x100 + 48
+	alertCertificateRequired = 0x100 + 116
+)
+
+// clientCertHint explains err if it is the server rejecting the handshake
+// over the client certificate. hasCert tells whether -cert was given.
+func clientCertHint(err error, hasCert bool) (string, bool) {
+	var te *quic.TransportError
+	if !errors.As(err, &te) || !te.Remote {
+		return "", false
+	}
+	switch te.ErrorCode {
+	case alertCertificateRequired:
+		if hasCert {
+			// crypto/tls only presents a certificate issued by one of the
+			// CAs the server names.
+			return "the server requires a client certificate issued by a CA it trusts, and -cert is not", true
+		}
+		return "the server requires a client certificate, pass one with -cert and -key", true
+	case alertBadCertificate, alertUnsupportedCert, alertCertificateRevoked,
+		alertCertificateExpired, alertCertificateUnknown, alertUnknownCA:
+		if !hasCert {
+			return "the server may require a client certificate, pass one with -cert and -key", true
+		}
+		return "the server rejected the client certificate; check that it is issued by a CA the server trusts and still valid", true
+	}
+	return "", false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// promptCommand is a command of the interactive prompt.
+type promptCommand struct {
+	name string
+	// args is the usage of the arguments: required ones in angle brackets,
+	// optional ones in square brackets.
+	args string
+	help string
+}
+
+// promptCommands are the commands of the interactive prompt, as listed by
+// /help and completed with Tab.
+var promptCommands = []promptCommand{
+	{name: "/help", help: "list the commands"},
+	{name: "/quit", help: "end the session"},
+	{name: "/exit", help: "end the session"},
+	{name: "/newstream", help: "continue on a new stream"},
+	{name: "/uni", args: "<msg>", help: "echo msg over a pair of unidirectional streams"},
+	{name: "/ping", args: "[count]", help: "compare the round trip of datagrams with the transport RTT"},
+	{name: "/migrate", args: "[addr]", help: "move the connection to a new local UDP socket, bound to addr if given"},
+	{name: "/stats", help: "print the state and statistics of the connection"},
+	{name: "/hist", help: "print the percentiles of the echo round trips so far"},
+	{name: "/hex", help: "toggle hex mode: send lines of hex digits as bytes and print echoes as hex dumps"},
+	{name: "/datagram", args: "<msg>", help: "send msg in an unreliable QUIC datagram"},
+	{name: "/send", args: "<path>", help: "upload a file to the server's transfer directory"},
+	{name: "/recv", args: "<name>", help: "download a file from the server's transfer directory"},
+}
+
+// usage returns the command with the usage of its arguments.
+func (c promptCommand) usage() string {
+	if c.args == "" {
+		return c.name
+	}
+	return c.name + " " + c.args
+}
+
+// commandNames returns the names of the prompt commands separated by " | ".
+func commandNames() string {
+	names := make([]string, len(promptCommands))
+	for i, c := range promptCommands {
+		names[i] = c.name
+	}
+	return strings.Join(names, " | ")
+}
+
+// checkCommand checks that cmd, a prompt line starting with a slash, is a
+// known command with the arguments it needs.
+func checkCommand(cmd string) error {
+	name, arg, _ := strings.Cut(cmd, " ")
+	arg = strings.TrimSpace(arg)
+	for _, c := range promptCommands {
+		if c.name != name {
+			continue
+		}
+		if (arg == "" && strings.HasPrefix(c.args, "<")) || (arg != "" && c.args == "") {
+			return fmt.Errorf("usage: %s", c.usage())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %s, /help lists the commands; start a message with // to send it with a leading slash", name)
+}
+
+// messageText returns the message a prompt line sends: the line itself, or
+// for a line starting with "//", the line with the first slash removed.
+func messageText(line string) string {
+	if strings.HasPrefix(strings.TrimSpace(line), "//") {
+		return strings.Replace(line, "/", "", 1)
+	}
+	return line
+}
+
+// completeCommand returns the prompt commands whose names start with
+// prefix.
+func completeCommand(prefix string) []string {
+	var names []string
+	for _, c := range promptCommands {
+		if strings.HasPrefix(c.name, prefix) {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// message returns the payload a prompt line sends: the line, see
+// messageText, or in hex mode the bytes its hex digits spell, which may be
+// separated by white space. Without end-to-end encryption, binary framing
+// or compression, these must not include a newline.
+func (p *prompt) message(line string) ([]byte, error) {
+	if !p.hex {
+		return []byte(messageText(line)), nil
+	}
+	digits := strings.Join(strings.Fields(line), "")
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("hex mode: %w", err)
+	}
+	if !p.negotiated.e2e && !p.negotiated.binary && !p.negotiated.compress && bytes.IndexByte(b, '\n') >= 0 {
+		// Only sealed, length-prefixed or compressed messages may contain
+		// the byte that ends lines.
+		return nil, errors.New("hex mode: 0a, a newline, can only be sent with -e2e, -binary or -compress")
+	}
+	return b, nil
+}
+
+// printHexEcho prints echo as a hex dump.
+func printHexEcho(echo string) {
+	if echo == "" {
+		fmt.Println("echo: (empty)")
+		return
+	}
+	fmt.Print("echo:\n", hex.Dump([]byte(echo)))
+}
+
+// printHelp lists the prompt commands.
+func printHelp(jsonOut bool) {
+	if jsonOut {
+		usages := make([]string, len(promptCommands))
+		for i, c := range promptCommands {
+			usages[i] = c.usage()
+		}
+		printRecord(opRecord{Op: "help", StreamID: -1, Commands: usages})
+		return
+	}
+	fmt.Println("commands:")
+	for _, c := range promptCommands {
+		fmt.Printf("  %-18s %s\n", c.usage(), c.help)
+	}
+	fmt.Printf("  %-18s %s\n", "//<msg>", "echo /msg, a message that starts with a slash")
+	fmt.Println("other lines are echoed on the current stream")
+}
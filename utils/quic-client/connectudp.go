@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// maxUDPPayload is the largest UDP payload relayed.
+const maxUDPPayload = 65527
+
+// runConnectUDP asks the server at addr to proxy UDP to target with
+// CONNECT-UDP (RFC 9298) and relays between the proxied flow and a local UDP
+// socket bound to listen: datagrams received on the socket are sent to
+// target, and its replies go back to whoever sent to the socket last. The
+// request carries token, if it is not empty. It runs until ctx is canceled
+// or the proxy ends the flow.
+func runConnectUDP(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, target, listen string) error {
+	local, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer func() { _ = local.Close() }()
+
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, http3.NextProtoH3), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	logger = logger.With("component", "connect-udp", "target", target)
+
+	rs, err := openConnectUDP(ctx, conn, addr, token, target)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer func() { _ = rs.Close() }()
+	logger.Info("relaying", "listen", local.LocalAddr().String(), "proxy", addr)
+
+	var peer atomic.Pointer[net.Addr]
+	go func() {
+		buf := make([]byte, 1+maxUDPPayload)
+		for {
+			// The leading zero is context ID 0.
+			n, from, err := local.ReadFrom(buf[1:])
+			if err != nil {
+				return
+			}
+			peer.Store(&from)
+			if err := rs.SendDatagram(buf[:1+n]); err != nil {
+				logger.Debug("datagram dropped", "bytes", n, "err", err)
+			}
+		}
+	}()
+
+	var relayed int64
+	defer func() { logger.Info("relay done", "down_datagrams", relayed) }()
+	for {
+		p, err := rs.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("receive datagram: %w", err)
+		}
+		id, n, err := quicvarint.Parse(p)
+		if err != nil || id != 0 {
+			continue
+		}
+		to := peer.Load()
+		if to == nil {
+			continue
+		}
+		if _, err := local.WriteTo(p[n:], *to); err != nil {
+			logger.Debug("send to local peer", "err", err)
+			continue
+		}
+		relayed++
+	}
+}
+
+// openConnectUDP asks the proxy at addr, to which conn is an HTTP/3
+// connection, to proxy UDP to target, a host and port, with CONNECT-UDP and
+// returns the request stream of the flow. Its datagrams carry the UDP
+// payloads after a context ID of 0. The request authenticates with token, a
+// bearer token, if it is not empty.
+func openConnectUDP(ctx context.Context, conn *quic.Conn, addr, token, target string) (*http3.RequestStream, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("connect-udp target: %w", err)
+	}
+	tr := &http3.Transport{EnableDatagrams: true}
+	cc := tr.NewClientConn(conn)
+	select {
+	case <-cc.ReceivedSettings():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s := cc.Settings(); !s.EnableDatagrams || !s.EnableExtendedConnect {
+		return nil, errors.New("server does not support CONNECT-UDP")
+	}
+
+	rs, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open request stream: %w", err)
+	}
+	// IPv6 addresses must be percent-encoded in the path.
+	escHost := strings.ReplaceAll(host, ":", "%3A")
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   addr,
+		Header: http.Header{"Capsule-Protocol": []string{"?1"}},
+		URL: &url.URL{
+			Scheme:  "https",
+			Host:    addr,
+			Path:    "/.well-known/masque/udp/" + host + "/" + port + "/",
+			RawPath: "/.well-known/masque/udp/" + escHost + "/" + port + "/",
+		},
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := rs.SendRequestHeader(req); err != nil {
+		_ = rs.Close()
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	rsp, err := rs.ReadResponse()
+	if err != nil {
+		_ = rs.Close()
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		_ = rs.Close()
+		return nil, fmt.Errorf("proxy refused: %s", rsp.Status)
+	}
+	return rs, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTime reports that the CPU time of the process is not known on this
+// platform.
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
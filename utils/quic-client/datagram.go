@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// datagramHeaderLen is the size of the sequence number and send offset that
+// start every probe datagram.
+const datagramHeaderLen = 16
+
+// runDatagrams sends cfg.datagrams probe datagrams at a fixed interval,
+// collects their echoes and reports loss and round-trip times.
+func runDatagrams(ctx context.Context, logger *slog.Logger, conn *quic.Conn, cfg config) error {
+	l := logger.With("component", "datagram")
+	if !conn.ConnectionState().SupportsDatagrams {
+		return errors.New("server does not support datagrams")
+	}
+	size := max(cfg.datagramSize, datagramHeaderLen)
+
+	start := time.Now()
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		rtts  []time.Duration
+		dupes int
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		seen := make([]bool, cfg.datagrams)
+		for {
+			p, err := conn.ReceiveDatagram(rctx)
+			if err != nil {
+				done <- res
+				return
+			}
+			if len(p) < datagramHeaderLen {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(p)
+			sent := time.Duration(binary.BigEndian.Uint64(p[8:]))
+			if seq >= uint64(len(seen)) {
+				continue
+			}
+			if seen[seq] {
+				res.dupes++
+				continue
+			}
+			seen[seq] = true
+			res.rtts = append(res.rtts, time.Since(start)-sent)
+		}
+	}()
+
+	l.Info("sending datagrams", "count", cfg.datagrams, "size", size, "interval", cfg.datagramInterval)
+	tick := time.NewTicker(cfg.datagramInterval)
+	defer tick.Stop()
+
+	p := make([]byte, size)
+	for seq := range cfg.datagrams {
+		binary.BigEndian.PutUint64(p, uint64(seq))
+		binary.BigEndian.PutUint64(p[8:], uint64(time.Since(start)))
+		if err := conn.SendDatagram(p); err != nil {
+			return fmt.Errorf("send datagram %d: %w", seq, err)
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Give the last echoes time to arrive before counting them as lost.
+	select {
+	case <-time.After(cfg.datagramWait):
+	case <-ctx.Done():
+	}
+	cancel()
+	res := <-done
+
+	received := len(res.rtts)
+	lost := cfg.datagrams - received
+	attrs := []any{
+		"sent", cfg.datagrams,
+		"received", received,
+		"lost", lost,
+		"loss_pct", fmt.Sprintf("%.2f", 100*float64(lost)/float64(max(cfg.datagrams, 1))),
+		"duplicates", res.dupes,
+	}
+	if received > 0 {
+		slices.Sort(res.rtts)
+		var sum time.Duration
+		for _, d := range res.rtts {
+			sum += d
+		}
+		attrs = append(attrs,
+			"rtt_min", res.rtts[0],
+			"rtt_avg", sum/time.Duration(received),
+			"rtt_p50", res.rtts[received/2],
+			"rtt_p99", res.rtts[received*99/100],
+			"rtt_max", res.rtts[received-1],
+		)
+	}
+	l.Info("datagram results", attrs...)
+	return nil
+}
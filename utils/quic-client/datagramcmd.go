@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// datagramReceiver receives the datagrams of a connection in the background
+// for the interactive prompt. Datagrams a /ping probe waits for are handed
+// to it; all others are printed as they arrive.
+type datagramReceiver struct {
+	conn    *quic.Conn
+	jsonOut bool
+
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+// newDatagramReceiver returns a receiver for conn, which must support
+// datagrams. It does nothing until run.
+func newDatagramReceiver(conn *quic.Conn, jsonOut bool) *datagramReceiver {
+	return &datagramReceiver{conn: conn, jsonOut: jsonOut, waiters: make(map[string]chan struct{})}
+}
+
+// run receives datagrams until ctx is done or the connection is closed.
+func (r *datagramReceiver) run(ctx context.Context) {
+	for {
+		p, err := r.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		ch, ok := r.waiters[string(p)]
+		delete(r.waiters, string(p))
+		r.mu.Unlock()
+		if ok {
+			close(ch)
+			continue
+		}
+		if r.jsonOut {
+			echo := string(p)
+			printRecord(opRecord{Op: "datagram", StreamID: -1, Echoed: len(p), Echo: &echo})
+			continue
+		}
+		fmt.Printf("\ndatagram: %s\n", p)
+	}
+}
+
+// expect returns a channel that is closed when a datagram equal to p
+// arrives, instead of printing it. Call the returned function to stop
+// waiting.
+func (r *datagramReceiver) expect(p []byte) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	key := string(p)
+	r.mu.Lock()
+	r.waiters[key] = ch
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		if r.waiters[key] == ch {
+			delete(r.waiters, key)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// sendDatagram sends msg in a datagram for the /datagram command. The echo,
+// if any, is printed by recv, which is nil if the server does not support
+// datagrams. Errors that leave the connection usable are only logged.
+func sendDatagram(logger *slog.Logger, conn *quic.Conn, recv *datagramReceiver, msg string, jsonOut bool) error {
+	err := errors.New("server does not support datagrams")
+	if recv != nil {
+		err = conn.SendDatagram([]byte(msg))
+		var tooLarge *quic.DatagramTooLargeError
+		if err != nil && !errors.As(err, &tooLarge) {
+			return fmt.Errorf("send datagram: %w", err)
+		}
+	}
+	if err != nil {
+		logger.Warn("datagram not sent", "bytes", len(msg), "err", err)
+		if jsonOut {
+			printRecord(opRecord{Op: "datagram", StreamID: -1, Sent: len(msg), Error: err.Error()})
+		}
+	}
+	return nil
+}
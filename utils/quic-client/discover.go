@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/mdns"
+)
+
+// runDiscover browses the local network for servers advertised via
+// mDNS/DNS-SD for timeout and prints one line per server: its name, the
+// addresses to connect to and its protocols. It fails if none is found.
+func runDiscover(ctx context.Context, logger *slog.Logger, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Debug("browsing", "component", "mdns", "service", mdns.ServiceType, "timeout", timeout)
+	insts, err := mdns.Browse(ctx, mdns.ServiceType)
+	if err != nil {
+		return fmt.Errorf("browse: %w", err)
+	}
+	if len(insts) == 0 {
+		return errors.New("no servers found")
+	}
+	for _, inst := range insts {
+		alpn, _ := inst.Lookup("alpn")
+		for _, a := range inst.Addrs {
+			fmt.Printf("%s\t%s\talpn=%s\n", inst.Name, net.JoinHostPort(a.String(), strconv.Itoa(int(inst.Port))), alpn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Failover policies of -failover: the order in which the dialer tries the
+// addresses of the server.
+const (
+	// failoverPriority tries the addresses in order, so that the client
+	// returns to the first one as soon as it is reachable again.
+	failoverPriority = "priority"
+	// failoverRoundRobin starts with the address after the one last
+	// connected to, so that a lost connection moves on to the next one.
+	failoverRoundRobin = "round-robin"
+)
+
+// parseServers parses the comma-separated host:port addresses of -servers.
+func parseServers(list string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("server address %q: %w", addr, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no server addresses in %q", list)
+	}
+	return addrs, nil
+}
+
+// order returns the addresses of the server in the order to try them under
+// the -failover policy.
+func (d *dialer) order() []string {
+	if d.cfg.failover != failoverRoundRobin {
+		return d.addrs
+	}
+	for i, addr := range d.addrs {
+		if addr == d.addr {
+			next := i + 1
+			return append(slices.Clone(d.addrs[next:]), d.addrs[:next]...)
+		}
+	}
+	return d.addrs
+}
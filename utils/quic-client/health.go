@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// alpnHealth is the ALPN identifier of the server's health-check protocol.
+// It must match the server's.
+const alpnHealth = "quic-health"
+
+// runHealth performs one health check against addr: it sends "PING" on a
+// fresh connection and prints the server's status line. It fails if the
+// server does not answer with "PONG" within timeout.
+func runHealth(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, alpnHealth), nil)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = st.SetDeadline(deadline)
+	}
+	if _, err := st.Write([]byte("PING\n")); err != nil {
+		return fmt.Errorf("write ping: %w", err)
+	}
+	_ = st.Close()
+
+	b, err := bufio.NewReaderSize(st, 512).ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+	line := strings.TrimSpace(string(b))
+	fmt.Println(line)
+	if !strings.HasPrefix(line, "PONG ") {
+		return fmt.Errorf("unhealthy: %s", line)
+	}
+	logger.Info("healthy", "rtt", time.Since(start))
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// histSubBits sets the precision of rttHist: every power of two range of
+// values is split into 2^histSubBits buckets, which keeps recorded values
+// within 1/2^histSubBits (under 1%) of the true ones, as in an HDR
+// histogram with two significant digits.
+const histSubBits = 7
+
+// rttHist is a log-linear histogram of round-trip times in the manner of
+// an HDR histogram: constant relative precision over any range of values,
+// in memory that grows with the logarithm of the largest one.
+type rttHist struct {
+	counts   []uint64
+	total    uint64
+	min, max time.Duration
+}
+
+// record adds the round-trip time d to h.
+func (h *rttHist) record(d time.Duration) {
+	d = max(d, 0)
+	i := histIndex(uint64(d))
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.total++
+}
+
+// quantile returns the round-trip time that the fraction q of the recorded
+// ones do not exceed, or 0 if none were recorded.
+func (h *rttHist) quantile(q float64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if c > 0 && seen >= max(rank, 1) {
+			return min(time.Duration(histUpper(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// histIndex returns the index of the bucket holding v. Values below
+// 2^histSubBits get a bucket each; above, every power of two range of
+// values shares 2^histSubBits buckets.
+func histIndex(v uint64) int {
+	const sub = 1 << histSubBits
+	if v < sub {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histSubBits - 1
+	return (shift+1)*sub + int(v>>shift) - sub
+}
+
+// histUpper returns the largest value of the bucket with index i.
+func histUpper(i int) uint64 {
+	const sub = 1 << histSubBits
+	if i < sub {
+		return uint64(i)
+	}
+	shift := i/sub - 1
+	m := uint64(i%sub + sub)
+	return (m+1)<<shift - 1
+}
+
+// histSummary is the summary of an rttHist printed by /hist and at exit, in
+// milliseconds.
+type histSummary struct {
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p99_9"`
+	Max   float64 `json:"max"`
+}
+
+// summary returns the count, extremes and percentiles of the round-trip
+// times recorded in h.
+func (h *rttHist) summary() *histSummary {
+	return &histSummary{
+		Count: h.total,
+		Min:   ms(h.min),
+		P50:   ms(h.quantile(0.50)),
+		P90:   ms(h.quantile(0.90)),
+		P99:   ms(h.quantile(0.99)),
+		P999:  ms(h.quantile(0.999)),
+		Max:   ms(h.max),
+	}
+}
+
+// printHist prints the summary of the round-trip times recorded in h.
+func printHist(h *rttHist, jsonOut bool) {
+	s := h.summary()
+	if jsonOut {
+		printRecord(opRecord{Op: "hist", StreamID: -1, Hist: s})
+		return
+	}
+	if s.Count == 0 {
+		fmt.Println("rtt: no round trips yet")
+		return
+	}
+	fmt.Printf("rtt of %d round trips: min %.3f, p50 %.3f, p90 %.3f, p99 %.3f, p99.9 %.3f, max %.3f ms\n",
+		s.Count, s.Min, s.P50, s.P90, s.P99, s.P999, s.Max)
+}
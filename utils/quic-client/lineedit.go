@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// historyMax is the number of lines of prompt history kept, in memory and
+// in the history file.
+const historyMax = 1000
+
+// lineInput reads the lines of the interactive prompt.
+type lineInput interface {
+	// readLine shows prompt, if not empty, and returns the next line. At the
+	// end of the input it returns io.EOF.
+	readLine(prompt string) (string, error)
+	// output returns the writer through which output reaches the screen
+	// without disturbing the line being edited, or nil if the input is not
+	// a terminal.
+	output() io.Writer
+	// close releases the input and saves its history.
+	close() error
+}
+
+// newLineInput returns a line editor on the terminal if both stdin and
+// stdout are one, with the history kept in historyPath unless it is empty.
+// Otherwise, e.g. when stdin is a pipe, it returns plain line reading.
+// Tab completes the words at the start of a line with complete.
+//
+// The editor takes os.Stdout over, so that what the client prints while a
+// line is edited is printed above it: close gives it back.
+func newLineInput(historyPath string, complete func(prefix string) []string, logger *slog.Logger) lineInput {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return &scannerInput{s: bufio.NewScanner(os.Stdin)}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		logger.Warn("line editing disabled", "component", "prompt", "err", err)
+		return &scannerInput{s: bufio.NewScanner(os.Stdin)}
+	}
+
+	hist := loadHistory(historyPath, logger)
+	t := term.NewTerminal(stdio{Reader: os.Stdin, Writer: os.Stdout}, "")
+	t.History = hist
+	in := &termInput{fd: fd, sizeFd: int(os.Stdout.Fd()), term: t, hist: hist, stdout: os.Stdout, pipeW: w}
+	t.AutoCompleteCallback = completer(complete, func(s string) {
+		_, _ = io.WriteString(t, s+"\n")
+	})
+	os.Stdout = w
+	in.copied.Add(1)
+	go func() {
+		defer in.copied.Done()
+		_, _ = io.Copy(t, r)
+		_ = r.Close()
+	}()
+	return in
+}
+
+// scannerInput reads plain lines from stdin.
+type scannerInput struct {
+	s *bufio.Scanner
+}
+
+// readLine implements lineInput.
+func (in *scannerInput) readLine(prompt string) (string, error) {
+	if prompt != "" {
+		fmt.Print(prompt)
+	}
+	if !in.s.Scan() {
+		if err := in.s.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return in.s.Text(), nil
+}
+
+// output implements lineInput.
+func (in *scannerInput) output() io.Writer {
+	return nil
+}
+
+// close implements lineInput.
+func (in *scannerInput) close() error {
+	return nil
+}
+
+// stdio joins the standard input and output into the terminal a
+// [term.Terminal] runs on.
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+// termInput edits lines on a terminal with a [term.Terminal]: arrow keys,
+// emacs-style editing keys, history and Tab completion. The terminal is in
+// raw mode while a line is read, and output goes through the
+// [term.Terminal], which keeps the line being edited below it.
+type termInput struct {
+	// fd is the terminal read from, and sizeFd the one whose size the line
+	// is laid out for.
+	fd, sizeFd int
+	term       *term.Terminal
+	hist       *history
+
+	// stdout is os.Stdout as it was, and pipeW the pipe that replaces it,
+	// copied to term.
+	stdout, pipeW *os.File
+	copied        sync.WaitGroup
+}
+
+// readLine implements lineInput.
+func (in *termInput) readLine(prompt string) (string, error) {
+	state, err := term.MakeRaw(in.fd)
+	if err != nil {
+		return "", fmt.Errorf("raw terminal: %w", err)
+	}
+	defer func() { _ = term.Restore(in.fd, state) }()
+
+	if w, h, err := term.GetSize(in.sizeFd); err == nil {
+		_ = in.term.SetSize(w, h)
+	}
+	in.term.SetPrompt(prompt)
+	line, err := in.term.ReadLine()
+	if errors.Is(err, term.ErrPasteIndicator) {
+		// A pasted line is a line like any other.
+		err = nil
+	}
+	return line, err
+}
+
+// output implements lineInput.
+func (in *termInput) output() io.Writer {
+	return in.term
+}
+
+// close implements lineInput, giving os.Stdout back.
+func (in *termInput) close() error {
+	os.Stdout = in.stdout
+	_ = in.pipeW.Close()
+	in.copied.Wait()
+	return in.hist.close()
+}
+
+// completer returns a [term.Terminal] AutoCompleteCallback that completes
+// the word before the cursor with complete if it starts the line: as far as
+// all completions agree, or, if that adds nothing, by showing them with
+// notice.
+func completer(complete func(prefix string) []string, notice func(s string)) func(line string, pos int, key rune) (string, int, bool) {
+	return func(line string, pos int, key rune) (string, int, bool) {
+		prefix := line[:pos]
+		if key != '\t' || complete == nil || strings.ContainsFunc(prefix, unicode.IsSpace) {
+			return "", 0, false
+		}
+		words := complete(prefix)
+		if len(words) == 0 {
+			return "", 0, false
+		}
+		common := words[0]
+		for _, w := range words[1:] {
+			for !strings.HasPrefix(w, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		if len(words) == 1 {
+			common += " "
+		}
+		if common == prefix {
+			notice(strings.Join(words, "  "))
+			return line, pos, true
+		}
+		return common + line[pos:], len(common), true
+	}
+}
+
+// history is the list of lines entered at the prompt, oldest first. If it
+// has a file, lines are appended to it as they are entered, so that later
+// sessions can recall them. It implements [term.History].
+type history struct {
+	lines  []string
+	f      *os.File
+	logger *slog.Logger
+}
+
+// loadHistory returns the history kept in the file at path, or an empty one
+// without a file if path is empty. A file longer than historyMax lines is
+// cut down to the newest ones first. Problems with the file are logged, and
+// leave the history in memory only.
+func loadHistory(path string, logger *slog.Logger) *history {
+	h := &history{logger: logger.With("component", "prompt")}
+	if path == "" {
+		return h
+	}
+	l := h.logger.With("path", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.Warn("read history failed", "err", err)
+		return h
+	}
+	if s := strings.TrimSuffix(string(data), "\n"); s != "" {
+		h.lines = strings.Split(s, "\n")
+	}
+	if len(h.lines) > historyMax {
+		h.lines = h.lines[len(h.lines)-historyMax:]
+		if err := rewriteHistory(path, h.lines); err != nil {
+			l.Warn("trim history failed", "err", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		l.Warn("create history directory failed", "err", err)
+		return h
+	}
+	// The history holds the messages sent, so it is private.
+	if h.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+		l.Warn("open history failed", "err", err)
+	}
+	l.Debug("history loaded", "lines", len(h.lines))
+	return h
+}
+
+// Add implements [term.History], appending line to the history unless it
+// is blank or repeats the previous line.
+func (h *history) Add(line string) {
+	if strings.TrimSpace(line) == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > historyMax {
+		h.lines = h.lines[1:]
+	}
+	if h.f == nil {
+		return
+	}
+	if _, err := io.WriteString(h.f, line+"\n"); err != nil {
+		h.logger.Warn("write history failed", "err", err)
+		_ = h.f.Close()
+		h.f = nil
+	}
+}
+
+// Len implements [term.History].
+func (h *history) Len() int {
+	return len(h.lines)
+}
+
+// At implements [term.History]: 0 is the newest line.
+func (h *history) At(i int) string {
+	return h.lines[len(h.lines)-1-i]
+}
+
+// close closes the history file.
+func (h *history) close() error {
+	if h.f == nil {
+		return nil
+	}
+	return h.f.Close()
+}
+
+// rewriteHistory atomically replaces the history file at path with lines.
+func rewriteHistory(path string, lines []string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = io.WriteString(f, strings.Join(lines, "\n")+"\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// defaultHistoryFile returns the default path of the prompt history in the
+// user's cache directory, or "" if there is none.
+func defaultHistoryFile() string {
+	return userCacheFile("history")
+}
@@ -1,49 +1,378 @@
 // Command quic-echo-client runs an interactive QUIC echo client over UDP.
 //
 // The client connects to a QUIC echo server, opens a stream, and then sends
-// user-provided lines and prints the echoed response. It supports basic
-// commands to quit or open a new stream, and it stops gracefully on SIGINT/SIGTERM.
+// user-provided lines and prints the echoed response. Lines starting with a
+// slash are commands, listed by /help, such as those to quit or open a new
+// stream; a message that starts with a slash is written with two. The client
+// stops gracefully on SIGINT/SIGTERM.
+//
+// The /ping command reports the transport RTT quic-go measures next to the
+// round trip of a datagram echo, to tell network latency from the server's,
+// and /stats prints the connection's state and statistics. /hist prints the
+// percentiles of the echo round trips so far, which are also printed on
+// exit.
+//
+// /hex switches to sending the bytes spelled by lines of hex digits, and
+// printing echoes as hex dumps, to exercise binary payloads. With -binary,
+// messages are length-prefixed over the server's echo-bin protocol, so that
+// they may hold newlines too, as they may with -compress, which offers zstd
+// compression of the messages to the server; /stats then shows the
+// compression ratio.
+//
+// /datagram sends a message in an unreliable QUIC datagram; datagrams from
+// the server are printed as they arrive.
+//
+// /migrate moves the connection to a new local UDP socket once the server
+// validated the path from it, to demonstrate and test QUIC connection
+// migration.
+//
+// /send and /recv upload a file to and download one from the server's
+// transfer directory, verified by SHA-256, with progress output. Interrupted
+// transfers resume where they stopped, automatically or when repeated.
+//
+// On a terminal the prompt edits lines with golang.org/x/term: arrow keys,
+// emacs-style editing keys, history and Tab completion of commands. The
+// history is kept in -history-file across runs; set -history-file= (empty)
+// to keep none.
+//
+// With -tui the prompt runs full-screen, with panes for the lines sent, what
+// comes back, the live statistics of the connection and the log, which
+// keeps long sessions and datagram traffic easy to follow.
+//
+// -host may be a name with both IPv6 and IPv4 addresses: the client tries
+// them alternately, IPv6 first, racing a new attempt every 250ms against the
+// ones still running, and keeps the first connection established (Happy
+// Eyeballs, RFC 8305).
+//
+// With -srv the client finds the server in the DNS SRV records of a name,
+// such as _quic-echo._udp.example.com, instead of at -host and -port, for
+// deployments where the port is not fixed. The targets are tried by priority
+// and weight, each after connecting to the one before failed, and the
+// certificate of each must be valid for its host name. The modes that do not
+// speak the echo protocol, such as -bench and -socks, use the first target.
+//
+// -servers lists several addresses of the server instead, such as a UDP
+// endpoint and a bridged USB one. Like SRV targets, they are tried in turn
+// until a connection is established, when dialing and when reconnecting
+// after a connection loss. With -failover priority, the default, the first
+// address is always tried first; with -failover round-robin, the one after
+// the address that was lost. The active address is logged with every
+// connection, and a change of it as a failover. With -multipath, the client
+// uses all of them at once instead, so that a USB cable adds a path rather
+// than replacing one: it connects to every address, and sends each line
+// from stdin on the path with the lowest RTT, on all paths, or on the least
+// busy one, as the policy says. quic-go does not implement QUIC multipath,
+// so every path is a connection of its own; /paths shows them.
+//
+// The server's certificate is verified against the system roots, or the CAs
+// in -ca, and must be valid for -host. -insecure skips verification, e.g. for
+// the self-signed certificate the server generates when started without one.
+// -pin accepts a certificate by the hash of its public key instead, a secure
+// option for self-signed deployments without a CA. With -cert and -key the
+// client presents a certificate to servers that require mutual TLS.
+//
+// -sni sends another name than -host in the TLS handshake, and verifies the
+// certificate for it, to test a server's virtual hosting. -alpn offers a list
+// of ALPN protocols instead of the echo protocol, or of -pipe-protocol with
+// -pipe, to reach other handlers of a server; the one negotiated is logged.
+//
+// With -keylog, or SSLKEYLOGFILE in the environment, the TLS secrets of
+// every connection are appended to a file in NSS key log format so that
+// client-side packet captures can be decrypted in Wireshark. This is for
+// debugging only. With -qlog-dir the client writes a qlog trace of every
+// connection, named after its connection ID like the server's traces, so
+// that loss, pacing and flow control can be analyzed from both ends in qvis.
+//
+// Path MTU discovery (-pmtud) grows the packets from -initial-packet-size to
+// what the path carries, up to quic-go's limit of 1452 bytes, and its result
+// is logged, as USB framing and bridges make for unusual MTUs; the steps of
+// the search are logged at debug level. With -pmtud=false, packets stay at
+// -initial-packet-size.
+//
+// With -session-export the client saves its TLS resumption state and
+// negotiated options on exit; a replacement process started with
+// -session-import resumes from them without a full handshake.
+//
+// The client keeps the latest TLS session ticket of every server it connected
+// to in the -session-cache file, so that later runs resume their sessions.
+// Set -session-cache= (empty) to leave no trace of the servers contacted.
+// QUIC address validation tokens are only reused within the process.
+//
+// -dial-timeout bounds every connection attempt, and -handshake-timeout
+// fails a handshake when the server stops answering. -io-timeout bounds every
+// operation of the prompt, such as an echo, so that a hung server or a dead
+// link ends the session with an error naming the operation, or with
+// -reconnect moves it to a new connection, rather than blocking it.
+//
+// With -reconnect the client retries a failed connection or handshake with
+// jittered exponential backoff, and when the connection drops mid-session it
+// resumes the interactive prompt on a new one. The new connection resumes the
+// TLS session and sends its first message as 0-RTT data, if the server
+// allows it, and the client logs whether the early data was accepted.
+//
+// With -health the client performs a single health check and exits non-zero
+// if the server is not healthy. With -discover it lists the servers on the
+// local network that advertise themselves via mDNS instead of connecting.
+//
+// With -stdin the client runs non-interactively for test scripts: it sends
+// the lines piped to it, checks every echo, and exits non-zero on the first
+// mismatch or timeout.
+//
+// With -scenario the client runs a test plan from a YAML file, a sequence of
+// steps such as sending a message and expecting its echo within a timeout,
+// opening a stream, pausing, sending a datagram or asserting the connection
+// statistics, reports every step and exits non-zero on the first failure,
+// for reproducible protocol regression tests.
+//
+// With -soak the client keeps a connection busy with an echo every
+// -soak-echo-interval for the given duration, reconnecting whenever it is
+// lost, and logs rolling statistics every -soak-interval. Failed echoes,
+// path changes, packet loss spikes and reconnects are logged as disruptions,
+// and the client exits non-zero if there were any, for validating the
+// stability of a link over hours or days.
+//
+// With -pipe the client copies stdin to a stream and the stream to stdout as
+// raw bytes, like netcat, so that binary data and throughput tests such as
+// "pv /dev/zero | quic-echo-client -pipe -pipe-protocol discard" run through
+// QUIC.
+//
+// -rate paces what the echo modes, -pipe and the uploads of -bench write to
+// a steady number of bytes per second, with a token bucket, to observe how the
+// server, flow control and the link behave under a controlled load rather
+// than bursts. Round trips then include the time an echo waited to be sent.
+//
+// With -output json the echo modes print one JSON object per operation to
+// stdout, with the bytes sent and echoed, the round-trip time, the stream ID
+// and any error, for automation to parse.
+//
+// With -datagrams the client sends QUIC datagrams instead and reports how many
+// echoes were lost and their round-trip times.
+//
+// With -pubsub the client speaks the server's pub/sub protocol instead:
+// commands typed at the prompt subscribe to and publish on topics, and
+// messages on subscribed topics are printed as they arrive. With -rpc it
+// calls the example services of the server's rpc protocol: lines typed at
+// the prompt go to the Echo service, and /stats asks the Stats service for
+// the server's view of the connection.
+//
+// With -socks the client is a SOCKS5 proxy: every TCP connection it accepts
+// is carried over a stream to the server, which dials the target.
+//
+// With -udp-forward the client forwards UDP packets from a local socket in
+// QUIC datagrams to the target of the server's udp protocol, e.g. for
+// WireGuard or game traffic.
+//
+// With -reverse-to the client serves the server's reverse tunnel, for
+// devices that cannot accept inbound connections: it connects out, and every
+// connection accepted on the server's reverse listener is relayed to the
+// given local target.
+//
+// With -connect-udp the client relays a local UDP socket to a target
+// through the server's CONNECT-UDP proxy.
+//
+// With -proxy the connections of the echo prompt are tunneled through a
+// CONNECT-UDP proxy, for networks that only let UDP through to the proxy:
+// the client connects to the proxy over HTTP/3, asks it for a UDP flow to
+// the server and sends the packets of its connection to the server in the
+// datagrams of the flow. Its packets start at 1200 bytes, which the
+// datagrams of any proxy connection carry, and path MTU discovery finds out
+// how large they may grow. /migrate does not apply to tunneled connections.
+//
+// With -bench the client measures the goodput the link sustains, uploading
+// to the server's discard protocol, downloading from its chargen protocol or
+// both at once on parallel streams, and reports it with the client's CPU
+// use, without external tools. With -bench-perf it runs over the server's
+// perf protocol instead, which agrees on the test with the server and
+// reports the goodput as measured where the data arrived, so that client
+// and server report the same figures.
+//
+// With -streams the client opens several streams and echoes traffic on all
+// of them at once to exercise stream multiplexing, reporting the results of
+// every stream and in aggregate.
+//
+// With -torture the client instead runs a non-interactive test that splits
+// writes at adversarial boundaries and verifies that every echo is byte-exact.
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"os"
-	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	quic "github.com/quic-go/quic-go"
-)
 
-// alpn is the Application-Layer Protocol Negotiation identifier required by the server.
-const alpn = "quic-echo"
+	"github.com/romanov9617/usb-quic/pkg/cmdutil"
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
 
 // config holds command-line configuration for the client.
 type config struct {
-	host string
-	port int
+	host         string
+	port         int
+	srv          string
+	servers      string
+	failover     string
+	multipath    string
+	sni          string
+	alpn         string
+	quicVersions string
+	ecn          bool
+	gso          bool
+	pmtud        bool
+	packetSize   int
+
+	// rate is -rate, and pace the pacer for it, shared by all streams.
+	rate byteRate
+	pace *pacer
+
+	keepAlive        time.Duration
+	idleTimeout      time.Duration
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	ioTimeout        time.Duration
+
+	initialStreamWindow uint64
+	maxStreamWindow     uint64
+	initialConnWindow   uint64
+	maxConnWindow       uint64
+
+	failAtStreamLimit bool
+	authTokenFile     string
+
+	caFile   string
+	pins     []string
+	insecure bool
+	certFile string
+	keyFile  string
+	keyLog   string
+
+	maxMsg   int
+	e2e      bool
+	binary   bool
+	compress bool
+
+	// e2ePSKFile is -e2e-psk-file, and e2ePSK the key read from it.
+	e2ePSKFile string
+	e2ePSK     []byte
+
+	logLevel  slog.Level
+	logFormat string
+	output    string
+	pprofAddr string
+	qlogDir   string
+
+	sessionImport string
+	sessionExport string
+	sessionCache  string
+	historyFile   string
+	early         bool
+
+	reconnect         bool
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+	reconnectAttempts int
+
+	health        bool
+	healthTimeout time.Duration
+
+	discover        bool
+	discoverTimeout time.Duration
+
+	pubsub bool
+	rpc    bool
+	tui    bool
+
+	stdin        bool
+	stdinTimeout time.Duration
+
+	scenario string
+
+	soak             time.Duration
+	soakInterval     time.Duration
+	soakEchoInterval time.Duration
+
+	pipe         bool
+	pipeProtocol string
+
+	connectUDP string
+	udpListen  string
+	proxy      string
+
+	socks      string
+	udpForward string
+	reverseTo  string
+
+	datagrams        int
+	datagramSize     int
+	datagramInterval time.Duration
+	datagramWait     time.Duration
+
+	streams         int
+	streamsMessages int
+	streamsSize     int
+
+	bench          bool
+	benchSize      int
+	benchDuration  time.Duration
+	benchDirection string
+	benchStreams   int
+	benchPerf      bool
+
+	torture       bool
+	tortureSize   int
+	tortureRounds int
+	tortureSeed   int64
 }
 
+// errAuthRejected reports that the server closed the connection because
+// the authentication token is invalid or missing.
+var errAuthRejected = errors.New("server rejected the authentication token")
+
 // main parses flags, configures logging, and runs the interactive client.
 // It exits with a non-zero status on fatal errors.
 func main() {
 	cfg := parseFlags()
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	// With -pipe and -output json, stdout carries the stream's bytes and
+	// the records only.
+	logOut := os.Stdout
+	if cfg.pipe || cfg.output == outputJSON {
+		logOut = os.Stderr
+	}
+	h, err := cmdutil.NewLogHandler(logOut, cfg.logFormat, &slog.HandlerOptions{Level: cfg.logLevel})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := slog.New(h)
 	slog.SetDefault(logger)
 
 	if err := run(context.Background(), logger, cfg); err != nil {
-		logger.Error("fatal", "err", err)
+		attrs := []any{"err", err}
+		if reason, ok := errcode.Describe(err); ok {
+			attrs = append(attrs, "reason", reason)
+		}
+		if hint, ok := clientCertHint(err, cfg.certFile != ""); ok {
+			attrs = append(attrs, "hint", hint)
+		}
+		if cfg.output == outputJSON {
+			printRecord(opRecord{Op: "fatal", StreamID: -1, Error: err.Error()})
+		}
+		logger.Error("fatal", attrs...)
 		os.Exit(1)
 	}
 }
@@ -52,8 +381,113 @@ func main() {
 func parseFlags() config {
 	var cfg config
 
-	flag.StringVar(&cfg.host, "host", "127.0.0.1", "QUIC server host or IP")
+	flag.StringVar(&cfg.srv, "srv", "", "Find the server in the SRV records of this name, e.g. _quic-echo._udp.example.com, instead of at -host and -port, failing over from target to target by priority and weight")
+	flag.StringVar(&cfg.servers, "servers", "", "Comma-separated host:port addresses of the server, e.g. a UDP and a bridged USB endpoint, to try in the order of -failover instead of -host and -port")
+	flag.StringVar(&cfg.multipath, "multipath", "", "Use all addresses of -servers at once, a connection each, sending every line from stdin by this policy: lowest-rtt, redundant (on all, first echo wins) or aggregate (on the least busy)")
+	flag.StringVar(&cfg.failover, "failover", failoverPriority, "Order in which to try the addresses of -servers or -srv: priority (always from the first, returning to it when it is back) or round-robin (from the one after the last connected)")
+	flag.StringVar(&cfg.sni, "sni", "", "Server name to send in the TLS SNI extension and verify the certificate for, e.g. to test virtual hosting (default -host, the SRV target or the -servers host)")
+	flag.StringVar(&cfg.alpn, "alpn", "", "Comma-separated ALPN protocols to offer instead of the echo protocol, or the -pipe-protocol of -pipe, in order of preference, e.g. to reach another server handler")
+	flag.StringVar(&cfg.host, "host", "127.0.0.1", "QUIC server host name or IP address; the IPv6 and IPv4 addresses of a name are raced")
 	flag.IntVar(&cfg.port, "port", 4242, "QUIC server UDP port")
+	flag.StringVar(&cfg.caFile, "ca", "", "Verify the server certificate against the CA certificates in this PEM file instead of the system roots")
+	flag.Func("pin", "Accept the server certificate only if its public key hash is this sha256:<base64> value, as logged by the server; repeat to allow several. Without -ca, a pinned self-signed certificate is accepted", func(pin string) error {
+		cfg.pins = append(cfg.pins, pin)
+		return nil
+	})
+	flag.StringVar(&cfg.certFile, "cert", "", "PEM client certificate file to present to servers that require mutual TLS")
+	flag.StringVar(&cfg.keyFile, "key", "", "PEM private key file for -cert")
+	flag.StringVar(&cfg.keyLog, "keylog", os.Getenv("SSLKEYLOGFILE"), "Append TLS secrets in NSS key log format to this file so captures can be decrypted, e.g. in Wireshark; debugging only (default $SSLKEYLOGFILE)")
+	flag.BoolVar(&cfg.insecure, "insecure", false, "Skip server certificate verification, e.g. for the server's generated self-signed certificate; local development only")
+	flag.StringVar(&cfg.quicVersions, "quic-versions", "v1,v2", "Comma-separated QUIC versions to offer, in order of preference: v1, v2")
+	flag.DurationVar(&cfg.keepAlive, "keep-alive", 10*time.Second, "Send keep-alive PINGs this often on an idle connection (0 = never)")
+	flag.DurationVar(&cfg.idleTimeout, "idle-timeout", 0, "Close the connection after it is idle for this long (0 = quic-go default, 30s); the server's lower value wins")
+	flag.TextVar(&cfg.rate, "rate", byteRate(0), "Pace writes to streams to this many bytes per second in total, with a k, M or G suffix for thousands, millions or billions, for a steady load instead of bursts (0 = unpaced)")
+	flag.DurationVar(&cfg.dialTimeout, "dial-timeout", 10*time.Second, "Give up on a connection attempt of the echo prompt after this long, handshake included (0 = never)")
+	flag.DurationVar(&cfg.handshakeTimeout, "handshake-timeout", 0, "Fail the handshake when the server does not answer for this long (0 = quic-go default, 5s)")
+	flag.DurationVar(&cfg.ioTimeout, "io-timeout", 30*time.Second, "Fail an operation of the echo prompt, such as opening a stream or an echo, that does not complete within this long (0 = never)")
+	flag.Uint64Var(&cfg.initialStreamWindow, "initial-stream-window", 0, "Initial per-stream receive window in bytes (0 = quic-go default, 512 KiB)")
+	flag.Uint64Var(&cfg.maxStreamWindow, "max-stream-window", 0, "Maximum per-stream receive window in bytes the window may grow to (0 = quic-go default, 6 MiB)")
+	flag.Uint64Var(&cfg.initialConnWindow, "initial-conn-window", 0, "Initial connection receive window in bytes (0 = quic-go default, 768 KiB)")
+	flag.Uint64Var(&cfg.maxConnWindow, "max-conn-window", 0, "Maximum connection receive window in bytes the window may grow to (0 = quic-go default, 15 MiB)")
+	flag.BoolVar(&cfg.ecn, "ecn", true, "Use ECN on the UDP socket; disable on paths that mangle ECN bits")
+	flag.BoolVar(&cfg.gso, "gso", true, "Use generic segmentation offload (GSO) on the UDP socket where the kernel supports it")
+	flag.BoolVar(&cfg.pmtud, "pmtud", true, "Discover the path MTU (DPLPMTUD, RFC 8899) to send packets of up to 1452 bytes, and log what it finds; disable on paths that silently drop large packets")
+	flag.IntVar(&cfg.packetSize, "initial-packet-size", 0, "Size in bytes of the first packets, 1200 to 1452, and without -pmtud of all of them (0 = quic-go default, 1280)")
+	flag.BoolVar(&cfg.failAtStreamLimit, "fail-at-stream-limit", false, "Report the server's stream limit being reached instead of waiting for it to be raised")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.logFormat, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&cfg.output, "output", outputText, "Output format of the echo modes: text (prompts) or json (one object per operation on stdout, logs on stderr)")
+	flag.StringVar(&cfg.authTokenFile, "auth-token-file", "", "Authenticate with the token in this file, for servers that require one")
+	flag.StringVar(&cfg.qlogDir, "qlog-dir", "", "Directory for per-connection qlog files (disabled if empty)")
+	flag.StringVar(&cfg.pprofAddr, "pprof-addr", "", "Serve net/http/pprof on this TCP address, e.g. localhost:6061 (disabled if empty)")
+	flag.IntVar(&cfg.maxMsg, "max-msg", 64*1024, "Maximum message (line) size in bytes to offer the server (0 = the server's)")
+	flag.BoolVar(&cfg.e2e, "e2e", false, "Encrypt messages end to end (X25519 + AES-GCM), independent of TLS")
+	flag.StringVar(&cfg.e2ePSKFile, "e2e-psk-file", "", "With -e2e, bind the keys to the pre-shared key (32 hex-encoded bytes) in this file, which the server must share; without it the key exchange is unauthenticated")
+	flag.BoolVar(&cfg.compress, "compress", false, "Offer zstd compression of messages, which pays off for text over slow links; the server may decline it")
+	flag.BoolVar(&cfg.binary, "binary", false, "Frame messages with 4-byte length prefixes instead of newlines, over the server's echo-bin protocol, which it must enable with -protocols, so that they may hold any bytes")
+	flag.StringVar(&cfg.sessionImport, "session-import", "", "Resume the session exported by a previous client process from this file")
+	flag.StringVar(&cfg.sessionExport, "session-export", "", "On exit, export session state to this file for a replacement process")
+	flag.StringVar(&cfg.historyFile, "history-file", defaultHistoryFile(), "Keep the prompt history in this file, to recall lines across runs (not kept if empty)")
+	flag.StringVar(&cfg.sessionCache, "session-cache", defaultTicketCache(), "Keep TLS session tickets in this file, to resume sessions across runs (disabled if empty)")
+	flag.BoolVar(&cfg.early, "0rtt", false, "Send the first data as 0-RTT when resuming a session, if the server accepts it")
+	flag.BoolVar(&cfg.reconnect, "reconnect", false, "When the connection or handshake fails, retry with jittered exponential backoff and resume the interactive prompt on the new connection instead of exiting")
+	flag.DurationVar(&cfg.reconnectDelay, "reconnect-delay", 500*time.Millisecond, "Delay before the first retry of -reconnect; it doubles with every further retry")
+	flag.DurationVar(&cfg.reconnectMaxDelay, "reconnect-max-delay", 30*time.Second, "Upper bound of the -reconnect delay")
+	flag.IntVar(&cfg.reconnectAttempts, "reconnect-attempts", 0, "Give up after this many failed retries in a row (0 = never)")
+
+	flag.BoolVar(&cfg.health, "health", false, "Run a single health check against the server, which must enable the health protocol with -protocols, and exit non-zero if it fails")
+	flag.DurationVar(&cfg.healthTimeout, "health-timeout", 5*time.Second, "Timeout for -health")
+
+	flag.BoolVar(&cfg.discover, "discover", false, "List the servers advertised on the local network via mDNS/DNS-SD (server -mdns) and exit")
+	flag.DurationVar(&cfg.discoverTimeout, "discover-timeout", 3*time.Second, "How long -discover waits for servers to answer")
+
+	flag.BoolVar(&cfg.tui, "tui", false, "Run the interactive prompt in a full-screen terminal UI with panes for sent and received data, live connection stats and the log")
+
+	flag.BoolVar(&cfg.stdin, "stdin", false, "Scripted mode: send every line read from stdin, check that its echo matches, and exit non-zero on the first mismatch or timeout instead of the interactive prompt")
+	flag.DurationVar(&cfg.stdinTimeout, "stdin-timeout", 5*time.Second, "How long -stdin waits for each line to be echoed")
+
+	flag.StringVar(&cfg.scenario, "scenario", "", "Run the test plan in this YAML file, a sequence of steps such as sends with their expected echoes, new streams, pauses, datagrams and assertions on the connection statistics, and exit non-zero if a step fails, instead of the interactive prompt")
+
+	flag.DurationVar(&cfg.soak, "soak", 0, "Soak test for this long, e.g. 24h: echo periodically on one connection, reconnecting whenever it is lost, log rolling stats and disruptions such as path changes, loss spikes and reconnects, and exit non-zero if there were any, instead of the interactive prompt")
+	flag.DurationVar(&cfg.soakInterval, "soak-interval", time.Minute, "How often -soak logs its rolling stats")
+	flag.DurationVar(&cfg.soakEchoInterval, "soak-echo-interval", time.Second, "How often -soak sends an echo")
+
+	flag.BoolVar(&cfg.pipe, "pipe", false, "Copy stdin to a stream and the stream to stdout as raw bytes, like netcat, instead of the interactive prompt; logs go to stderr")
+	flag.StringVar(&cfg.pipeProtocol, "pipe-protocol", "echo", "Server protocol for -pipe: echo, discard, chargen or tunnel")
+
+	flag.BoolVar(&cfg.pubsub, "pubsub", false, "Use the pub/sub protocol: send SUB, UNSUB and PUB commands from stdin and print messages on subscribed topics")
+	flag.BoolVar(&cfg.rpc, "rpc", false, "Use the rpc protocol: call the server's Echo service with every line from stdin, and its Stats service with /stats")
+
+	flag.StringVar(&cfg.connectUDP, "connect-udp", "", "Relay UDP between -udp-listen and this host:port through the server's CONNECT-UDP proxy (RFC 9298) instead of the interactive prompt")
+	flag.StringVar(&cfg.udpListen, "udp-listen", "127.0.0.1:0", "Local UDP address to relay for -connect-udp")
+	flag.StringVar(&cfg.proxy, "proxy", "", "Tunnel the connections of the echo prompt through the CONNECT-UDP proxy (RFC 9298) at this URL, quic://host:port, where UDP to the server is blocked")
+
+	flag.StringVar(&cfg.socks, "socks", "", "Serve SOCKS5 on this TCP address, e.g. 127.0.0.1:1080, forwarding every connection over a stream to the server's proxy protocol instead of the interactive prompt")
+
+	flag.StringVar(&cfg.udpForward, "udp-forward", "", "Forward the UDP packets received on this local address in QUIC datagrams to the server's udp protocol target instead of the interactive prompt")
+
+	flag.StringVar(&cfg.reverseTo, "reverse-to", "", "Serve the server's reverse tunnel: relay every connection the server's reverse listener accepts to this host:port instead of the interactive prompt")
+
+	flag.IntVar(&cfg.datagrams, "datagrams", 0, "Send this many QUIC datagrams and report echo loss and RTT instead of the interactive prompt")
+	flag.IntVar(&cfg.datagramSize, "datagram-size", 64, "Payload size in bytes of each probe datagram")
+	flag.DurationVar(&cfg.datagramInterval, "datagram-interval", 10*time.Millisecond, "Interval between probe datagrams")
+	flag.DurationVar(&cfg.datagramWait, "datagram-wait", time.Second, "How long to wait for echoes after the last datagram is sent")
+
+	flag.IntVar(&cfg.streams, "streams", 0, "Open this many streams and echo traffic on all of them concurrently, reporting per-stream and aggregate results, instead of the interactive prompt")
+	flag.IntVar(&cfg.streamsMessages, "streams-messages", 100, "Number of messages to echo on each stream of -streams")
+	flag.IntVar(&cfg.streamsSize, "streams-size", 1024, "Size in bytes of each -streams message, up to the negotiated maximum")
+
+	flag.BoolVar(&cfg.bench, "bench", false, "Measure the goodput the link sustains against the server's discard and chargen protocols, which it must enable with -protocols, and the client's CPU use, instead of the interactive prompt")
+	flag.IntVar(&cfg.benchSize, "bench-size", 64*1024, "Payload size in bytes of each -bench write or read")
+	flag.DurationVar(&cfg.benchDuration, "bench-duration", 10*time.Second, "How long -bench runs")
+	flag.StringVar(&cfg.benchDirection, "bench-direction", benchUp, "Direction of -bench: up (client to server), down (server to client) or bidi (both at once)")
+	flag.IntVar(&cfg.benchStreams, "bench-streams", 1, "Number of parallel streams per direction of -bench")
+	flag.BoolVar(&cfg.benchPerf, "bench-perf", false, "Run -bench over the server's perf protocol, which agrees on the parameters with the server and reports the goodput measured by the receiving side; bidi runs up, then down")
+
+	flag.BoolVar(&cfg.torture, "torture", false, "Run the write-splitting torture test instead of the interactive prompt")
+	flag.IntVar(&cfg.tortureSize, "torture-size", 64*1024, "Payload size in bytes for each torture case")
+	flag.IntVar(&cfg.tortureRounds, "torture-rounds", 1, "Number of times to run every torture case")
+	flag.Int64Var(&cfg.tortureSeed, "torture-seed", 1, "Seed for torture payloads and random splits")
 
 	flag.Parse()
 	return cfg
@@ -62,46 +496,519 @@ func parseFlags() config {
 // run connects to the QUIC server and starts an interactive loop that
 // sends lines and prints their echoed responses.
 func run(ctx context.Context, logger *slog.Logger, cfg config) error {
-	addr := fmt.Sprintf("%s:%d", cfg.host, cfg.port)
+	addr := net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port))
 
-	ctx, cancel := withSignals(ctx, logger)
+	ctx, cancel := cmdutil.WithSignals(ctx, logger)
 	defer cancel()
 
+	if cfg.output != outputText && cfg.output != outputJSON {
+		return fmt.Errorf("unknown output format %q", cfg.output)
+	}
+	if cfg.streams > 0 && (cfg.streamsMessages < 1 || cfg.streamsSize < 1) {
+		return errors.New("-streams-messages and -streams-size must be positive")
+	}
+	if cfg.soak < 0 || (cfg.soak > 0 && (cfg.soakInterval <= 0 || cfg.soakEchoInterval <= 0)) {
+		return errors.New("-soak must not be negative, and -soak-interval and -soak-echo-interval must be positive")
+	}
+	if (cfg.reconnect || cfg.soak > 0) && (cfg.reconnectDelay <= 0 || cfg.reconnectMaxDelay < cfg.reconnectDelay) {
+		return errors.New("-reconnect-delay must be positive and at most -reconnect-max-delay")
+	}
+	if cfg.srv != "" && cfg.servers != "" {
+		return errors.New("-srv and -servers are mutually exclusive")
+	}
+	var policy echoclient.PathPolicy
+	if cfg.multipath != "" {
+		var err error
+		if policy, err = echoclient.ParsePathPolicy(cfg.multipath); err != nil {
+			return fmt.Errorf("-multipath: %w", err)
+		}
+		if cfg.servers == "" {
+			return errors.New("-multipath requires -servers")
+		}
+	}
+	if cfg.failover != failoverPriority && cfg.failover != failoverRoundRobin {
+		return fmt.Errorf("unknown -failover policy %q: want %s or %s", cfg.failover, failoverPriority, failoverRoundRobin)
+	}
+	if cfg.dialTimeout < 0 || cfg.handshakeTimeout < 0 || cfg.ioTimeout < 0 {
+		return errors.New("-dial-timeout, -handshake-timeout and -io-timeout must not be negative")
+	}
+	cfg.pace = newPacer(cfg.rate)
+	if cfg.tui && cfg.output == outputJSON {
+		return errors.New("-tui cannot be used with -output json")
+	}
+	if cfg.bench && (cfg.benchSize < 1 || cfg.benchStreams < 1 || cfg.benchDuration <= 0) {
+		return errors.New("-bench-size, -bench-streams and -bench-duration must be positive")
+	}
+	if cfg.benchPerf && !cfg.bench {
+		return errors.New("-bench-perf requires -bench")
+	}
+	if cfg.torture && cfg.tortureSize < 0 {
+		return errors.New("-torture-size must not be negative")
+	}
+	if cfg.datagrams > 0 && cfg.datagramInterval <= 0 {
+		return errors.New("-datagram-interval must be positive")
+	}
+	if cfg.binary && cfg.e2e {
+		return errors.New("-binary cannot be used with -e2e")
+	}
+	if cfg.compress && (cfg.binary || cfg.e2e) {
+		return errors.New("-compress cannot be used with -e2e or -binary")
+	}
+	if cfg.e2ePSKFile != "" {
+		if !cfg.e2e {
+			return errors.New("-e2e-psk-file requires -e2e")
+		}
+		var err error
+		if cfg.e2ePSK, err = e2e.ReadPSK(cfg.e2ePSKFile); err != nil {
+			return fmt.Errorf("-e2e-psk-file: %w", err)
+		}
+	} else if cfg.e2e {
+		logger.Warn("end-to-end encryption without -e2e-psk-file: the key exchange is unauthenticated")
+	}
+	var proxyAddr string
+	if cfg.proxy != "" {
+		var err error
+		if proxyAddr, err = parseProxyURL(cfg.proxy); err != nil {
+			return fmt.Errorf("-proxy: %w", err)
+		}
+		if mode := nonEchoMode(cfg); mode != "" {
+			return fmt.Errorf("-proxy cannot be used with %s", mode)
+		}
+	}
+
+	if cfg.pprofAddr != "" {
+		if err := cmdutil.StartPprof(ctx, cfg.pprofAddr, logger); err != nil {
+			return fmt.Errorf("pprof: %w", err)
+		}
+	}
+
+	if cfg.discover {
+		return runDiscover(ctx, logger, cfg.discoverTimeout)
+	}
+
+	// server names the server for session import and export.
+	addrs, server, tlsHost := []string{addr}, addr, cfg.host
+	if cfg.srv != "" {
+		var err error
+		if addrs, err = lookupSRV(ctx, cfg.srv); err != nil {
+			return fmt.Errorf("look up SRV records: %w", err)
+		}
+		logger.Info("SRV records resolved", "component", "dns", "name", cfg.srv, "targets", addrs)
+		// The modes that do not speak the echo protocol use the first
+		// target. The certificate of each target is verified for its own
+		// name.
+		addr, server, tlsHost = addrs[0], cfg.srv, ""
+	}
+	if cfg.servers != "" {
+		var err error
+		if addrs, err = parseServers(cfg.servers); err != nil {
+			return err
+		}
+		addr, server, tlsHost = addrs[0], cfg.servers, ""
+	}
+	if cfg.sni != "" {
+		tlsHost = cfg.sni
+	}
+	alpns, err := parseALPNs(cfg.alpn)
+	if err != nil {
+		return err
+	}
+
+	baseTLS, err := clientTLSConfig(tlsHost, cfg.caFile, cfg.pins, cfg.insecure)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if cfg.certFile != "" || cfg.keyFile != "" {
+		if cfg.certFile == "" || cfg.keyFile == "" {
+			return errors.New("a client certificate and a key file must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return fmt.Errorf("client certificate: %w", err)
+		}
+		baseTLS.Certificates = []tls.Certificate{cert}
+		logger.Debug("client certificate loaded", "component", "tls", "cert", cfg.certFile)
+	}
+	if cfg.insecure {
+		logger.Warn("server certificate verification disabled", "component", "tls")
+	}
+	if cfg.keyLog != "" {
+		f, err := os.OpenFile(cfg.keyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("key log: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		baseTLS.KeyLogWriter = f
+		logger.Warn("TLS key logging enabled, captured traffic can be decrypted", "component", "tls", "file", cfg.keyLog)
+	}
+	if cfg.health {
+		return runHealth(ctx, logger, addr, baseTLS, cfg.healthTimeout)
+	}
+
 	logger.Info(
 		"starting interactive quic echo client",
 		"addr", addr,
 	)
 
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,           // Dev-only: accept self-signed certificates.
-		NextProtos:         []string{alpn}, // Must match the server's ALPN.
+	sessions := newExportableCache()
+	if cfg.sessionCache != "" {
+		if err := openTicketCache(cfg.sessionCache, sessions, logger.With("component", "tls")); err != nil {
+			return fmt.Errorf("open session cache: %w", err)
+		}
+	}
+	if cfg.sessionImport != "" {
+		if err := importSession(cfg.sessionImport, server, sessions, &cfg, logger); err != nil {
+			return fmt.Errorf("import session: %w", err)
+		}
 	}
 
-	conn, err := quic.DialAddr(ctx, addr, tlsConf, &quic.Config{
-		KeepAlivePeriod: 10 * time.Second,
-	})
+	versions, err := cmdutil.ParseQUICVersions(cfg.quicVersions)
 	if err != nil {
-		return fmt.Errorf("dial %s: %w", addr, err)
+		return err
+	}
+	if cfg.packetSize != 0 && (cfg.packetSize < minPacketSize || cfg.packetSize > maxPacketSize) {
+		return fmt.Errorf("-initial-packet-size must be between %d and %d", minPacketSize, maxPacketSize)
+	}
+	// quic-go only offers these switches through the environment.
+	if !cfg.ecn {
+		if err := os.Setenv("QUIC_GO_DISABLE_ECN", "true"); err != nil {
+			return fmt.Errorf("disable ECN: %w", err)
+		}
+	}
+	if !cfg.gso {
+		if err := os.Setenv("QUIC_GO_DISABLE_GSO", "true"); err != nil {
+			return fmt.Errorf("disable GSO: %w", err)
+		}
 	}
-	defer func() { _ = conn.CloseWithError(0, "bye") }()
 
-	logger.Info("connected", "remote", conn.RemoteAddr().String())
+	echoALPN := echoclient.ALPN
+	if cfg.binary {
+		echoALPN = echoclient.ALPNBinary
+	}
+	tlsConf := withALPN(baseTLS, echoALPN)
+	if alpns != nil {
+		tlsConf.NextProtos = alpns
+	}
+	tlsConf.ClientSessionCache = sessions
+
+	var token string
+	if cfg.authTokenFile != "" {
+		data, err := os.ReadFile(cfg.authTokenFile)
+		if err != nil {
+			return fmt.Errorf("auth token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	quicConf := &quic.Config{
+		Versions:                       versions,
+		KeepAlivePeriod:                cfg.keepAlive,
+		MaxIdleTimeout:                 cfg.idleTimeout,
+		HandshakeIdleTimeout:           cfg.handshakeTimeout,
+		EnableDatagrams:                true,
+		InitialStreamReceiveWindow:     cfg.initialStreamWindow,
+		MaxStreamReceiveWindow:         cfg.maxStreamWindow,
+		InitialConnectionReceiveWindow: cfg.initialConnWindow,
+		MaxConnectionReceiveWindow:     cfg.maxConnWindow,
+		InitialPacketSize:              uint16(cfg.packetSize),
+		DisablePathMTUDiscovery:        !cfg.pmtud,
+		// Lets reconnects skip the server's address validation round trip.
+		TokenStore: quic.NewLRUTokenStore(8, 4),
+	}
+	if cfg.qlogDir != "" {
+		qt, err := qlogTracer(cfg.qlogDir, logger)
+		if err != nil {
+			return fmt.Errorf("qlog: %w", err)
+		}
+		quicConf.Tracer = qt
+		logger.Info("qlog enabled", "component", "qlog", "dir", cfg.qlogDir)
+	}
+	if cfg.pmtud {
+		quicConf.Tracer = mtuTracer(quicConf.Tracer, logger)
+	}
+	if cfg.pubsub {
+		return runPubSub(ctx, logger, addr, baseTLS, quicConf, token, cfg.maxMsg)
+	}
+	if cfg.rpc {
+		return runRPC(ctx, logger, addr, baseTLS, quicConf, token)
+	}
+	if cfg.multipath != "" {
+		opts := echoclient.Options{TLSConfig: tlsConf, QUICConfig: quicConf, Token: token, Binary: cfg.binary, StreamOptions: streamOptions(cfg)}
+		return runMultipath(ctx, logger, addrs, policy, opts)
+	}
+	if cfg.pipe {
+		return runPipe(ctx, logger, addr, baseTLS, quicConf, token, cfg.pipeProtocol, alpns, cfg.pace)
+	}
+	if cfg.socks != "" {
+		return runSOCKS(ctx, logger, addr, baseTLS, quicConf, token, cfg.socks)
+	}
+	if cfg.udpForward != "" {
+		return runUDPForward(ctx, logger, addr, baseTLS, quicConf, token, cfg.udpForward)
+	}
+	if cfg.reverseTo != "" {
+		return runReverse(ctx, logger, addr, baseTLS, quicConf, token, cfg.reverseTo)
+	}
+	if cfg.connectUDP != "" {
+		return runConnectUDP(ctx, logger, addr, baseTLS, quicConf, token, cfg.connectUDP, cfg.udpListen)
+	}
+	if cfg.bench && cfg.benchPerf {
+		return runPerf(ctx, logger, addr, baseTLS, quicConf, token, cfg)
+	}
+	if cfg.bench {
+		return runBench(ctx, logger, addr, baseTLS, quicConf, token, cfg)
+	}
+
+	var sc *scenario
+	if cfg.scenario != "" {
+		if sc, err = loadScenario(cfg.scenario); err != nil {
+			return fmt.Errorf("scenario: %w", err)
+		}
+	}
 
-	st, err := conn.OpenStreamSync(ctx)
+	var proxy *upstreamProxy
+	if proxyAddr != "" {
+		// The certificate of the proxy is verified for its own name, and
+		// not pinned.
+		proxyTLS, err := clientTLSConfig("", cfg.caFile, nil, cfg.insecure)
+		if err != nil {
+			return fmt.Errorf("proxy tls: %w", err)
+		}
+		proxyTLS.KeyLogWriter = baseTLS.KeyLogWriter
+		proxy = newUpstreamProxy(proxyAddr, proxyTLS, quicConf, logger)
+		logger.Info("tunneling through proxy", "component", "proxy", "proxy", proxyAddr)
+	}
+
+	logger = logger.With("component", "conn")
+	d := &dialer{
+		addrs: addrs,
+		proxy: proxy,
+		opts: echoclient.Options{
+			TLSConfig:         tlsConf,
+			QUICConfig:        quicConf,
+			Early:             cfg.early,
+			FailAtStreamLimit: cfg.failAtStreamLimit,
+			Token:             token,
+			Binary:            cfg.binary,
+			// For /migrate.
+			ConnectionIDLength: connIDLength,
+		},
+		cfg:    cfg,
+		logger: logger,
+	}
+	client, err := d.connect(ctx)
 	if err != nil {
-		return fmt.Errorf("open stream: %w", err)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	// client is replaced when the prompt reconnects. The sockets /migrate
+	// opened go with the connection.
+	mig := new(migrator)
+	defer func() {
+		_ = client.Close()
+		mig.close()
+	}()
+	conn := client.Conn()
+
+	// negotiated tracks the options of the current stream for session export.
+	negotiated := cfg
+	if cfg.sessionExport != "" {
+		defer func() {
+			if err := exportSession(cfg.sessionExport, server, sessions, negotiated); err != nil {
+				logger.Warn("export session failed", "err", err)
+				return
+			}
+			logger.Info("session exported", "path", cfg.sessionExport)
+		}()
+	}
+
+	if cfg.torture || cfg.datagrams > 0 {
+		// These modes use the connection directly.
+		if err := client.Authenticate(ctx); err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
+	}
+	if cfg.streams > 0 {
+		return runStreams(ctx, logger, client, cfg)
+	}
+	if cfg.torture {
+		return runTorture(ctx, logger, conn, cfg)
+	}
+	if cfg.datagrams > 0 {
+		return runDatagrams(ctx, logger, conn, cfg)
+	}
+
+	jsonOut := cfg.output == outputJSON
+	// hist collects the echo round trips, summarized by /hist and on exit.
+	hist := new(rttHist)
+	defer func() {
+		if hist.total > 0 {
+			printHist(hist, jsonOut)
+		}
+	}()
+	if cfg.stdin {
+		st, err := openStream(ctx, client, streamOptions(cfg))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = st.Close() }()
+		negotiated.maxMsg, negotiated.e2e, negotiated.compress = st.MaxMsg(), st.Encrypted(), st.Compressed()
+		return runScript(ctx, logger, st, cfg.stdinTimeout, hist, jsonOut)
+	}
+	if sc != nil {
+		return runScenario(ctx, logger, client, sc, cfg, hist, jsonOut)
+	}
+	if cfg.soak > 0 {
+		return runSoak(ctx, logger, d, client, cfg, hist, jsonOut)
+	}
+
+	var input lineInput
+	var screen *tui
+	if cfg.tui {
+		if screen, err = startTUI(d.addr); err != nil {
+			return fmt.Errorf("tui: %w", err)
+		}
+		defer screen.close()
+		h, err := cmdutil.NewLogHandler(screen.logWriter(), cfg.logFormat, &slog.HandlerOptions{Level: cfg.logLevel})
+		if err != nil {
+			return err
+		}
+		logger = slog.New(h).With("component", "conn")
+		d.logger = logger
+		input = screen.lineInput(cfg.historyFile, completeCommand, logger)
+	} else {
+		input = newLineInput(cfg.historyFile, completeCommand, logger)
+		// Log lines go through the line editor too, unless they go to
+		// stderr, so that they do not break the line being edited.
+		if out := input.output(); out != nil && !jsonOut {
+			h, err := cmdutil.NewLogHandler(out, cfg.logFormat, &slog.HandlerOptions{Level: cfg.logLevel})
+			if err != nil {
+				return err
+			}
+			logger = slog.New(h).With("component", "conn")
+			d.logger = logger
+		}
+	}
+	defer func() { _ = input.close() }()
+	p := &prompt{
+		cfg:        cfg,
+		logger:     logger,
+		files:      &transferClient{addr: d.addr, tlsConf: baseTLS, quicConf: quicConf, token: token, jsonOut: jsonOut, logger: logger.With("component", "transfer")},
+		input:      input,
+		screen:     screen,
+		paths:      mig,
+		hist:       hist,
+		negotiated: &negotiated,
+		jsonOut:    jsonOut,
+	}
+	for {
+		err := p.run(ctx, client)
+		if !cfg.reconnect || ctx.Err() != nil || !reconnectable(err, client.Conn()) {
+			if errors.Is(err, errServerShutdown) {
+				return nil
+			}
+			return err
+		}
+		logger.Warn("connection lost, reconnecting", "err", err)
+		if jsonOut {
+			printRecord(opRecord{Op: "reconnect", StreamID: -1, Error: err.Error()})
+		}
+		if screen != nil {
+			screen.setClient(nil)
+		}
+		_ = client.Close()
+		mig.close()
+		// The session ticket of the lost connection lets the new one
+		// resume with 0-RTT data, where the server allows it.
+		d.opts.Early = true
+		if client, err = d.connect(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// Transfers go to the server the prompt is connected to.
+		p.files.addr = d.addr
+		if screen != nil {
+			screen.setTitle(d.addr)
+		}
+	}
+}
+
+// prompt is the interactive session: it reads lines and commands from input
+// and echoes them on a stream. With -reconnect it outlives the connection it
+// runs on, and continues on the next one.
+type prompt struct {
+	cfg    config
+	logger *slog.Logger
+	files  *transferClient
+	input  lineInput
+	// screen is the -tui screen, or nil.
+	screen     *tui
+	paths      *migrator
+	hist       *rttHist
+	negotiated *config
+	jsonOut    bool
+	// hex is set by /hex: lines are hex digits, and echoes are printed as
+	// hex dumps.
+	hex bool
+	// pending is a line whose echo was cut off by the loss of the
+	// connection, sent again first on the next one.
+	pending *string
+}
+
+// run opens a stream on client and runs the session on it until input ends,
+// the user quits or the stream or connection fails. It returns
+// errServerShutdown if the server shut down.
+func (p *prompt) run(ctx context.Context, client *echoclient.Client) error {
+	cfg, logger, jsonOut, hist, files, negotiated := p.cfg, p.logger, p.jsonOut, p.hist, p.files, p.negotiated
+	conn := client.Conn()
+	if p.screen != nil {
+		p.screen.setClient(client)
+	}
+
+	// A line cut off by the loss of the previous connection goes out right
+	// behind the preamble of the new stream, as 0-RTT data if the
+	// connection resumed early.
+	opts := streamOptions(cfg)
+	first := p.pending
+	if first != nil {
+		// It was checked before it was first sent.
+		opts.First, _ = p.message(*first)
+	}
+	opened := time.Now()
+	opCtx, cancel := opContext(ctx, cfg)
+	st, err := openStream(opCtx, client, opts)
+	cancel()
+	if terr := opTimeout(ctx, err, "open stream", cfg); terr != nil {
+		return terr
+	}
+	if err != nil {
+		return err
 	}
 	defer func() { _ = st.Close() }()
+	negotiated.maxMsg, negotiated.e2e, negotiated.compress = st.MaxMsg(), st.Encrypted(), st.Compressed()
 
 	logger.Info(
 		"stream opened",
-		"commands", "/quit | /exit | /newstream",
+		"component", "stream",
+		"quic_id", st.QUICStream().StreamID(),
+		"max_msg", st.MaxMsg(),
+		"e2e", st.Encrypted(),
+		"compressed", st.Compressed(),
+		"commands", commandNames(),
 	)
+	if jsonOut {
+		printRecord(opRecord{Op: "open", StreamID: int64(st.QUICStream().StreamID())})
+	}
 
-	// reader reads echoed data from the current stream.
-	reader := bufio.NewReader(st)
-	// input reads user input from stdin line-by-line.
-	input := bufio.NewScanner(os.Stdin)
+	// recv prints the datagrams the server sends, echoes of /datagram.
+	var recv *datagramReceiver
+	if conn.ConnectionState().SupportsDatagrams {
+		recv = newDatagramReceiver(conn, jsonOut)
+		go recv.run(ctx)
+	}
 
 	for {
 		select {
@@ -111,81 +1018,441 @@ func run(ctx context.Context, logger *slog.Logger, cfg config) error {
 		default:
 		}
 
-		fmt.Print("> ")
-		if !input.Scan() {
-			if err := input.Err(); err != nil {
-				return fmt.Errorf("stdin scan: %w", err)
+		var line string
+		sent := first != nil
+		if sent {
+			line, first = *first, nil
+			logger.Info("sent again on the new connection", "bytes", len(line))
+		} else {
+			prompt := "> "
+			if jsonOut {
+				prompt = ""
+			}
+			line, err = p.input.readLine(prompt)
+			if errors.Is(err, io.EOF) {
+				logger.Info("stdin closed")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("read stdin: %w", err)
 			}
-			logger.Info("stdin closed")
-			return nil
 		}
-
-		line := input.Text()
 		cmd := strings.TrimSpace(line)
+		if strings.HasPrefix(cmd, "/") && !strings.HasPrefix(cmd, "//") {
+			if err := checkCommand(cmd); err != nil {
+				logger.Warn("not sent", "err", err)
+				continue
+			}
+		}
 
 		switch cmd {
+		case "/help":
+			printHelp(jsonOut)
+			continue
+
 		case "/quit", "/exit":
 			logger.Info("quit requested")
 			return nil
 
+		case "/stats":
+			printStats(client, st, jsonOut)
+			continue
+
+		case "/hist":
+			printHist(hist, jsonOut)
+			continue
+
+		case "/hex":
+			p.hex = !p.hex
+			logger.Info("hex mode", "on", p.hex)
+			continue
+
 		case "/newstream":
 			// Open a fresh QUIC stream within the same connection.
 			logger.Info("opening new stream")
+			if !cfg.failAtStreamLimit {
+				// Waiting for a stream slot needs this one freed first. With
+				// -fail-at-stream-limit it is kept until the new stream is
+				// open, so that hitting the limit loses nothing.
+				_ = st.Close()
+			}
+			opCtx, cancel := opContext(ctx, cfg)
+			next, err := client.OpenStream(opCtx, streamOptions(cfg))
+			cancel()
+			if terr := opTimeout(ctx, err, "open new stream", cfg); terr != nil {
+				return terr
+			}
+			if echoclient.IsStreamLimit(err) {
+				logger.Warn("server stream limit reached, keeping current stream", "err", err)
+				if jsonOut {
+					printRecord(opRecord{Op: "newstream", StreamID: int64(st.QUICStream().StreamID()), Error: err.Error()})
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("open new stream: %w", err)
+			}
 			_ = st.Close()
+			st = next
+			negotiated.maxMsg, negotiated.e2e, negotiated.compress = st.MaxMsg(), st.Encrypted(), st.Compressed()
+			logger.Info("new stream opened", "component", "stream", "quic_id", st.QUICStream().StreamID(), "max_msg", st.MaxMsg())
+			if jsonOut {
+				printRecord(opRecord{Op: "newstream", StreamID: int64(st.QUICStream().StreamID())})
+			}
+			continue
+		}
+
+		if arg, ok := strings.CutPrefix(cmd, "/ping"); ok && (arg == "" || arg[0] == ' ') {
+			// Measure latency with datagrams, apart from the stream.
+			n := defaultPingProbes
+			if arg = strings.TrimSpace(arg); arg != "" {
+				if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+					logger.Warn("usage: /ping [count]")
+					continue
+				}
+			}
+			if err := ping(ctx, conn, recv, n, jsonOut); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("ping: %w", err)
+			}
+			continue
+		}
 
-			st, err = conn.OpenStreamSync(ctx)
+		if arg, ok := strings.CutPrefix(cmd, "/migrate"); ok && (arg == "" || arg[0] == ' ') {
+			// Move to a new local socket; the server validates the new path
+			// before the connection switches to it.
+			from := conn.LocalAddr()
+			laddr, validated, err := p.paths.migrate(ctx, conn, strings.TrimSpace(arg))
+			if jsonOut {
+				rec := opRecord{Op: "migrate", StreamID: -1}
+				if err != nil {
+					rec.Error = err.Error()
+				} else {
+					rec.LocalAddr, rec.DurMs = laddr.String(), ms(validated)
+				}
+				printRecord(rec)
+			}
 			if err != nil {
-				return fmt.Errorf("open new stream: %w", err)
+				if ctx.Err() != nil {
+					return nil
+				}
+				logger.Warn("migration failed, staying on the current path", "err", err)
+				continue
+			}
+			logger.Info("connection migrated", "from", from, "to", laddr, "validated_in", validated)
+			if !jsonOut {
+				fmt.Printf("migrated from %s to %s, path validated in %.3f ms\n", from, laddr, ms(validated))
 			}
-			reader = bufio.NewReader(st)
-			logger.Info("new stream opened")
 			continue
 		}
 
-		msg := line + "\n"
+		if path, ok := strings.CutPrefix(cmd, "/send "); ok {
+			if err := files.send(ctx, strings.TrimSpace(path)); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logger.Warn("send failed", "path", path, "err", err)
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(cmd, "/recv "); ok {
+			if err := files.recv(ctx, strings.TrimSpace(name)); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logger.Warn("recv failed", "name", name, "err", err)
+			}
+			continue
+		}
+
+		if msg, ok := strings.CutPrefix(line, "/datagram "); ok {
+			if err := sendDatagram(logger, conn, recv, msg, jsonOut); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg, ok := strings.CutPrefix(line, "/uni "); ok {
+			// Echo over a pair of unidirectional streams instead of the current stream.
+			start := time.Now()
+			opCtx, cancel := opContext(ctx, cfg)
+			echo, err := client.EchoUni(opCtx, []byte(msg))
+			cancel()
+			if terr := opTimeout(ctx, err, "uni echo", cfg); terr != nil {
+				return terr
+			}
+			if echoclient.IsStreamLimit(err) {
+				logger.Warn("server stream limit reached", "err", err)
+				if jsonOut {
+					printRecord(opRecord{Op: "uni", StreamID: -1, Sent: len(msg), Error: err.Error()})
+				}
+				continue
+			}
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return nil
+				}
+				return fmt.Errorf("uni echo: %w", err)
+			}
+			rtt := time.Since(start)
+			hist.record(rtt)
+			if jsonOut {
+				// The pair of uni streams has no single ID.
+				echoed := string(echo)
+				printRecord(opRecord{Op: "uni", StreamID: -1, Sent: len(msg), Echoed: len(echo), RTTMs: ms(rtt), Echo: &echoed})
+			} else {
+				fmt.Printf("echo (uni): %s\n", echo)
+			}
+			logger.Debug("uni roundtrip", "bytes", len(msg), "echoed", len(echo), "rtt", rtt)
+			continue
+		}
 
+		var msg []byte
+		if msg, err = p.message(line); err != nil {
+			logger.Warn("not sent", "err", err)
+			continue
+		}
+		p.pending = &line
 		start := time.Now()
-		if _, err := io.WriteString(st, msg); err != nil {
+		// The echo, sending and receiving, is bounded by -io-timeout.
+		opCtx, cancel := opContext(ctx, cfg)
+		err = nil
+		if sent {
+			start = opened
+		} else {
+			err = st.Send(opCtx, msg)
+		}
+		if echoclient.IsIdleReset(err) {
+			// The server reaped the stream while the prompt sat idle; carry on with a fresh one.
+			logger.Info("stream reset after being idle, opening new stream")
+			_ = st.Close()
+			if st, err = client.OpenStream(opCtx, streamOptions(cfg)); err != nil {
+				cancel()
+				if terr := opTimeout(ctx, err, "open new stream", cfg); terr != nil {
+					return terr
+				}
+				return fmt.Errorf("open new stream: %w", err)
+			}
+			negotiated.maxMsg, negotiated.e2e, negotiated.compress = st.MaxMsg(), st.Encrypted(), st.Compressed()
+			err = st.Send(opCtx, msg)
+		}
+		if err != nil {
+			cancel()
+			// Oversized messages are rejected locally; the server would reset the stream.
+			var tooLarge *echoclient.MessageTooLargeError
+			if errors.As(err, &tooLarge) {
+				p.pending = nil
+				logger.Warn("not sent", "err", err)
+				if jsonOut {
+					printRecord(opRecord{Op: "echo", StreamID: int64(st.QUICStream().StreamID()), Error: err.Error()})
+				}
+				continue
+			}
 			if errors.Is(err, context.Canceled) {
 				return nil
 			}
+			if reason, ok := echoclient.IsGoAway(err); ok {
+				logger.Info("server is shutting down", "reason", reason)
+				return errServerShutdown
+			}
+			if echoclient.IsAuthFailed(err) {
+				return errAuthRejected
+			}
+			if terr := opTimeout(ctx, err, "echo", cfg); terr != nil {
+				return terr
+			}
 			return fmt.Errorf("write: %w", err)
 		}
 
-		// The echo server replies with the same bytes, line-terminated.
-		echo, err := reader.ReadString('\n')
+		// The echo server replies with the same bytes, line-terminated. The echo
+		// is printed as it arrives so long lines never sit in memory whole.
+		var n int
+		var echo strings.Builder
+		if jsonOut || p.hex {
+			n, err = st.Receive(opCtx, &echo)
+		} else {
+			fmt.Print("echo: ")
+			n, err = st.Receive(opCtx, os.Stdout)
+			fmt.Println()
+		}
+		cancel()
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
 				logger.Info("stream closed by peer")
 				return nil
 			}
+			if reason, ok := echoclient.IsGoAway(err); ok {
+				logger.Info("server is shutting down", "reason", reason)
+				return errServerShutdown
+			}
+			if echoclient.IsAuthFailed(err) {
+				return errAuthRejected
+			}
+			if terr := opTimeout(ctx, err, "echo", cfg); terr != nil {
+				return terr
+			}
 			return fmt.Errorf("read echo: %w", err)
 		}
 
+		p.pending = nil
 		rtt := time.Since(start)
-		fmt.Printf("echo: %s", echo)
+		hist.record(rtt)
+		switch {
+		case jsonOut && p.hex:
+			echoed := hex.EncodeToString([]byte(echo.String()))
+			printRecord(opRecord{Op: "echo", StreamID: int64(st.QUICStream().StreamID()), Sent: len(msg), Echoed: n, RTTMs: ms(rtt), EchoHex: &echoed})
+		case jsonOut:
+			echoed := echo.String()
+			printRecord(opRecord{Op: "echo", StreamID: int64(st.QUICStream().StreamID()), Sent: len(msg), Echoed: n, RTTMs: ms(rtt), Echo: &echoed})
+		case p.hex:
+			printHexEcho(echo.String())
+		}
 
 		logger.Debug(
 			"roundtrip",
-			"bytes", len(msg),
+			"bytes", len(msg)+1,
+			"echoed", n,
 			"rtt", rtt,
 		)
 	}
 }
 
-// withSignals returns a child context that is canceled on SIGINT or SIGTERM.
-// The returned cancel function should be called to release resources.
-func withSignals(ctx context.Context, logger *slog.Logger) (context.Context, context.CancelFunc) {
-	ctx, cancel := context.WithCancel(ctx)
+// openStream opens an echo stream on client with opts.
+func openStream(ctx context.Context, client *echoclient.Client, opts echoclient.StreamOptions) (*echoclient.Stream, error) {
+	st, err := client.OpenStream(ctx, opts)
+	if echoclient.IsAuthFailed(err) {
+		return nil, errAuthRejected
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	return st, nil
+}
 
-	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+// streamOptions returns the echo stream options selected by cfg.
+func streamOptions(cfg config) echoclient.StreamOptions {
+	return echoclient.StreamOptions{MaxMsg: cfg.maxMsg, Encrypt: cfg.e2e, E2EPSK: cfg.e2ePSK, Compress: cfg.compress, Interceptors: cfg.pace.interceptors()}
+}
 
-	go func() {
-		sig := <-ch
-		logger.Info("signal received, shutting down", "signal", sig.String())
-		cancel()
-	}()
+// importSession loads session state exported by a previous client process
+// into sessions and applies its negotiated options to cfg. A missing file is
+// not an error, so the same command line works for the first process too.
+func importSession(path, addr string, sessions *exportableCache, cfg *config, logger *slog.Logger) error {
+	sf, err := readSessionFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info("no session to import", "path", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sf.Addr != addr {
+		logger.Warn("ignoring session exported for another server", "path", path, "addr", sf.Addr)
+		return nil
+	}
+
+	if err := sessions.load(sf.Tickets); err != nil {
+		return err
+	}
+	cfg.maxMsg, cfg.e2e, cfg.compress = sf.MaxMsg, sf.E2E, sf.Compress
+	logger.Info(
+		"session imported",
+		"path", path,
+		"age", time.Since(sf.ExportedAt).Round(time.Millisecond),
+		"tickets", len(sf.Tickets),
+		"max_msg", sf.MaxMsg,
+		"e2e", sf.E2E,
+		"compress", sf.Compress,
+	)
+	return nil
+}
 
-	return ctx, cancel
+// exportSession writes the resumable state of the current session to path.
+func exportSession(path, addr string, sessions *exportableCache, negotiated config) error {
+	tickets, err := sessions.export()
+	if err != nil {
+		return err
+	}
+	return writeSessionFile(path, &sessionFile{
+		Version:    sessionFileVersion,
+		Addr:       addr,
+		ExportedAt: time.Now(),
+		Tickets:    tickets,
+		MaxMsg:     negotiated.maxMsg,
+		E2E:        negotiated.e2e,
+		Compress:   negotiated.compress,
+	})
+}
+
+// Bounds of -initial-packet-size: every QUIC path carries packets of 1200
+// bytes, and quic-go sends none larger than 1452 bytes.
+const (
+	minPacketSize = 1200
+	maxPacketSize = 1452
+)
+
+// clientTLSConfig returns the TLS configuration shared by all modes. It
+// verifies that the server's certificate is valid for host and issued by a CA
+// in the PEM file caFile, or by one of the system roots if caFile is empty,
+// unless insecure is set. With pins, the hash of the server's public key must
+// also be one of them; without caFile, that is all that is verified, which
+// suits self-signed certificates.
+func clientTLSConfig(host, caFile string, pins []string, insecure bool) (*tls.Config, error) {
+	if insecure {
+		if caFile != "" || len(pins) > 0 {
+			return nil, errors.New("-insecure cannot be combined with -ca or -pin")
+		}
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	conf := &tls.Config{ServerName: host}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+		}
+	}
+	if len(pins) > 0 {
+		sums := make([][]byte, len(pins))
+		for i, pin := range pins {
+			var err error
+			if sums[i], err = parsePin(pin); err != nil {
+				return nil, err
+			}
+		}
+		// The pins replace chain verification unless there is a CA file;
+		// VerifyPeerCertificate runs either way.
+		conf.InsecureSkipVerify = caFile == ""
+		conf.VerifyPeerCertificate = verifyPins(sums)
+	}
+	return conf, nil
+}
+
+// withALPN returns a copy of conf that offers alpn.
+func withALPN(conf *tls.Config, alpn string) *tls.Config {
+	conf = conf.Clone()
+	conf.NextProtos = []string{alpn}
+	return conf
+}
+
+// parseALPNs turns a comma-separated list of ALPN protocol IDs into a list,
+// in order of preference. It returns nil for an empty list.
+func parseALPNs(list string) ([]string, error) {
+	var alpns []string
+	for id := range strings.SplitSeq(list, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || slices.Contains(alpns, id) {
+			continue
+		}
+		if len(id) > 255 {
+			return nil, fmt.Errorf("ALPN protocol %.16q... is longer than 255 bytes", id)
+		}
+		alpns = append(alpns, id)
+	}
+	return alpns, nil
 }
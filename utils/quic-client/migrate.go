@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// Settings of /migrate.
+const (
+	// connIDLength is the length of the connection IDs of the prompt's
+	// connections. A connection with empty ones could not move to another
+	// socket, as the socket could not tell its packets apart.
+	connIDLength = 4
+	// migrateTimeout bounds the validation of a new path.
+	migrateTimeout = 5 * time.Second
+)
+
+// migrator moves a connection to new local UDP sockets for /migrate. The
+// sockets it opens stay open until the connection is closed.
+type migrator struct {
+	transports []*quic.Transport
+}
+
+// migrate binds a UDP socket to local, or to a new port on the IP of the
+// current one if local is empty, probes the path from it to the server and
+// switches conn to it once the server validated the path. It returns the new
+// local address and how long the validation took. If migrating fails, conn
+// stays on its current path.
+func (m *migrator) migrate(ctx context.Context, conn *quic.Conn, local string) (*net.UDPAddr, time.Duration, error) {
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); !ok {
+		// Such as a connection tunneled through -proxy.
+		return nil, 0, fmt.Errorf("connection to %s is not over UDP", conn.RemoteAddr())
+	}
+	laddr := &net.UDPAddr{}
+	if cur, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		laddr.IP = cur.IP
+	}
+	if local != "" {
+		var err error
+		if laddr, err = net.ResolveUDPAddr("udp", local); err != nil {
+			return nil, 0, fmt.Errorf("resolve %s: %w", local, err)
+		}
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listen: %w", err)
+	}
+	tr := &quic.Transport{Conn: udpConn, ConnectionIDLength: connIDLength}
+
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		_ = tr.Close()
+		return nil, 0, fmt.Errorf("add path: %w", err)
+	}
+	// The connection is registered with the transport from now on, and
+	// closing the transport would close the connection: it is kept until
+	// the connection is closed even if the path is abandoned.
+	m.transports = append(m.transports, tr)
+	ctx, cancel := context.WithTimeout(ctx, migrateTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := path.Probe(ctx); err != nil {
+		_ = path.Close()
+		return nil, 0, fmt.Errorf("probe path: %w", err)
+	}
+	validated := time.Since(start)
+	if err := path.Switch(); err != nil {
+		_ = path.Close()
+		return nil, 0, fmt.Errorf("switch path: %w", err)
+	}
+	return udpConn.LocalAddr().(*net.UDPAddr), validated, nil
+}
+
+// close closes the sockets opened by migrate. Call it once the connection
+// is closed.
+func (m *migrator) close() {
+	for _, tr := range m.transports {
+		_ = tr.Close()
+	}
+	m.transports = nil
+}
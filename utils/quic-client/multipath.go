@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// maxMultipathInFlight bounds the lines of -multipath sent and not yet
+// echoed.
+const maxMultipathInFlight = 64
+
+// runMultipath connects to every address of the server at once and sends
+// every line read from stdin over the paths by policy, without waiting for
+// the echo of the line before, so that the aggregate policy spreads them.
+// Echoes are printed as they arrive, with the path they came back on and
+// their round trip; /paths prints the state of every path.
+func runMultipath(ctx context.Context, logger *slog.Logger, addrs []string, policy echoclient.PathPolicy, opts echoclient.Options) error {
+	logger = logger.With("component", "multipath")
+	m, err := echoclient.DialMultipath(ctx, addrs, policy, opts)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() { _ = m.Close() }()
+	for _, p := range m.Paths() {
+		if p.Err != nil {
+			logger.Warn("path not connected", "addr", p.Addr, "err", p.Err)
+			continue
+		}
+		logger.Info("path connected", "addr", p.Addr)
+	}
+	logger.Info("multipath started", "policy", policy, "commands", "<message> | /paths | /quit")
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, maxMultipathInFlight)
+	input := bufio.NewScanner(os.Stdin)
+	for input.Scan() {
+		line := input.Text()
+		switch strings.TrimSpace(line) {
+		case "":
+			continue
+		case "/quit", "/exit":
+			logger.Info("quit requested")
+			return nil
+		case "/paths":
+			printPaths(m.Paths())
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			echo, addr, err := m.Send(ctx, []byte(messageText(line)))
+			switch {
+			case errors.Is(err, context.Canceled):
+			case err != nil:
+				logger.Warn("not echoed", "err", err)
+			default:
+				fmt.Printf("echo: %s (via %s, %.3f ms)\n", echo, addr, ms(time.Since(start)))
+			}
+		}()
+	}
+	if err := input.Err(); err != nil {
+		return fmt.Errorf("stdin scan: %w", err)
+	}
+	logger.Info("stdin closed")
+	return nil
+}
+
+// printPaths prints the state of the paths of -multipath.
+func printPaths(paths []echoclient.PathInfo) {
+	for _, p := range paths {
+		if p.Err != nil {
+			fmt.Printf("path %s: down: %v\n", p.Addr, p.Err)
+			continue
+		}
+		fmt.Printf("path %s: rtt %.3f ms, %d in flight, %d echoed\n", p.Addr, ms(p.SmoothedRTT), p.InFlight, p.Echoed)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Output formats accepted by -output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// opRecord is the JSON object printed to stdout for every operation with
+// -output json, one per line.
+type opRecord struct {
+	// Op is the operation: "open", "newstream", "echo", "uni", "datagram",
+	// "ping", "stats", "stream" (one per stream of -streams), "send",
+	// "recv", "bench" (one per direction of -bench), "hist", "reconnect",
+	// "step" (one per step of -scenario), "soak" (one per interval of
+	// -soak), "disruption", "failover" or "fatal". A "datagram" record is
+	// printed for every datagram received, and for one that could not be
+	// sent. A "reconnect" record carries the error that ended the connection
+	// it replaces, and a "failover" record sets Name to the server address
+	// connected to instead of the last one.
+	Op string `json:"op"`
+	// StreamID is -1 for operations without a single stream.
+	StreamID int64 `json:"stream_id"`
+	// Sent and Echoed count message bytes, without the newline.
+	Sent   int     `json:"sent_bytes"`
+	Echoed int     `json:"echoed_bytes"`
+	RTTMs  float64 `json:"rtt_ms"`
+	Echo   *string `json:"echo,omitempty"`
+	// EchoHex replaces Echo in the hex mode of /hex, hex-encoded.
+	EchoHex *string `json:"echo_hex,omitempty"`
+	// Probes, Lost, TransportRTT and EchoRTT are set by "ping", whose RTTMs
+	// is the smoothed RTT.
+	Probes       int       `json:"probes,omitempty"`
+	Lost         int       `json:"lost,omitempty"`
+	TransportRTT *rttRange `json:"transport_rtt_ms,omitempty"`
+	EchoRTT      *rttRange `json:"echo_rtt_ms,omitempty"`
+	// Stats is set by "stats", whose RTTMs is the smoothed RTT.
+	Stats *connStats `json:"stats,omitempty"`
+	// Name, Bytes, ResumedFrom and DurMs are set by "send" and "recv". A
+	// "step" sets Name to the step and DurMs to how long it took.
+	Name        string  `json:"name,omitempty"`
+	Bytes       int64   `json:"bytes,omitempty"`
+	ResumedFrom int64   `json:"resumed_from,omitempty"`
+	DurMs       float64 `json:"dur_ms,omitempty"`
+	// Direction, MbitPerS and CPUPct are set by "bench", which also sets
+	// Bytes and DurMs. CPUPct is the client's CPU use over the run, relative
+	// to one core.
+	Direction string  `json:"direction,omitempty"`
+	MbitPerS  float64 `json:"mbit_per_s,omitempty"`
+	CPUPct    float64 `json:"cpu_pct,omitempty"`
+	// Hist is set by "hist", printed by /hist and at exit with the
+	// percentiles of the echo round trips so far.
+	Hist *histSummary `json:"rtt_hist_ms,omitempty"`
+	// LocalAddr is set by "migrate" to the new local address, with DurMs
+	// the time the server took to validate the path.
+	LocalAddr string `json:"local_addr,omitempty"`
+	// Soak is set by "soak", whose RTTMs is the smoothed RTT. A
+	// "disruption" of -soak sets Name to its kind and Error to its details.
+	Soak *soakReport `json:"soak,omitempty"`
+	// Commands is set by "help", printed by /help with the usage of every
+	// prompt command.
+	Commands []string `json:"commands,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// printRecord writes rec to stdout as a line of JSON.
+func printRecord(rec opRecord) {
+	_ = json.NewEncoder(os.Stdout).Encode(rec)
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// paceChunk is the largest write a pacedWriter passes on at once, so that
+// bulk writes go out at a steady rate rather than in bursts.
+const paceChunk = 16 * 1024
+
+// byteRate is a rate in bytes per second, as set by -rate: a number with an
+// optional k, M or G suffix for powers of 1000.
+type byteRate int64
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *byteRate) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1000
+	case strings.HasSuffix(s, "M"):
+		mult = 1000 * 1000
+	case strings.HasSuffix(s, "G"):
+		mult = 1000 * 1000 * 1000
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q: want bytes per second, e.g. 500k", text)
+	}
+	*r = byteRate(n * mult)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r byteRate) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(r), 10)), nil
+}
+
+// pacer is a token bucket that paces writes to a rate in bytes per second.
+// Its tokens are bytes, and a write may take more than there are, to be
+// paid off by waiting before the next one. The nil pacer does not pace.
+type pacer struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newPacer returns a pacer for rate bytes per second, or nil if rate is 0.
+func newPacer(rate byteRate) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{rate: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes may be written, or ctx is done. The bucket
+// holds at most a tenth of a second's worth of bytes, so that an idle
+// writer cannot save up for a burst.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	p.tokens = min(p.rate/10, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+	p.tokens -= float64(n)
+	delay := time.Duration(-p.tokens / p.rate * float64(time.Second))
+	p.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// interceptors returns stream interceptors that pace the messages of a
+// stream, newline included, or nil for the nil pacer.
+func (p *pacer) interceptors() *echoclient.Interceptors {
+	if p == nil {
+		return nil
+	}
+	ic := new(echoclient.Interceptors)
+	ic.OnSend(func(ctx context.Context, msg []byte) ([]byte, error) {
+		return msg, p.wait(ctx, len(msg)+1)
+	})
+	return ic
+}
+
+// pacedWriter writes to w paced by p, in chunks of at most paceChunk
+// bytes.
+type pacedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	p   *pacer
+}
+
+// Write implements io.Writer.
+func (pw *pacedWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), paceChunk)]
+		if err := pw.p.wait(pw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := pw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/perf"
+)
+
+// runPerf is -bench with -bench-perf: it runs the benchmark over the
+// server's perf protocol, which agrees on the parameters with the server
+// and reports the goodput of every direction as measured by the side that
+// received the data, the server for uploads and the client for downloads.
+// Both directions of bidi run one after the other. If token is not empty,
+// it is sent on a stream first to authenticate.
+func runPerf(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token string, cfg config) error {
+	l := logger.With("component", "bench")
+	phases := []string{cfg.benchDirection}
+	if cfg.benchDirection == benchBidi {
+		phases = []string{perf.Up, perf.Down}
+	}
+	p := perf.Params{Streams: cfg.benchStreams, Size: cfg.benchSize, Duration: cfg.benchDuration, Phases: phases}
+	if err := p.Check(); err != nil {
+		return fmt.Errorf("-bench-perf: %w", err)
+	}
+
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, perf.ALPN), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	if token != "" {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return fmt.Errorf("open stream: %w", err)
+		}
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+		_ = st.Close()
+	}
+
+	ctrl, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open control stream: %w", err)
+	}
+	defer ctrl.CancelRead(0)
+	br := bufio.NewReader(ctrl)
+	if err := perf.WriteParams(ctrl, p); err != nil {
+		return fmt.Errorf("send parameters: %w", err)
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(perf.Drain))
+	if err := perf.ReadReply(br); err != nil {
+		return perfError("read reply", err)
+	}
+	l.Info("starting benchmark", "protocol", "perf", "direction", cfg.benchDirection, "streams", p.Streams, "size", p.Size, "duration", p.Duration)
+
+	cpu0, cpuOK := cpuTime()
+	start := time.Now()
+	var failed error
+	for _, dir := range phases {
+		r, sent, err := perfPhase(ctx, conn, ctrl, br, p, dir, cfg.pace)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if cfg.output == outputJSON {
+			rec := opRecord{Op: "bench", StreamID: -1, Direction: dir, Bytes: r.Bytes, DurMs: ms(r.Dur), MbitPerS: r.MbitPerS()}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			printRecord(rec)
+		}
+		if err != nil {
+			l.Warn("bench failed", "direction", dir, "err", err)
+			failed = err
+			break
+		}
+		attrs := []any{"direction", dir, "streams", p.Streams, "bytes", r.Bytes, "dur", r.Dur, "mbit_per_s", fmt.Sprintf("%.2f", r.MbitPerS())}
+		if dir == perf.Up {
+			attrs = append(attrs, "measured_by", "server", "sent_bytes", sent)
+		} else {
+			attrs = append(attrs, "measured_by", "client")
+		}
+		l.Info("bench results", attrs...)
+	}
+	cpu1, _ := cpuTime()
+	if cpuOK {
+		cpu := cpu1 - cpu0
+		l.Info("bench cpu", "cpu_time", cpu.Round(time.Millisecond), "cpu_pct", fmt.Sprintf("%.1f", 100*cpu.Seconds()/time.Since(start).Seconds()))
+	}
+	if failed != nil {
+		return failed
+	}
+
+	// The server ends the control stream once it has the last result.
+	_ = ctrl.Close()
+	_ = ctrl.SetReadDeadline(time.Now().Add(perf.Drain))
+	_, _ = io.Copy(io.Discard, br)
+	return nil
+}
+
+// perfPhase runs the phase of p in direction dir on conn: it starts it on
+// the control stream ctrl, read through br, opens its data streams and
+// sends on them, paced by pace, or receives on them. It returns the result
+// of the phase, which it gets from the server for an upload and sends to
+// it for a download, and for an upload the number of bytes sent.
+func perfPhase(ctx context.Context, conn *quic.Conn, ctrl *quic.Stream, br *bufio.Reader, p perf.Params, dir string, pace *pacer) (perf.Result, int64, error) {
+	if err := perf.WriteStart(ctrl, dir); err != nil {
+		return perf.Result{}, 0, fmt.Errorf("send start: %w", err)
+	}
+	start := time.Now()
+	sts := make([]*quic.Stream, 0, p.Streams)
+	for range p.Streams {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			for _, st := range sts {
+				st.CancelRead(0)
+				st.CancelWrite(0)
+			}
+			return perf.Result{}, 0, perfError("open stream", err)
+		}
+		sts = append(sts, st)
+	}
+
+	if dir == perf.Up {
+		sctx, cancel := context.WithTimeout(ctx, p.Duration)
+		defer cancel()
+		sent, err := perf.Send(sctx, sts, p.Size, pace.wait)
+		if err != nil {
+			return perf.Result{}, sent, perfError("send", err)
+		}
+		_ = ctrl.SetReadDeadline(time.Now().Add(perf.Drain))
+		r, err := perf.ReadResult(br, dir)
+		if err != nil {
+			return perf.Result{}, sent, perfError("read result", err)
+		}
+		return r, sent, nil
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, p.Duration+perf.Drain)
+	defer cancel()
+	n, err := perf.Receive(rctx, sts)
+	if err != nil {
+		return perf.Result{}, 0, perfError("receive", err)
+	}
+	r := perf.Result{Dir: dir, Bytes: n, Dur: time.Since(start)}
+	if err := perf.WriteResult(ctrl, r); err != nil {
+		return perf.Result{}, 0, fmt.Errorf("send result: %w", err)
+	}
+	return r, 0, nil
+}
+
+// perfError describes the failure of op in the perf protocol.
+func perfError(op string, err error) error {
+	var rerr *perf.RemoteError
+	switch {
+	case echoclient.IsAuthFailed(err):
+		return errAuthRejected
+	case errors.As(err, &rerr):
+		return fmt.Errorf("perf test refused by the %w", err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
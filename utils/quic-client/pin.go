@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/romanov9617/usb-quic/pkg/cmdutil"
+)
+
+// parsePin decodes a pin of the form "sha256:<base64>", the SHA-256 hash of
+// a certificate's DER-encoded SubjectPublicKeyInfo, as logged by the server.
+func parsePin(s string) ([]byte, error) {
+	b64, ok := strings.CutPrefix(s, cmdutil.PinPrefix)
+	if !ok {
+		return nil, fmt.Errorf("pin %q: want %s<base64>", s, cmdutil.PinPrefix)
+	}
+	sum, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("pin %q: %w", s, err)
+	}
+	if len(sum) != sha256.Size {
+		return nil, fmt.Errorf("pin %q: hash is %d bytes, want %d", s, len(sum), sha256.Size)
+	}
+	return sum, nil
+}
+
+// verifyPins returns a [tls.Config] VerifyPeerCertificate function that
+// accepts the server's certificate only if the hash of its public key is one
+// of pins.
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("parse server certificate: %w", err)
+		}
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("server public key %s matches no -pin", cmdutil.SPKIPin(leaf))
+	}
+}
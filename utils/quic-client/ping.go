@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// Settings of the /ping command.
+const (
+	// defaultPingProbes is the number of probes sent by /ping without a
+	// count.
+	defaultPingProbes = 5
+	// pingTimeout is how long a probe's echo is waited for before the probe
+	// counts as lost.
+	pingTimeout = time.Second
+	// pingInterval separates consecutive probes.
+	pingInterval = 100 * time.Millisecond
+)
+
+// rttRange is the minimum, average and maximum of a set of RTT samples, in
+// milliseconds.
+type rttRange struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// newRTTRange summarizes samples, which must not be empty.
+func newRTTRange(samples []time.Duration) *rttRange {
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	return &rttRange{
+		Min: ms(slices.Min(samples)),
+		Avg: ms(sum / time.Duration(len(samples))),
+		Max: ms(slices.Max(samples)),
+	}
+}
+
+// String formats r as "min/avg/max ms".
+func (r *rttRange) String() string {
+	return fmt.Sprintf("%.3f/%.3f/%.3f ms", r.Min, r.Avg, r.Max)
+}
+
+// ping sends n probe datagrams to the echo server, one at a time, and prints
+// the minimum, average and maximum of two latencies: the transport RTT that
+// quic-go measures from the acknowledgment of each probe, and the round trip
+// of the probe's echo, which adds the server's processing. The ACK travels
+// with the echo, so the transport sample is current once the echo arrives.
+// The echoes are received by recv; if it is nil because the server does not
+// support datagrams, only quic-go's RTT estimates are printed.
+func ping(ctx context.Context, conn *quic.Conn, recv *datagramReceiver, n int, jsonOut bool) error {
+	stats := conn.ConnectionStats()
+	if recv == nil {
+		if jsonOut {
+			printRecord(opRecord{Op: "ping", StreamID: -1, RTTMs: ms(stats.SmoothedRTT), Error: "server does not support datagrams"})
+			return nil
+		}
+		fmt.Printf("ping: server does not support datagrams; smoothed rtt %.3f ms, min %.3f ms, latest %.3f ms\n",
+			ms(stats.SmoothedRTT), ms(stats.MinRTT), ms(stats.LatestRTT))
+		return nil
+	}
+
+	var transport, echo []time.Duration
+	probe := make([]byte, 16)
+	for i := range n {
+		if i > 0 {
+			select {
+			case <-time.After(pingInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		_, _ = rand.Read(probe)
+		arrived, stop := recv.expect(probe)
+		start := time.Now()
+		if err := conn.SendDatagram(probe); err != nil {
+			stop()
+			return fmt.Errorf("send probe: %w", err)
+		}
+		select {
+		case <-arrived:
+			echo = append(echo, time.Since(start))
+			transport = append(transport, conn.ConnectionStats().LatestRTT)
+		case <-time.After(pingTimeout):
+		case <-ctx.Done():
+		}
+		stop()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	rec := opRecord{Op: "ping", StreamID: -1, Probes: n, Lost: n - len(echo), RTTMs: ms(conn.ConnectionStats().SmoothedRTT)}
+	if len(echo) > 0 {
+		rec.TransportRTT, rec.EchoRTT = newRTTRange(transport), newRTTRange(echo)
+	}
+	if jsonOut {
+		printRecord(rec)
+		return nil
+	}
+	fmt.Printf("ping: %d probes, %d lost, smoothed rtt %.3f ms\n", rec.Probes, rec.Lost, rec.RTTMs)
+	if rec.EchoRTT != nil {
+		fmt.Printf("  transport rtt min/avg/max = %s\n", rec.TransportRTT)
+		fmt.Printf("  echo rtt      min/avg/max = %s\n", rec.EchoRTT)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// pipeALPNs maps the server protocols -pipe can be used with to their ALPN
+// identifiers, which must match the server's.
+var pipeALPNs = map[string]string{
+	"echo":    echoclient.ALPN,
+	"discard": "quic-discard",
+	"chargen": "quic-chargen",
+	"tunnel":  "quic-tunnel",
+}
+
+// runPipe connects to addr with the server protocol proto and copies stdin
+// to a single stream and the stream to stdout as raw bytes, like netcat,
+// until both directions are done. If token is not empty, it is sent on the
+// stream first to authenticate. If alpns is not empty, the connection offers
+// them instead of the ALPN of proto. Writes to the stream are paced by pace.
+func runPipe(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, proto string, alpns []string, pace *pacer) error {
+	alpn, ok := pipeALPNs[proto]
+	if !ok && alpns == nil {
+		return fmt.Errorf("-pipe-protocol must be one of %s, got %q", strings.Join(slices.Sorted(maps.Keys(pipeALPNs)), ", "), proto)
+	}
+	tlsConf = withALPN(tlsConf, alpn)
+	if alpns != nil {
+		tlsConf.NextProtos = alpns
+	}
+	conn, err := echoclient.DialAddr(ctx, addr, tlsConf, quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	// Reading the stream does not stop with ctx otherwise.
+	stop := context.AfterFunc(ctx, func() { _ = conn.CloseWithError(errcode.NoError, "bye") })
+	defer stop()
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if token != "" {
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+	}
+	l := logger.With("component", "pipe", "alpn", conn.ConnectionState().TLS.NegotiatedProtocol, "quic_id", st.StreamID())
+	l.Debug("piping")
+
+	start := time.Now()
+	type result struct {
+		n   int64
+		err error
+	}
+	up := make(chan result, 1)
+	go func() {
+		n, err := io.Copy(&pacedWriter{ctx: ctx, w: st, p: pace}, os.Stdin)
+		_ = st.Close()
+		up <- result{n, err}
+	}()
+	down, derr := io.Copy(os.Stdout, st)
+	if derr != nil {
+		// Do not wait for stdin, which may never end.
+		if ctx.Err() != nil {
+			return nil
+		}
+		if echoclient.IsAuthFailed(derr) {
+			return errAuthRejected
+		}
+		return fmt.Errorf("read stream: %w", derr)
+	}
+	var u result
+	select {
+	case u = <-up:
+	case <-ctx.Done():
+		return nil
+	}
+	if u.err != nil && !errors.Is(u.err, context.Canceled) {
+		return fmt.Errorf("write stream: %w", u.err)
+	}
+	l.Info("pipe done", "up_bytes", u.n, "down_bytes", down, "dur", time.Since(start))
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// mtuTracer returns a [quic.Config] Tracer that logs the path MTU updates
+// of every connection to l, and records to the traces of next, if not nil,
+// as well.
+func mtuTracer(next func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace, l *slog.Logger) func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	l = l.With("component", "pmtud")
+	return func(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		t := &mtuTrace{l: l.With("odcid", connID.String())}
+		if next != nil {
+			t.next = next(ctx, isClient, connID)
+		}
+		return t
+	}
+}
+
+// mtuTrace is a [qlogwriter.Trace] that logs path MTU updates and passes
+// all events on to next, if not nil.
+type mtuTrace struct {
+	l    *slog.Logger
+	next qlogwriter.Trace
+}
+
+// AddProducer implements [qlogwriter.Trace].
+func (t *mtuTrace) AddProducer() qlogwriter.Recorder {
+	r := &mtuRecorder{l: t.l}
+	if t.next != nil {
+		r.next = t.next.AddProducer()
+	}
+	return r
+}
+
+// SupportsSchemas implements [qlogwriter.Trace].
+func (t *mtuTrace) SupportsSchemas(schema string) bool {
+	return schema == qlog.EventSchema || (t.next != nil && t.next.SupportsSchemas(schema))
+}
+
+// mtuRecorder is the [qlogwriter.Recorder] of an mtuTrace.
+type mtuRecorder struct {
+	l    *slog.Logger
+	next qlogwriter.Recorder
+}
+
+// RecordEvent implements [qlogwriter.Recorder]. The steps of the search are
+// logged at debug level, and its result.
+func (r *mtuRecorder) RecordEvent(ev qlogwriter.Event) {
+	if ev, ok := ev.(qlog.MTUUpdated); ok {
+		if ev.Done {
+			r.l.Info("path MTU discovered", "mtu", ev.Value)
+		} else {
+			r.l.Debug("path MTU updated", "mtu", ev.Value)
+		}
+	}
+	if r.next != nil {
+		r.next.RecordEvent(ev)
+	}
+}
+
+// Close implements [qlogwriter.Recorder].
+func (r *mtuRecorder) Close() error {
+	if r.next != nil {
+		return r.next.Close()
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// proxyScheme is the scheme of the URL of -proxy.
+const proxyScheme = "quic"
+
+// parseProxyURL returns the host and port of the proxy named by s, a URL of
+// the form quic://host[:port]. The port defaults to 443.
+func parseProxyURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != proxyScheme || u.Host == "" || (u.Path != "" && u.Path != "/") || u.User != nil || u.RawQuery != "" {
+		return "", fmt.Errorf("%q is not a URL of the form %s://host:port", s, proxyScheme)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// upstreamProxy is a CONNECT-UDP (RFC 9298) proxy that the connections to
+// the server are tunneled through, for networks that block UDP to anywhere
+// but the proxy.
+type upstreamProxy struct {
+	addr     string
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	logger   *slog.Logger
+}
+
+// newUpstreamProxy returns the proxy at addr, connected to with tlsConf and
+// quicConf, which is cloned with datagrams enabled.
+func newUpstreamProxy(addr string, tlsConf *tls.Config, quicConf *quic.Config, logger *slog.Logger) *upstreamProxy {
+	quicConf = quicConf.Clone()
+	quicConf.EnableDatagrams = true
+	return &upstreamProxy{
+		addr:     addr,
+		tlsConf:  withALPN(tlsConf, http3.NextProtoH3),
+		quicConf: quicConf,
+		logger:   logger.With("component", "proxy", "proxy", addr),
+	}
+}
+
+// dial connects to the echo server at target through the proxy, configured
+// by opts like [echoclient.Dial]. Every connection has a connection to the
+// proxy and a flow of its own, both closed with it. The packets of the
+// connection travel in the datagrams of the flow, so they start at the
+// minimum size QUIC allows, unless opts set a size, and path MTU discovery
+// finds out how much the flow carries beyond that.
+func (p *upstreamProxy) dial(ctx context.Context, target string, opts echoclient.Options) (*echoclient.Client, error) {
+	conn, err := echoclient.DialAddr(ctx, p.addr, p.tlsConf, p.quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", p.addr, err)
+	}
+	rs, err := openConnectUDP(ctx, conn, p.addr, "", target)
+	if err != nil {
+		_ = conn.CloseWithError(errcode.NoError, "")
+		return nil, fmt.Errorf("proxy %s: %w", p.addr, err)
+	}
+
+	pc := newProxyConn(conn, rs, target)
+	tr := &quic.Transport{Conn: pc}
+	closeAll := func() {
+		_ = tr.Close()
+		_ = pc.Close()
+		_ = conn.CloseWithError(errcode.NoError, "bye")
+	}
+	switch {
+	case opts.QUICConfig == nil:
+		opts.QUICConfig = &quic.Config{InitialPacketSize: minPacketSize}
+	case opts.QUICConfig.InitialPacketSize == 0:
+		opts.QUICConfig = opts.QUICConfig.Clone()
+		opts.QUICConfig.InitialPacketSize = minPacketSize
+	}
+	// quic-go takes the server name from the address if opts leave it
+	// empty, as it does for a resolved one.
+	client, err := echoclient.DialTransport(ctx, tr, pc.RemoteAddr(), opts)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	p.logger.Debug("tunneling through proxy", "target", target)
+	go func() {
+		<-client.Conn().Context().Done()
+		closeAll()
+	}()
+	return client, nil
+}
+
+// proxiedAddr is the address of the target of a CONNECT-UDP flow, a host
+// and port as given to the proxy.
+type proxiedAddr string
+
+// Network implements net.Addr.
+func (a proxiedAddr) Network() string { return "connect-udp" }
+
+// String implements net.Addr.
+func (a proxiedAddr) String() string { return string(a) }
+
+// proxyConn is a [net.PacketConn] that sends and receives the packets of a
+// QUIC connection as the datagrams of a CONNECT-UDP flow, all of them to and
+// from the target of the flow.
+type proxyConn struct {
+	conn   *quic.Conn
+	rs     *http3.RequestStream
+	remote proxiedAddr
+
+	// closed ends reads for good, and readCtx the read in progress when
+	// the read deadline changes.
+	closed context.Context
+	close  context.CancelFunc
+
+	mu         sync.Mutex
+	readCtx    context.Context
+	readCancel context.CancelFunc
+}
+
+// newProxyConn returns a packet conn on the flow rs to target, of the proxy
+// connection conn.
+func newProxyConn(conn *quic.Conn, rs *http3.RequestStream, target string) *proxyConn {
+	c := &proxyConn{conn: conn, rs: rs, remote: proxiedAddr(target)}
+	c.closed, c.close = context.WithCancel(context.Background())
+	c.readCtx, c.readCancel = context.WithCancel(c.closed)
+	return c
+}
+
+// ReadFrom implements [net.PacketConn]. All packets come from the target.
+func (c *proxyConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		ctx := c.readCtx
+		c.mu.Unlock()
+		d, err := c.rs.ReceiveDatagram(ctx)
+		switch {
+		case c.closed.Err() != nil:
+			return 0, nil, net.ErrClosed
+		case errors.Is(err, context.DeadlineExceeded):
+			return 0, nil, os.ErrDeadlineExceeded
+		case errors.Is(err, context.Canceled):
+			// The deadline changed.
+			continue
+		case err != nil:
+			return 0, nil, err
+		}
+		id, n, err := quicvarint.Parse(d)
+		if err != nil || id != 0 {
+			continue
+		}
+		return copy(p, d[n:]), c.remote, nil
+	}
+}
+
+// WriteTo implements [net.PacketConn], sending p to the target whatever
+// addr. Packets too large for a datagram of the proxy connection are
+// dropped, as a link drops those above its MTU.
+func (c *proxyConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	if c.closed.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	// The leading zero is context ID 0.
+	d := make([]byte, 1+len(p))
+	copy(d[1:], p)
+	var tooLarge *quic.DatagramTooLargeError
+	if err := c.rs.SendDatagram(d); err != nil && !errors.As(err, &tooLarge) {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements [net.PacketConn], ending the flow but not the proxy
+// connection.
+func (c *proxyConn) Close() error {
+	c.close()
+	return c.rs.Close()
+}
+
+// LocalAddr implements [net.PacketConn], returning the local address of the
+// proxy connection.
+func (c *proxyConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the target of the flow.
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline implements [net.PacketConn]. Writes never block, so only the
+// read deadline applies.
+func (c *proxyConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline implements [net.PacketConn]. A read in progress is
+// subject to the new deadline, too.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readCancel()
+	if t.IsZero() {
+		c.readCtx, c.readCancel = context.WithCancel(c.closed)
+	} else {
+		c.readCtx, c.readCancel = context.WithDeadline(c.closed, t)
+	}
+	return nil
+}
+
+// SetWriteDeadline implements [net.PacketConn]. Writes never block.
+func (c *proxyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// SetReadBuffer tells quic-go that there is no socket buffer to size.
+func (c *proxyConn) SetReadBuffer(int) error { return nil }
+
+// SetWriteBuffer tells quic-go that there is no socket buffer to size.
+func (c *proxyConn) SetWriteBuffer(int) error { return nil }
+
+// nonEchoMode returns the flag of the mode selected by cfg if it does not
+// run the echo prompt, which -proxy is limited to, or "" otherwise.
+func nonEchoMode(cfg config) string {
+	modes := []struct {
+		flag string
+		on   bool
+	}{
+		{"-discover", cfg.discover},
+		{"-health", cfg.health},
+		{"-pubsub", cfg.pubsub},
+		{"-rpc", cfg.rpc},
+		{"-multipath", cfg.multipath != ""},
+		{"-pipe", cfg.pipe},
+		{"-socks", cfg.socks != ""},
+		{"-udp-forward", cfg.udpForward != ""},
+		{"-reverse-to", cfg.reverseTo != ""},
+		{"-connect-udp", cfg.connectUDP != ""},
+		{"-bench", cfg.bench},
+	}
+	for _, m := range modes {
+		if m.on {
+			return m.flag
+		}
+	}
+	return ""
+}
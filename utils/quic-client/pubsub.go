@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// alpnPubSub is the ALPN identifier of the server's pub/sub protocol. It
+// must match the server's.
+const alpnPubSub = "quic-pubsub"
+
+// runPubSub connects to addr with the pub/sub protocol and sends the
+// commands read from stdin ("SUB <topic>", "UNSUB <topic>",
+// "PUB <topic> <payload>") on a single stream, printing the server's reply to
+// each. Messages on subscribed topics arrive on server-initiated
+// unidirectional streams and are printed as they come in. If token is not
+// empty, it is sent first to authenticate.
+func runPubSub(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token string, maxMsg int) error {
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, alpnPubSub), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	logger = logger.With("component", "pubsub")
+	logger.Info("connected", "remote", conn.RemoteAddr().String(), "quic_version", conn.ConnectionState().Version.String())
+
+	go receiveMessages(ctx, conn, maxMsg, logger)
+
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer func() { _ = st.Close() }()
+	if token != "" {
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+	}
+	logger.Info("stream opened", "quic_id", st.StreamID(), "commands", "SUB <topic> | UNSUB <topic> | PUB <topic> <payload> | /quit")
+
+	replies := bufio.NewReader(st)
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				return fmt.Errorf("stdin scan: %w", err)
+			}
+			logger.Info("stdin closed")
+			return nil
+		}
+		line := strings.TrimSpace(input.Text())
+		switch line {
+		case "":
+			continue
+		case "/quit", "/exit":
+			logger.Info("quit requested")
+			return nil
+		}
+
+		if _, err := io.WriteString(st, line+"\n"); err != nil {
+			return pubsubError("send command", err)
+		}
+		reply, err := replies.ReadString('\n')
+		if err != nil {
+			return pubsubError("read reply", err)
+		}
+		fmt.Print(reply)
+	}
+}
+
+// receiveMessages prints the messages the server delivers on
+// unidirectional streams of conn until conn is closed. Payloads are cut
+// after maxMsg bytes.
+func receiveMessages(ctx context.Context, conn *quic.Conn, maxMsg int, l *slog.Logger) {
+	for {
+		st, err := conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			br := bufio.NewReader(io.LimitReader(st, int64(maxMsg)+1024))
+			topic, err := br.ReadString('\n')
+			if err != nil {
+				l.Warn("read message topic", "quic_id", st.StreamID(), "err", err)
+				return
+			}
+			payload, err := io.ReadAll(br)
+			if err != nil {
+				l.Warn("read message", "quic_id", st.StreamID(), "err", err)
+				return
+			}
+			st.CancelRead(0)
+			fmt.Printf("\n[%s] %s\n", strings.TrimSuffix(topic, "\n"), payload)
+		}()
+	}
+}
+
+// pubsubError turns a failed command exchange into the error to exit with.
+func pubsubError(op string, err error) error {
+	if echoclient.IsAuthFailed(err) {
+		return errAuthRejected
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// qlogTracer returns a [quic.Config] Tracer that writes one qlog file per
+// connection into dir. Files are named after the original destination
+// connection ID like the server's, so the traces of both ends of a
+// connection pair up.
+func qlogTracer(dir string, l *slog.Logger) (func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create qlog dir: %w", err)
+	}
+	l = l.With("component", "qlog", "dir", dir)
+
+	return func(_ context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		label := "server"
+		if isClient {
+			label = "client"
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s_%s.sqlog", connID, label))
+		f, err := os.Create(path)
+		if err != nil {
+			l.Warn("create qlog file failed", "err", err)
+			return nil
+		}
+		l.Debug("qlog started", "file", path)
+
+		fs := qlogwriter.NewConnectionFileSeq(&qlogFile{f: f, bw: bufio.NewWriter(f)}, isClient, connID, []string{qlog.EventSchema})
+		go fs.Run()
+		return fs
+	}, nil
+}
+
+// qlogFile is a buffered io.WriteCloser for a qlog trace file.
+type qlogFile struct {
+	f  *os.File
+	bw *bufio.Writer
+}
+
+// Write implements io.Writer.
+func (q *qlogFile) Write(p []byte) (int, error) {
+	return q.bw.Write(p)
+}
+
+// Close implements io.Closer.
+func (q *qlogFile) Close() error {
+	if err := q.bw.Flush(); err != nil {
+		_ = q.f.Close()
+		return err
+	}
+	return q.f.Close()
+}
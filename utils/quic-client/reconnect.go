@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// errServerShutdown reports that the server ended the session because it is
+// shutting down.
+var errServerShutdown = errors.New("server is shutting down")
+
+// dialer connects the client to the echo server, with -reconnect as often
+// as it takes.
+type dialer struct {
+	// addrs are the addresses of the server, tried in the order of
+	// -failover: the SRV targets of -srv, the endpoints of -servers, or
+	// -host and -port.
+	addrs []string
+	// addr is the address of the last connection.
+	addr   string
+	opts   echoclient.Options
+	cfg    config
+	logger *slog.Logger
+
+	// proxy, if not nil, tunnels the connections through -proxy.
+	proxy *upstreamProxy
+}
+
+// dial connects to the server once, failing over to its next address if
+// connecting to one fails, and reports a change of the active address.
+func (d *dialer) dial(ctx context.Context) (*echoclient.Client, error) {
+	addrs := d.order()
+	var err error
+	for i, addr := range addrs {
+		var client *echoclient.Client
+		if client, err = d.dialAddr(ctx, addr); err == nil {
+			if d.addr != "" && d.addr != addr {
+				d.logger.Warn("failed over to another server address", "from", d.addr, "to", addr)
+				if d.cfg.output == outputJSON {
+					printRecord(opRecord{Op: "failover", StreamID: -1, Name: addr})
+				}
+			}
+			d.addr = addr
+			return client, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i < len(addrs)-1 {
+			d.logger.Warn("connect failed, trying the next server address", "addr", addr, "next", addrs[i+1], "err", err)
+		}
+	}
+	return nil, err
+}
+
+// dialAddr connects to the server at addr, within -dial-timeout.
+func (d *dialer) dialAddr(ctx context.Context, addr string) (*echoclient.Client, error) {
+	dctx := ctx
+	if d.cfg.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, d.cfg.dialTimeout)
+		defer cancel()
+	}
+	var client *echoclient.Client
+	var err error
+	if d.proxy != nil {
+		client, err = d.proxy.dial(dctx, addr, d.opts)
+	} else {
+		client, err = echoclient.Dial(dctx, addr, d.opts)
+	}
+	if err != nil {
+		return nil, dialError(ctx, err, addr, d.cfg)
+	}
+	conn := client.Conn()
+	if d.opts.Early {
+		// Resumption and 0-RTT are only known once the handshake completes.
+		d.logger.Info("connected early", "endpoint", addr, "remote", conn.RemoteAddr().String(), "quic_version", conn.ConnectionState().Version.String(), "alpn", conn.ConnectionState().TLS.NegotiatedProtocol)
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+				cs := conn.ConnectionState()
+				d.logger.Info("handshake complete", "resumed", cs.TLS.DidResume, "early_data", earlyData(cs))
+			case <-conn.Context().Done():
+			}
+		}()
+		return client, nil
+	}
+	d.logger.Info("connected", "endpoint", addr, "remote", conn.RemoteAddr().String(), "quic_version", conn.ConnectionState().Version.String(), "alpn", conn.ConnectionState().TLS.NegotiatedProtocol, "resumed", conn.ConnectionState().TLS.DidResume)
+	return client, nil
+}
+
+// earlyData describes what became of the 0-RTT data of a connection dialed
+// early, once its handshake completed: "accepted" by the server;
+// "not_accepted" if the session resumed without it, because the server
+// rejected it or its ticket did not allow it, so that it was sent again; or
+// "none" without a session to resume.
+func earlyData(cs quic.ConnectionState) string {
+	switch {
+	case cs.Used0RTT:
+		return "accepted"
+	case cs.TLS.DidResume:
+		return "not_accepted"
+	}
+	return "none"
+}
+
+// connect dials the server. With -reconnect, a dial that fails for a reason
+// that may pass is retried after a jittered, exponentially growing delay,
+// up to -reconnect-attempts times.
+func (d *dialer) connect(ctx context.Context) (*echoclient.Client, error) {
+	client, err := d.dial(ctx)
+	if !d.cfg.reconnect {
+		return client, err
+	}
+	b := backoff{next: d.cfg.reconnectDelay, max: d.cfg.reconnectMaxDelay}
+	for attempt := 1; err != nil; attempt++ {
+		if ctx.Err() != nil || !dialRetryable(err) || (d.cfg.reconnectAttempts > 0 && attempt > d.cfg.reconnectAttempts) {
+			return nil, err
+		}
+		delay := b.delay()
+		d.logger.Warn("connect failed, retrying", "attempt", attempt, "retry_in", delay.Round(time.Millisecond), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		client, err = d.dial(ctx)
+	}
+	return client, nil
+}
+
+// backoff yields exponentially growing delays with jitter.
+type backoff struct {
+	next, max time.Duration
+}
+
+// delay returns the delay before the next attempt and doubles the one after,
+// up to max. Half of each delay is random, so that clients that lost the
+// same link do not retry in lockstep.
+func (b *backoff) delay() time.Duration {
+	d := b.next
+	b.next = min(2*b.next, b.max)
+	return d/2 + rand.N(d/2+1)
+}
+
+// dialRetryable reports whether a dial that failed with err may succeed
+// later: not if the server and client cannot agree on a QUIC version or the
+// TLS handshake failed, e.g. on the certificate.
+func dialRetryable(err error) bool {
+	var (
+		verr *quic.VersionNegotiationError
+		terr *quic.TransportError
+	)
+	if errors.As(err, &verr) {
+		return false
+	}
+	return !errors.As(err, &terr) || !terr.ErrorCode.IsCryptoError()
+}
+
+// reconnectable reports whether an interactive session that ended with err
+// on conn may resume on a new connection: if the server shut down or the
+// connection was lost or stopped answering, but not if the server rejected
+// the client.
+func reconnectable(err error, conn *quic.Conn) bool {
+	var terr *timeoutError
+	switch {
+	case err == nil, errors.Is(err, errAuthRejected), echoclient.IsAuthFailed(err):
+		return false
+	case errors.Is(err, errServerShutdown), errors.As(err, &terr):
+		return true
+	}
+	return conn.Context().Err() != nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// alpnReverse is the ALPN identifier of the server's reverse tunnel
+// protocol. It must match the server's.
+const alpnReverse = "quic-reverse"
+
+// runReverse connects out to the server at addr with the reverse tunnel
+// protocol and relays every stream the server opens to a new TCP connection
+// to target, so that the server's reverse listener reaches target although
+// this side accepts no inbound connections. It runs until ctx is canceled or
+// the connection ends. If token is not empty, it is sent on a stream first to
+// authenticate.
+func runReverse(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, target string) error {
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, alpnReverse), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	if token != "" {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return fmt.Errorf("open stream: %w", err)
+		}
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+		_ = st.Close()
+	}
+	logger = logger.With("component", "reverse", "target", target)
+	logger.Info("waiting for reverse connections", "proxy", addr)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		st, err := conn.AcceptStream(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if echoclient.IsAuthFailed(err) {
+				return errAuthRejected
+			}
+			return fmt.Errorf("accept stream: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := logger.With("quic_id", st.StreamID())
+			if err := relayReverse(ctx, st, target, l); err != nil {
+				l.Warn("reverse connection failed", "err", err)
+			}
+		}()
+	}
+}
+
+// relayReverse connects st to a new TCP connection to target and relays
+// bytes in both directions until both sides are done.
+func relayReverse(ctx context.Context, st *quic.Stream, target string, l *slog.Logger) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		st.CancelWrite(errcode.TunnelError)
+		return fmt.Errorf("dial target: %w", err)
+	}
+	tc := c.(*net.TCPConn)
+	defer func() { _ = tc.Close() }()
+
+	start := time.Now()
+	up := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(tc, st)
+		_ = tc.CloseWrite()
+		up <- err
+	}()
+	n, derr := io.Copy(st, tc)
+	_ = st.Close()
+	if err := errors.Join(<-up, derr); err != nil {
+		st.CancelRead(errcode.TunnelError)
+		return fmt.Errorf("relay: %w", err)
+	}
+	l.Info("reverse connection done", "up_bytes", n, "dur", time.Since(start))
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/rpc"
+)
+
+// runRPC connects to addr with the rpc protocol and calls the server's
+// example services on a single stream: every line read from stdin is sent
+// to the Echo service, and /stats calls the Stats service. The reply and the
+// round trip of every call are printed. If token is not empty, it is sent
+// on the stream first to authenticate.
+func runRPC(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token string) error {
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, rpc.ALPN), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	logger = logger.With("component", "rpc")
+	logger.Info("connected", "remote", conn.RemoteAddr().String(), "quic_version", conn.ConnectionState().Version.String())
+
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if token != "" {
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+	}
+	client := rpc.NewClient(st)
+	defer func() { _ = client.Close() }()
+	logger.Info("stream opened", "quic_id", st.StreamID(), "commands", "<message> | /stats | /quit")
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				return fmt.Errorf("stdin scan: %w", err)
+			}
+			logger.Info("stdin closed")
+			return nil
+		}
+		line := input.Text()
+		switch strings.TrimSpace(line) {
+		case "":
+			continue
+		case "/quit", "/exit":
+			logger.Info("quit requested")
+			return nil
+		case "/stats":
+			start := time.Now()
+			s, err := rpc.GetStats(ctx, client)
+			if err != nil {
+				return rpcError(rpc.MethodStats, err)
+			}
+			fmt.Printf("stats: remote %s, smoothed rtt %s, min rtt %s, sent %d bytes in %d packets, %d lost, received %d bytes (%.3f ms)\n",
+				s.RemoteAddr, s.SmoothedRTT, s.MinRTT, s.BytesSent, s.PacketsSent, s.PacketsLost, s.BytesReceived, ms(time.Since(start)))
+			continue
+		}
+
+		start := time.Now()
+		echo, err := rpc.Echo(ctx, client, []byte(line))
+		if err != nil {
+			return rpcError(rpc.MethodEcho, err)
+		}
+		fmt.Printf("echo: %s (%.3f ms)\n", echo, ms(time.Since(start)))
+	}
+}
+
+// rpcError turns a failed call of method into the error to exit with.
+func rpcError(method string, err error) error {
+	var rerr *rpc.Error
+	switch {
+	case echoclient.IsAuthFailed(err):
+		return errAuthRejected
+	case errors.Is(err, context.Canceled):
+		return nil
+	case errors.As(err, &rerr):
+		return err
+	}
+	return fmt.Errorf("call %s: %w", method, err)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// defaultStepTimeout bounds a scenario step that waits for an echo if
+// neither the step nor the scenario sets a timeout.
+const defaultStepTimeout = 5 * time.Second
+
+// scenario is a test plan read from a -scenario file: a sequence of steps
+// run on one connection, in order, until one fails.
+//
+//	name: smoke
+//	timeout: 2s
+//	steps:
+//	  - send: hello
+//	  - send: "  padded"
+//	    expect: "  padded"
+//	    within: 500ms
+//	  - newstream: true
+//	  - sleep: 100ms
+//	  - datagram: ping
+//	  - uni: hello
+//	  - stats:
+//	      max_smoothed_rtt: 50ms
+//	      max_packets_lost: 0
+type scenario struct {
+	Name string `yaml:"name"`
+	// Timeout is the default of Within for every step.
+	Timeout time.Duration  `yaml:"timeout"`
+	Steps   []scenarioStep `yaml:"steps"`
+}
+
+// scenarioStep is a step of a scenario. Exactly one of its actions is set.
+type scenarioStep struct {
+	// Send, Uni and Datagram send a message on the current stream, over a
+	// pair of unidirectional streams or in a datagram, and expect its echo
+	// within Within. Expect replaces the message as the expected echo.
+	Send     *string       `yaml:"send"`
+	Uni      *string       `yaml:"uni"`
+	Datagram *string       `yaml:"datagram"`
+	Expect   *string       `yaml:"expect"`
+	Within   time.Duration `yaml:"within"`
+	// NewStream continues on a new stream.
+	NewStream bool `yaml:"newstream"`
+	// Sleep pauses the scenario.
+	Sleep time.Duration `yaml:"sleep"`
+	// Stats asserts the statistics of the connection.
+	Stats *statsAssertion `yaml:"stats"`
+}
+
+// statsAssertion bounds the statistics of the connection, see connStats.
+// Unset fields are not checked.
+type statsAssertion struct {
+	MaxSmoothedRTT time.Duration `yaml:"max_smoothed_rtt"`
+	MaxPacketsLost *uint64       `yaml:"max_packets_lost"`
+	MaxBytesLost   *uint64       `yaml:"max_bytes_lost"`
+	MinBidiStreams int64         `yaml:"min_bidi_streams"`
+	Resumed        *bool         `yaml:"resumed"`
+}
+
+// loadScenario reads and checks the scenario in the YAML file path.
+// Unknown keys are errors, so that a misspelled assertion is not silently
+// skipped.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var sc scenario
+	if err := dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i, s := range sc.Steps {
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", path, i+1, err)
+		}
+	}
+	if sc.Name == "" {
+		sc.Name = path
+	}
+	if sc.Timeout <= 0 {
+		sc.Timeout = defaultStepTimeout
+	}
+	return &sc, nil
+}
+
+// check checks that s sets exactly one action, and only the options that
+// apply to it.
+func (s scenarioStep) check() error {
+	actions := 0
+	for _, set := range []bool{s.Send != nil, s.Uni != nil, s.Datagram != nil, s.NewStream, s.Sleep > 0, s.Stats != nil} {
+		if set {
+			actions++
+		}
+	}
+	switch {
+	case actions != 1:
+		return errors.New("want exactly one of send, uni, datagram, newstream, sleep or stats")
+	case s.Send == nil && s.Uni == nil && s.Datagram == nil && (s.Expect != nil || s.Within != 0):
+		return errors.New("expect and within only apply to send, uni and datagram")
+	case s.Within < 0:
+		return errors.New("within must not be negative")
+	}
+	return nil
+}
+
+// String describes s for the report.
+func (s scenarioStep) String() string {
+	switch {
+	case s.Send != nil:
+		return fmt.Sprintf("send %.40q", *s.Send)
+	case s.Uni != nil:
+		return fmt.Sprintf("uni %.40q", *s.Uni)
+	case s.Datagram != nil:
+		return fmt.Sprintf("datagram %.40q", *s.Datagram)
+	case s.NewStream:
+		return "newstream"
+	case s.Sleep > 0:
+		return "sleep " + s.Sleep.String()
+	}
+	return "stats"
+}
+
+// expected returns the echo s expects for msg.
+func (s scenarioStep) expected(msg string) string {
+	if s.Expect != nil {
+		return *s.Expect
+	}
+	return msg
+}
+
+// scenarioRun is the state of a scenario being run on a connection.
+type scenarioRun struct {
+	sc      *scenario
+	client  *echoclient.Client
+	cfg     config
+	st      *echoclient.Stream
+	hist    *rttHist
+	jsonOut bool
+}
+
+// runScenario runs sc on client and reports every step, failing on the
+// first step that fails. Echo round trips are recorded in hist.
+func runScenario(ctx context.Context, logger *slog.Logger, client *echoclient.Client, sc *scenario, cfg config, hist *rttHist, jsonOut bool) error {
+	l := logger.With("component", "scenario", "name", sc.Name)
+	st, err := openStream(ctx, client, streamOptions(cfg))
+	if err != nil {
+		return err
+	}
+	r := &scenarioRun{sc: sc, client: client, cfg: cfg, st: st, hist: hist, jsonOut: jsonOut}
+	defer func() { _ = r.st.Close() }()
+
+	start := time.Now()
+	for i, step := range sc.Steps {
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted at step %d", i+1)
+		}
+		began := time.Now()
+		err := r.step(ctx, step)
+		dur := time.Since(began)
+		if r.jsonOut {
+			rec := opRecord{Op: "step", StreamID: int64(r.st.QUICStream().StreamID()), Name: step.String(), DurMs: ms(dur)}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			printRecord(rec)
+		} else {
+			verdict := "ok"
+			if err != nil {
+				verdict = "FAIL: " + err.Error()
+			}
+			fmt.Printf("step %d/%d %s: %s (%.3f ms)\n", i+1, len(sc.Steps), step, verdict, ms(dur))
+		}
+		if err != nil {
+			return fmt.Errorf("scenario %s: step %d, %s: %w", sc.Name, i+1, step, err)
+		}
+	}
+	l.Info("scenario passed", "steps", len(sc.Steps), "dur", time.Since(start))
+	if !r.jsonOut {
+		fmt.Printf("scenario %s: passed %d steps\n", sc.Name, len(sc.Steps))
+	}
+	return nil
+}
+
+// step runs s.
+func (r *scenarioRun) step(ctx context.Context, s scenarioStep) error {
+	within := s.Within
+	if within == 0 {
+		within = r.sc.Timeout
+	}
+	switch {
+	case s.Send != nil:
+		return r.echo(ctx, *s.Send, s.expected(*s.Send), within)
+	case s.Uni != nil:
+		return r.uni(ctx, *s.Uni, s.expected(*s.Uni), within)
+	case s.Datagram != nil:
+		return r.datagram(ctx, *s.Datagram, s.expected(*s.Datagram), within)
+	case s.NewStream:
+		next, err := openStream(ctx, r.client, streamOptions(r.cfg))
+		if err != nil {
+			return err
+		}
+		_ = r.st.Close()
+		r.st = next
+		return nil
+	case s.Sleep > 0:
+		select {
+		case <-time.After(s.Sleep):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.Stats.check(collectStats(r.client))
+}
+
+// echo sends msg on the current stream and expects want back within
+// timeout.
+func (r *scenarioRun) echo(ctx context.Context, msg, want string, timeout time.Duration) error {
+	sctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	if err := r.st.Send(sctx, []byte(msg)); err != nil {
+		return stepError("send", timeout, err)
+	}
+	var echo strings.Builder
+	if _, err := r.st.Receive(sctx, &echo); err != nil {
+		return stepError("read echo", timeout, err)
+	}
+	r.hist.record(time.Since(start))
+	return matchEcho(echo.String(), want)
+}
+
+// uni sends msg over a pair of unidirectional streams and expects want back
+// within timeout.
+func (r *scenarioRun) uni(ctx context.Context, msg, want string, timeout time.Duration) error {
+	sctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	echo, err := r.client.EchoUni(sctx, []byte(msg))
+	if err != nil {
+		return stepError("uni echo", timeout, err)
+	}
+	r.hist.record(time.Since(start))
+	return matchEcho(string(echo), want)
+}
+
+// datagram sends msg in a datagram and expects a datagram equal to want
+// within timeout. Other datagrams, such as late echoes of earlier steps,
+// are skipped.
+func (r *scenarioRun) datagram(ctx context.Context, msg, want string, timeout time.Duration) error {
+	conn := r.client.Conn()
+	if !conn.ConnectionState().SupportsDatagrams {
+		return errors.New("server does not support datagrams")
+	}
+	sctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := conn.SendDatagram([]byte(msg)); err != nil {
+		return fmt.Errorf("send datagram: %w", err)
+	}
+	for {
+		p, err := conn.ReceiveDatagram(sctx)
+		if err != nil {
+			return stepError("receive datagram", timeout, err)
+		}
+		if string(p) == want {
+			return nil
+		}
+	}
+}
+
+// check checks s against a.
+func (a *statsAssertion) check(s connStats) error {
+	var failed []string
+	if a.MaxSmoothedRTT > 0 && s.SmoothedRTTMs > ms(a.MaxSmoothedRTT) {
+		failed = append(failed, fmt.Sprintf("smoothed RTT %.3f ms > %s", s.SmoothedRTTMs, a.MaxSmoothedRTT))
+	}
+	if a.MaxPacketsLost != nil && s.PacketsLost > *a.MaxPacketsLost {
+		failed = append(failed, fmt.Sprintf("%d packets lost > %d", s.PacketsLost, *a.MaxPacketsLost))
+	}
+	if a.MaxBytesLost != nil && s.BytesLost > *a.MaxBytesLost {
+		failed = append(failed, fmt.Sprintf("%d bytes lost > %d", s.BytesLost, *a.MaxBytesLost))
+	}
+	if s.BidiStreams < a.MinBidiStreams {
+		failed = append(failed, fmt.Sprintf("%d streams opened < %d", s.BidiStreams, a.MinBidiStreams))
+	}
+	if a.Resumed != nil && s.Resumed != *a.Resumed {
+		failed = append(failed, fmt.Sprintf("resumed is %t", s.Resumed))
+	}
+	if failed != nil {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// matchEcho checks that the echo got is want.
+func matchEcho(got, want string) error {
+	if got != want {
+		return fmt.Errorf("echo %.80q does not match %.80q", got, want)
+	}
+	return nil
+}
+
+// stepError describes the failure of op in a step that waits up to
+// timeout.
+func stepError(op string, timeout time.Duration, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s: nothing within %s", op, timeout)
+	}
+	if echoclient.IsAuthFailed(err) {
+		return errAuthRejected
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
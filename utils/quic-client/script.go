@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// mismatchError reports an echo that differs from the line sent.
+type mismatchError struct {
+	line int
+	sent []byte
+	got  []byte
+}
+
+// Error implements error. Long lines are cut short.
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("line %d: echo %.80q does not match %.80q", e.line, e.got, e.sent)
+}
+
+// runScript sends every line read from stdin on st and checks that the echo
+// matches it, for use in test scripts. It fails on the first mismatch, or if
+// a line is not echoed within timeout, and succeeds once stdin is exhausted.
+// The round trips are recorded in hist. With jsonOut, a record is printed
+// for every line.
+func runScript(ctx context.Context, logger *slog.Logger, st *echoclient.Stream, timeout time.Duration, hist *rttHist, jsonOut bool) error {
+	l := logger.With("component", "script", "quic_id", st.QUICStream().StreamID())
+	input := bufio.NewScanner(os.Stdin)
+	// Lines longer than the server accepts fail to scan.
+	input.Buffer(nil, st.MaxMsg()+1)
+
+	start := time.Now()
+	var lines, total int
+	var echo bytes.Buffer
+	for input.Scan() {
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted after %d lines", lines)
+		}
+		lines++
+		line := input.Bytes()
+		sent := time.Now()
+		_ = st.QUICStream().SetDeadline(sent.Add(timeout))
+
+		echo.Reset()
+		err := st.Send(ctx, line)
+		if err != nil {
+			err = scriptError(lines, "send", timeout, err)
+		} else if _, err = st.Receive(ctx, &echo); err != nil {
+			err = scriptError(lines, "read echo", timeout, err)
+		} else if !bytes.Equal(echo.Bytes(), line) {
+			err = &mismatchError{line: lines, sent: bytes.Clone(line), got: bytes.Clone(echo.Bytes())}
+		}
+		rtt := time.Since(sent)
+		if err == nil {
+			hist.record(rtt)
+		}
+		if jsonOut {
+			rec := opRecord{Op: "echo", StreamID: int64(st.QUICStream().StreamID()), Sent: len(line), RTTMs: ms(rtt)}
+			if echo.Len() > 0 || err == nil {
+				echoed := echo.String()
+				rec.Echoed, rec.Echo = echo.Len(), &echoed
+			}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			printRecord(rec)
+		}
+		if err != nil {
+			return err
+		}
+		total += len(line) + 1
+		l.Debug("line echoed", "line", lines, "bytes", len(line))
+	}
+	if err := input.Err(); err != nil {
+		return fmt.Errorf("line %d: stdin: %w", lines+1, err)
+	}
+	l.Info("all lines echoed", "lines", lines, "bytes", total, "dur", time.Since(start))
+	return nil
+}
+
+// scriptError describes the failure of op for line number line.
+func scriptError(line int, op string, timeout time.Duration, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("line %d: no echo within %s", line, timeout)
+	}
+	if echoclient.IsAuthFailed(err) {
+		return errAuthRejected
+	}
+	return fmt.Errorf("line %d: %s: %w", line, op, err)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionFileVersion is bumped whenever the layout of sessionFile changes.
+const sessionFileVersion = 1
+
+// sessionFile is the on-disk form of exported client session state. It lets
+// a replacement client process resume the TLS session of the process it
+// replaces and keep the options that were negotiated with the server.
+//
+// QUIC address validation tokens (NEW_TOKEN) are not included: quic-go keeps
+// them opaque, so the new process may need one extra round trip if the
+// server requires address validation.
+type sessionFile struct {
+	Version    int             `json:"version"`
+	Addr       string          `json:"addr"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Tickets    []sessionTicket `json:"tickets"`
+
+	MaxMsg   int  `json:"max_msg"`
+	E2E      bool `json:"e2e"`
+	Compress bool `json:"compress,omitempty"`
+}
+
+// sessionTicket is a TLS resumption ticket together with its client state.
+// The key identifies the server, as chosen by crypto/tls.
+type sessionTicket struct {
+	Key     string    `json:"key"`
+	Ticket  []byte    `json:"ticket"`
+	State   []byte    `json:"state"`
+	SavedAt time.Time `json:"saved_at,omitzero"`
+}
+
+// cachedSession is a session remembered by an exportableCache.
+type cachedSession struct {
+	cs    *tls.ClientSessionState
+	saved time.Time
+}
+
+// exportableCache is a [tls.ClientSessionCache] that remembers the latest
+// session stored for each key so that it can be exported.
+type exportableCache struct {
+	tls.ClientSessionCache
+
+	mu     sync.Mutex
+	latest map[string]cachedSession
+	// onPut, if set, is called after every session stored or removed.
+	onPut func()
+}
+
+// newExportableCache returns an empty exportable session cache.
+func newExportableCache() *exportableCache {
+	return &exportableCache{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		latest:             make(map[string]cachedSession),
+	}
+}
+
+// Put implements [tls.ClientSessionCache].
+func (c *exportableCache) Put(key string, cs *tls.ClientSessionState) {
+	c.put(key, cs, time.Now())
+	if c.onPut != nil {
+		c.onPut()
+	}
+}
+
+// put stores cs for key as saved at the given time.
+func (c *exportableCache) put(key string, cs *tls.ClientSessionState, saved time.Time) {
+	c.mu.Lock()
+	if cs == nil {
+		delete(c.latest, key)
+	} else {
+		c.latest[key] = cachedSession{cs: cs, saved: saved}
+	}
+	c.mu.Unlock()
+	c.ClientSessionCache.Put(key, cs)
+}
+
+// export serializes the remembered sessions.
+func (c *exportableCache) export() ([]sessionTicket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tickets := make([]sessionTicket, 0, len(c.latest))
+	for key, cached := range c.latest {
+		ticket, state, err := cached.cs.ResumptionState()
+		if err != nil {
+			return nil, fmt.Errorf("resumption state for %q: %w", key, err)
+		}
+		if state == nil {
+			continue
+		}
+		b, err := state.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("encode session state for %q: %w", key, err)
+		}
+		tickets = append(tickets, sessionTicket{Key: key, Ticket: ticket, State: b, SavedAt: cached.saved})
+	}
+	return tickets, nil
+}
+
+// load adds previously exported tickets to the cache. Tickets without a
+// save time count as saved now.
+func (c *exportableCache) load(tickets []sessionTicket) error {
+	for _, t := range tickets {
+		state, err := tls.ParseSessionState(t.State)
+		if err != nil {
+			return fmt.Errorf("parse session state for %q: %w", t.Key, err)
+		}
+		cs, err := tls.NewResumptionState(t.Ticket, state)
+		if err != nil {
+			return fmt.Errorf("restore session for %q: %w", t.Key, err)
+		}
+		saved := t.SavedAt
+		if saved.IsZero() {
+			saved = time.Now()
+		}
+		c.put(t.Key, cs, saved)
+	}
+	return nil
+}
+
+// readSessionFile reads exported session state from path.
+func readSessionFile(path string) (*sessionFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sf sessionFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if sf.Version != sessionFileVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", path, sf.Version)
+	}
+	return &sf, nil
+}
+
+// writeSessionFile atomically writes sf to path.
+func writeSessionFile(path string, sf *sessionFile) error {
+	return writeSecretJSON(path, sf)
+}
+
+// writeSecretJSON atomically writes v as JSON to path. The files hold secret
+// resumption material and are therefore only readable by the owner. Every
+// writer uses a temporary file of its own, so that concurrent processes
+// never interleave.
+func writeSecretJSON(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
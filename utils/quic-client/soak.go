@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// Thresholds of the disruptions -soak records.
+const (
+	// lossSpikeRatio is the share of the packets sent in a report interval
+	// that must be lost for a loss spike.
+	lossSpikeRatio = 0.02
+	// lossSpikeMin is the fewest packets lost in a report interval that
+	// count as a loss spike, so that a single loss on an idle link does
+	// not.
+	lossSpikeMin = 5
+)
+
+// Kinds of disruptions recorded by -soak.
+const (
+	disruptEcho      = "echo_failed"
+	disruptCorrupt   = "echo_corrupt"
+	disruptPath      = "path_changed"
+	disruptLoss      = "loss_spike"
+	disruptReconnect = "reconnected"
+)
+
+// soakReport is the rolling report -soak logs every interval. The counts
+// and RTT are those of the interval; Reconnects and Disruptions are totals.
+type soakReport struct {
+	UptimeS       float64      `json:"uptime_s"`
+	Echoes        int          `json:"echoes"`
+	Errors        int          `json:"errors"`
+	RTT           *histSummary `json:"rtt_ms"`
+	SmoothedRTTMs float64      `json:"smoothed_rtt_ms"`
+	BytesSent     uint64       `json:"bytes_sent"`
+	BytesReceived uint64       `json:"bytes_received"`
+	PacketsSent   uint64       `json:"packets_sent"`
+	PacketsLost   uint64       `json:"packets_lost"`
+	Reconnects    int          `json:"reconnects"`
+	Disruptions   int          `json:"disruptions"`
+	LocalAddr     string       `json:"local_addr"`
+	RemoteAddr    string       `json:"remote_addr"`
+}
+
+// soak keeps a connection busy with periodic echoes for -soak and records
+// whatever disrupts it.
+type soak struct {
+	d       *dialer
+	client  *echoclient.Client
+	st      *echoclient.Stream
+	cfg     config
+	l       *slog.Logger
+	hist    *rttHist
+	jsonOut bool
+
+	start time.Time
+	seq   int
+	// interval collects the echoes since the last report, and last the
+	// connection statistics at it.
+	interval       *rttHist
+	echoes, errors int
+	last           connStats
+	local, remote  string
+
+	reconnects  int
+	disruptions map[string]int
+}
+
+// runSoak echoes a message every -soak-echo-interval on client for -soak,
+// reconnecting through d whenever the connection is lost, and logs rolling
+// statistics every -soak-interval. It records as disruptions failed and
+// corrupt echoes, changes of the connection's path, spikes of packet loss
+// and reconnects, and fails at the end if there were any. Echo round trips
+// are recorded in hist.
+func runSoak(ctx context.Context, logger *slog.Logger, d *dialer, client *echoclient.Client, cfg config, hist *rttHist, jsonOut bool) error {
+	s := &soak{
+		d:           d,
+		client:      client,
+		cfg:         cfg,
+		l:           logger.With("component", "soak"),
+		hist:        hist,
+		jsonOut:     jsonOut,
+		start:       time.Now(),
+		interval:    new(rttHist),
+		disruptions: make(map[string]int),
+	}
+	// Ride out any outage for as long as the soak runs.
+	d.cfg.reconnect = true
+	defer func() { _ = s.client.Close() }()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.soak)
+	defer cancel()
+	if err := s.connected(ctx); err != nil {
+		return err
+	}
+	defer func() { _ = s.st.Close() }()
+	s.l.Info("soak started", "duration", cfg.soak, "interval", cfg.soakInterval, "echo_interval", cfg.soakEchoInterval)
+
+	echoes := time.NewTicker(cfg.soakEchoInterval)
+	defer echoes.Stop()
+	reports := time.NewTicker(cfg.soakInterval)
+	defer reports.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.report()
+			return s.finish()
+		case <-reports.C:
+			s.report()
+		case <-echoes.C:
+			if err := s.echo(ctx); err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				return err
+			}
+		}
+	}
+}
+
+// connected opens the stream of a new connection and notes its path.
+func (s *soak) connected(ctx context.Context) error {
+	st, err := openStream(ctx, s.client, streamOptions(s.cfg))
+	if err != nil {
+		return err
+	}
+	s.st = st
+	conn := s.client.Conn()
+	s.local, s.remote = conn.LocalAddr().String(), conn.RemoteAddr().String()
+	s.last = collectStats(s.client)
+	return nil
+}
+
+// echo sends the next message and checks its echo. A failed echo is
+// recorded, and the session continues on a new stream, or on a new
+// connection if the connection was lost. It returns an error only if no new
+// connection can be made.
+func (s *soak) echo(ctx context.Context) error {
+	s.checkPath()
+	s.seq++
+	msg := fmt.Sprintf("soak %d %s", s.seq, time.Now().Format(time.RFC3339Nano))
+	opCtx, cancel := opContext(ctx, s.cfg)
+	defer cancel()
+	start := time.Now()
+	err := s.st.Send(opCtx, []byte(msg))
+	var echo strings.Builder
+	if err == nil {
+		_, err = s.st.Receive(opCtx, &echo)
+	}
+	if err == nil && echo.String() != msg {
+		s.errors++
+		s.disrupt(disruptCorrupt, "seq", s.seq, "echo", fmt.Sprintf("%.80q", echo.String()))
+		return s.recover(ctx, false)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.errors++
+		lost := s.client.Conn().Context().Err() != nil
+		terr := opTimeout(ctx, err, "echo", s.cfg)
+		if terr != nil {
+			err = terr
+		}
+		s.disrupt(disruptEcho, "seq", s.seq, "connection_lost", lost, "err", err)
+		return s.recover(ctx, lost || terr != nil)
+	}
+	rtt := time.Since(start)
+	s.echoes++
+	s.interval.record(rtt)
+	s.hist.record(rtt)
+	return nil
+}
+
+// recover continues after a failed echo on a new stream, or with reconnect
+// or if that fails, on a new connection.
+func (s *soak) recover(ctx context.Context, reconnect bool) error {
+	_ = s.st.Close()
+	if !reconnect {
+		if err := s.connected(ctx); err == nil {
+			return nil
+		}
+	}
+	_ = s.client.Close()
+	down := time.Now()
+	client, err := s.d.connect(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	s.client = client
+	s.reconnects++
+	s.disrupt(disruptReconnect, "downtime", time.Since(down).Round(time.Millisecond), "remote", client.Conn().RemoteAddr().String())
+	return s.connected(ctx)
+}
+
+// checkPath records a change of the local or remote address of the
+// connection, such as a migration or a NAT rebinding.
+func (s *soak) checkPath() {
+	conn := s.client.Conn()
+	local, remote := conn.LocalAddr().String(), conn.RemoteAddr().String()
+	if local == s.local && remote == s.remote {
+		return
+	}
+	s.disrupt(disruptPath, "from_local", s.local, "to_local", local, "from_remote", s.remote, "to_remote", remote)
+	s.local, s.remote = local, remote
+}
+
+// disrupt records a disruption of kind, described by attrs.
+func (s *soak) disrupt(kind string, attrs ...any) {
+	s.disruptions[kind]++
+	s.l.Warn("disruption", append([]any{"kind", kind}, attrs...)...)
+	if s.jsonOut {
+		var details []string
+		for i := 0; i+1 < len(attrs); i += 2 {
+			details = append(details, fmt.Sprintf("%v=%v", attrs[i], attrs[i+1]))
+		}
+		printRecord(opRecord{Op: "disruption", StreamID: -1, Name: kind, Error: strings.Join(details, " ")})
+	}
+}
+
+// report logs the statistics of the interval since the last report and
+// records a loss spike in it.
+func (s *soak) report() {
+	cur := collectStats(s.client)
+	sent := cur.PacketsSent - min(s.last.PacketsSent, cur.PacketsSent)
+	lost := cur.PacketsLost - min(s.last.PacketsLost, cur.PacketsLost)
+	if lost >= lossSpikeMin && float64(lost) > lossSpikeRatio*float64(sent) {
+		s.disrupt(disruptLoss, "packets_lost", lost, "packets_sent", sent)
+	}
+	conn := s.client.Conn()
+	r := soakReport{
+		UptimeS:       time.Since(s.start).Seconds(),
+		Echoes:        s.echoes,
+		Errors:        s.errors,
+		RTT:           s.interval.summary(),
+		SmoothedRTTMs: cur.SmoothedRTTMs,
+		BytesSent:     cur.BytesSent - min(s.last.BytesSent, cur.BytesSent),
+		BytesReceived: cur.BytesReceived - min(s.last.BytesReceived, cur.BytesReceived),
+		PacketsSent:   sent,
+		PacketsLost:   lost,
+		Reconnects:    s.reconnects,
+		Disruptions:   s.totalDisruptions(),
+		LocalAddr:     conn.LocalAddr().String(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+	}
+	s.last, s.interval, s.echoes, s.errors = cur, new(rttHist), 0, 0
+
+	if s.jsonOut {
+		printRecord(opRecord{Op: "soak", StreamID: int64(s.st.QUICStream().StreamID()), RTTMs: r.SmoothedRTTMs, Soak: &r})
+	}
+	s.l.Info("soak stats",
+		"uptime", time.Duration(r.UptimeS*float64(time.Second)).Round(time.Second),
+		"echoes", r.Echoes,
+		"errors", r.Errors,
+		"rtt_p50_ms", r.RTT.P50,
+		"rtt_p99_ms", r.RTT.P99,
+		"rtt_max_ms", r.RTT.Max,
+		"smoothed_rtt_ms", r.SmoothedRTTMs,
+		"bytes_sent", r.BytesSent,
+		"bytes_received", r.BytesReceived,
+		"packets_lost", r.PacketsLost,
+		"reconnects", r.Reconnects,
+		"disruptions", r.Disruptions,
+	)
+}
+
+// totalDisruptions returns the number of disruptions recorded.
+func (s *soak) totalDisruptions() int {
+	var n int
+	for _, c := range s.disruptions {
+		n += c
+	}
+	return n
+}
+
+// finish logs the outcome of the soak and returns an error listing the
+// disruptions, if there were any.
+func (s *soak) finish() error {
+	n := s.totalDisruptions()
+	s.l.Info("soak done", "uptime", time.Since(s.start).Round(time.Second), "echoes", s.hist.total, "reconnects", s.reconnects, "disruptions", n)
+	if n == 0 {
+		return nil
+	}
+	kinds := make([]string, 0, len(s.disruptions))
+	for _, kind := range slices.Sorted(maps.Keys(s.disruptions)) {
+		kinds = append(kinds, fmt.Sprintf("%d %s", s.disruptions[kind], kind))
+	}
+	return errors.New("soak: disruptions: " + strings.Join(kinds, ", "))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// alpnProxy is the ALPN identifier of the server's proxy protocol. It must
+// match the server's.
+const alpnProxy = "quic-proxy"
+
+// SOCKS5 (RFC 1928) constants used by the listener.
+const (
+	socksVersion     = 0x05
+	socksNoAuth      = 0x00
+	socksNoMethods   = 0xff
+	socksCmdConnect  = 0x01
+	socksAtypIPv4    = 0x01
+	socksAtypDomain  = 0x03
+	socksAtypIPv6    = 0x04
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksNetUnreach  = 0x03
+	socksRefused     = 0x05
+	socksCmdNotSupp  = 0x07
+	socksAtypNotSupp = 0x08
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation of a local connection.
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksProxy forwards the TCP connections accepted by a local SOCKS5
+// listener over streams of a single QUIC connection to the server, which
+// dials their targets.
+type socksProxy struct {
+	conn *quic.Conn
+
+	// mu serializes opening streams while the token is still to be sent,
+	// so that it goes out first on the first stream.
+	mu    sync.Mutex
+	token string
+}
+
+// runSOCKS connects to addr with the proxy protocol and serves SOCKS5 CONNECT
+// requests on listen until ctx is canceled. If token is not empty, it is sent
+// on the first stream to authenticate.
+func runSOCKS(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, listen string) error {
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, alpnProxy), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-conn.Context().Done():
+		}
+		_ = ln.Close()
+	}()
+	logger = logger.With("component", "socks")
+	logger.Info("SOCKS5 listener ready", "listen", ln.Addr().String(), "proxy", addr)
+
+	p := &socksProxy{conn: conn, token: token}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if cause := context.Cause(conn.Context()); cause != nil {
+				return fmt.Errorf("connection lost: %w", cause)
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { _ = c.Close() }()
+			l := logger.With("local", c.RemoteAddr().String())
+			if err := p.serve(ctx, c.(*net.TCPConn), l); err != nil {
+				l.Warn("SOCKS connection failed", "err", err)
+			}
+		}()
+	}
+}
+
+// serve negotiates SOCKS5 on c and relays it over a new stream to the
+// target the client asks for.
+func (p *socksProxy) serve(ctx context.Context, c *net.TCPConn, l *slog.Logger) error {
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(c)
+	target, err := socksHandshake(br, c)
+	if err != nil {
+		return fmt.Errorf("socks handshake: %w", err)
+	}
+	l = l.With("target", target)
+
+	st, err := p.openStream(ctx)
+	if err != nil {
+		_ = socksReply(c, socksFailure)
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if _, err := io.WriteString(st, target+"\n"); err != nil {
+		_ = socksReply(c, socksFailure)
+		return fmt.Errorf("send target: %w", err)
+	}
+	sr := bufio.NewReader(st)
+	reply, err := sr.ReadString('\n')
+	if err != nil {
+		_ = socksReply(c, socksFailure)
+		return fmt.Errorf("read reply: %w", err)
+	}
+	if reason, failed := strings.CutPrefix(strings.TrimSpace(reply), "ERR "); failed {
+		code := byte(socksFailure)
+		switch reason {
+		case "refused":
+			code = socksRefused
+		case "unreachable":
+			code = socksNetUnreach
+		}
+		_ = socksReply(c, code)
+		l.Info("target not reachable", "reason", reason)
+		return nil
+	}
+	if err := socksReply(c, socksSucceeded); err != nil {
+		st.CancelRead(0)
+		st.CancelWrite(0)
+		return fmt.Errorf("socks reply: %w", err)
+	}
+	_ = c.SetDeadline(time.Time{})
+	l.Debug("proxying")
+
+	start := time.Now()
+	up := make(chan error, 1)
+	go func() {
+		// The client may have sent data right after its request.
+		_, err := io.Copy(st, br)
+		_ = st.Close()
+		up <- err
+	}()
+	n, derr := io.Copy(c, sr)
+	_ = c.CloseWrite()
+	if err := errors.Join(<-up, derr); err != nil {
+		st.CancelRead(0)
+		return fmt.Errorf("relay: %w", err)
+	}
+	l.Info("proxy done", "down_bytes", n, "dur", time.Since(start))
+	return nil
+}
+
+// openStream opens a stream to the server, sending the token on it first if
+// it is the first stream.
+func (p *socksProxy) openStream(ctx context.Context) (*quic.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, err := p.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		if _, err := io.WriteString(st, p.token+"\n"); err != nil {
+			st.CancelRead(0)
+			st.CancelWrite(0)
+			return nil, fmt.Errorf("send token: %w", err)
+		}
+		p.token = ""
+	}
+	return st, nil
+}
+
+// socksHandshake reads the method selection and CONNECT request of a SOCKS5
+// client from br, answering on w, and returns the requested target as
+// host:port. Only the no-authentication method and CONNECT are supported.
+func socksHandshake(br *bufio.Reader, w io.Writer) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoMethods)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoMethods {
+		return "", errors.New("client offers no supported authentication method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = socksReply(w, socksAtypNotSupp)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		_ = socksReply(w, socksCmdNotSupp)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply sends a SOCKS5 reply with code. The bound address is not
+// meaningful for a proxied connection and is sent as 0.0.0.0:0.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
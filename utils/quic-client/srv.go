@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV resolves the SRV records of name, e.g.
+// _quic-echo._udp.example.com, to the host:port addresses of their targets
+// in the order to try them: by priority, and at random by weight among the
+// records of the same priority (RFC 2782).
+func lookupSRV(ctx context.Context, name string) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, r := range records {
+		target := strings.TrimSuffix(r.Target, ".")
+		if target == "" {
+			// A lone "." target means the service is not offered.
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(r.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("the service is not available at the domain")
+	}
+	return addrs, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// connStats is the state and statistics of the connection printed by
+// /stats.
+type connStats struct {
+	Version   string `json:"quic_version"`
+	ALPN      string `json:"alpn"`
+	Resumed   bool   `json:"resumed"`
+	Used0RTT  bool   `json:"used_0rtt"`
+	Datagrams bool   `json:"datagrams"`
+
+	MinRTTMs      float64 `json:"min_rtt_ms"`
+	SmoothedRTTMs float64 `json:"smoothed_rtt_ms"`
+	LatestRTTMs   float64 `json:"latest_rtt_ms"`
+	RTTVarMs      float64 `json:"rtt_var_ms"`
+
+	BytesSent       uint64 `json:"bytes_sent"`
+	BytesReceived   uint64 `json:"bytes_received"`
+	BytesLost       uint64 `json:"bytes_lost"`
+	PacketsSent     uint64 `json:"packets_sent"`
+	PacketsReceived uint64 `json:"packets_received"`
+	PacketsLost     uint64 `json:"packets_lost"`
+
+	BidiStreams int64 `json:"bidi_streams_opened"`
+	UniStreams  int64 `json:"uni_streams_opened"`
+
+	// Compression is set for a stream that compresses its messages.
+	Compression *compressionStats `json:"compression,omitempty"`
+}
+
+// compressionStats are the bytes of the messages of a compressed stream,
+// in both directions, raw and as carried on the stream.
+type compressionStats struct {
+	RawBytes  uint64  `json:"raw_bytes"`
+	WireBytes uint64  `json:"wire_bytes"`
+	Ratio     float64 `json:"ratio"`
+}
+
+// collectStats reads the current state and statistics of client's
+// connection.
+func collectStats(client *echoclient.Client) connStats {
+	s := client.Stats()
+	return connStats{
+		Version:   s.Version.String(),
+		ALPN:      s.ALPN,
+		Resumed:   s.Resumed,
+		Used0RTT:  s.Used0RTT,
+		Datagrams: s.Datagrams,
+
+		MinRTTMs:      ms(s.MinRTT),
+		SmoothedRTTMs: ms(s.SmoothedRTT),
+		LatestRTTMs:   ms(s.LatestRTT),
+		RTTVarMs:      ms(s.RTTVar),
+
+		BytesSent:       s.BytesSent,
+		BytesReceived:   s.BytesReceived,
+		BytesLost:       s.BytesLost,
+		PacketsSent:     s.PacketsSent,
+		PacketsReceived: s.PacketsReceived,
+		PacketsLost:     s.PacketsLost,
+
+		BidiStreams: s.BidiStreams,
+		UniStreams:  s.UniStreams,
+	}
+}
+
+// printStats prints the state and statistics of client's connection, and
+// the compression ratio of st if it compresses its messages, as a record
+// with jsonOut.
+func printStats(client *echoclient.Client, st *echoclient.Stream, jsonOut bool) {
+	s := collectStats(client)
+	if st.Compressed() {
+		c := st.Compression()
+		s.Compression = &compressionStats{
+			RawBytes:  c.RawSent + c.RawReceived,
+			WireBytes: c.WireSent + c.WireReceived,
+			Ratio:     c.Ratio(),
+		}
+	}
+	if jsonOut {
+		printRecord(opRecord{Op: "stats", StreamID: -1, RTTMs: s.SmoothedRTTMs, Stats: &s})
+		return
+	}
+	fmt.Printf("connection: %s, alpn %s, resumed %t, 0-rtt %t, datagrams %t\n",
+		s.Version, s.ALPN, s.Resumed, s.Used0RTT, s.Datagrams)
+	fmt.Printf("  rtt:     min %.3f ms, smoothed %.3f ms, latest %.3f ms, var %.3f ms\n",
+		s.MinRTTMs, s.SmoothedRTTMs, s.LatestRTTMs, s.RTTVarMs)
+	fmt.Printf("  sent:    %d bytes in %d packets\n", s.BytesSent, s.PacketsSent)
+	fmt.Printf("  recv:    %d bytes in %d packets\n", s.BytesReceived, s.PacketsReceived)
+	fmt.Printf("  lost:    %d bytes in %d packets\n", s.BytesLost, s.PacketsLost)
+	fmt.Printf("  streams: %d bidirectional, %d unidirectional opened\n", s.BidiStreams, s.UniStreams)
+	if c := s.Compression; c != nil {
+		fmt.Printf("  zstd:    %d bytes of messages in %d bytes, ratio %.2f\n", c.RawBytes, c.WireBytes, c.Ratio)
+	}
+}
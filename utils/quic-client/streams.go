@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// streamResult is the outcome of the traffic on one stream of -streams.
+type streamResult struct {
+	id       int64
+	messages int
+	bytes    int
+	rttSum   time.Duration
+	rttMax   time.Duration
+	dur      time.Duration
+	err      error
+}
+
+// runStreams opens cfg.streams streams on client and echoes
+// cfg.streamsMessages messages of cfg.streamsSize bytes on all of them
+// concurrently, verifying every echo. It reports the results of each stream
+// and in aggregate, and fails if any stream did.
+func runStreams(ctx context.Context, logger *slog.Logger, client *echoclient.Client, cfg config) error {
+	l := logger.With("component", "streams")
+	l.Info("starting streams", "streams", cfg.streams, "messages", cfg.streamsMessages, "size", cfg.streamsSize)
+
+	start := time.Now()
+	results := make([]streamResult, cfg.streams)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = echoStream(ctx, client, cfg, i)
+		}()
+	}
+	wg.Wait()
+	dur := time.Since(start)
+
+	jsonOut := cfg.output == outputJSON
+	var messages, total, failed int
+	for _, r := range results {
+		messages += r.messages
+		total += r.bytes
+		attrs := []any{"quic_id", r.id, "messages", r.messages, "bytes", r.bytes, "dur", r.dur}
+		if r.messages > 0 {
+			attrs = append(attrs, "rtt_avg", r.rttSum/time.Duration(r.messages), "rtt_max", r.rttMax)
+		}
+		if jsonOut {
+			rec := opRecord{Op: "stream", StreamID: r.id, Sent: r.bytes, Echoed: r.bytes}
+			if r.messages > 0 {
+				rec.RTTMs = ms(r.rttSum / time.Duration(r.messages))
+			}
+			if r.err != nil {
+				rec.Error = r.err.Error()
+			}
+			printRecord(rec)
+		}
+		if r.err != nil {
+			failed++
+			l.Warn("stream failed", append(attrs, "err", r.err)...)
+			continue
+		}
+		l.Info("stream done", attrs...)
+	}
+	l.Info("streams results",
+		"streams", cfg.streams,
+		"failed", failed,
+		"messages", messages,
+		"bytes", total,
+		"dur", dur,
+		"mbit_per_s", fmt.Sprintf("%.2f", float64(total)*8/1e6/dur.Seconds()),
+	)
+	if failed > 0 {
+		if slices.ContainsFunc(results, func(r streamResult) bool { return errors.Is(r.err, errAuthRejected) }) {
+			return errAuthRejected
+		}
+		return fmt.Errorf("%d of %d streams failed", failed, cfg.streams)
+	}
+	return nil
+}
+
+// echoStream opens a stream and echoes the messages of stream number n on
+// it, stopping at the first error.
+func echoStream(ctx context.Context, client *echoclient.Client, cfg config, n int) (res streamResult) {
+	res.id = -1
+	start := time.Now()
+	defer func() { res.dur = time.Since(start) }()
+
+	st, err := client.OpenStream(ctx, streamOptions(cfg))
+	if echoclient.IsAuthFailed(err) {
+		err = errAuthRejected
+	}
+	if err != nil {
+		res.err = fmt.Errorf("open stream: %w", err)
+		return res
+	}
+	defer func() { _ = st.Close() }()
+	res.id = int64(st.QUICStream().StreamID())
+
+	// Every stream sends its own pattern, so that echoes crossing streams
+	// are noticed.
+	msg := make([]byte, min(cfg.streamsSize, st.MaxMsg()))
+	for i := range msg {
+		msg[i] = 'a' + byte((n+i)%26)
+	}
+	var echo bytes.Buffer
+	for i := range cfg.streamsMessages {
+		sent := time.Now()
+		echo.Reset()
+		if err := st.Send(ctx, msg); err != nil {
+			res.err = fmt.Errorf("message %d: send: %w", i+1, err)
+			return res
+		}
+		if _, err := st.Receive(ctx, &echo); err != nil {
+			if echoclient.IsAuthFailed(err) {
+				err = errAuthRejected
+			}
+			res.err = fmt.Errorf("message %d: read echo: %w", i+1, err)
+			return res
+		}
+		if !bytes.Equal(echo.Bytes(), msg) {
+			res.err = fmt.Errorf("message %d: echo does not match", i+1)
+			return res
+		}
+		rtt := time.Since(sent)
+		res.messages++
+		res.bytes += len(msg)
+		res.rttSum += rtt
+		res.rttMax = max(res.rttMax, rtt)
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ticketCacheVersion is bumped whenever the layout of ticketCacheFile
+// changes.
+const ticketCacheVersion = 1
+
+// ticketLifetime is the longest a TLS 1.3 session ticket may be used for
+// resumption (RFC 8446, section 4.6.1). Older tickets are dropped from the
+// cache file.
+const ticketLifetime = 7 * 24 * time.Hour
+
+// ticketCacheFile is the on-disk form of the persistent session ticket
+// cache, with the latest ticket of every server the client resumed with.
+//
+// QUIC address validation tokens (NEW_TOKEN) are not included, as quic-go
+// keeps them opaque: they are only reused within the process.
+type ticketCacheFile struct {
+	Version int             `json:"version"`
+	Tickets []sessionTicket `json:"tickets"`
+}
+
+// ticketCache persists the sessions of an exportableCache to a file, so that
+// resumption works across client processes.
+type ticketCache struct {
+	path     string
+	sessions *exportableCache
+	logger   *slog.Logger
+
+	// mu serializes writing the file.
+	mu sync.Mutex
+}
+
+// openTicketCache loads the tickets in the cache file at path into
+// sessions, if it exists, and saves the file whenever sessions stores a new
+// ticket or drops one from then on. A file that cannot be read is replaced.
+func openTicketCache(path string, sessions *exportableCache, logger *slog.Logger) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create cache directory: %w", err)
+	}
+	tc := &ticketCache{path: path, sessions: sessions, logger: logger}
+	tickets, err := tc.read()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		logger.Warn("session cache unreadable, starting empty", "path", path, "err", err)
+	default:
+		if err := sessions.load(tickets); err != nil {
+			logger.Warn("session cache unreadable, starting empty", "path", path, "err", err)
+		}
+	}
+	logger.Debug("session cache opened", "path", path, "tickets", len(tickets))
+	sessions.onPut = tc.save
+	return nil
+}
+
+// read returns the tickets in the cache file that may still be used.
+func (tc *ticketCache) read() ([]sessionTicket, error) {
+	b, err := os.ReadFile(tc.path)
+	if err != nil {
+		return nil, err
+	}
+	var f ticketCacheFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if f.Version != ticketCacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", f.Version)
+	}
+	return unexpired(f.Tickets), nil
+}
+
+// save writes the current sessions to the cache file. Failing to is logged only: the
+// client works on without resumption across processes.
+func (tc *ticketCache) save() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tickets, err := tc.sessions.export()
+	if err == nil {
+		err = writeSecretJSON(tc.path, &ticketCacheFile{Version: ticketCacheVersion, Tickets: unexpired(tickets)})
+	}
+	if err != nil {
+		tc.logger.Warn("save session cache failed", "path", tc.path, "err", err)
+		return
+	}
+	tc.logger.Debug("session cache saved", "path", tc.path, "tickets", len(tickets))
+}
+
+// unexpired returns the tickets saved within ticketLifetime.
+func unexpired(tickets []sessionTicket) []sessionTicket {
+	fresh := tickets[:0]
+	for _, t := range tickets {
+		if t.SavedAt.IsZero() || time.Since(t.SavedAt) < ticketLifetime {
+			fresh = append(fresh, t)
+		}
+	}
+	return fresh
+}
+
+// defaultTicketCache returns the default path of the session ticket cache
+// in the user's cache directory, or "" if there is none.
+func defaultTicketCache() string {
+	return userCacheFile("sessions.json")
+}
+
+// userCacheFile returns the path of the client's file name in the user's
+// cache directory, or "" if the user has none.
+func userCacheFile(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "quic-echo-client", name)
+}
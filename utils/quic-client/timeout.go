@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// defaultHandshakeTimeout is quic-go's handshake idle timeout, used when
+// -handshake-timeout is 0.
+const defaultHandshakeTimeout = 5 * time.Second
+
+// timeoutError reports an operation that did not complete within the
+// timeout set by a flag, e.g. because the server hung or the link died.
+type timeoutError struct {
+	op      string
+	timeout time.Duration
+	flag    string
+}
+
+// Error implements error.
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s (%s)", e.op, e.timeout, e.flag)
+}
+
+// dialError labels err, the failure of a connection attempt to addr under
+// ctx, if the attempt ran into -dial-timeout or -handshake-timeout.
+func dialError(ctx context.Context, err error, addr string, cfg config) error {
+	var (
+		herr *quic.HandshakeTimeoutError
+		ierr *quic.IdleTimeoutError
+	)
+	switch {
+	// A connection that was never established went idle in the handshake.
+	case errors.As(err, &herr), errors.As(err, &ierr):
+		timeout := cfg.handshakeTimeout
+		if timeout == 0 {
+			timeout = defaultHandshakeTimeout
+		}
+		return &timeoutError{op: "handshake with " + addr, timeout: timeout, flag: "-handshake-timeout"}
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		return &timeoutError{op: "connect to " + addr, timeout: cfg.dialTimeout, flag: "-dial-timeout"}
+	}
+	return err
+}
+
+// opContext returns the context of a prompt operation, bounded by
+// -io-timeout if it is set.
+func opContext(ctx context.Context, cfg config) (context.Context, context.CancelFunc) {
+	if cfg.ioTimeout > 0 {
+		return context.WithTimeout(ctx, cfg.ioTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// opTimeout returns a timeoutError for op if err is the failure of an
+// operation under a context from opContext that ran out of time, and nil
+// otherwise. ctx is the context opContext was called with.
+func opTimeout(ctx context.Context, err error, op string, cfg config) error {
+	if ctx.Err() != nil || !(errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)) {
+		return nil
+	}
+	return &timeoutError{op: op, timeout: cfg.ioTimeout, flag: "-io-timeout"}
+}
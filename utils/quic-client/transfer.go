@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/transfer"
+)
+
+// Settings of the /send and /recv commands.
+const (
+	// progressInterval is how often transfer progress is printed.
+	progressInterval = 500 * time.Millisecond
+	// transferRetries is how many times an interrupted transfer is resumed
+	// before the command fails.
+	transferRetries = 5
+	// transferRetryDelay is the wait before the first resume attempt; it
+	// doubles with every further attempt.
+	transferRetryDelay = time.Second
+)
+
+// errStalePart reports a partial download that does not belong to the file
+// on the server, which changed since the download was interrupted. The part
+// is discarded, so the transfer can start over.
+var errStalePart = errors.New("sha256 mismatch after resuming, partial download discarded")
+
+// transferClient runs the /send and /recv commands, each over a connection
+// of its own with the server's transfer protocol. Interrupted transfers are
+// resumed where they stopped.
+type transferClient struct {
+	addr     string
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	token    string
+	jsonOut  bool
+	logger   *slog.Logger
+}
+
+// send uploads the file at path to the server's transfer directory, under
+// its base name.
+func (t *transferClient) send(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	name := filepath.Base(path)
+	if err := transfer.CheckName(name); err != nil {
+		return err
+	}
+
+	// The digest goes before the content, so the file is read twice.
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("hash file: %w", err)
+	}
+	req := transfer.Request{Op: transfer.OpPut, Name: name, Size: size, Sum: h.Sum(nil)}
+
+	return t.run(ctx, "send", name, func(rec *opRecord) (int64, error) {
+		st, br, done, err := t.open(ctx, req, rec)
+		if err != nil {
+			return 0, err
+		}
+		defer done()
+		offset, err := transfer.ReadReady(br)
+		if err != nil {
+			return 0, err
+		}
+		rec.ResumedFrom = offset
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("seek file: %w", err)
+		}
+
+		p := &progress{op: "send", name: name, total: size, offset: offset, done: offset, quiet: t.jsonOut}
+		_, werr := io.CopyN(io.MultiWriter(st, p), f, size-offset)
+		if werr == nil {
+			werr = st.Close()
+		}
+		// A server that refuses the upload says why before it stops
+		// reading.
+		_, err = transfer.ReadReply(br, false)
+		if werr != nil && err == nil {
+			err = fmt.Errorf("send file: %w", werr)
+		}
+		if err != nil {
+			return 0, err
+		}
+		p.finish()
+		return size, nil
+	})
+}
+
+// recv downloads the file name from the server's transfer directory into
+// the current directory. The file is written to a part file, which an
+// interrupted download resumes, and only replaces a file of the same name
+// once its size and digest are verified.
+func (t *transferClient) recv(ctx context.Context, name string) error {
+	if err := transfer.CheckName(name); err != nil {
+		return err
+	}
+	part := "." + name + ".part"
+
+	return t.run(ctx, "recv", name, func(rec *opRecord) (int64, error) {
+		f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return 0, err
+		}
+		discard := false
+		defer func() {
+			_ = f.Close()
+			if discard {
+				_ = os.Remove(part)
+			}
+		}()
+		// The digest covers the part kept from earlier attempts too.
+		h := sha256.New()
+		offset, err := io.Copy(h, f)
+		if err != nil {
+			return 0, fmt.Errorf("read part: %w", err)
+		}
+
+		st, br, done, err := t.open(ctx, transfer.Request{Op: transfer.OpGet, Name: name, Offset: offset}, rec)
+		if err != nil {
+			return 0, err
+		}
+		defer done()
+		if err := st.Close(); err != nil {
+			return 0, fmt.Errorf("send request: %w", err)
+		}
+		reply, err := transfer.ReadReply(br, true)
+		if transferRemote(err) {
+			// The part is of no use for a refused download, and one the
+			// server refuses to resume is stale: start over.
+			discard = true
+			if offset > 0 {
+				return 0, errStalePart
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		rec.ResumedFrom = offset
+
+		p := &progress{op: "recv", name: name, total: reply.Size, offset: offset, done: offset, quiet: t.jsonOut}
+		if _, err := io.CopyN(io.MultiWriter(f, h, p), br, reply.Size-offset); err != nil {
+			return 0, fmt.Errorf("receive file: %w", err)
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, reply.Sum) {
+			// Never keep a part that cannot complete.
+			discard = true
+			if offset > 0 {
+				return 0, errStalePart
+			}
+			return 0, fmt.Errorf("sha256 mismatch: got %x, server announced %x", sum, reply.Sum)
+		}
+		if err := f.Close(); err != nil {
+			return 0, fmt.Errorf("write file: %w", err)
+		}
+		if err := os.Rename(part, name); err != nil {
+			return 0, fmt.Errorf("store file: %w", err)
+		}
+		p.finish()
+		return reply.Size, nil
+	})
+}
+
+// run performs attempt, resuming the transfer with another attempt while it
+// is interrupted by the connection, up to transferRetries times with
+// exponential backoff. attempt returns the size of the file. With jsonOut,
+// a record of the transfer is printed.
+func (t *transferClient) run(ctx context.Context, op, name string, attempt func(rec *opRecord) (int64, error)) error {
+	rec := opRecord{Op: op, StreamID: -1, Name: name}
+	start := time.Now()
+	delay := transferRetryDelay
+	var n int64
+	var err error
+	for i := 0; ; i++ {
+		n, err = attempt(&rec)
+		if err == nil || i == transferRetries || !transferRetryable(err) || ctx.Err() != nil {
+			break
+		}
+		t.logger.Warn("transfer interrupted, resuming", "op", op, "name", name, "attempt", i+1, "retry_in", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+	if t.jsonOut {
+		rec.Bytes, rec.DurMs = n, ms(time.Since(start))
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		printRecord(rec)
+	}
+	return err
+}
+
+// open connects to the server and sends req on a new stream, after the
+// token if one is set. It sets the stream ID of rec. Call done to close the
+// connection.
+func (t *transferClient) open(ctx context.Context, req transfer.Request, rec *opRecord) (st *quic.Stream, br *bufio.Reader, done func(), err error) {
+	conn, err := echoclient.DialAddr(ctx, t.addr, withALPN(t.tlsConf, transfer.ALPN), t.quicConf)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("dial %s: %w", t.addr, err)
+	}
+	done = func() { _ = conn.CloseWithError(errcode.NoError, "bye") }
+	defer func() {
+		if err != nil {
+			done()
+		}
+	}()
+	if st, err = conn.OpenStreamSync(ctx); err != nil {
+		return nil, nil, nil, fmt.Errorf("open stream: %w", err)
+	}
+	rec.StreamID = int64(st.StreamID())
+	if t.token != "" {
+		if _, err = io.WriteString(st, t.token+"\n"); err != nil {
+			return nil, nil, nil, fmt.Errorf("send token: %w", err)
+		}
+	}
+	if err = transfer.WriteRequest(st, req); err != nil {
+		return nil, nil, nil, fmt.Errorf("send request: %w", err)
+	}
+	return st, bufio.NewReader(st), done, nil
+}
+
+// transferRemote reports whether err is the server refusing a transfer.
+func transferRemote(err error) bool {
+	var rerr *transfer.RemoteError
+	return errors.As(err, &rerr)
+}
+
+// transferRetryable reports whether a transfer that failed with err may
+// succeed when resumed: if the connection was lost or closed by the server
+// other than for authentication, or a stale part was discarded.
+func transferRetryable(err error) bool {
+	if errors.Is(err, errStalePart) {
+		return true
+	}
+	if echoclient.IsAuthFailed(err) {
+		return false
+	}
+	var (
+		idle      *quic.IdleTimeoutError
+		handshake *quic.HandshakeTimeoutError
+		app       *quic.ApplicationError
+		reset     *quic.StatelessResetError
+	)
+	return errors.As(err, &idle) || errors.As(err, &handshake) || errors.As(err, &app) || errors.As(err, &reset)
+}
+
+// progress is an io.Writer that counts the bytes of a transfer and prints
+// its progress at most every progressInterval, unless quiet. A resumed
+// transfer starts with done at its offset.
+type progress struct {
+	op, name string
+	total    int64
+	offset   int64
+	quiet    bool
+
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+// Write implements io.Writer.
+func (p *progress) Write(b []byte) (int, error) {
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start, p.last = now, now
+	}
+	p.done += int64(len(b))
+	if !p.quiet && now.Sub(p.last) >= progressInterval {
+		p.last = now
+		fmt.Printf("\r%s %s: %d/%d bytes (%.0f%%)", p.op, p.name, p.done, p.total, 100*float64(p.done)/float64(max(p.total, 1)))
+	}
+	return len(b), nil
+}
+
+// finish prints the summary of a completed transfer, unless quiet.
+func (p *progress) finish() {
+	if p.quiet {
+		return
+	}
+	dur := time.Since(p.start)
+	if p.start.IsZero() {
+		dur = 0
+	}
+	resumed := ""
+	if p.offset > 0 {
+		resumed = fmt.Sprintf(", resumed at %d", p.offset)
+	}
+	n := p.done - p.offset
+	fmt.Printf("\r%s %s: %d bytes in %s (%.2f MB/s%s), sha256 verified\n", p.op, p.name, p.done, dur.Round(time.Millisecond), float64(n)/1e6/max(dur.Seconds(), 1e-9), resumed)
+}
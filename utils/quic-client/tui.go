@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+)
+
+// Settings of the -tui screen.
+const (
+	// tuiRefresh is how often the screen is redrawn for the live stats.
+	tuiRefresh = 500 * time.Millisecond
+	// paneLines is the number of lines every pane keeps for scrolling off.
+	paneLines = 1000
+	// statsWidth is the width of the stats column, which is left out on
+	// terminals narrower than statsMinScreen.
+	statsWidth     = 30
+	statsMinScreen = 90
+)
+
+// tui is the full-screen terminal UI of -tui. It shows the lines typed at
+// the prompt, what the client prints, the statistics of the connection and
+// the log in panes of their own, above the input line.
+//
+// What the client prints reaches the received pane by replacing os.Stdout
+// with a pipe, so the commands print as they would without the UI.
+type tui struct {
+	fd     int
+	out    *os.File
+	title  string
+	client atomic.Pointer[echoclient.Client]
+
+	// input edits the input line, once lineInput has been called.
+	input atomic.Pointer[term.Terminal]
+
+	mu             sync.Mutex
+	sent, recv     *pane
+	log            *pane
+	cols, rows     int
+	restore        func()
+	stdout, pipeW  *os.File
+	kick, done     chan struct{}
+	copied, render sync.WaitGroup
+}
+
+// startTUI takes over the terminal for the UI, titled title. Call close to
+// give it back.
+func startTUI(title string) (*tui, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("stdin and stdout must be a terminal")
+	}
+	// Raw mode for the whole session keeps keys typed while a command runs
+	// from being echoed over the screen.
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("raw terminal: %w", err)
+	}
+	restore := func() { _ = term.Restore(fd, state) }
+	r, w, err := os.Pipe()
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("redirect stdout: %w", err)
+	}
+
+	t := &tui{
+		fd:      int(os.Stdout.Fd()),
+		out:     os.Stdout,
+		title:   title,
+		sent:    &pane{title: "sent"},
+		recv:    &pane{title: "received"},
+		log:     &pane{title: "log"},
+		restore: restore,
+		stdout:  os.Stdout,
+		pipeW:   w,
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	os.Stdout = w
+	t.copied.Add(1)
+	go func() {
+		defer t.copied.Done()
+		_, _ = io.Copy(paneWriter{t: t, p: t.recv}, r)
+		_ = r.Close()
+	}()
+
+	// The alternate screen keeps the terminal's contents for afterwards.
+	t.write("\x1b[?1049h\x1b[2J")
+	t.render.Add(1)
+	go func() {
+		defer t.render.Done()
+		t.run()
+	}()
+	return t, nil
+}
+
+// close stops the UI and gives the terminal back, as it was.
+func (t *tui) close() {
+	close(t.done)
+	t.render.Wait()
+	os.Stdout = t.stdout
+	_ = t.pipeW.Close()
+	t.copied.Wait()
+	t.write("\x1b[?1049l\x1b[?25h")
+	t.restore()
+}
+
+// logWriter returns the writer for the log pane.
+func (t *tui) logWriter() io.Writer {
+	return paneWriter{t: t, p: t.log}
+}
+
+// setClient makes client the one whose statistics are shown, or shows the
+// client reconnecting if it is nil.
+func (t *tui) setClient(client *echoclient.Client) {
+	t.client.Store(client)
+	t.redraw()
+}
+
+// setTitle sets the title of the UI, e.g. to the server address after a
+// failover.
+func (t *tui) setTitle(title string) {
+	t.mu.Lock()
+	t.title = title
+	t.mu.Unlock()
+	t.redraw()
+}
+
+// lineInput returns the input line of the UI, which edits lines like
+// newLineInput on a terminal and shows them in the sent pane. The
+// completions of a word are shown in the received pane.
+func (t *tui) lineInput(historyPath string, complete func(prefix string) []string, logger *slog.Logger) lineInput {
+	hist := loadHistory(historyPath, logger)
+	input := term.NewTerminal(stdio{Reader: os.Stdin, Writer: (*tuiLine)(t)}, "")
+	input.History = hist
+	input.AutoCompleteCallback = completer(complete, func(s string) {
+		_, _ = paneWriter{t: t, p: t.recv}.Write([]byte(s + "\n"))
+	})
+	t.input.Store(input)
+	t.repaintInput()
+	return &tuiInput{t: t, term: input, hist: hist}
+}
+
+// redraw asks for the screen to be redrawn soon.
+func (t *tui) redraw() {
+	select {
+	case t.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run redraws the screen when asked to and every tuiRefresh, until the UI is
+// closed.
+func (t *tui) run() {
+	tick := time.NewTicker(tuiRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.kick:
+		case <-tick.C:
+		}
+		if t.draw() {
+			t.repaintInput()
+		}
+	}
+}
+
+// repaintInput has the input line, which a resize or clearing the screen
+// erased, drawn again by its editor, which does so when the width changes.
+func (t *tui) repaintInput() {
+	input := t.input.Load()
+	if input == nil {
+		return
+	}
+	t.mu.Lock()
+	w := t.cols
+	t.mu.Unlock()
+	_ = input.SetSize(w+1, 1)
+	_ = input.SetSize(w, 1)
+}
+
+// draw redraws the panes and the stats, and puts the cursor back on the
+// input line. It reports whether the screen was cleared, after a resize,
+// so that the input line needs to be redrawn too.
+func (t *tui) draw() bool {
+	stats := t.statsLines()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, h := screenSize(t.fd)
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	resized := w != t.cols || h != t.rows
+	if resized {
+		t.cols, t.rows = w, h
+		b.WriteString("\x1b[2J")
+	}
+	if w < 40 || h < 10 {
+		b.WriteString("\x1b[H terminal too small")
+		t.write(b.String())
+		return false
+	}
+
+	// The title, the headers of the top panes, their lines, the header of
+	// the log pane, its lines, and the input line.
+	logRows := max(h/4, 3)
+	topRows := h - logRows - 4
+	row := func(n int, s string) {
+		fmt.Fprintf(&b, "\x1b[%d;1H%s", n, s)
+	}
+	reverse := func(s string) string {
+		return "\x1b[7m" + s + "\x1b[0m"
+	}
+
+	row(1, reverse(fit(" quic-echo-client "+t.title+"   Ctrl-C quits, /help lists the commands", w)))
+	cols := []*pane{t.sent, t.recv}
+	widths := []int{(w - 1) / 2, w - 1 - (w-1)/2}
+	if w >= statsMinScreen {
+		rest := w - statsWidth - 2
+		widths = []int{rest / 2, rest - rest/2, statsWidth}
+	}
+	headers := make([]string, len(widths))
+	bodies := make([][]string, len(widths))
+	for i, cw := range widths {
+		if i < len(cols) {
+			headers[i], bodies[i] = cols[i].title, cols[i].tail(cw, topRows)
+		} else {
+			headers[i], bodies[i] = "stats", stats
+		}
+	}
+	var hdr []string
+	for i, cw := range widths {
+		hdr = append(hdr, fit(" "+headers[i], cw))
+	}
+	row(2, reverse(strings.Join(hdr, "│")))
+	for r := range topRows {
+		var cells []string
+		for i, cw := range widths {
+			cell := ""
+			if r < len(bodies[i]) {
+				cell = bodies[i][r]
+			}
+			cells = append(cells, fit(cell, cw))
+		}
+		row(3+r, strings.Join(cells, "│"))
+	}
+	row(3+topRows, reverse(fit(" "+t.log.title, w)))
+	for r, line := range padTail(t.log.tail(w, logRows), logRows) {
+		row(4+topRows+r, fit(line, w))
+	}
+
+	if resized {
+		row(h, "")
+		b.WriteString("\x1b7")
+	}
+	b.WriteString("\x1b8\x1b[?25h")
+	t.write(b.String())
+	return resized
+}
+
+// statsLines returns the lines of the stats column.
+func (t *tui) statsLines() []string {
+	client := t.client.Load()
+	if client == nil {
+		return []string{" reconnecting..."}
+	}
+	s := collectStats(client)
+	return []string{
+		fmt.Sprintf(" quic %s, alpn %s", s.Version, s.ALPN),
+		fmt.Sprintf(" resumed %t, 0-rtt %t", s.Resumed, s.Used0RTT),
+		fmt.Sprintf(" datagrams %t", s.Datagrams),
+		"",
+		fmt.Sprintf(" rtt     %.3f ms", s.SmoothedRTTMs),
+		fmt.Sprintf(" min     %.3f ms", s.MinRTTMs),
+		fmt.Sprintf(" latest  %.3f ms", s.LatestRTTMs),
+		fmt.Sprintf(" var     %.3f ms", s.RTTVarMs),
+		"",
+		fmt.Sprintf(" sent    %s, %d pkts", formatBytes(s.BytesSent), s.PacketsSent),
+		fmt.Sprintf(" recv    %s, %d pkts", formatBytes(s.BytesReceived), s.PacketsReceived),
+		fmt.Sprintf(" lost    %s, %d pkts", formatBytes(s.BytesLost), s.PacketsLost),
+		"",
+		fmt.Sprintf(" streams %d bidi, %d uni", s.BidiStreams, s.UniStreams),
+	}
+}
+
+// write writes s to the terminal.
+func (t *tui) write(s string) {
+	_, _ = io.WriteString(t.out, s)
+}
+
+// tuiLine is the input line of a tui, the bottom row of the screen, as
+// the [term.Terminal] that edits it writes to it.
+type tuiLine tui
+
+// rowMove matches the escape sequences that move the cursor up or down.
+var rowMove = regexp.MustCompile(`\x1b\[[0-9]*[AB]`)
+
+// Write implements io.Writer. The editor's output moves the cursor relative
+// to where it left it, which is saved for the screen to return to after a
+// redraw. Lines wider than the screen are shown on the one row a part at a
+// time, so the line breaks and moves between rows of the editor are dropped,
+// and clearing the screen redraws the whole UI.
+func (l *tuiLine) Write(p []byte) (int, error) {
+	t := (*tui)(l)
+	s := string(p)
+	cleared := strings.Contains(s, "\x1b[2J")
+	s = strings.ReplaceAll(s, "\x1b[2J\x1b[H", "\r\x1b[K")
+	s = strings.ReplaceAll(s, "\r\n", "\r\x1b[K")
+	s = rowMove.ReplaceAllString(s, "")
+
+	t.mu.Lock()
+	t.write("\x1b8" + s + "\x1b7")
+	if cleared {
+		t.cols = 0
+	}
+	t.mu.Unlock()
+	if cleared {
+		t.redraw()
+	}
+	return len(p), nil
+}
+
+// tuiInput is the lineInput of a tui.
+type tuiInput struct {
+	t    *tui
+	term *term.Terminal
+	hist *history
+}
+
+// readLine implements lineInput, adding the line to the sent pane.
+func (in *tuiInput) readLine(prompt string) (string, error) {
+	in.term.SetPrompt(prompt)
+	line, err := in.term.ReadLine()
+	if errors.Is(err, term.ErrPasteIndicator) {
+		err = nil
+	}
+	if err == nil {
+		in.t.mu.Lock()
+		in.t.sent.add([]byte(line + "\n"))
+		in.t.mu.Unlock()
+		in.t.redraw()
+	}
+	return line, err
+}
+
+// output implements lineInput. What the client prints reaches the received
+// pane anyway.
+func (in *tuiInput) output() io.Writer {
+	return nil
+}
+
+// close implements lineInput.
+func (in *tuiInput) close() error {
+	return in.hist.close()
+}
+
+// pane is a scrolling region of a tui.
+type pane struct {
+	title string
+	lines []string
+	// partial is the last line, until it ends. A carriage return starts
+	// it over, as progress output expects.
+	partial []rune
+}
+
+// add appends the text b to p, dropping control characters other than line
+// ends and tabs. The caller must hold the lock of the tui.
+func (p *pane) add(b []byte) {
+	for _, r := range string(b) {
+		switch {
+		case r == '\n':
+			p.lines = append(p.lines, string(p.partial))
+			p.partial = p.partial[:0]
+			if len(p.lines) > paneLines {
+				p.lines = p.lines[len(p.lines)-paneLines:]
+			}
+		case r == '\r':
+			p.partial = p.partial[:0]
+		case r == '\t':
+			p.partial = append(p.partial, ' ', ' ', ' ', ' ')
+		case r != utf8.RuneError && unicode.IsPrint(r):
+			p.partial = append(p.partial, r)
+		}
+	}
+}
+
+// tail returns the last rows lines of p, wrapped to width. The caller must
+// hold the lock of the tui.
+func (p *pane) tail(width, rows int) []string {
+	width = max(width-1, 1)
+	var out []string
+	all := p.lines
+	if len(p.partial) > 0 {
+		all = append(all[:len(all):len(all)], string(p.partial))
+	}
+	for i := len(all) - 1; i >= 0 && len(out) < rows; i-- {
+		wrapped := wrap(all[i], width)
+		out = append(wrapped, out...)
+	}
+	if len(out) > rows {
+		out = out[len(out)-rows:]
+	}
+	return out
+}
+
+// paneWriter is an io.Writer that adds to a pane of a tui.
+type paneWriter struct {
+	t *tui
+	p *pane
+}
+
+// Write implements io.Writer.
+func (w paneWriter) Write(b []byte) (int, error) {
+	w.t.mu.Lock()
+	w.p.add(b)
+	w.t.mu.Unlock()
+	w.t.redraw()
+	return len(b), nil
+}
+
+// wrap splits s into lines of width runes, after a leading space.
+func wrap(s string, width int) []string {
+	r := []rune(s)
+	lines := []string{}
+	for len(r) > width {
+		lines = append(lines, " "+string(r[:width]))
+		r = r[width:]
+	}
+	return append(lines, " "+string(r))
+}
+
+// padTail returns lines with empty ones in front to make rows.
+func padTail(lines []string, rows int) []string {
+	if len(lines) >= rows {
+		return lines
+	}
+	return append(make([]string, rows-len(lines)), lines...)
+}
+
+// fit cuts or pads s to exactly width runes.
+func fit(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		return string([]rune(s)[:width])
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// screenSize returns the number of columns and rows of the terminal fd, or
+// 80 by 24 if it is not known.
+func screenSize(fd int) (width, height int) {
+	w, h, err := term.GetSize(fd)
+	if err != nil || w == 0 || h == 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/romanov9617/usb-quic/pkg/echoclient"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// alpnUDP is the ALPN identifier of the server's UDP forwarding protocol. It
+// must match the server's.
+const alpnUDP = "quic-udp"
+
+// udpPeerIdle is how long a local peer keeps its flow ID without sending or
+// receiving packets, as long as the server keeps the flow.
+const udpPeerIdle = 2 * time.Minute
+
+// udpPeer is a local peer of the forwarder and its flow.
+type udpPeer struct {
+	addr net.Addr
+	id   uint64
+	last time.Time
+}
+
+// runUDPForward connects to addr with the UDP forwarding protocol and
+// forwards the packets received on a local UDP socket bound to listen in
+// QUIC datagrams; the server sends them on to its configured target. Every
+// local peer gets a flow ID of its own, so that replies reach the right one.
+// It runs until ctx is canceled or the connection ends. If token is not
+// empty, it is sent on a stream first to authenticate.
+func runUDPForward(ctx context.Context, logger *slog.Logger, addr string, tlsConf *tls.Config, quicConf *quic.Config, token, listen string) error {
+	local, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer func() { _ = local.Close() }()
+
+	conn, err := echoclient.DialAddr(ctx, addr, withALPN(tlsConf, alpnUDP), quicConf)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+	if !conn.ConnectionState().SupportsDatagrams {
+		return errors.New("server does not support datagrams")
+	}
+	if token != "" {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return fmt.Errorf("open stream: %w", err)
+		}
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return fmt.Errorf("send token: %w", err)
+		}
+		_ = st.Close()
+	}
+	logger = logger.With("component", "udp")
+	logger.Info("forwarding", "listen", local.LocalAddr().String(), "proxy", addr)
+
+	// Peers are looked up by address for packets from them and by flow ID
+	// for packets to them. Idle ones are forgotten, so that the maps do not
+	// grow with every peer that ever sent.
+	var mu sync.Mutex
+	var nextID uint64
+	ids := make(map[string]*udpPeer)
+	peers := make(map[uint64]*udpPeer)
+
+	go func() {
+		tick := time.NewTicker(udpPeerIdle / 2)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-tick.C:
+				mu.Lock()
+				for key, p := range ids {
+					if now.Sub(p.last) >= udpPeerIdle {
+						delete(ids, key)
+						delete(peers, p.id)
+						logger.Debug("flow expired", "flow", p.id, "peer", key)
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, quicvarint.Len(quicvarint.Max)+maxUDPPayload)
+		for {
+			n, from, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			peer, ok := ids[from.String()]
+			if !ok {
+				// IDs are not reused, so that late replies to an
+				// expired flow reach no one.
+				peer = &udpPeer{addr: from, id: nextID}
+				nextID++
+				ids[from.String()] = peer
+				peers[peer.id] = peer
+				logger.Debug("flow started", "flow", peer.id, "peer", from.String())
+			}
+			peer.last = time.Now()
+			id := peer.id
+			mu.Unlock()
+
+			p := append(quicvarint.Append(nil, id), buf[:n]...)
+			if err := conn.SendDatagram(p); err != nil {
+				logger.Debug("datagram dropped", "flow", id, "bytes", n, "err", err)
+			}
+		}
+	}()
+
+	for {
+		p, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("receive datagram: %w", err)
+		}
+		id, n, err := quicvarint.Parse(p)
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		peer := peers[id]
+		if peer != nil {
+			peer.last = time.Now()
+		}
+		mu.Unlock()
+		if peer == nil {
+			continue
+		}
+		if _, err := local.WriteTo(p[n:], peer.addr); err != nil {
+			logger.Debug("send to local peer", "flow", id, "err", err)
+		}
+	}
+}
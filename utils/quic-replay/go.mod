@@ -0,0 +1,16 @@
+module quic_replay
+
+go 1.25.5
+
+require (
+	github.com/quic-go/quic-go v0.58.0
+	github.com/romanov9617/usb-quic v0.0.0
+)
+
+require (
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
+
+replace github.com/romanov9617/usb-quic => ../..
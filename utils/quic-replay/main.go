@@ -0,0 +1,261 @@
+// Command quic-replay re-sends streams recorded by quic-echo-server with
+// -record-dir against a server, to reproduce bug reports that involve
+// specific payload patterns.
+//
+// Every recording given as an argument is replayed on a connection of its
+// own, negotiating the ALPN protocol it was recorded with: the bytes the
+// server received are sent again with their original timing, scaled by
+// -speed, and what the server sends back is compared to what it sent in the
+// recording. The command exits non-zero if any replay differs. Streams that
+// negotiated end-to-end encryption cannot be replayed faithfully, since the
+// keys differ on every run.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/cmdutil"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/recording"
+)
+
+// config holds command-line configuration for the replay tool.
+type config struct {
+	host          string
+	port          int
+	alpn          string
+	speed         float64
+	wait          time.Duration
+	authTokenFile string
+
+	logLevel  slog.Level
+	logFormat string
+
+	files []string
+}
+
+// main parses flags, configures logging, and replays the recordings.
+// It exits with a non-zero status on fatal errors or mismatching replays.
+func main() {
+	cfg := parseFlags()
+
+	h, err := cmdutil.NewLogHandler(os.Stdout, cfg.logFormat, &slog.HandlerOptions{Level: cfg.logLevel})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := slog.New(h)
+	slog.SetDefault(logger)
+
+	if err := run(context.Background(), logger, cfg); err != nil {
+		logger.Error("fatal", "err", err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses command-line flags and returns the resulting config.
+func parseFlags() config {
+	var cfg config
+
+	flag.StringVar(&cfg.host, "host", "127.0.0.1", "QUIC server host or IP")
+	flag.IntVar(&cfg.port, "port", 4242, "QUIC server UDP port")
+	flag.StringVar(&cfg.alpn, "alpn", "", "ALPN protocol to negotiate instead of the recorded one")
+	flag.Float64Var(&cfg.speed, "speed", 1, "Replay speed relative to the recording (0 = send without pauses)")
+	flag.DurationVar(&cfg.wait, "wait", 5*time.Second, "How long to wait for the server to finish a stream after everything is sent")
+	flag.StringVar(&cfg.authTokenFile, "auth-token-file", "", "Authenticate with the token in this file, for servers that require one")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.logFormat, "log-format", "text", "Log format: text or json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] recording...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	cfg.files = flag.Args()
+	return cfg
+}
+
+// run replays every recording in cfg.files in turn.
+func run(ctx context.Context, logger *slog.Logger, cfg config) error {
+	if len(cfg.files) == 0 {
+		return errors.New("no recordings given")
+	}
+	if cfg.speed < 0 {
+		return fmt.Errorf("speed must not be negative, got %v", cfg.speed)
+	}
+	addr := net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port))
+
+	ctx, cancel := cmdutil.WithSignals(ctx, logger)
+	defer cancel()
+
+	var token string
+	if cfg.authTokenFile != "" {
+		data, err := os.ReadFile(cfg.authTokenFile)
+		if err != nil {
+			return fmt.Errorf("auth token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	var differ int
+	for _, file := range cfg.files {
+		same, err := replayFile(ctx, logger.With("file", file), addr, file, token, cfg)
+		if err != nil {
+			return fmt.Errorf("replay %s: %w", file, err)
+		}
+		if !same {
+			differ++
+		}
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d replays differ from their recording", differ, len(cfg.files))
+	}
+	return nil
+}
+
+// replayFile replays the recording in file against addr and reports whether
+// the server's replies matched the recorded ones.
+func replayFile(ctx context.Context, l *slog.Logger, addr, file, token string, cfg config) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	rd, err := recording.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	alpn := rd.Header.ALPN
+	if cfg.alpn != "" {
+		alpn = cfg.alpn
+	}
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true, // Dev-only: accept self-signed certificates.
+		NextProtos:         []string{alpn},
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, nil)
+	if err != nil {
+		return false, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.CloseWithError(errcode.NoError, "bye") }()
+
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return false, fmt.Errorf("open stream: %w", err)
+	}
+	if token != "" {
+		if _, err := io.WriteString(st, token+"\n"); err != nil {
+			return false, fmt.Errorf("send token: %w", err)
+		}
+	}
+	l.Info("replaying", "alpn", alpn, "recorded_remote", rd.Header.Remote, "recorded_at", rd.Header.Start)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(st)
+		received <- result{data, err}
+	}()
+
+	start := time.Now()
+	var want []byte
+	var records int
+	var sent int64
+	for {
+		rec, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			st.CancelWrite(0)
+			return false, fmt.Errorf("read recording: %w", err)
+		}
+		if rec.Dir == recording.Sent {
+			want = append(want, rec.Data...)
+			continue
+		}
+		if cfg.speed > 0 {
+			at := time.Duration(float64(rec.At) / cfg.speed)
+			if err := sleepUntil(ctx, start.Add(at)); err != nil {
+				return false, err
+			}
+		}
+		n, err := st.Write(rec.Data)
+		sent += int64(n)
+		if err != nil {
+			return false, fmt.Errorf("write: %w", err)
+		}
+		records++
+	}
+	_ = st.Close()
+
+	var res result
+	select {
+	case res = <-received:
+	case <-time.After(cfg.wait):
+		st.CancelRead(0)
+		res = <-received
+	case <-ctx.Done():
+		st.CancelRead(0)
+		return false, ctx.Err()
+	}
+
+	attrs := []any{"records", records, "sent", sent, "received", len(res.data), "expected", len(want), "dur", time.Since(start)}
+	if res.err != nil {
+		attrs = append(attrs, "err", res.err)
+		if reason, ok := errcode.Describe(res.err); ok {
+			attrs = append(attrs, "reason", reason)
+		}
+	}
+	if !bytes.Equal(res.data, want) {
+		l.Warn("replay differs from recording", append(attrs, "first_diff", firstDiff(res.data, want))...)
+		return false, nil
+	}
+	l.Info("replay matches recording", attrs...)
+	return true, nil
+}
+
+// firstDiff returns the offset of the first byte at which a and b differ.
+func firstDiff(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// sleepUntil waits until t or until ctx is canceled.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// adminHelp lists the commands understood on the admin socket.
+const adminHelp = `conns                 list active connections
+streams               list active streams
+stats                 show server-wide counters
+close <conn-id> [reason...]
+                      close a connection
+loglevel [level]      show or set the log level: debug, info, warn, error
+help                  show this help`
+
+// startAdmin serves the admin control API on a Unix socket at path until ctx
+// is canceled. A stale socket left at path is replaced. It returns once the
+// socket is bound so that path errors are reported early.
+//
+// Clients send one command per line. Every reply is zero or more lines of
+// output followed by a line of "OK" or "ERR <message>".
+func (s *server) startAdmin(ctx context.Context, path string, level *slog.LevelVar, l *slog.Logger) error {
+	l = l.With("component", "admin", "socket", path)
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		// Closing a Unix listener also removes its socket file.
+		_ = ln.Close()
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					l.Warn("admin accept stopped", "err", err)
+				}
+				return
+			}
+			go s.serveAdmin(ctx, c, level, l)
+		}
+	}()
+
+	l.Info("admin socket listening")
+	return nil
+}
+
+// serveAdmin runs the commands read from one admin client until it
+// disconnects or ctx is canceled.
+func (s *server) serveAdmin(ctx context.Context, c net.Conn, level *slog.LevelVar, l *slog.Logger) {
+	defer func() { _ = c.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer stop()
+
+	sc := bufio.NewScanner(c)
+	w := bufio.NewWriter(c)
+	for sc.Scan() {
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		l.Debug("admin command", "cmd", args[0])
+		if err := s.adminCommand(w, args, level); err != nil {
+			_, _ = fmt.Fprintf(w, "ERR %v\n", err)
+		} else {
+			_, _ = fmt.Fprintln(w, "OK")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// adminCommand runs the admin command args and writes its output to w.
+func (s *server) adminCommand(w io.Writer, args []string, level *slog.LevelVar) error {
+	switch args[0] {
+	case "help":
+		_, _ = fmt.Fprintln(w, adminHelp)
+
+	case "conns":
+		now := time.Now()
+		for _, ci := range s.srv.Conns() {
+			_, _ = fmt.Fprintf(w, "conn_id=%d remote=%s alpn=%s age=%s streams=%d total_streams=%d rtt=%s bytes_sent=%d bytes_received=%d packets_lost=%d\n",
+				ci.ID, ci.Remote, ci.ALPN, now.Sub(ci.Since).Round(time.Second), len(ci.Streams), ci.TotalStreams,
+				ci.Stats.SmoothedRTT, ci.Stats.BytesSent, ci.Stats.BytesReceived, ci.Stats.PacketsLost)
+		}
+
+	case "streams":
+		now := time.Now()
+		for _, ci := range s.srv.Conns() {
+			for _, si := range ci.Streams {
+				_, _ = fmt.Fprintf(w, "conn_id=%d stream_id=%d quic_id=%d uni=%t age=%s\n",
+					ci.ID, si.ID, si.QUICID, si.Uni, now.Sub(si.Since).Round(time.Second))
+			}
+		}
+
+	case "stats":
+		st := s.srv.Stats()
+		_, _ = fmt.Fprintf(w, "uptime=%s conns=%d total_conns=%d streams=%d total_streams=%d busy_workers=%d queued_streams=%d rejected_streams=%d goroutines=%d version=%s\n",
+			time.Since(s.started).Round(time.Second), st.ActiveConns, st.TotalConns, st.ActiveStreams, st.TotalStreams,
+			st.BusyWorkers, st.QueuedStreams, st.RejectedStreams, runtime.NumGoroutine(), version)
+
+	case "close":
+		if len(args) < 2 {
+			return errors.New("usage: close <conn-id> [reason...]")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad connection id %q", args[1])
+		}
+		reason := "closed by operator"
+		if len(args) > 2 {
+			reason = strings.Join(args[2:], " ")
+		}
+		if !s.srv.CloseConn(id, errcode.AdminClose, reason) {
+			return fmt.Errorf("no connection %d", id)
+		}
+
+	case "loglevel":
+		if len(args) > 1 {
+			var lvl slog.Level
+			if err := lvl.UnmarshalText([]byte(args[1])); err != nil {
+				return fmt.Errorf("bad log level %q", args[1])
+			}
+			level.Set(lvl)
+		}
+		_, _ = fmt.Fprintf(w, "level=%s\n", level.Level())
+
+	default:
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// tokenAuth is a [streamserver.Authenticator] that accepts a single bearer
+// token. Connections on the exempt protocols, such as health checks, need no
+// token.
+type tokenAuth struct {
+	token  []byte
+	exempt []string
+}
+
+// newTokenAuth returns an authenticator for the token in file: its content
+// with surrounding whitespace removed.
+func newTokenAuth(file string, exempt []string) (*tokenAuth, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("%s: empty token", file)
+	}
+	return &tokenAuth{token: []byte(token), exempt: exempt}, nil
+}
+
+// Required implements [streamserver.Authenticator].
+func (a *tokenAuth) Required(conn *quic.Conn) bool {
+	return !slices.Contains(a.exempt, conn.ConnectionState().TLS.NegotiatedProtocol)
+}
+
+// Check implements [streamserver.Authenticator].
+func (a *tokenAuth) Check(_ *quic.Conn, token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// wrap returns next, answering requests without the token in an
+// Authorization header, as "Bearer <token>", with 401 Unauthorized. It
+// authenticates HTTP/3 clients, which know nothing of the token stream.
+func (a *tokenAuth) wrap(next http.Handler, l *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.Check(nil, token) != nil {
+			l.Warn("request unauthorized", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
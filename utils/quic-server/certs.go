@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/romanov9617/usb-quic/pkg/cmdutil"
+)
+
+// certStore holds the server certificate. The certificate can be replaced at
+// runtime; new handshakes pick up the replacement.
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// load replaces the certificate with the key pair in certFile and keyFile, or
+// with a freshly generated self-signed certificate if both are empty.
+func (cs *certStore) load(certFile, keyFile string, l *slog.Logger) error {
+	l = l.With("component", "tls")
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile == "" && keyFile == "":
+		cert, err = selfSignedCert(l)
+	case certFile == "" || keyFile == "":
+		return errors.New("a certificate and a key file must be given together")
+	default:
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			l.Info("certificate loaded", "cert", certFile, "key", keyFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if cert.Leaf != nil {
+		l.Info("certificate public key pin", "pin", cmdutil.SPKIPin(cert.Leaf))
+	}
+	cs.cert.Store(&cert)
+	return nil
+}
+
+// getCertificate implements [tls.Config] GetCertificate.
+func (cs *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cs.cert.Load(), nil
+}
+
+// selfSignedCert returns a freshly generated self-signed certificate for
+// "localhost", suitable for local development.
+func selfSignedCert(l *slog.Logger) (tls.Certificate, error) {
+	l.Debug("generating self-signed certificate")
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("ed25519 keygen: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("serial: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// DNSNames is set for "localhost" to support local testing.
+		DNSNames: []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create cert: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("marshal private key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse keypair: %w", err)
+	}
+	l.Info("self-signed certificate ready")
+	return cert, nil
+}
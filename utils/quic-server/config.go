@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// applyConfigFile sets the flags of fs from the file at path. Each non-empty
+// line that is not a "#" comment has the form "name = value", where name is a
+// flag name without the leading dash. Flags given on the command line take
+// precedence over the file.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	sc := bufio.NewScanner(f)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", path, lineNo)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, lineNo, name, err)
+		}
+	}
+	return sc.Err()
+}
+
+// static returns c with the settings that can be changed at runtime zeroed,
+// so that two configs compare equal if they differ only in those.
+func (c config) static() config {
+	c.logLevel = 0
+	c.certFile, c.keyFile = "", ""
+
+	c.maxMsg = 0
+	c.requireE2E, c.e2ePSKFile, c.compress = false, "", false
+	c.maxStreamBytes, c.maxConnBytes = 0, 0
+	c.idleTimeout = 0
+	c.recordMaxFile, c.recordMaxTotal = 0, 0
+
+	c.delayDist, c.delay, c.delaySpread, c.delayAlpha, c.delayPer, c.jitter = "", 0, 0, 0, "", 0
+	c.dropRate, c.truncateAt = 0, 0
+
+	c.maxConns, c.maxConnsPerIP = 0, 0
+	return c
+}
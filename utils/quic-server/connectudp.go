@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// connectUDPPattern is where CONNECT-UDP requests are served, following the
+// default URI template of RFC 9298.
+const connectUDPPattern = "/.well-known/masque/udp/{host}/{port}/{$}"
+
+// maxUDPPayload is the largest UDP payload relayed.
+const maxUDPPayload = 65527
+
+// udpTargets decides which targets CONNECT-UDP may proxy to.
+type udpTargets struct {
+	// allow, if not empty, lists the only prefixes targets may be in.
+	allow []netip.Prefix
+}
+
+// parseUDPTargets returns the target policy for s, a comma-separated list of
+// CIDR prefixes or addresses, which may be empty.
+func parseUDPTargets(s string) (*udpTargets, error) {
+	t := new(udpTargets)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			a, aerr := netip.ParseAddr(f)
+			if aerr != nil {
+				return nil, fmt.Errorf("%q is neither a prefix nor an address", f)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		t.allow = append(t.allow, p.Masked())
+	}
+	return t, nil
+}
+
+// permits reports whether a may be proxied to. Without an allowlist, any
+// address but the loopback, link-local, private and unspecified ones may,
+// so that clients cannot reach the server's own services or its network.
+func (t *udpTargets) permits(a netip.Addr) bool {
+	a = a.Unmap()
+	if len(t.allow) > 0 {
+		for _, p := range t.allow {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		return false
+	}
+	return !(a.IsLoopback() || a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() ||
+		a.IsInterfaceLocalMulticast() || a.IsPrivate() || a.IsUnspecified())
+}
+
+// resolve returns the first address of host a target on port may be
+// proxied to. The address is dialed as resolved, so that the name cannot
+// resolve to another one in between.
+func (t *udpTargets) resolve(ctx context.Context, host string, port uint16) (netip.AddrPort, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, a := range addrs {
+		if t.permits(a) {
+			return netip.AddrPortFrom(a.Unmap(), port), nil
+		}
+	}
+	return netip.AddrPort{}, errTargetForbidden
+}
+
+// errTargetForbidden reports a CONNECT-UDP target that is not permitted.
+var errTargetForbidden = errors.New("target not permitted")
+
+// serveConnectUDP proxies a CONNECT-UDP request (RFC 9298): it opens a UDP
+// socket to the target named in the path, if h.udpTargets permits it, and
+// relays UDP payloads between it
+// and the HTTP datagrams of the request stream until the client closes the
+// stream. Only datagrams with context ID 0, which carry UDP payloads, are
+// relayed.
+func (h *http3Handler) serveConnectUDP(w http.ResponseWriter, r *http.Request, l *slog.Logger) {
+	target := net.JoinHostPort(r.PathValue("host"), r.PathValue("port"))
+	l = l.With("component", "connect-udp", "remote", r.RemoteAddr, "target", target)
+
+	if r.Method != http.MethodConnect || r.Proto != "connect-udp" {
+		l.Warn("not a CONNECT-UDP request", "method", r.Method, "protocol", r.Proto)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.ParseUint(r.PathValue("port"), 10, 16)
+	if err != nil {
+		l.Warn("invalid target port", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ap, err := h.udpTargets.resolve(r.Context(), r.PathValue("host"), uint16(port))
+	if errors.Is(err, errTargetForbidden) {
+		l.Warn("target not permitted")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		l.Warn("resolve target", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(ap))
+	if err != nil {
+		l.Warn("dial target", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = c.Close() }()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	l.Info("proxying started")
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(r.Context())
+	var up, down atomic.Int64
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			p, err := str.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			payload, ok := udpPayload(p)
+			if !ok {
+				continue
+			}
+			if _, err := c.Write(payload); err != nil {
+				l.Debug("send to target", "err", err)
+				continue
+			}
+			up.Add(1)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 1+maxUDPPayload)
+		for {
+			// The leading zero is context ID 0.
+			n, err := c.Read(buf[1:])
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					l.Debug("receive from target", "err", err)
+				}
+				return
+			}
+			if err := str.SendDatagram(buf[:1+n]); err != nil {
+				l.Debug("datagram dropped", "bytes", n, "err", err)
+				continue
+			}
+			down.Add(1)
+		}
+	}()
+
+	// The stream carries nothing but capsules this proxy does not use; it
+	// ends when the client is done.
+	_, err = io.Copy(io.Discard, str)
+	cancel()
+	_ = c.Close()
+	wg.Wait()
+	_ = str.Close()
+
+	attrs := []any{"up_datagrams", up.Load(), "down_datagrams", down.Load(), "dur", time.Since(start)}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	l.Info("proxying ended", attrs...)
+}
+
+// udpPayload returns the UDP payload carried by the HTTP datagram p, and
+// false if p does not carry one.
+func udpPayload(p []byte) ([]byte, bool) {
+	id, n, err := quicvarint.Parse(p)
+	if err != nil || id != 0 {
+		return nil, false
+	}
+	return p[n:], true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// connLimiter enforces a global cap and a per-source-IP cap on concurrent
+// connections. A zero cap means unlimited.
+type connLimiter struct {
+	maxTotal int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// newConnLimiter returns a limiter with the given caps.
+func newConnLimiter(maxTotal, maxPerIP int) *connLimiter {
+	return &connLimiter{maxTotal: maxTotal, maxPerIP: maxPerIP, perIP: make(map[string]int)}
+}
+
+// setLimits changes the caps. Connections already admitted are not affected.
+func (cl *connLimiter) setLimits(maxTotal, maxPerIP int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.maxTotal, cl.maxPerIP = maxTotal, maxPerIP
+}
+
+// acquire reserves a slot for a connection from addr. If a cap is reached it
+// returns a reason and false; otherwise the slot must be returned with release.
+func (cl *connLimiter) acquire(addr net.Addr) (string, bool) {
+	ip := hostOf(addr)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.maxTotal > 0 && cl.total >= cl.maxTotal {
+		return fmt.Sprintf("connection limit of %d reached", cl.maxTotal), false
+	}
+	if cl.maxPerIP > 0 && cl.perIP[ip] >= cl.maxPerIP {
+		return fmt.Sprintf("per-ip connection limit of %d reached", cl.maxPerIP), false
+	}
+
+	cl.total++
+	cl.perIP[ip]++
+	return "", true
+}
+
+// release returns the slot reserved by a successful acquire for addr.
+func (cl *connLimiter) release(addr net.Addr) {
+	ip := hostOf(addr)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.total--
+	if cl.perIP[ip]--; cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+}
+
+// hostOf returns the IP part of addr, or its string form if it has no port.
+func hostOf(addr net.Addr) string {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return ua.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// connTraceKey is the context key of a connection's [connTrace].
+type connTraceKey struct{}
+
+// connTrace collects the statistics of one connection that quic-go only
+// reports through its qlog events: the handshake duration, the congestion
+// window, the path MTU and the ECN markings, see [ecnCounters]. Every step
+// of path MTU discovery is logged as it happens. Tracing costs work for
+// every packet, so it is only installed with -conn-stats.
+//
+// It is both the [qlogwriter.Trace] and its only [qlogwriter.Recorder].
+type connTrace struct {
+	started time.Time
+	ecn     bool // whether ECN is in use, so that its counters are of interest
+	l       *slog.Logger
+
+	mu        sync.Mutex
+	handshake time.Duration
+	cwnd      int
+	mtu       int
+	ecnCounts ecnCounters
+}
+
+// installConnTrace attaches a fresh [connTrace] to the context of every
+// connection accepted on tr, after any ConnContext already installed. ecn
+// tells whether ECN is in use. Path MTU updates are logged to l.
+func installConnTrace(tr *quic.Transport, ecn bool, l *slog.Logger) {
+	next := tr.ConnContext
+	tr.ConnContext = func(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+		if next != nil {
+			var err error
+			if ctx, err = next(ctx, info); err != nil {
+				return ctx, err
+			}
+		}
+		ct := &connTrace{started: time.Now(), ecn: ecn, l: l.With("component", "pmtud", "remote", info.RemoteAddr.String())}
+		return context.WithValue(ctx, connTraceKey{}, ct), nil
+	}
+}
+
+// connTracer is a [quic.Config] Tracer that feeds the traces attached by
+// installConnTrace.
+func connTracer(ctx context.Context, _ bool, _ quic.ConnectionID) qlogwriter.Trace {
+	ct, ok := ctx.Value(connTraceKey{}).(*connTrace)
+	if !ok {
+		return nil
+	}
+	return ct
+}
+
+// connTraceOf returns the trace of conn, or nil if it has none.
+func connTraceOf(conn *quic.Conn) *connTrace {
+	ct, _ := conn.Context().Value(connTraceKey{}).(*connTrace)
+	return ct
+}
+
+// AddProducer implements [qlogwriter.Trace].
+func (ct *connTrace) AddProducer() qlogwriter.Recorder { return ct }
+
+// SupportsSchemas implements [qlogwriter.Trace].
+func (ct *connTrace) SupportsSchemas(schema string) bool { return schema == qlog.EventSchema }
+
+// RecordEvent implements [qlogwriter.Recorder].
+func (ct *connTrace) RecordEvent(ev qlogwriter.Event) {
+	if ev, ok := ev.(qlog.MTUUpdated); ok {
+		ct.mu.Lock()
+		ct.mtu = ev.Value
+		ct.mu.Unlock()
+		logMTU(ct.l, ev)
+		return
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	switch ev := ev.(type) {
+	case qlog.KeyDiscarded:
+		// The server drops its handshake keys once the handshake is
+		// complete and confirmed.
+		if ev.KeyType == qlog.KeyTypeServerHandshake && ct.handshake == 0 {
+			ct.handshake = time.Since(ct.started)
+		}
+	case qlog.MetricsUpdated:
+		if ev.CongestionWindow > 0 {
+			ct.cwnd = ev.CongestionWindow
+		}
+	default:
+		ct.ecnCounts.record(ev)
+	}
+}
+
+// Close implements [qlogwriter.Recorder].
+func (ct *connTrace) Close() error { return nil }
+
+// attrs returns the collected statistics as log attributes, the ECN
+// counters as a group and only if ECN is in use.
+func (ct *connTrace) attrs() []any {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	attrs := []any{"handshake", ct.handshake, "cwnd", ct.cwnd}
+	if ct.mtu > 0 {
+		attrs = append(attrs, "mtu", ct.mtu)
+	}
+	if ct.ecn {
+		attrs = append(attrs, ct.ecnCounts.group())
+	}
+	return attrs
+}
+
+// logMTU logs a path MTU update, ev, to l: the steps of the search at debug
+// level, and its result.
+func logMTU(l *slog.Logger, ev qlog.MTUUpdated) {
+	if ev.Done {
+		l.Info("path MTU discovered", "mtu", ev.Value)
+		return
+	}
+	l.Debug("path MTU updated", "mtu", ev.Value)
+}
+
+// teeTracers returns a [quic.Config] Tracer that records to the traces of
+// both a and b. Either may be nil.
+func teeTracers(a, b func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace) func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		ta, tb := a(ctx, isClient, connID), b(ctx, isClient, connID)
+		switch {
+		case ta == nil:
+			return tb
+		case tb == nil:
+			return ta
+		}
+		return teeTrace{ta, tb}
+	}
+}
+
+// teeTrace is a [qlogwriter.Trace] recording to two traces.
+type teeTrace [2]qlogwriter.Trace
+
+// AddProducer implements [qlogwriter.Trace].
+func (t teeTrace) AddProducer() qlogwriter.Recorder {
+	return teeRecorder{t[0].AddProducer(), t[1].AddProducer()}
+}
+
+// SupportsSchemas implements [qlogwriter.Trace].
+func (t teeTrace) SupportsSchemas(schema string) bool {
+	return t[0].SupportsSchemas(schema) || t[1].SupportsSchemas(schema)
+}
+
+// teeRecorder is a [qlogwriter.Recorder] recording to two recorders.
+type teeRecorder [2]qlogwriter.Recorder
+
+// RecordEvent implements [qlogwriter.Recorder].
+func (r teeRecorder) RecordEvent(ev qlogwriter.Event) {
+	r[0].RecordEvent(ev)
+	r[1].RecordEvent(ev)
+}
+
+// Close implements [qlogwriter.Recorder].
+func (r teeRecorder) Close() error {
+	err0, err1 := r[0].Close(), r[1].Close()
+	if err0 != nil {
+		return err0
+	}
+	return err1
+}
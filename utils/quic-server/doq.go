@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// alpnDoQ is the ALPN identifier of DNS over QUIC (RFC 9250).
+const alpnDoQ = "doq"
+
+// Error codes of DNS over QUIC (RFC 9250, section 4.3).
+const (
+	doqInternalError quic.StreamErrorCode      = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// dnsHeaderLen is the length of a DNS message header.
+const dnsHeaderLen = 12
+
+// doqHandler answers DNS queries received over QUIC by forwarding them to an
+// upstream resolver. Every query comes on a stream of its own, prefixed with
+// its length, and the response is sent back the same way.
+type doqHandler struct {
+	upstream string
+	timeout  time.Duration
+}
+
+// Serve implements [streamserver.StreamHandler]. It answers the single
+// query on st.
+func (d *doqHandler) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	l := streamserver.Logger(ctx)
+	defer l.Debug("closed")
+
+	query, err := readDNSMessage(st)
+	if err != nil {
+		st.CancelRead(doqInternalError)
+		st.CancelWrite(doqInternalError)
+		return fmt.Errorf("read query: %w", err)
+	}
+	// The message ID is not needed over QUIC and must be zero.
+	if len(query) < dnsHeaderLen || binary.BigEndian.Uint16(query) != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "malformed query")
+		return errors.New("malformed query")
+	}
+
+	start := time.Now()
+	qctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	resp, err := d.exchange(qctx, query)
+	if err != nil {
+		st.CancelWrite(doqInternalError)
+		return fmt.Errorf("forward query: %w", err)
+	}
+
+	msg := make([]byte, 2+len(resp))
+	binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+	copy(msg[2:], resp)
+	if _, err := st.Write(msg); err != nil {
+		return fmt.Errorf("write response: %w", err)
+	}
+	_ = st.Close()
+	l.Debug("query answered", "query_bytes", len(query), "response_bytes", len(resp), "dur", time.Since(start))
+	return nil
+}
+
+// exchange sends query to the upstream resolver over UDP and returns its
+// response, retrying over TCP if the response is truncated. The response
+// carries the message ID of query.
+func (d *doqHandler) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// Upstream gets a random ID, so that its responses cannot be guessed.
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	out := append([]byte(nil), query...)
+	copy(out, id[:])
+
+	resp, err := exchangeUDP(ctx, d.upstream, out)
+	if err == nil && resp[2]&0x02 != 0 {
+		resp, err = exchangeTCP(ctx, d.upstream, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	copy(resp, query[:2])
+	return resp, nil
+}
+
+// exchangeUDP sends query to addr in a UDP datagram and waits for the
+// response with the same ID until ctx is done.
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(dl)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= dnsHeaderLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeTCP sends query to addr over TCP and reads the response.
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(dl)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	resp, err := readDNSMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < dnsHeaderLen {
+		return nil, errors.New("short response")
+	}
+	return resp, nil
+}
+
+// readDNSMessage reads a DNS message prefixed with its 2-byte length.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
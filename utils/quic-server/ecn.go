@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// disableECN turns off ECN on the UDP sockets created from now on. quic-go
+// only offers this through the environment.
+func disableECN() error {
+	return os.Setenv("QUIC_GO_DISABLE_ECN", "true")
+}
+
+// ecnCounters counts the ECN markings of a connection's packets, as seen in
+// its qlog events. Comparing the markings sent with those the peer reports
+// in its ACKs shows whether the path clears or rewrites ECN bits.
+type ecnCounters struct {
+	state                      qlog.ECNState
+	sentECT0, sentECT1         uint64
+	receivedECT0, receivedECT1 uint64
+	receivedCE                 uint64
+	peerECT0, peerECT1, peerCE uint64 // as reported in the peer's ACKs
+}
+
+// record counts the markings of ev, if it has any.
+func (c *ecnCounters) record(ev qlogwriter.Event) {
+	switch ev := ev.(type) {
+	case qlog.PacketSent:
+		switch ev.ECN {
+		case qlog.ECT0:
+			c.sentECT0++
+		case qlog.ECT1:
+			c.sentECT1++
+		}
+	case qlog.PacketReceived:
+		switch ev.ECN {
+		case qlog.ECT0:
+			c.receivedECT0++
+		case qlog.ECT1:
+			c.receivedECT1++
+		case qlog.ECNCE:
+			c.receivedCE++
+		}
+		for _, f := range ev.Frames {
+			if ack, ok := f.Frame.(*qlog.AckFrame); ok {
+				c.peerECT0 = max(c.peerECT0, ack.ECT0)
+				c.peerECT1 = max(c.peerECT1, ack.ECT1)
+				c.peerCE = max(c.peerCE, ack.ECNCE)
+			}
+		}
+	case qlog.ECNStateUpdated:
+		c.state = ev.State
+	}
+}
+
+// group returns the counters as a log group.
+func (c *ecnCounters) group() slog.Attr {
+	return slog.Group("ecn",
+		"state", string(c.state),
+		"sent_ect0", c.sentECT0,
+		"sent_ect1", c.sentECT1,
+		"received_ect0", c.receivedECT0,
+		"received_ect1", c.receivedECT1,
+		"received_ce", c.receivedCE,
+		"peer_ect0", c.peerECT0,
+		"peer_ect1", c.peerECT1,
+		"peer_ce", c.peerCE,
+	)
+}
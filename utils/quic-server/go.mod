@@ -2,10 +2,20 @@ module quic_server
 
 go 1.25.5
 
-require github.com/quic-go/quic-go v0.57.1
+require (
+	github.com/quic-go/quic-go v0.58.0
+	github.com/quic-go/webtransport-go v0.9.0
+	github.com/romanov9617/usb-quic v0.0.0
+)
 
 require (
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
 )
+
+replace github.com/romanov9617/usb-quic => ../..
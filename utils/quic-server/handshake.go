@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// errHandshakeRateLimited is returned from ConnContext to refuse a handshake
+// when the handshake rate limit is exceeded.
+var errHandshakeRateLimited = errors.New("handshake rate limit exceeded")
+
+// tokenBucket is a minimal token-bucket rate limiter.
+type tokenBucket struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket refilled at rate tokens per second.
+// A burst below 1 is raised to 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := max(float64(burst), 1)
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// allow takes one token if available and reports whether it did.
+func (tb *tokenBucket) allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Retry modes select when new connections must complete address validation
+// with a QUIC Retry first.
+const (
+	retryAuto   = "auto"   // above the retry rate, if one is set
+	retryAlways = "always" // for every new connection
+	retryNever  = "never"  // never
+)
+
+// handshakeLimiter protects the UDP listener from handshake floods.
+//
+// Handshakes beyond retryRate must first complete address validation with a
+// QUIC Retry, which costs a spoofing attacker its reflection; handshakes
+// beyond rate are refused outright. A nil bucket disables that stage.
+// alwaysRetry requires a Retry for every handshake instead.
+type handshakeLimiter struct {
+	accept      *tokenBucket
+	retry       *tokenBucket
+	alwaysRetry bool
+	l           *slog.Logger
+}
+
+// newHandshakeLimiter returns a limiter allowing rate handshakes per second
+// with the given burst. With retryMode auto it requires Retry above
+// retryRate handshakes per second; always and never require Retry for all
+// or no handshakes. A zero rate disables the respective stage; it returns
+// nil if nothing is enabled.
+func newHandshakeLimiter(rate float64, burst int, retryMode string, retryRate float64, l *slog.Logger) (*handshakeLimiter, error) {
+	if rate < 0 || retryRate < 0 {
+		return nil, fmt.Errorf("rates must not be negative")
+	}
+	switch retryMode {
+	case retryAuto:
+	case retryAlways, retryNever:
+		if retryRate > 0 {
+			return nil, fmt.Errorf("a retry rate only applies in retry mode %q", retryAuto)
+		}
+	default:
+		return nil, fmt.Errorf("unknown retry mode %q", retryMode)
+	}
+	if rate == 0 && retryRate == 0 && retryMode != retryAlways {
+		return nil, nil
+	}
+
+	hl := &handshakeLimiter{alwaysRetry: retryMode == retryAlways, l: l.With("component", "handshake")}
+	if rate > 0 {
+		hl.accept = newTokenBucket(rate, burst)
+	}
+	if retryRate > 0 {
+		hl.retry = newTokenBucket(retryRate, burst)
+	}
+	return hl, nil
+}
+
+// install hooks the limiter into tr. It is a no-op for a nil limiter.
+func (hl *handshakeLimiter) install(tr *quic.Transport) {
+	if hl == nil {
+		return
+	}
+	switch {
+	case hl.alwaysRetry:
+		tr.VerifySourceAddress = func(net.Addr) bool { return true }
+	case hl.retry != nil:
+		tr.VerifySourceAddress = hl.verifySourceAddress
+	}
+	if hl.accept != nil {
+		tr.ConnContext = hl.connContext
+	}
+}
+
+// verifySourceAddress implements [quic.Transport] VerifySourceAddress.
+func (hl *handshakeLimiter) verifySourceAddress(addr net.Addr) bool {
+	if hl.retry.allow() {
+		return false
+	}
+	hl.l.Debug("requiring address validation", "remote", addr.String())
+	return true
+}
+
+// connContext implements [quic.Transport] ConnContext.
+func (hl *handshakeLimiter) connContext(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+	if !hl.accept.allow() {
+		hl.l.Debug("handshake refused", "remote", info.RemoteAddr.String(), "addr_verified", info.AddrVerified)
+		return ctx, errHandshakeRateLimited
+	}
+	return ctx, nil
+}
+
+// String describes the limiter for logging.
+func (hl *handshakeLimiter) String() string {
+	s := "rate=unlimited"
+	if hl.accept != nil {
+		s = fmt.Sprintf("rate=%g/s burst=%g", hl.accept.rate, hl.accept.burst)
+	}
+	if hl.retry != nil {
+		s += fmt.Sprintf(" retry-above=%g/s", hl.retry.rate)
+	}
+	if hl.alwaysRetry {
+		s += " retry=always"
+	}
+	return s
+}
+
+// errTooManyHandshakes is returned from ConnContext to refuse a handshake
+// while the maximum number of handshakes is in progress.
+var errTooManyHandshakes = errors.New("too many handshakes in progress")
+
+// defaultHandshakeIdleTimeout is quic-go's handshake idle timeout, used when
+// none is configured.
+const defaultHandshakeIdleTimeout = 5 * time.Second
+
+// handshakeIdleTimeout returns the handshake idle timeout that bounds
+// handshakes to total as well as to idle. quic-go ends a handshake after
+// twice its idle timeout, so a total below that lowers the idle timeout to
+// half of it. A zero total keeps quic-go's bound; a zero idle is quic-go's
+// default.
+func handshakeIdleTimeout(idle, total time.Duration) (time.Duration, error) {
+	if idle < 0 || total < 0 {
+		return 0, fmt.Errorf("timeouts must not be negative")
+	}
+	if idle == 0 {
+		idle = defaultHandshakeIdleTimeout
+	}
+	if total > 2*idle {
+		return 0, fmt.Errorf("a handshake timeout of %s exceeds twice the handshake idle timeout of %s", total, idle)
+	}
+	if total > 0 {
+		idle = min(idle, total/2)
+	}
+	return idle, nil
+}
+
+// handshakeKey is the context key of a connection's [handshake].
+type handshakeKey struct{}
+
+// pendingHandshakes tracks the handshakes in progress on the listeners,
+// refuses new ones beyond max so that a flood of handshakes that never
+// complete cannot hold unbounded state, and logs those that time out.
+type pendingHandshakes struct {
+	max int // 0 for no limit
+	l   *slog.Logger
+
+	mu      sync.Mutex
+	pending int
+
+	refused  atomic.Uint64
+	timedOut atomic.Uint64
+}
+
+// newPendingHandshakes returns a tracker allowing max handshakes in progress
+// at once, or any number if max is 0. Tracking traces every packet until
+// the handshake ends, so it is only set up when handshakes are bounded.
+func newPendingHandshakes(max int, l *slog.Logger) (*pendingHandshakes, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("maximum handshakes must not be negative, got %d", max)
+	}
+	return &pendingHandshakes{max: max, l: l.With("component", "handshake")}, nil
+}
+
+// install hooks ph into tr, after any ConnContext already installed. It is a
+// no-op for a nil tracker.
+func (ph *pendingHandshakes) install(tr *quic.Transport) {
+	if ph == nil {
+		return
+	}
+	next := tr.ConnContext
+	tr.ConnContext = func(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+		if next != nil {
+			var err error
+			if ctx, err = next(ctx, info); err != nil {
+				return ctx, err
+			}
+		}
+		if !ph.acquire() {
+			ph.refused.Add(1)
+			ph.l.Debug("handshake refused", "remote", info.RemoteAddr.String(), "reason", errTooManyHandshakes)
+			return ctx, errTooManyHandshakes
+		}
+		h := &handshake{ph: ph, started: time.Now(), remote: info.RemoteAddr.String()}
+		ctx = context.WithValue(ctx, handshakeKey{}, h)
+		// quic-go cancels the context when the connection closes, which
+		// releases the handshake even if no trace reports its end, e.g.
+		// when the connection is refused before the tracer is set up.
+		context.AfterFunc(ctx, func() { h.end(false) })
+		return ctx, nil
+	}
+}
+
+// acquire counts a handshake in progress, unless max are already.
+func (ph *pendingHandshakes) acquire() bool {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if ph.max > 0 && ph.pending >= ph.max {
+		return false
+	}
+	ph.pending++
+	return true
+}
+
+// release ends a handshake counted by acquire.
+func (ph *pendingHandshakes) release() {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	ph.pending--
+}
+
+// tracer is a [quic.Config] Tracer that follows the handshakes attached by
+// install until they end.
+func (ph *pendingHandshakes) tracer(ctx context.Context, _ bool, _ quic.ConnectionID) qlogwriter.Trace {
+	h, ok := ctx.Value(handshakeKey{}).(*handshake)
+	if !ok {
+		return nil
+	}
+	return h
+}
+
+// group returns the counters of ph as a log attribute group, which is empty
+// for a nil tracker.
+func (ph *pendingHandshakes) group() slog.Attr {
+	if ph == nil {
+		return slog.Attr{}
+	}
+	ph.mu.Lock()
+	pending := ph.pending
+	ph.mu.Unlock()
+	return slog.Group("handshakes",
+		"in_progress", pending,
+		"refused", ph.refused.Load(),
+		"timed_out", ph.timedOut.Load(),
+	)
+}
+
+// handshake is the handshake of one connection, counted by its
+// pendingHandshakes until it completes or the connection closes, as its
+// trace reports or, failing that, its context. It is both the
+// [qlogwriter.Trace] and its only [qlogwriter.Recorder].
+type handshake struct {
+	ph      *pendingHandshakes
+	started time.Time
+	remote  string
+	once    sync.Once
+	// done is set once the handshake ended, after which the trace records
+	// nothing for the rest of the connection.
+	done atomic.Bool
+}
+
+// AddProducer implements [qlogwriter.Trace].
+func (h *handshake) AddProducer() qlogwriter.Recorder { return h }
+
+// SupportsSchemas implements [qlogwriter.Trace].
+func (h *handshake) SupportsSchemas(schema string) bool {
+	return schema == qlog.EventSchema && !h.done.Load()
+}
+
+// RecordEvent implements [qlogwriter.Recorder].
+func (h *handshake) RecordEvent(ev qlogwriter.Event) {
+	if h.done.Load() {
+		return
+	}
+	switch ev := ev.(type) {
+	case qlog.KeyDiscarded:
+		// The server drops its handshake keys once the handshake is
+		// complete and confirmed.
+		if ev.KeyType == qlog.KeyTypeServerHandshake {
+			h.end(false)
+		}
+	case qlog.ConnectionClosed:
+		// quic-go reports handshake timeouts as idle timeouts.
+		h.end(ev.Trigger == qlog.ConnectionCloseTriggerIdleTimeout)
+	}
+}
+
+// Close implements [qlogwriter.Recorder].
+func (h *handshake) Close() error {
+	h.end(false)
+	return nil
+}
+
+// end releases the handshake the first time it is called, and logs it if it
+// timedOut.
+func (h *handshake) end(timedOut bool) {
+	h.once.Do(func() {
+		h.done.Store(true)
+		h.ph.release()
+		if timedOut {
+			h.ph.timedOut.Add(1)
+			h.ph.l.Info("handshake timed out", "remote", h.remote, "after", time.Since(h.started).Round(time.Millisecond))
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// alpnHealth is the ALPN identifier of the health-check protocol.
+const alpnHealth = "quic-health"
+
+// version is the server version reported by health checks. It is set at
+// build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// healthStream answers a health check: a first line of "PING" gets a single
+// status line such as "PONG status=ok uptime=1m2s conns=3 version=dev".
+// Anything else gets an "ERR" line.
+func (s *server) healthStream(st *quic.Stream, l *slog.Logger) error {
+	defer func() {
+		_ = st.Close()
+		l.Debug("closed")
+	}()
+
+	br := bufio.NewReaderSize(st, 64)
+	line, err := br.ReadSlice('\n')
+	st.CancelRead(0)
+	if err != nil {
+		_, _ = fmt.Fprintf(st, "ERR expected PING\n")
+		return fmt.Errorf("read command: %w", err)
+	}
+
+	if cmd := strings.TrimSpace(string(line)); cmd != "PING" {
+		_, _ = fmt.Fprintf(st, "ERR unknown command %q\n", cmd)
+		l.Debug("health check with unknown command", "cmd", cmd)
+		return nil
+	}
+
+	_, err = fmt.Fprintf(st, "PONG status=ok uptime=%s conns=%d version=%s\n",
+		time.Since(s.started).Round(time.Second), s.srv.ActiveConns(), version)
+	if err != nil {
+		return fmt.Errorf("write status: %w", err)
+	}
+	l.Debug("health check answered")
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// alpnHTTP3 is the ALPN identifier of HTTP/3.
+const alpnHTTP3 = http3.NextProtoH3
+
+// http3Handler serves the file root over HTTP/3, so that the transports can
+// be exercised with a real application protocol and standard clients such as
+// curl --http3, and optionally WebTransport echo sessions for browser-based
+// clients and a CONNECT-UDP proxy. It takes over whole connections.
+type http3Handler struct {
+	srv *http3.Server
+	// wt, if non-nil, wraps srv to serve WebTransport sessions as well.
+	wt *webtransport.Server
+	// udpTargets, if non-nil, enables CONNECT-UDP to the targets it
+	// permits.
+	udpTargets *udpTargets
+	// shutdown starts the graceful shutdown of srv once.
+	shutdown sync.Once
+}
+
+// newHTTP3Handler returns a handler serving the files below root, if root
+// is not nil, WebTransport echo sessions at wtPath, if it is not empty, and
+// CONNECT-UDP requests to the targets udpTargets permits, if it is not nil.
+// With auth, every request must carry its token, see [tokenAuth.wrap].
+// Requests and sessions are logged to logger.
+func newHTTP3Handler(root *os.Root, wtPath string, udpTargets *udpTargets, auth *tokenAuth, logger *slog.Logger) *http3Handler {
+	logger = logger.With("component", "http3")
+	files := http.NotFoundHandler()
+	if root != nil {
+		files = http.FileServerFS(root.FS())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", logRequests(files, logger))
+
+	h := &http3Handler{udpTargets: udpTargets}
+	if wtPath == "" {
+		h.srv = &http3.Server{Logger: logger}
+	} else {
+		h.wt = &webtransport.Server{
+			H3: http3.Server{Logger: logger},
+			// This is a test server; let pages from any origin connect.
+			CheckOrigin: func(*http.Request) bool { return true },
+		}
+		h.srv = &h.wt.H3
+		// Upgrading needs the writer of http3 itself, so sessions are not
+		// wrapped by logRequests; they log on their own.
+		mux.HandleFunc(wtPath, func(w http.ResponseWriter, r *http.Request) {
+			h.serveWebTransport(w, r, logger)
+		})
+	}
+	if udpTargets != nil {
+		h.srv.EnableDatagrams = true
+		mux.HandleFunc(connectUDPPattern, func(w http.ResponseWriter, r *http.Request) {
+			h.serveConnectUDP(w, r, logger)
+		})
+	}
+	h.srv.Handler = mux
+	if auth != nil {
+		h.srv.Handler = auth.wrap(mux, logger)
+	}
+	return h
+}
+
+// ServeConn implements [streamserver.ConnHandler]. It serves HTTP/3
+// requests on conn until the client closes it. On shutdown it sends a
+// GOAWAY and waits for requests in flight.
+func (h *http3Handler) ServeConn(ctx context.Context, conn *quic.Conn) error {
+	l := streamserver.Logger(ctx)
+	done := make(chan error, 1)
+	go func() {
+		if h.wt != nil {
+			done <- h.wt.ServeQUICConn(conn)
+			return
+		}
+		done <- h.srv.ServeQUICConn(conn)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		h.shutdown.Do(func() {
+			go func() { _ = h.srv.Shutdown(context.Background()) }()
+		})
+		err = <-done
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve http3: %w", err)
+	}
+	l.Debug("http3 done")
+	return nil
+}
+
+// statusWriter records the status code and body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records code and passes it on.
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts the bytes of p and passes them on.
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying writer for [http.ResponseController].
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests wraps next so that every request is logged once it has been
+// answered.
+func logRequests(next http.Handler, l *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		l.Info("request served",
+			"remote", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"dur", time.Since(start),
+		)
+	})
+}
@@ -2,208 +2,971 @@
 //
 // The server listens on a given address, accepts QUIC connections and streams,
 // and echoes stream payload back to the sender. It uses a self-signed
-// certificate generated at startup and logs events via slog.
+// certificate generated at startup and logs events via slog. With -qlog-dir
+// it also writes a qlog trace per connection for analysis with qvis.
+//
+// Other test protocols (discard, chargen, file, transfer, tunnel, proxy, udp,
+// pubsub) and a health check can be served on the same listener when listed
+// in -protocols, which serves echo only by default; the ALPN negotiated by a
+// connection selects the handler for all of its streams. The
+// echo-bin protocol echoes like echo, but frames messages with 4-byte length
+// prefixes instead of newlines, so that they may hold any bytes. The
+// proxy protocol carries the TCP connections of the client's SOCKS5 listener,
+// and the udp protocol forwards UDP packets in QUIC datagrams to -udp-to. With
+// the reverse protocol, a device that cannot accept inbound links connects out
+// to the server, and connections to -reverse-listen are carried back to it
+// over streams the server opens; the device must authenticate with the token
+// of -auth-token-file. The transfer protocol stores files clients upload in
+// -transfer-dir, up to -transfer-max-bytes in all, and serves them back,
+// verified by SHA-256; interrupted uploads are kept for resuming for
+// -transfer-part-ttl. The perf protocol runs goodput tests whose parameters
+// the client proposes on a control stream, and reports their results as
+// measured by the receiving side, so that both sides agree on them. The rpc protocol serves example
+// Echo and Stats services over protobuf-encoded calls, see package rpc.
+//
+// The http3 protocol serves -file-root over HTTP/3 for standard clients such
+// as curl --http3, and with -webtransport also WebTransport sessions that echo
+// streams and datagrams, for browser-based clients. Browsers only connect
+// with a certificate they trust, see -cert. With -connect-udp it is also a
+// CONNECT-UDP (RFC 9298) proxy that relays UDP flows through the connection,
+// to public addresses only unless -connect-udp-allow lists others. With
+// -auth-token-file, HTTP/3 requests carry the token in an Authorization
+// header, as "Bearer <token>".
+//
+// With -admin-socket, operators can list connections and streams, show
+// counters, close connections and change the log level over a Unix socket.
+// On Unix, SIGUSR1 logs a snapshot of the server state.
+//
+// Settings may also come from a -config file. SIGHUP re-reads it and applies
+// the log level, certificate, echo limits and impairments, and connection
+// limits without dropping existing connections.
+//
+// -listen may be repeated to serve several addresses, e.g. 0.0.0.0:443 and
+// [::]:443 for dual-stack, with one listener each sharing the handlers,
+// limits and stats.
+//
+// With -allow-0rtt, resuming clients may send 0-RTT data on the protocols in
+// -0rtt-protocols. Each session ticket carries 0-RTT at most once, so that
+// captured early data cannot be replayed.
+//
+// Echo streams may offer zstd compression of their messages in their
+// preamble, which pays off for text-heavy traffic over slow links. The
+// server accepts it unless -compress=false, and logs the compression ratio
+// per stream and in the SIGUSR1 summary. They may also ask for a priority,
+// so that the echoes of bulk streams do not delay those of control streams
+// on the same connection.
+//
+// With -record-dir, the bytes of every echo stream are recorded in both
+// directions for replay with quic-replay.
+//
+// With -mode chat, every line received on an echo stream is broadcast to all
+// echo streams, tagged with the sender, which makes the server a test bed for
+// fan-out and concurrent writes. With -mode doq, the server also answers DNS
+// over QUIC (RFC 9250) queries by forwarding them to -doq-upstream, a
+// realistic request/response workload for benchmarking the transports.
+//
+// Path MTU discovery (-pmtud) grows the packets of every connection from
+// -initial-packet-size to what the path carries, up to quic-go's limit of
+// 1452 bytes. With -conn-stats, its steps are logged at debug level and its
+// result per connection, since USB framing and bridges make for unusual
+// MTUs; the MTU is also logged when the connection closes. With
+// -pmtud=false, packets stay at -initial-packet-size.
+//
+// Handshakes take at most -handshake-timeout, and at most -max-handshakes
+// are in progress at once; further ones are refused, so that a flood of
+// handshakes that never complete holds bounded state. Handshakes that time
+// out are logged as such. Together with -handshake-rate and -retry they
+// guard the listener against handshake floods.
+//
+// With -keylog, or SSLKEYLOGFILE in the environment, the TLS secrets of
+// every connection are appended to a file in NSS key log format so that
+// packet captures can be decrypted in Wireshark. This is for debugging only.
+//
+// With -mdns, the server advertises itself on the local network via
+// mDNS/DNS-SD so that clients can find it with -discover.
+//
+// When started by systemd, the server uses the socket-activated UDP sockets
+// instead if any are passed, and reports readiness and shutdown via sd_notify.
 package main
 
 import (
 	"context"
-	"crypto/ed25519"
-	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log/slog"
-	"math/big"
+	"net"
+	"net/netip"
 	"os"
-	"sync/atomic"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/cmdutil"
+	"github.com/romanov9617/usb-quic/pkg/e2e"
+	"github.com/romanov9617/usb-quic/pkg/echoserver"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/mdns"
+	"github.com/romanov9617/usb-quic/pkg/perf"
+	"github.com/romanov9617/usb-quic/pkg/recording"
+	"github.com/romanov9617/usb-quic/pkg/rpc"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+	"github.com/romanov9617/usb-quic/pkg/transfer"
 )
 
-// alpn is the Application-Layer Protocol Negotiation identifier used by this server.
-const alpn = "quic-echo"
+// queuePolicies maps the names accepted by -stream-queue-policy to policies.
+var queuePolicies = map[string]streamserver.QueuePolicy{
+	"reject": streamserver.QueueReject,
+	"wait":   streamserver.QueueWait,
+}
 
-// server holds the QUIC listener and counters used for structured logging.
+// config holds command-line configuration for the server.
+type config struct {
+	configFile string
+	logLevel   slog.Level
+	logFormat  string
+	certFile   string
+	keyFile    string
+	keyLogFile string
+
+	// listen holds the comma-separated -listen addresses.
+	listen        string
+	protocols     string
+	mode          string
+	fileRoot      string
+	tunnelTo      string
+	udpTo         string
+	reverseListen string
+	transferDir   string
+	wtPath        string
+	connectUDP    bool
+	// connectUDPAllow is -connect-udp-allow.
+	connectUDPAllow string
+
+	doqUpstream string
+	doqTimeout  time.Duration
+
+	qlogDir      string
+	qlogMaxBytes int64
+	qlogKeep     int
+
+	maxMsg         int
+	requireE2E     bool
+	e2ePSKFile     string
+	compress       bool
+	maxStreamBytes int64
+	maxConnBytes   int64
+	idleTimeout    time.Duration
+	recordDir      string
+	// recordMaxFile and recordMaxTotal are -record-max-file-bytes and
+	// -record-max-bytes.
+	recordMaxFile  int64
+	recordMaxTotal int64
+
+	delayDist   string
+	delay       time.Duration
+	delaySpread time.Duration
+	delayAlpha  float64
+	delayPer    string
+	jitter      time.Duration
+
+	dropRate   float64
+	truncateAt int64
+
+	maxConns      int
+	maxConnsPerIP int
+
+	handshakeRate  float64
+	handshakeBurst int
+	retryMode      string
+	retryRate      float64
+
+	quicVersions string
+	ecn          bool
+	connStats    bool
+	gso          bool
+	pmtud        bool
+	packetSize   int
+	rcvBuf       int
+	sndBuf       int
+
+	initialStreamWindow uint64
+	maxStreamWindow     uint64
+	initialConnWindow   uint64
+	maxConnWindow       uint64
+
+	keepAlive       time.Duration
+	connIdleTimeout time.Duration
+
+	maxStreams    int64
+	maxUniStreams int64
+
+	streamWorkers     int
+	streamQueue       int
+	streamQueuePolicy string
+
+	handshakeIdleTimeout time.Duration
+	handshakeTimeout     time.Duration
+	maxHandshakes        int
+	tokenMaxAge          time.Duration
+
+	allow0RTT     bool
+	zeroRTTProtos string
+	zeroRTTWindow time.Duration
+
+	ticketKeyRotation time.Duration
+	ticketKeyFile     string
+	resetKeyFile      string
+
+	pprofAddr   string
+	adminSocket string
+	mdns        bool
+
+	authTokenFile string
+	authTimeout   time.Duration
+
+	transferMaxSize int64
+	// transferMaxBytes and transferPartTTL are -transfer-max-bytes and
+	// -transfer-part-ttl.
+	transferMaxBytes int64
+	transferPartTTL  time.Duration
+
+	drainPeriod     time.Duration
+	shutdownTimeout time.Duration
+}
+
+// server holds the state shared by the stream handlers.
 type server struct {
-	logger    *slog.Logger
-	listener  *quic.Listener
-	connSeq   atomic.Uint64
-	streamSeq atomic.Uint64
+	echo *echoserver.Handler
+	// chat serves the echo protocol instead of echo in chat mode.
+	chat *echoserver.Chat
+	// pubsub serves the pub/sub protocol.
+	pubsub *pubsub
+	// rpc serves the example services of the rpc protocol.
+	rpc *rpc.Server
+	// http3 serves the file root over HTTP/3, if enabled.
+	http3 *http3Handler
+	// reverse serves the reverse tunnel, if enabled.
+	reverse *reverseTunnel
+
+	// fileRoot is the directory served by the file protocol, if enabled.
+	fileRoot *os.Root
+	// transferDir is the directory of the transfer protocol, if enabled.
+	transferDir *os.Root
+	// uploads holds the part names of the uploads in progress.
+	uploads sync.Map
+	// transferMu guards transferPending, the bytes reserved in the
+	// transfer directory by the uploads in progress.
+	transferMu      sync.Mutex
+	transferPending int64
+	// tunnelTo is the TCP target of the tunnel protocol, if enabled.
+	tunnelTo string
+
+	// srv and started feed the status reported by health checks.
+	srv     *streamserver.Server
+	started time.Time
+	// handshakes tracks the handshakes in progress for state dumps.
+	handshakes *pendingHandshakes
+
+	// cfg is the configuration the server was started with. level, certs
+	// and limiter hold the settings that reloads can change.
+	cfg     config
+	level   *slog.LevelVar
+	certs   *certStore
+	limiter *connLimiter
 }
 
 // main configures structured logging and runs the server.
 // It exits with a non-zero status on fatal errors.
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}))
+	cfg, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// level can be changed at runtime through the admin socket and reloads.
+	level := new(slog.LevelVar)
+	level.Set(cfg.logLevel)
+	h, err := cmdutil.NewLogHandler(os.Stdout, cfg.logFormat, &slog.HandlerOptions{Level: level})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := slog.New(h)
 	slog.SetDefault(logger)
 
-	if err := run(context.Background(), logger); err != nil {
+	if err := run(context.Background(), logger, level, cfg); err != nil {
 		// Fatal only here: keep helpers testable and error-returning.
 		logger.Error("fatal", "err", err)
 		os.Exit(1)
 	}
 }
 
+// parseFlags parses the command-line arguments args, and the config file
+// they name if any, and returns the resulting config.
+func parseFlags(args []string) (config, error) {
+	var cfg config
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&cfg.configFile, "config", "", "Read settings from this file of \"name = value\" lines, named like the flags; flags take precedence. SIGHUP reloads it")
+	fs.TextVar(&cfg.logLevel, "log-level", slog.LevelDebug, "Log level: debug, info, warn or error")
+	fs.StringVar(&cfg.logFormat, "log-format", "text", "Log format: text or json")
+	fs.StringVar(&cfg.certFile, "cert", "", "PEM certificate file (a self-signed certificate is generated if empty)")
+	fs.StringVar(&cfg.keyFile, "key", "", "PEM private key file for -cert")
+	fs.StringVar(&cfg.keyLogFile, "keylog", os.Getenv("SSLKEYLOGFILE"), "Append TLS secrets in NSS key log format to this file so captures can be decrypted, e.g. in Wireshark; debugging only (default $SSLKEYLOGFILE)")
+	fs.Func("listen", "UDP address to listen on, e.g. 0.0.0.0:443 or [::]:443; repeat to listen on several (default 0.0.0.0:443)", func(addr string) error {
+		cfg.listen = strings.TrimPrefix(cfg.listen+","+addr, ",")
+		return nil
+	})
+	fs.StringVar(&cfg.protocols, "protocols", "echo", "Comma-separated protocols to serve, selected by ALPN: echo, echo-bin, discard, chargen, file, transfer, tunnel, proxy, udp, reverse, health, pubsub, http3, perf, rpc")
+	fs.StringVar(&cfg.mode, "mode", modeEcho, "Server mode: echo (reply to the sender), chat (broadcast every echo line to all streams, tagged with the sender) or doq (also answer DNS over QUIC queries via -doq-upstream)")
+	fs.StringVar(&cfg.doqUpstream, "doq-upstream", "", "DNS resolver host:port that -mode doq forwards queries to")
+	fs.DurationVar(&cfg.doqTimeout, "doq-timeout", 5*time.Second, "How long -mode doq waits for the upstream resolver to answer a query")
+	fs.StringVar(&cfg.fileRoot, "file-root", "", "Directory served by the file and http3 protocols")
+	fs.StringVar(&cfg.transferDir, "transfer-dir", "", "Directory the transfer protocol stores uploaded files in and serves downloads from")
+	fs.Int64Var(&cfg.transferMaxSize, "transfer-max-size", 1<<30, "Largest file in bytes the transfer protocol accepts for upload")
+	fs.Int64Var(&cfg.transferMaxBytes, "transfer-max-bytes", 10<<30, "Refuse uploads that would make the files in -transfer-dir exceed this many bytes (0 = unlimited)")
+	fs.DurationVar(&cfg.transferPartTTL, "transfer-part-ttl", 24*time.Hour, "Remove interrupted uploads from -transfer-dir once not resumed for this long (0 = never)")
+	fs.StringVar(&cfg.wtPath, "webtransport", "", "Serve WebTransport echo sessions at this path, e.g. /echo, with the http3 protocol")
+	fs.BoolVar(&cfg.connectUDP, "connect-udp", false, "Proxy UDP for CONNECT-UDP (RFC 9298) requests with the http3 protocol")
+	fs.StringVar(&cfg.connectUDPAllow, "connect-udp-allow", "", "Comma-separated prefixes or addresses CONNECT-UDP targets must be in (if empty, any but loopback, link-local and private addresses)")
+	fs.StringVar(&cfg.tunnelTo, "tunnel-to", "", "TCP address the tunnel protocol connects streams to")
+	fs.StringVar(&cfg.udpTo, "udp-to", "", "UDP address the udp protocol forwards datagrams to")
+	fs.StringVar(&cfg.reverseListen, "reverse-listen", "", "TCP address whose connections the reverse protocol carries to the connected device")
+	fs.IntVar(&cfg.maxMsg, "max-msg", echoserver.DefaultMaxMsg, "Maximum message (line) size in bytes accepted on a stream, or as the payload of a unidirectional stream; must be positive")
+	fs.Int64Var(&cfg.maxStreamBytes, "max-stream-bytes", 0, "Reset a stream once its echo would exceed this many bytes (0 = unlimited)")
+	fs.Int64Var(&cfg.maxConnBytes, "max-conn-bytes", 0, "Reset streams once the echo on a connection would exceed this many bytes (0 = unlimited)")
+	fs.DurationVar(&cfg.idleTimeout, "stream-idle-timeout", 10*time.Minute, "Reset echo streams that transfer no data for this long (0 = never)")
+	fs.BoolVar(&cfg.requireE2E, "require-e2e", false, "Reject streams that do not negotiate end-to-end message encryption")
+	fs.StringVar(&cfg.e2ePSKFile, "e2e-psk-file", "", "Bind end-to-end encryption keys to the pre-shared key (32 hex-encoded bytes) in this file, which clients must share; without it the key exchange is unauthenticated")
+	fs.BoolVar(&cfg.compress, "compress", true, "Accept zstd compression of echo messages on the streams that offer it")
+	fs.StringVar(&cfg.recordDir, "record-dir", "", "Record the bytes of every echo stream in both directions to a timestamped file in this directory, for quic-replay (disabled if empty)")
+	fs.Int64Var(&cfg.recordMaxFile, "record-max-file-bytes", 64<<20, "Stop recording a stream once its recording reaches this many bytes (0 = unlimited)")
+	fs.Int64Var(&cfg.recordMaxTotal, "record-max-bytes", 1<<30, "Stop recording once the recordings in -record-dir take up this many bytes, counting those there at startup (0 = unlimited)")
+	fs.StringVar(&cfg.delayDist, "echo-delay-dist", "", "Inject echo delay drawn from a distribution: fixed, uniform, normal or pareto (fixed if empty and -echo-delay or -echo-jitter is set)")
+	fs.DurationVar(&cfg.delay, "echo-delay", 0, "Echo delay: the fixed value, the mean (uniform, normal) or the scale (pareto)")
+	fs.DurationVar(&cfg.delaySpread, "echo-delay-spread", 0, "Echo delay half-width (uniform) or standard deviation (normal)")
+	fs.Float64Var(&cfg.delayAlpha, "echo-delay-alpha", 2, "Echo delay shape for the pareto distribution")
+	fs.StringVar(&cfg.delayPer, "echo-delay-per", "message", "Apply each delay sample per message or per byte")
+	fs.DurationVar(&cfg.jitter, "echo-jitter", 0, "Add a uniformly random echo delay in [0, jitter) on top of -echo-delay")
+	fs.Float64Var(&cfg.dropRate, "drop-rate", 0, "Probability in [0, 1] of silently dropping each echoed message or datagram; end-to-end encrypted messages are never dropped")
+	fs.Int64Var(&cfg.truncateAt, "truncate-at", 0, "End each stream's echo after this many bytes, and cut datagrams to this size (0 = never)")
+	fs.IntVar(&cfg.maxConns, "max-conns", 0, "Maximum number of concurrent connections (0 = unlimited)")
+	fs.IntVar(&cfg.maxConnsPerIP, "max-conns-per-ip", 0, "Maximum number of concurrent connections per source IP (0 = unlimited)")
+	fs.Float64Var(&cfg.handshakeRate, "handshake-rate", 0, "Maximum new handshakes per second; excess handshakes are refused (0 = unlimited)")
+	fs.IntVar(&cfg.handshakeBurst, "handshake-burst", 32, "Burst size for -handshake-rate and -retry-rate")
+	fs.StringVar(&cfg.retryMode, "retry", retryAuto, "When to require Retry address validation: auto (above -retry-rate), always or never")
+	fs.Float64Var(&cfg.retryRate, "retry-rate", 0, "With -retry=auto, require Retry address validation once handshakes exceed this rate per second (0 = never)")
+	fs.StringVar(&cfg.quicVersions, "quic-versions", "v1,v2", "Comma-separated QUIC versions to accept, in order of preference: v1, v2")
+	fs.Uint64Var(&cfg.initialStreamWindow, "initial-stream-window", 0, "Initial per-stream receive window in bytes (0 = quic-go default, 512 KiB)")
+	fs.Uint64Var(&cfg.maxStreamWindow, "max-stream-window", 0, "Maximum per-stream receive window in bytes the window may grow to (0 = quic-go default, 6 MiB)")
+	fs.Uint64Var(&cfg.initialConnWindow, "initial-conn-window", 0, "Initial connection receive window in bytes (0 = quic-go default, 768 KiB)")
+	fs.Uint64Var(&cfg.maxConnWindow, "max-conn-window", 0, "Maximum connection receive window in bytes the window may grow to (0 = quic-go default, 15 MiB)")
+	fs.Int64Var(&cfg.maxStreams, "max-streams", 0, "Maximum concurrent bidirectional streams per connection (0 = quic-go default, 100; negative = none)")
+	fs.Int64Var(&cfg.maxUniStreams, "max-uni-streams", 0, "Maximum concurrent unidirectional streams per connection (0 = quic-go default, 100; negative = none)")
+	fs.IntVar(&cfg.streamWorkers, "stream-workers", 0, "Serve streams with this many workers shared by all connections; http3, reverse and perf connections serve their own (0 = one goroutine per stream)")
+	fs.IntVar(&cfg.streamQueue, "stream-queue", 64, "With -stream-workers, number of streams that may wait for a worker")
+	fs.StringVar(&cfg.streamQueuePolicy, "stream-queue-policy", "reject", "With -stream-workers, what to do with streams once the queue is full: reject (reset them) or wait (stop accepting streams on the connection)")
+	fs.BoolVar(&cfg.ecn, "ecn", true, "Use ECN on the UDP sockets, and with -conn-stats log ECN counters when connections close; disable on paths that mangle ECN bits")
+	fs.BoolVar(&cfg.connStats, "conn-stats", false, "Trace every connection to log its handshake duration, congestion window, path MTU and ECN counters when it closes, and the steps of path MTU discovery; costs work for every packet")
+	fs.BoolVar(&cfg.gso, "gso", true, "Use generic segmentation offload (GSO) on the UDP sockets where the kernel supports it")
+	fs.BoolVar(&cfg.pmtud, "pmtud", true, "Discover the path MTU (DPLPMTUD, RFC 8899) to send packets of up to 1452 bytes, and log what it finds; disable on paths that silently drop large packets")
+	fs.IntVar(&cfg.packetSize, "initial-packet-size", 0, "Size in bytes of the first packets, 1200 to 1452, and without -pmtud of all of them (0 = quic-go default, 1280)")
+	fs.IntVar(&cfg.rcvBuf, "udp-rcvbuf", 0, "UDP socket receive buffer (SO_RCVBUF) in bytes, with a warning if the kernel grants less (0 = quic-go default; it raises buffers below 7 MiB where permitted)")
+	fs.IntVar(&cfg.sndBuf, "udp-sndbuf", 0, "UDP socket send buffer (SO_SNDBUF) in bytes, with a warning if the kernel grants less (0 = quic-go default; it raises buffers below 7 MiB where permitted)")
+	fs.DurationVar(&cfg.keepAlive, "keep-alive", 0, "Send keep-alive PINGs this often on idle connections (0 = never)")
+	fs.DurationVar(&cfg.connIdleTimeout, "idle-timeout", 0, "Close connections idle for this long (0 = quic-go default, 30s); the peer's lower value wins")
+	fs.DurationVar(&cfg.handshakeIdleTimeout, "handshake-idle-timeout", 5*time.Second, "Handshake idle timeout; Retry tokens stay valid for twice this long")
+	fs.DurationVar(&cfg.handshakeTimeout, "handshake-timeout", 0, "Close connections whose handshake takes longer than this, at most twice -handshake-idle-timeout, which it lowers to half of it if needed (0 = twice -handshake-idle-timeout)")
+	fs.IntVar(&cfg.maxHandshakes, "max-handshakes", 0, "Maximum number of handshakes in progress at once; excess handshakes are refused (0 = unlimited)")
+	fs.DurationVar(&cfg.tokenMaxAge, "token-max-age", 24*time.Hour, "How long address validation tokens from earlier connections (NEW_TOKEN) stay valid")
+	fs.BoolVar(&cfg.allow0RTT, "allow-0rtt", false, "Accept 0-RTT data from resuming clients, with replay protection")
+	fs.StringVar(&cfg.zeroRTTProtos, "0rtt-protocols", "echo,health", "Comma-separated protocols that may run over 0-RTT data; their requests must be safe to replay")
+	fs.DurationVar(&cfg.zeroRTTWindow, "0rtt-window", time.Hour, "Maximum session ticket age for 0-RTT; each ticket carries 0-RTT at most once within it")
+	fs.DurationVar(&cfg.ticketKeyRotation, "ticket-key-rotation", 0, "Rotate session ticket keys at this interval (0 = crypto/tls default keys)")
+	fs.StringVar(&cfg.ticketKeyFile, "ticket-key-file", "", "Keep session ticket keys in this file, shared by instances and kept across restarts; requires -ticket-key-rotation")
+	fs.StringVar(&cfg.resetKeyFile, "stateless-reset-key-file", "", "Read the stateless reset key (32 hex-encoded bytes) from this file, else from $"+resetKeyEnv+"; keep it across restarts so old connections get reset")
+	fs.DurationVar(&cfg.drainPeriod, "drain-period", 5*time.Second, "On shutdown, how long in-flight streams may finish before connections are closed")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 10*time.Second, "On shutdown, how long to wait for connection handlers before exiting")
+	fs.StringVar(&cfg.pprofAddr, "pprof-addr", "", "Serve net/http/pprof on this TCP address, e.g. localhost:6060 (disabled if empty)")
+	fs.StringVar(&cfg.authTokenFile, "auth-token-file", "", "Require clients to send the token in this file as the first line of their first stream; health checks are exempt (disabled if empty)")
+	fs.DurationVar(&cfg.authTimeout, "auth-timeout", 10*time.Second, "How long a connection may take to present its token with -auth-token-file")
+	fs.BoolVar(&cfg.mdns, "mdns", false, "Advertise the server on the local network via mDNS/DNS-SD as "+mdns.ServiceType+", with its protocols and port in TXT records")
+	fs.StringVar(&cfg.adminSocket, "admin-socket", "", "Serve the admin control API on this Unix socket path (disabled if empty)")
+	fs.StringVar(&cfg.qlogDir, "qlog-dir", "", "Directory for per-connection qlog files (disabled if empty)")
+	fs.Int64Var(&cfg.qlogMaxBytes, "qlog-max-bytes", 64<<20, "Rotate a connection's qlog file after this many bytes (0 disables rotation)")
+	fs.IntVar(&cfg.qlogKeep, "qlog-keep", 4, "Number of rotated qlog segments to keep per connection")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if cfg.configFile != "" {
+		if err := applyConfigFile(fs, cfg.configFile); err != nil {
+			return cfg, fmt.Errorf("config file: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
 // run prepares TLS and QUIC listener configuration and starts serving.
-func run(ctx context.Context, logger *slog.Logger) error {
-	addr := "0.0.0.0:443"
+// level is the log level of logger, exposed through the admin socket.
+func run(ctx context.Context, logger *slog.Logger, level *slog.LevelVar, cfg config) error {
+	ctx, cancel := cmdutil.WithSignals(ctx, logger)
+	defer cancel()
+
+	if cfg.pprofAddr != "" {
+		if err := cmdutil.StartPprof(ctx, cfg.pprofAddr, logger); err != nil {
+			return fmt.Errorf("pprof: %w", err)
+		}
+	}
 
-	tlsConf, err := buildTLSConfig(logger)
+	echoOpts, err := echoOptions(cfg, logger)
 	if err != nil {
-		return fmt.Errorf("build tls config: %w", err)
+		return err
 	}
 
-	ln, err := quic.ListenAddr(addr, tlsConf, &quic.Config{})
+	switch cfg.mode {
+	case modeEcho, modeChat:
+	case modeDoQ:
+		if cfg.doqUpstream == "" {
+			return errors.New("mode doq requires -doq-upstream")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", cfg.mode)
+	}
+
+	alpns, err := parseProtocols(cfg.protocols, cfg)
 	if err != nil {
-		return fmt.Errorf("listen %s: %w", addr, err)
+		return fmt.Errorf("protocols: %w", err)
 	}
 
-	s := &server{
-		logger:   logger.With("component", "server", "addr", addr, "proto", "udp"),
-		listener: ln,
+	var fileRoot *os.Root
+	if cfg.fileRoot != "" && (slices.Contains(alpns, alpnFile) || slices.Contains(alpns, alpnHTTP3)) {
+		if fileRoot, err = os.OpenRoot(cfg.fileRoot); err != nil {
+			return fmt.Errorf("file root: %w", err)
+		}
+		defer func() { _ = fileRoot.Close() }()
 	}
 
-	s.logger.Info("started")
-	return s.serve(ctx)
-}
+	var transferDir *os.Root
+	if slices.Contains(alpns, transfer.ALPN) {
+		if cfg.transferMaxSize < 0 || cfg.transferMaxBytes < 0 || cfg.transferPartTTL < 0 {
+			return errors.New("-transfer-max-size, -transfer-max-bytes and -transfer-part-ttl must not be negative")
+		}
+		if transferDir, err = os.OpenRoot(cfg.transferDir); err != nil {
+			return fmt.Errorf("transfer directory: %w", err)
+		}
+		defer func() { _ = transferDir.Close() }()
+	}
 
-// serve accepts incoming QUIC connections until ctx is canceled or an error occurs.
-func (s *server) serve(ctx context.Context) error {
-	for {
-		conn, err := s.listener.Accept(ctx)
-		if err != nil {
-			// Context cancellation is a graceful shutdown path.
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				s.logger.Info("accept loop stopped by context", "err", err)
-				return nil
-			}
-			return fmt.Errorf("accept conn: %w", err)
+	var auth *tokenAuth
+	if cfg.authTokenFile != "" {
+		if cfg.mode == modeDoQ {
+			return errors.New("mode doq cannot be combined with -auth-token-file")
+		}
+		// HTTP/3 clients know nothing about the token stream; their
+		// requests carry the token instead.
+		if auth, err = newTokenAuth(cfg.authTokenFile, []string{alpnHealth, alpnHTTP3}); err != nil {
+			return fmt.Errorf("auth token: %w", err)
 		}
+	}
+
+	s := &server{
+		echo: echoserver.New(echoOpts),
 
-		connID := s.connSeq.Add(1)
-		l := s.logger.With(
-			"component", "conn",
-			"conn_id", connID,
-			"remote", conn.RemoteAddr().String(),
-		)
+		pubsub: newPubSub(cfg.maxMsg),
+		rpc:    rpc.NewServer(),
 
-		l.Info("accepted")
-		go func() {
-			if err := s.handleConn(ctx, conn, connID, l); err != nil {
-				l.Warn("connection handler ended with error", "err", err)
+		fileRoot:    fileRoot,
+		transferDir: transferDir,
+		tunnelTo:    cfg.tunnelTo,
+		started:     time.Now(),
+
+		cfg:     cfg,
+		level:   level,
+		certs:   new(certStore),
+		limiter: newConnLimiter(cfg.maxConns, cfg.maxConnsPerIP),
+	}
+	rpc.RegisterEcho(s.rpc)
+	rpc.RegisterStats(s.rpc)
+	if transferDir != nil {
+		// Parts left over from earlier runs expire here, or with the next
+		// upload.
+		if _, err := s.transferUsage(logger.With("component", "transfer")); err != nil {
+			return fmt.Errorf("transfer directory: %w", err)
+		}
+	}
+	if cfg.mode == modeChat {
+		s.chat = echoserver.NewChat(s.echo)
+		logger.Info("chat mode enabled")
+	}
+	mux := streamserver.NewProtocolMux()
+	for _, id := range alpns {
+		if id == alpnHTTP3 {
+			var targets *udpTargets
+			if cfg.connectUDP {
+				if targets, err = parseUDPTargets(cfg.connectUDPAllow); err != nil {
+					return fmt.Errorf("-connect-udp-allow: %w", err)
+				}
+				if len(targets.allow) == 0 {
+					logger.Warn("CONNECT-UDP proxy enabled, clients can send UDP to any public address")
+				} else {
+					logger.Info("CONNECT-UDP proxy enabled", "allow", cfg.connectUDPAllow)
+				}
 			}
-		}()
+			s.http3 = newHTTP3Handler(fileRoot, cfg.wtPath, targets, auth, logger)
+			mux.HandleConn(id, s.http3)
+			continue
+		}
+		if id == alpnReverse {
+			s.reverse = new(reverseTunnel)
+			if err := s.reverse.listen(ctx, cfg.reverseListen, logger); err != nil {
+				return fmt.Errorf("reverse listener: %w", err)
+			}
+			logger.Warn("reverse tunnel enabled, connections to -reverse-listen are carried to the authenticated device that connected last")
+			mux.HandleConn(id, s.reverse)
+			continue
+		}
+		if id == perf.ALPN {
+			mux.HandleConn(id, perfHandler{})
+			continue
+		}
+		mux.Handle(id, s.handlerFor(id))
+	}
+	if slices.Contains(alpns, alpnProxy) {
+		logger.Warn("proxy protocol enabled, clients can reach any TCP target")
+	}
+	if cfg.mode == modeDoQ {
+		mux.Handle(alpnDoQ, &doqHandler{upstream: cfg.doqUpstream, timeout: cfg.doqTimeout})
+		logger.Info("DNS over QUIC enabled", "upstream", cfg.doqUpstream)
 	}
-}
 
-// handleConn accepts streams from conn and starts an echo handler for each stream.
-func (s *server) handleConn(ctx context.Context, conn *quic.Conn, _ uint64, l *slog.Logger) error {
-	defer func() {
-		l.Info("closing")
-		_ = conn.CloseWithError(0, "server closing")
-	}()
+	if err := s.certs.load(cfg.certFile, cfg.keyFile, logger); err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+	tlsConf := buildTLSConfig(mux.Protocols(), s.certs, logger)
+	if cfg.keyLogFile != "" {
+		f, err := os.OpenFile(cfg.keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("key log: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		tlsConf.KeyLogWriter = f
+		logger.Warn("TLS key logging enabled, captured traffic can be decrypted", "component", "tls", "file", cfg.keyLogFile)
+	}
 
-	for {
-		st, err := conn.AcceptStream(ctx)
+	if cfg.ticketKeyRotation > 0 || cfg.ticketKeyFile != "" {
+		tk, err := newTicketKeys(tlsConf, cfg.ticketKeyFile, cfg.ticketKeyRotation, logger)
 		if err != nil {
-			// Client close or context cancellation commonly ends the stream loop.
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				l.Info("accept stream stopped by context", "err", err)
-				return nil
-			}
-			return fmt.Errorf("accept stream: %w", err)
+			return fmt.Errorf("session ticket keys: %w", err)
+		}
+		if err := tk.start(ctx); err != nil {
+			return fmt.Errorf("session ticket keys: %w", err)
+		}
+	}
+
+	versions, err := cmdutil.ParseQUICVersions(cfg.quicVersions)
+	if err != nil {
+		return err
+	}
+	if cfg.packetSize != 0 && (cfg.packetSize < minPacketSize || cfg.packetSize > maxPacketSize) {
+		return fmt.Errorf("-initial-packet-size must be between %d and %d", minPacketSize, maxPacketSize)
+	}
+	hsIdleTimeout, err := handshakeIdleTimeout(cfg.handshakeIdleTimeout, cfg.handshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("handshake timeout: %w", err)
+	}
+	quicConf := &quic.Config{
+		Versions:                       versions,
+		EnableDatagrams:                true,
+		InitialPacketSize:              uint16(cfg.packetSize),
+		DisablePathMTUDiscovery:        !cfg.pmtud,
+		HandshakeIdleTimeout:           hsIdleTimeout,
+		KeepAlivePeriod:                cfg.keepAlive,
+		MaxIdleTimeout:                 cfg.connIdleTimeout,
+		InitialStreamReceiveWindow:     cfg.initialStreamWindow,
+		MaxStreamReceiveWindow:         cfg.maxStreamWindow,
+		InitialConnectionReceiveWindow: cfg.initialConnWindow,
+		MaxConnectionReceiveWindow:     cfg.maxConnWindow,
+		MaxIncomingStreams:             cfg.maxStreams,
+		MaxIncomingUniStreams:          cfg.maxUniStreams,
+	}
+	if cfg.allow0RTT {
+		zeroRTTALPNs, err := parseProtocols(cfg.zeroRTTProtos, cfg)
+		if err != nil {
+			return fmt.Errorf("0-RTT protocols: %w", err)
+		}
+		ar, err := newAntiReplay(cfg.zeroRTTWindow, zeroRTTALPNs, logger)
+		if err != nil {
+			return fmt.Errorf("0-RTT: %w", err)
+		}
+		ar.install(tlsConf)
+		quicConf.Allow0RTT = true
+		logger.Info("0-RTT enabled", "anti_replay", ar.String())
+	}
+	if cfg.connStats {
+		quicConf.Tracer = connTracer
+	}
+	if !cfg.ecn {
+		if err := disableECN(); err != nil {
+			return fmt.Errorf("disable ECN: %w", err)
+		}
+	}
+	if !cfg.gso {
+		if err := disableGSO(); err != nil {
+			return fmt.Errorf("disable GSO: %w", err)
+		}
+	}
+	if cfg.qlogDir != "" {
+		qt, err := qlogTracer(cfg.qlogDir, cfg.qlogMaxBytes, cfg.qlogKeep, logger)
+		if err != nil {
+			return fmt.Errorf("qlog: %w", err)
 		}
+		quicConf.Tracer = teeTracers(quicConf.Tracer, qt)
+		logger.Info("qlog enabled", "dir", cfg.qlogDir, "max_bytes", cfg.qlogMaxBytes)
+	}
 
-		streamID := s.streamSeq.Add(1)
-		sl := l.With("component", "stream", "stream_id", streamID)
+	hs, err := newHandshakeLimiter(cfg.handshakeRate, cfg.handshakeBurst, cfg.retryMode, cfg.retryRate, logger)
+	if err != nil {
+		return fmt.Errorf("handshake limiter: %w", err)
+	}
+	if hs != nil {
+		logger.Info("handshake rate limiting enabled", "limits", hs.String())
+	}
+	var pending *pendingHandshakes
+	if cfg.handshakeTimeout != 0 || cfg.maxHandshakes != 0 {
+		if pending, err = newPendingHandshakes(cfg.maxHandshakes, logger); err != nil {
+			return fmt.Errorf("handshake limiter: %w", err)
+		}
+		quicConf.Tracer = teeTracers(quicConf.Tracer, pending.tracer)
+		logger.Info("handshakes bounded", "component", "handshake", "timeout", 2*hsIdleTimeout, "idle_timeout", hsIdleTimeout, "max_in_progress", cfg.maxHandshakes)
+	}
+	s.handshakes = pending
 
-		sl.Debug("opened")
-		go func() {
-			if err := echoStream(st, sl); err != nil {
-				sl.Warn("echo ended with error", "err", err)
-			}
-		}()
+	addrs := []string{"0.0.0.0:443"}
+	if cfg.listen != "" {
+		addrs = strings.Split(cfg.listen, ",")
+	}
+	resetKey, err := loadStatelessResetKey(cfg.resetKeyFile)
+	if err != nil {
+		return fmt.Errorf("stateless reset key: %w", err)
+	}
+	if resetKey != nil {
+		logger.Info("stateless reset key loaded")
 	}
-}
 
-// echoStream reads from st and writes back to st until EOF or an error occurs.
-func echoStream(st *quic.Stream, l *slog.Logger) error {
-	defer func() {
-		_ = st.Close()
-		l.Debug("closed")
-	}()
+	configure := func(tr *quic.Transport) error {
+		tr.StatelessResetKey = resetKey
+		tr.MaxTokenAge = cfg.tokenMaxAge
+		hs.install(tr)
+		pending.install(tr)
+		if cfg.connStats {
+			installConnTrace(tr, cfg.ecn, logger)
+		}
+		return nil
+	}
+	// quic-go sizes the socket buffers itself when it starts listening, so
+	// the configured sizes are only applied afterwards.
+	listening := func(tr *quic.Transport) error {
+		return setSocketBuffers(tr.Conn, cfg.rcvBuf, cfg.sndBuf, logger)
+	}
+	lns, err := listen(addrs, tlsConf, quicConf, configure, listening, logger)
+	if err != nil {
+		return err
+	}
 
-	start := time.Now()
-	// io.Copy reads from the stream and writes back to the same stream (echo).
-	n, err := io.Copy(st, st)
-	dur := time.Since(start)
+	srv := &streamserver.Server{
+		Handler:    mux,
+		Admit:      admitFunc(s.limiter, logger),
+		CloseAttrs: closeAttrs,
+		Logger:     logger.With("component", "server", "proto", "udp"),
 
-	// io.EOF is expected when the peer closes its write side.
-	if err != nil && !errors.Is(err, io.EOF) {
-		l.Warn("copy failed", "bytes", n, "dur", dur, "err", err)
-		return fmt.Errorf("io.Copy: %w", err)
+		DrainPeriod:     cfg.drainPeriod,
+		ShutdownTimeout: cfg.shutdownTimeout,
+		GoAwayCode:      errcode.ShuttingDown,
 	}
 
-	l.Info("echo done", "bytes", n, "dur", dur)
-	return nil
-}
+	if cfg.streamWorkers > 0 {
+		policy, ok := queuePolicies[cfg.streamQueuePolicy]
+		if !ok {
+			return fmt.Errorf("unknown stream queue policy %q", cfg.streamQueuePolicy)
+		}
+		if cfg.streamQueue < 0 {
+			return fmt.Errorf("stream queue must not be negative, got %d", cfg.streamQueue)
+		}
+		srv.Workers, srv.QueueLen, srv.QueuePolicy, srv.RejectCode = cfg.streamWorkers, cfg.streamQueue, policy, errcode.StreamRejected
+		logger.Info("stream worker pool enabled", "workers", cfg.streamWorkers, "queue_len", cfg.streamQueue, "policy", cfg.streamQueuePolicy)
+	}
 
-// buildTLSConfig returns a TLS configuration with a freshly generated self-signed certificate.
-// The certificate is suitable for local development and advertises the [alpn] protocol.
-func buildTLSConfig(l *slog.Logger) (*tls.Config, error) {
-	l = l.With("component", "tls")
-	l.Debug("generating self-signed certificate")
+	if auth != nil {
+		srv.Auth, srv.AuthTimeout, srv.AuthFailedCode = auth, cfg.authTimeout, errcode.AuthFailed
+		logger.Info("token authentication enabled", "timeout", cfg.authTimeout)
+	}
 
-	_, priv, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("ed25519 keygen: %w", err)
+	s.srv = srv
+	s.dumpStateOnSignal(ctx, logger)
+	s.reloadOnSignal(ctx, os.Args[1:], logger)
+
+	if cfg.adminSocket != "" {
+		if err := s.startAdmin(ctx, cfg.adminSocket, level, logger); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
 	}
 
-	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return nil, fmt.Errorf("serial: %w", err)
+	listeners := make([]string, len(lns))
+	for i, ln := range lns {
+		listeners[i] = ln.Addr().String()
+	}
+	srv.Logger.Info("started", "version", version, "listeners", listeners)
+	if cfg.mdns {
+		if err := startMDNS(ctx, lns, mux.Protocols(), logger); err != nil {
+			return fmt.Errorf("mdns: %w", err)
+		}
 	}
+	if err := sdNotify("READY=1"); err != nil {
+		srv.Logger.Warn("sd_notify", "err", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := sdNotify("STOPPING=1"); err != nil {
+			srv.Logger.Warn("sd_notify", "err", err)
+		}
+	}()
 
-	template := x509.Certificate{
-		SerialNumber: serial,
-		NotBefore:    time.Now().Add(-time.Hour),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	// Serve every listener; if one fails, shut the others down too.
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() { errc <- srv.Serve(ctx, ln) }()
+	}
+	var serveErr error
+	for range lns {
+		if err := <-errc; err != nil && serveErr == nil {
+			serveErr = err
+			cancel()
+		}
+	}
+	return serveErr
+}
+
+// admitFunc returns a [streamserver.Server] Admit hook that enforces the
+// connection limits of cl and closes rejected connections with [errcode.LimitExceeded].
+func admitFunc(cl *connLimiter, logger *slog.Logger) func(*quic.Conn) (func(), bool) {
+	return func(conn *quic.Conn) (func(), bool) {
+		addr := conn.RemoteAddr()
+		if reason, ok := cl.acquire(addr); !ok {
+			logger.Warn("connection rejected", "component", "conn", "remote", addr.String(), "reason", reason)
+			_ = conn.CloseWithError(errcode.LimitExceeded, reason)
+			return nil, false
+		}
+		return func() { cl.release(addr) }, true
+	}
+}
 
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		// DNSNames is set for "localhost" to support local testing.
-		DNSNames: []string{"localhost"},
+// closeAttrs returns the statistics of conn for the log record of its close.
+func closeAttrs(conn *quic.Conn) []any {
+	st := conn.ConnectionStats()
+	attrs := []any{"rtt", st.SmoothedRTT, "min_rtt", st.MinRTT, transportGroup(st)}
+	if ct := connTraceOf(conn); ct != nil {
+		attrs = append(attrs, ct.attrs()...)
 	}
+	return attrs
+}
 
-	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+// listen returns a QUIC listener on each UDP socket inherited from systemd
+// socket activation, if any, or on each of addrs otherwise. Every listener
+// has its own transport, set up by configure before it starts listening and
+// by listening once it does. If quicConf allows 0-RTT, the listeners return
+// connections before their handshake completes.
+func listen(addrs []string, tlsConf *tls.Config, quicConf *quic.Config, configure, listening func(*quic.Transport) error, logger *slog.Logger) ([]streamserver.Listener, error) {
+	pcs, err := activatedPacketConns()
 	if err != nil {
-		return nil, fmt.Errorf("create cert: %w", err)
+		return nil, err
+	}
+	if pcs != nil {
+		for _, pc := range pcs {
+			logger.Info("using socket from systemd", "addr", pc.LocalAddr().String())
+		}
+	} else {
+		for _, addr := range addrs {
+			pc, err := net.ListenPacket(udpNetwork(addr), addr)
+			if err != nil {
+				for _, pc := range pcs {
+					_ = pc.Close()
+				}
+				return nil, fmt.Errorf("listen %s: %w", addr, err)
+			}
+			pcs = append(pcs, pc)
+		}
 	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	var (
+		trs []*quic.Transport
+		lns []streamserver.Listener
+	)
+	for _, pc := range pcs {
+		tr := &quic.Transport{Conn: pc}
+		trs = append(trs, tr)
+		var ln streamserver.Listener
+		err := configure(tr)
+		switch {
+		case err != nil:
+		case quicConf.Allow0RTT:
+			ln, err = tr.ListenEarly(tlsConf, quicConf)
+		default:
+			ln, err = tr.Listen(tlsConf, quicConf)
+		}
+		if err == nil {
+			err = listening(tr)
+		}
+		if err != nil {
+			for _, tr := range trs {
+				_ = tr.Close()
+			}
+			for _, pc := range pcs {
+				_ = pc.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %w", pc.LocalAddr(), err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
 
-	keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+// udpNetwork returns the network to listen on addr with: "udp4" or "udp6" for
+// an IP literal, so that 0.0.0.0 and [::] can be listened on side by side,
+// and "udp" otherwise.
+func udpNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("marshal private key: %w", err)
+		return "udp"
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return "udp"
+	case ip.Is4() || ip.Is4In6():
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
 
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+// Bounds of -initial-packet-size: every QUIC path carries packets of 1200
+// bytes, and quic-go sends none larger than 1452 bytes.
+const (
+	minPacketSize = 1200
+	maxPacketSize = 1452
+)
+
+// buildTLSConfig returns a TLS configuration serving the certificate held by
+// certs; alpns are the protocols advertised.
+func buildTLSConfig(alpns []string, certs *certStore, l *slog.Logger) *tls.Config {
+	l.Info("tls config ready", "component", "tls", "alpn", alpns)
+	return &tls.Config{
+		GetCertificate: certs.getCertificate,
+		NextProtos:     alpns,
+	}
+}
+
+// echoOptions returns the echo handler options configured by cfg.
+func echoOptions(cfg config, logger *slog.Logger) (echoserver.Options, error) {
+	if cfg.maxMsg < 1 {
+		return echoserver.Options{}, fmt.Errorf("max message size must be positive, got %d", cfg.maxMsg)
+	}
+	dist := cfg.delayDist
+	if dist == "" && (cfg.delay > 0 || cfg.jitter > 0) {
+		dist = "fixed"
+	}
+	delay, err := echoserver.NewDelayModel(dist, cfg.delay, cfg.delaySpread, cfg.jitter, cfg.delayAlpha, cfg.delayPer)
 	if err != nil {
-		return nil, fmt.Errorf("parse keypair: %w", err)
+		return echoserver.Options{}, fmt.Errorf("echo delay: %w", err)
+	}
+	if delay != nil {
+		logger.Info("echo delay injection enabled", "model", delay.String())
+	}
+
+	var impair *echoserver.Impairment
+	if cfg.dropRate != 0 || cfg.truncateAt != 0 {
+		impair = &echoserver.Impairment{DropRate: cfg.dropRate, TruncateAt: cfg.truncateAt}
+		if err := impair.Validate(); err != nil {
+			return echoserver.Options{}, fmt.Errorf("impairment: %w", err)
+		}
+		logger.Info("echo impairment enabled", "impairment", impair.String())
 	}
 
-	l.Info("certificate ready", "alpn", alpn)
+	var psk []byte
+	if cfg.e2ePSKFile != "" {
+		if psk, err = e2e.ReadPSK(cfg.e2ePSKFile); err != nil {
+			return echoserver.Options{}, fmt.Errorf("e2e psk: %w", err)
+		}
+	} else if cfg.requireE2E {
+		logger.Warn("end-to-end encryption required without -e2e-psk-file: the key exchange is unauthenticated")
+	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{alpn},
+	var recLimits recording.Limits
+	if cfg.recordDir != "" {
+		fi, err := os.Stat(cfg.recordDir)
+		if err != nil {
+			return echoserver.Options{}, fmt.Errorf("record dir: %w", err)
+		}
+		if !fi.IsDir() {
+			return echoserver.Options{}, fmt.Errorf("record dir: %s is not a directory", cfg.recordDir)
+		}
+		if cfg.recordMaxFile < 0 || cfg.recordMaxTotal < 0 {
+			return echoserver.Options{}, errors.New("-record-max-file-bytes and -record-max-bytes must not be negative")
+		}
+		recLimits.MaxBytes = cfg.recordMaxFile
+		if cfg.recordMaxTotal > 0 {
+			used, err := recordedBytes(cfg.recordDir)
+			if err != nil {
+				return echoserver.Options{}, fmt.Errorf("record dir: %w", err)
+			}
+			recLimits.Quota = recording.NewQuota(max(cfg.recordMaxTotal-used, 0))
+		}
+		logger.Info("stream recording enabled", "dir", cfg.recordDir, "max_file_bytes", cfg.recordMaxFile, "max_bytes", cfg.recordMaxTotal)
+	}
+
+	return echoserver.Options{
+		MaxMsg:     cfg.maxMsg,
+		RequireE2E: cfg.requireE2E,
+		E2EPSK:     psk,
+		Compress:   cfg.compress,
+		Delay:      delay,
+		Impair:     impair,
+
+		MaxStreamBytes: cfg.maxStreamBytes,
+		MaxConnBytes:   cfg.maxConnBytes,
+		IdleTimeout:    cfg.idleTimeout,
+		RecordDir:      cfg.recordDir,
+		RecordLimits:   recLimits,
 	}, nil
 }
+
+// recordedBytes returns the size of the recordings in dir.
+func recordedBytes(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) != ".qrec" {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		n += fi.Size()
+	}
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/romanov9617/usb-quic/pkg/mdns"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// startMDNS advertises the server via mDNS/DNS-SD as an instance of
+// [mdns.ServiceType] named after the host, with alpns in the TXT record,
+// until ctx is canceled. The first of lns not bound to a loopback address is
+// advertised: with its address if it is bound to a specific IPv4 address,
+// and with those of all interfaces otherwise.
+func startMDNS(ctx context.Context, lns []streamserver.Listener, alpns []string, logger *slog.Logger) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("hostname: %w", err)
+	}
+	// Instance and host names are single labels.
+	host, _, _ = strings.Cut(host, ".")
+
+	var ap netip.AddrPort
+	for i, ln := range lns {
+		a, err := netip.ParseAddrPort(ln.Addr().String())
+		if err != nil {
+			return fmt.Errorf("listener address: %w", err)
+		}
+		if i == 0 || ap.Addr().IsLoopback() {
+			ap = a
+		}
+	}
+	var addrs []netip.Addr
+	if ip := ap.Addr().Unmap(); ip.Is4() && !ip.IsUnspecified() {
+		addrs = []netip.Addr{ip}
+	}
+
+	inst := mdns.Instance{
+		Name:  host,
+		Host:  host,
+		Port:  ap.Port(),
+		Addrs: addrs,
+		Text: []string{
+			"alpn=" + strings.Join(alpns, ","),
+			"port=" + strconv.Itoa(int(ap.Port())),
+			"version=" + version,
+		},
+	}
+	go func() {
+		if err := mdns.Advertise(ctx, mdns.ServiceType, inst, logger); err != nil {
+			logger.Warn("mDNS advertising stopped", "component", "mdns", "err", err)
+		}
+	}()
+	return nil
+}
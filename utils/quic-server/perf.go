@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/perf"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// perfHandler serves the perf protocol, see package perf. It takes over
+// whole connections, since the data streams of a phase belong to the
+// control stream that started it.
+type perfHandler struct{}
+
+// ServeConn implements [streamserver.ConnHandler]. It runs the test the
+// client sets up on the control stream, phase by phase, and logs the result
+// of every phase as the receiver measured it.
+func (perfHandler) ServeConn(ctx context.Context, conn *quic.Conn) error {
+	l := streamserver.Logger(ctx).With("component", "perf")
+
+	ctrl, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("accept control stream: %w", err)
+	}
+	br := bufio.NewReader(ctrl)
+	p, err := perf.ReadParams(br)
+	if err != nil {
+		ctrl.CancelRead(errcode.StreamProtocolError)
+		ctrl.CancelWrite(errcode.StreamProtocolError)
+		return fmt.Errorf("read parameters: %w", err)
+	}
+	if err := p.Check(); err != nil {
+		l.Warn("perf test refused", "err", err)
+		if err := perf.WriteReply(ctrl, err.Error()); err != nil {
+			return fmt.Errorf("send reply: %w", err)
+		}
+		_ = ctrl.Close()
+		_, _ = io.Copy(io.Discard, ctrl)
+		return nil
+	}
+	if err := perf.WriteReply(ctrl, ""); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+	l.Info("perf test started", "streams", p.Streams, "size", p.Size, "duration", p.Duration, "phases", p.Phases)
+
+	for _, dir := range p.Phases {
+		r, sent, err := perfPhase(ctx, conn, ctrl, br, p, dir)
+		if err != nil {
+			ctrl.CancelRead(errcode.StreamProtocolError)
+			ctrl.CancelWrite(errcode.StreamProtocolError)
+			return fmt.Errorf("phase %s: %w", dir, err)
+		}
+		attrs := []any{"direction", dir, "streams", p.Streams, "bytes", r.Bytes, "dur", r.Dur, "mbit_per_s", fmt.Sprintf("%.2f", r.MbitPerS())}
+		if dir == perf.Down {
+			attrs = append(attrs, "sent_bytes", sent)
+		}
+		l.Info("perf result", attrs...)
+	}
+
+	// The client ends the control stream once it has the last result;
+	// closing the connection before would lose it.
+	_ = ctrl.Close()
+	_ = ctrl.SetReadDeadline(time.Now().Add(perf.Drain))
+	_, _ = io.Copy(io.Discard, ctrl)
+	return nil
+}
+
+// perfPhase runs the phase of p in direction dir: it waits for its start on
+// the control stream ctrl, read through br, accepts its data streams from
+// conn and receives or sends on them. It returns the result of the phase,
+// which it sends to the client for an upload and gets from it for a
+// download, and for a download the number of bytes sent.
+func perfPhase(ctx context.Context, conn *quic.Conn, ctrl *quic.Stream, br *bufio.Reader, p perf.Params, dir string) (perf.Result, int64, error) {
+	if err := perf.ReadStart(br, dir); err != nil {
+		return perf.Result{}, 0, fmt.Errorf("read start: %w", err)
+	}
+	start := time.Now()
+	// The phase is bounded, so that a client that stops mid-way does not
+	// keep it waiting.
+	pctx, cancel := context.WithTimeout(ctx, p.Duration+perf.Drain)
+	defer cancel()
+
+	sts := make([]*quic.Stream, 0, p.Streams)
+	for range p.Streams {
+		st, err := conn.AcceptStream(pctx)
+		if err != nil {
+			for _, st := range sts {
+				st.CancelRead(0)
+				st.CancelWrite(0)
+			}
+			return perf.Result{}, 0, fmt.Errorf("accept stream: %w", err)
+		}
+		sts = append(sts, st)
+	}
+
+	if dir == perf.Up {
+		n, err := perf.Receive(pctx, sts)
+		if err != nil {
+			return perf.Result{}, 0, fmt.Errorf("receive: %w", err)
+		}
+		r := perf.Result{Dir: dir, Bytes: n, Dur: time.Since(start)}
+		if err := perf.WriteResult(ctrl, r); err != nil {
+			return perf.Result{}, 0, fmt.Errorf("send result: %w", err)
+		}
+		return r, 0, nil
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, p.Duration)
+	defer cancel()
+	sent, err := perf.Send(sctx, sts, p.Size, nil)
+	if err != nil {
+		return perf.Result{}, 0, fmt.Errorf("send: %w", err)
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(perf.Drain))
+	defer func() { _ = ctrl.SetReadDeadline(time.Time{}) }()
+	r, err := perf.ReadResult(br, dir)
+	if err != nil {
+		return perf.Result{}, 0, fmt.Errorf("read result: %w", err)
+	}
+	return r, sent, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/echoserver"
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/perf"
+	"github.com/romanov9617/usb-quic/pkg/rpc"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+	"github.com/romanov9617/usb-quic/pkg/transfer"
+)
+
+// ALPN identifiers of the test protocols besides echo ([echoserver.ALPN]). Each maps to
+// its own stream handler; a connection's negotiated ALPN selects the handler
+// for all of its streams.
+const (
+	alpnDiscard = "quic-discard"
+	alpnChargen = "quic-chargen"
+	alpnFile    = "quic-file"
+	alpnTunnel  = "quic-tunnel"
+	alpnProxy   = "quic-proxy"
+	alpnUDP     = "quic-udp"
+	alpnReverse = "quic-reverse"
+)
+
+// Modes of the echo protocol, see -mode.
+const (
+	modeEcho = "echo"
+	modeChat = "chat"
+	modeDoQ  = "doq"
+)
+
+// protocolALPNs maps the names accepted by -protocols to ALPN identifiers.
+var protocolALPNs = map[string]string{
+	"echo":     echoserver.ALPN,
+	"echo-bin": echoserver.ALPNBinary,
+	"discard":  alpnDiscard,
+	"chargen":  alpnChargen,
+	"file":     alpnFile,
+	"transfer": transfer.ALPN,
+	"tunnel":   alpnTunnel,
+	"proxy":    alpnProxy,
+	"udp":      alpnUDP,
+	"reverse":  alpnReverse,
+	"health":   alpnHealth,
+	"pubsub":   alpnPubSub,
+	"http3":    alpnHTTP3,
+	"perf":     perf.ALPN,
+	"rpc":      rpc.ALPN,
+}
+
+// streamHandler serves a single accepted stream.
+type streamHandler func(st *quic.Stream, l *slog.Logger) error
+
+// Serve implements [streamserver.StreamHandler].
+func (h streamHandler) Serve(ctx context.Context, _ *quic.Conn, st *quic.Stream) error {
+	return h(st, streamserver.Logger(ctx))
+}
+
+// parseProtocols turns a comma-separated list of protocol names into ALPN
+// identifiers, in order. The file, transfer and tunnel protocols need their
+// own configuration and are rejected without it.
+func parseProtocols(list string, cfg config) ([]string, error) {
+	var alpns []string
+	seen := make(map[string]bool)
+	for name := range strings.SplitSeq(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := protocolALPNs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol %q", name)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		switch {
+		case id == alpnFile && cfg.fileRoot == "":
+			return nil, errors.New("protocol file requires -file-root")
+		case id == transfer.ALPN && cfg.transferDir == "":
+			return nil, errors.New("protocol transfer requires -transfer-dir")
+		case id == alpnHTTP3 && cfg.fileRoot == "" && cfg.wtPath == "" && !cfg.connectUDP:
+			return nil, errors.New("protocol http3 requires -file-root, -webtransport or -connect-udp")
+		case id == alpnTunnel && cfg.tunnelTo == "":
+			return nil, errors.New("protocol tunnel requires -tunnel-to")
+		case id == alpnUDP && cfg.udpTo == "":
+			return nil, errors.New("protocol udp requires -udp-to")
+		case id == alpnReverse && cfg.reverseListen == "":
+			return nil, errors.New("protocol reverse requires -reverse-listen")
+		case id == alpnReverse && cfg.authTokenFile == "":
+			// Any client could otherwise take the connections over.
+			return nil, errors.New("protocol reverse requires -auth-token-file")
+		}
+		alpns = append(alpns, id)
+	}
+	if len(alpns) == 0 {
+		return nil, errors.New("no protocols enabled")
+	}
+	return alpns, nil
+}
+
+// handlerFor returns the stream handler for an ALPN protocol, or nil if the
+// server does not serve it. HTTP/3, the reverse tunnel and perf have no
+// stream handler; they take over whole connections.
+func (s *server) handlerFor(proto string) streamserver.StreamHandler {
+	switch proto {
+	case echoserver.ALPN:
+		if s.chat != nil {
+			return s.chat
+		}
+		return s.echo
+	case echoserver.ALPNBinary:
+		// Chat is line-based; binary streams are always echoed.
+		return s.echo
+	case alpnDiscard:
+		return streamHandler(discardStream)
+	case alpnChargen:
+		return streamHandler(chargenStream)
+	case alpnFile:
+		if s.fileRoot != nil {
+			return streamHandler(s.fileStream)
+		}
+	case transfer.ALPN:
+		if s.transferDir != nil {
+			return streamHandler(s.transferStream)
+		}
+	case alpnTunnel:
+		if s.tunnelTo != "" {
+			return streamHandler(s.tunnelStream)
+		}
+	case alpnProxy:
+		return streamHandler(proxyStream)
+	case alpnUDP:
+		if s.cfg.udpTo != "" {
+			return &udpForwarder{target: s.cfg.udpTo}
+		}
+	case alpnHealth:
+		return streamHandler(s.healthStream)
+	case alpnPubSub:
+		return s.pubsub
+	case rpc.ALPN:
+		return s.rpc
+	}
+	return nil
+}
+
+// discardStream reads and drops everything sent on st (RFC 863 over QUIC).
+func discardStream(st *quic.Stream, l *slog.Logger) error {
+	defer func() {
+		_ = st.Close()
+		l.Debug("closed")
+	}()
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, st)
+	if err != nil {
+		return fmt.Errorf("discard: %w", err)
+	}
+	l.Info("discard done", "bytes", n, "dur", time.Since(start))
+	return nil
+}
+
+// chargenLineLen is the number of characters per chargen line, excluding CRLF.
+const chargenLineLen = 72
+
+// chargenStream writes the RFC 864 character pattern on st until the peer
+// stops reading. Anything the peer sends is ignored.
+func chargenStream(st *quic.Stream, l *slog.Logger) error {
+	defer l.Debug("closed")
+	st.CancelRead(0)
+
+	const first, count = ' ', '~' - ' ' + 1
+	line := make([]byte, chargenLineLen+2)
+	start := time.Now()
+	var n int64
+	for i := 0; ; i++ {
+		for j := range chargenLineLen {
+			line[j] = byte(first + (i+j)%count)
+		}
+		line[chargenLineLen], line[chargenLineLen+1] = '\r', '\n'
+
+		nw, err := st.Write(line)
+		n += int64(nw)
+		if err != nil {
+			// The peer ending the stream is how chargen normally stops.
+			var serr *quic.StreamError
+			if errors.As(err, &serr) && serr.Remote {
+				l.Info("chargen done", "bytes", n, "dur", time.Since(start))
+				return nil
+			}
+			return fmt.Errorf("chargen: %w", err)
+		}
+	}
+}
+
+// maxPathLen bounds the request line of the file protocol.
+const maxPathLen = 4096
+
+// fileStream reads a path terminated by a newline from st and replies with
+// the contents of that file below the file root. Paths that escape the root
+// or cannot be opened reset the stream with [errcode.FileError].
+func (s *server) fileStream(st *quic.Stream, l *slog.Logger) error {
+	defer func() {
+		_ = st.Close()
+		l.Debug("closed")
+	}()
+
+	br := bufio.NewReaderSize(st, maxPathLen)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		st.CancelRead(errcode.FileError)
+		st.CancelWrite(errcode.FileError)
+		return fmt.Errorf("read path: %w", err)
+	}
+	st.CancelRead(0)
+
+	name := strings.TrimSpace(string(line))
+	l = l.With("path", name)
+
+	f, err := s.fileRoot.Open(name)
+	if err != nil {
+		st.CancelWrite(errcode.FileError)
+		l.Warn("file not served", "err", err)
+		return fmt.Errorf("open: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	start := time.Now()
+	n, err := io.Copy(st, f)
+	if err != nil {
+		st.CancelWrite(errcode.FileError)
+		return fmt.Errorf("send file: %w", err)
+	}
+	l.Info("file sent", "bytes", n, "dur", time.Since(start))
+	return nil
+}
+
+// tunnelStream connects st to a new TCP connection to the tunnel target and
+// relays bytes in both directions until both sides are done.
+func (s *server) tunnelStream(st *quic.Stream, l *slog.Logger) error {
+	defer l.Debug("closed")
+	l = l.With("target", s.tunnelTo)
+
+	var d net.Dialer
+	c, err := d.DialContext(st.Context(), "tcp", s.tunnelTo)
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		st.CancelWrite(errcode.TunnelError)
+		return fmt.Errorf("dial target: %w", err)
+	}
+	tc := c.(*net.TCPConn)
+	defer func() { _ = tc.Close() }()
+
+	start := time.Now()
+	n, err := relayTCP(st, tc)
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		return fmt.Errorf("relay: %w", err)
+	}
+	l.Info("tunnel done", "down_bytes", n, "dur", time.Since(start))
+	return nil
+}
+
+// relayTCP copies bytes between st and tc in both directions until both
+// sides are done. It returns the number of bytes sent on st.
+func relayTCP(st *quic.Stream, tc *net.TCPConn) (int64, error) {
+	up := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(tc, st)
+		_ = tc.CloseWrite()
+		up <- err
+	}()
+
+	n, derr := io.Copy(st, tc)
+	_ = st.Close()
+	uerr := <-up
+	return n, errors.Join(uerr, derr)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+)
+
+// proxyDialTimeout bounds how long the proxy protocol tries to reach a
+// target.
+const proxyDialTimeout = 10 * time.Second
+
+// maxProxyTarget bounds the request line of the proxy protocol.
+const maxProxyTarget = 512
+
+// proxyStream serves the proxy protocol: the first line of st names a TCP
+// target as host:port. The server dials it and replies "OK", then relays
+// bytes in both directions like the tunnel protocol, or replies
+// "ERR <reason>" and closes st if the target cannot be reached.
+func proxyStream(st *quic.Stream, l *slog.Logger) error {
+	defer l.Debug("closed")
+
+	br := bufio.NewReaderSize(st, maxProxyTarget)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		st.CancelWrite(errcode.TunnelError)
+		return fmt.Errorf("read target: %w", err)
+	}
+	target := strings.TrimSpace(string(line))
+	l = l.With("target", target)
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		_, _ = fmt.Fprintf(st, "ERR %v\n", err)
+		_ = st.Close()
+		return fmt.Errorf("parse target: %w", err)
+	}
+	d := net.Dialer{Timeout: proxyDialTimeout}
+	c, err := d.DialContext(st.Context(), "tcp", target)
+	if err != nil {
+		_, _ = fmt.Fprintf(st, "ERR %s\n", proxyDialReason(err))
+		_ = st.Close()
+		l.Info("proxy target unreachable", "err", err)
+		return nil
+	}
+	tc := c.(*net.TCPConn)
+	defer func() { _ = tc.Close() }()
+
+	if _, err := fmt.Fprintf(st, "OK\n"); err != nil {
+		return fmt.Errorf("write reply: %w", err)
+	}
+	// Bytes the client sent right after the request line are already
+	// buffered.
+	if n := br.Buffered(); n > 0 {
+		pending, _ := br.Peek(n)
+		if _, err := tc.Write(pending); err != nil {
+			st.CancelRead(errcode.TunnelError)
+			st.CancelWrite(errcode.TunnelError)
+			return fmt.Errorf("relay: %w", err)
+		}
+	}
+
+	start := time.Now()
+	n, err := relayTCP(st, tc)
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		return fmt.Errorf("relay: %w", err)
+	}
+	l.Info("proxy done", "down_bytes", n, "dur", time.Since(start))
+	return nil
+}
+
+// proxyDialReason classifies a failed dial for the client, which maps it to
+// a SOCKS reply: "refused", "unreachable" or "failed".
+func proxyDialReason(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	}
+	return "failed"
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// alpnPubSub is the ALPN identifier of the pub/sub protocol.
+const alpnPubSub = "quic-pubsub"
+
+// pubsubQueueLen is the number of messages queued per subscription before
+// further messages to it are dropped.
+const pubsubQueueLen = 256
+
+const (
+	// pubsubMaxConnSubs bounds the subscriptions of a connection, across
+	// its streams.
+	pubsubMaxConnSubs = 256
+	// pubsubMaxTopics bounds the topics with subscriptions, across
+	// connections.
+	pubsubMaxTopics = 4096
+)
+
+var (
+	errTooManySubs   = errors.New("too many subscriptions")
+	errTooManyTopics = errors.New("too many topics")
+)
+
+// pubsub implements a topic-based publish/subscribe protocol. Every line a
+// client sends on a bidirectional stream is a command, answered with a line
+// of its own:
+//
+//	SUB <topic>              subscribe the stream to topic; "OK"
+//	UNSUB <topic>            end the subscription; "OK"
+//	PUB <topic> <payload>    publish payload; "OK <n>" with the number of
+//	                         subscriptions it was queued for
+//
+// Errors are answered with "ERR <reason>", among them the limits on the
+// subscriptions of a connection and on the topics subscribed to. Topics
+// cannot contain tabs or carriage returns. Subscriptions end with their
+// stream. Every published message is delivered on a new server-initiated
+// unidirectional stream that carries the topic on its first line, followed
+// by the payload.
+type pubsub struct {
+	maxLine int
+
+	mu     sync.Mutex
+	topics map[string]map[*subscription]struct{}
+	// connSubs counts the subscriptions of every connection with any.
+	connSubs map[*quic.Conn]int
+}
+
+// subscription is a stream's interest in a topic.
+type subscription struct {
+	conn  *quic.Conn
+	topic string
+	// queue holds the payloads to deliver. It is closed once the
+	// subscription has ended.
+	queue   chan []byte
+	dropped atomic.Int64
+}
+
+// newPubSub returns a pub/sub hub that accepts command lines of up to
+// maxLine bytes.
+func newPubSub(maxLine int) *pubsub {
+	return &pubsub{
+		maxLine:  maxLine,
+		topics:   make(map[string]map[*subscription]struct{}),
+		connSubs: make(map[*quic.Conn]int),
+	}
+}
+
+// Serve implements [streamserver.StreamHandler]. It executes the commands
+// read from st until EOF and then ends the subscriptions made on st.
+func (ps *pubsub) Serve(ctx context.Context, conn *quic.Conn, st *quic.Stream) error {
+	l := streamserver.Logger(ctx)
+	defer func() {
+		_ = st.Close()
+		l.Debug("closed")
+	}()
+
+	subs := make(map[string]*subscription)
+	var deliveries sync.WaitGroup
+	defer func() {
+		for _, sub := range subs {
+			ps.unsubscribe(sub)
+		}
+		deliveries.Wait()
+	}()
+
+	br := bufio.NewReaderSize(st, ps.maxLine+1)
+	var published int
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			_, _ = fmt.Fprintf(st, "ERR line longer than %d bytes\n", ps.maxLine)
+			st.CancelRead(0)
+			return fmt.Errorf("read command: line longer than %d bytes", ps.maxLine)
+		}
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			l.Info("pubsub done", "published", published)
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read command: %w", err)
+		}
+
+		cmd, rest, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), " ")
+		var reply string
+		switch topic, payload, _ := strings.Cut(rest, " "); {
+		case cmd != "SUB" && cmd != "UNSUB" && cmd != "PUB":
+			reply = fmt.Sprintf("ERR unknown command %q", cmd)
+		case topic == "":
+			reply = "ERR missing topic"
+		case strings.ContainsAny(topic, "\t\r"):
+			reply = "ERR invalid topic"
+		case cmd == "SUB":
+			reply = "OK"
+			if subs[topic] == nil {
+				sub, err := ps.subscribe(conn, topic)
+				if err != nil {
+					reply = "ERR " + err.Error()
+					l.Debug("subscription refused", "topic", topic, "err", err)
+					break
+				}
+				subs[topic] = sub
+				deliveries.Add(1)
+				go func() {
+					defer deliveries.Done()
+					ps.deliver(ctx, conn, sub, l)
+				}()
+				l.Debug("subscribed", "topic", topic)
+			}
+		case cmd == "UNSUB":
+			if sub := subs[topic]; sub != nil {
+				ps.unsubscribe(sub)
+				delete(subs, topic)
+				l.Debug("unsubscribed", "topic", topic)
+			}
+			reply = "OK"
+		case cmd == "PUB":
+			reply = fmt.Sprintf("OK %d", ps.publish(topic, []byte(payload)))
+			published++
+		}
+		if _, err := io.WriteString(st, reply+"\n"); err != nil {
+			return fmt.Errorf("write reply: %w", err)
+		}
+	}
+}
+
+// subscribe adds a subscription of conn to topic, unless conn has
+// [pubsubMaxConnSubs] subscriptions already or topic is new and there are
+// [pubsubMaxTopics] topics.
+func (ps *pubsub) subscribe(conn *quic.Conn, topic string) (*subscription, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.connSubs[conn] >= pubsubMaxConnSubs {
+		return nil, errTooManySubs
+	}
+	if ps.topics[topic] == nil {
+		if len(ps.topics) >= pubsubMaxTopics {
+			return nil, errTooManyTopics
+		}
+		ps.topics[topic] = make(map[*subscription]struct{})
+	}
+	sub := &subscription{conn: conn, topic: topic, queue: make(chan []byte, pubsubQueueLen)}
+	ps.topics[topic][sub] = struct{}{}
+	ps.connSubs[conn]++
+	return sub, nil
+}
+
+// unsubscribe ends sub. Messages already queued are still delivered.
+func (ps *pubsub) unsubscribe(sub *subscription) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.topics[sub.topic], sub)
+	if len(ps.topics[sub.topic]) == 0 {
+		delete(ps.topics, sub.topic)
+	}
+	if ps.connSubs[sub.conn]--; ps.connSubs[sub.conn] == 0 {
+		delete(ps.connSubs, sub.conn)
+	}
+	close(sub.queue)
+}
+
+// publish queues payload for every subscription to topic and returns the
+// number of subscriptions it was queued for. Subscriptions whose queue is
+// full miss the message.
+func (ps *pubsub) publish(topic string, payload []byte) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var n int
+	for sub := range ps.topics[topic] {
+		select {
+		case sub.queue <- payload:
+			n++
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+	return n
+}
+
+// deliver sends every message queued for sub to conn, each on a
+// unidirectional stream of its own, until sub has ended. Streams are opened
+// in order as the peer's stream limit allows and written concurrently.
+func (ps *pubsub) deliver(ctx context.Context, conn *quic.Conn, sub *subscription, l *slog.Logger) {
+	l = l.With("topic", sub.topic)
+	start := time.Now()
+	var sent, failed atomic.Int64
+	var writes sync.WaitGroup
+	for payload := range sub.queue {
+		st, err := conn.OpenUniStreamSync(ctx)
+		if err != nil {
+			failed.Add(1)
+			continue
+		}
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+			if _, err := fmt.Fprintf(st, "%s\n%s", sub.topic, payload); err != nil {
+				st.CancelWrite(0)
+				failed.Add(1)
+				return
+			}
+			_ = st.Close()
+			sent.Add(1)
+		}()
+	}
+	writes.Wait()
+	l.Info("subscription ended", "sent", sent.Load(), "failed", failed.Load(), "dropped", sub.dropped.Load(), "dur", time.Since(start))
+}
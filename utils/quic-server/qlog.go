@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// qlogTracer returns a [quic.Config] Tracer that writes one qlog file per
+// connection into dir. Files are named after the original destination
+// connection ID and rotated once they grow past maxBytes (0 disables
+// rotation); at most keep segments are retained per connection.
+func qlogTracer(dir string, maxBytes int64, keep int, l *slog.Logger) (func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create qlog dir: %w", err)
+	}
+	l = l.With("component", "qlog", "dir", dir)
+
+	return func(_ context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+		label := "server"
+		if isClient {
+			label = "client"
+		}
+
+		w := &rotatingWriter{
+			base:     filepath.Join(dir, fmt.Sprintf("%s_%s", connID, label)),
+			maxBytes: maxBytes,
+			keep:     max(keep, 1),
+			l:        l.With("odcid", connID.String()),
+		}
+		if err := w.open(); err != nil {
+			l.Warn("create qlog file failed", "err", err)
+			return nil
+		}
+
+		fs := qlogwriter.NewConnectionFileSeq(w, isClient, connID, []string{qlog.EventSchema})
+		go fs.Run()
+		return fs
+	}, nil
+}
+
+// rotatingWriter is an io.WriteCloser for a JSON-SEQ qlog trace that starts a
+// new segment file once the current one exceeds maxBytes.
+//
+// Rotation only happens at record boundaries, and every segment begins with
+// the trace header, so each file can be loaded into qvis on its own.
+type rotatingWriter struct {
+	base     string
+	maxBytes int64
+	keep     int
+	l        *slog.Logger
+
+	f       *os.File
+	bw      *bufio.Writer
+	seg     int
+	written int64
+	header  []byte
+}
+
+// path returns the file name of segment n.
+func (w *rotatingWriter) path(n int) string {
+	if n == 0 {
+		return w.base + ".sqlog"
+	}
+	return fmt.Sprintf("%s.%d.sqlog", w.base, n)
+}
+
+// open creates the file for the current segment.
+func (w *rotatingWriter) open() error {
+	f, err := os.Create(w.path(w.seg))
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.bw = bufio.NewWriter(f)
+	w.written = 0
+	return nil
+}
+
+// Write implements io.Writer.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	// The first write is always the complete trace header.
+	if w.header == nil {
+		w.header = bytes.Clone(p)
+	} else if w.maxBytes > 0 && w.written >= w.maxBytes && len(p) > 0 && p[0] == qlogwriter.RecordSeparator {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.bw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// rotate closes the current segment, opens the next one, writes the header
+// into it and removes segments that fall outside the retention window.
+func (w *rotatingWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	w.seg++
+	if err := w.open(); err != nil {
+		return fmt.Errorf("rotate qlog: %w", err)
+	}
+	if _, err := w.bw.Write(w.header); err != nil {
+		return err
+	}
+	w.written = int64(len(w.header))
+
+	if old := w.seg - w.keep; old >= 0 {
+		if err := os.Remove(w.path(old)); err != nil && !os.IsNotExist(err) {
+			w.l.Warn("remove old qlog segment failed", "err", err)
+		}
+	}
+	w.l.Debug("qlog rotated", "segment", w.seg)
+	return nil
+}
+
+// closeFile flushes and closes the current segment file.
+func (w *rotatingWriter) closeFile() error {
+	if err := w.bw.Flush(); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Close implements io.Closer.
+func (w *rotatingWriter) Close() error {
+	return w.closeFile()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnSignal re-reads the configuration every time the process receives
+// SIGHUP, until ctx is canceled. The signal is handled from the moment it
+// returns.
+func (s *server) reloadOnSignal(ctx context.Context, args []string, l *slog.Logger) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	l = l.With("component", "reload")
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				if err := s.reload(args, l); err != nil {
+					l.Warn("reload failed, keeping the current configuration", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// reload parses args and the config file again and applies the settings that
+// are safe to change at runtime: the log level, the certificate, the echo
+// limits and impairments, and the connection limits. Existing connections are
+// kept; streams opened afterwards see the new settings. Other changes are
+// reported and ignored until the next restart. Nothing is applied if the new
+// configuration is invalid.
+func (s *server) reload(args []string, l *slog.Logger) error {
+	cfg, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	opts, err := echoOptions(cfg, l)
+	if err != nil {
+		return err
+	}
+	if cfg.certFile != "" || cfg.keyFile != "" {
+		if err := s.certs.load(cfg.certFile, cfg.keyFile, l); err != nil {
+			return fmt.Errorf("certificate: %w", err)
+		}
+	}
+
+	s.level.Set(cfg.logLevel)
+	s.echo.SetOptions(opts)
+	s.limiter.setLimits(cfg.maxConns, cfg.maxConnsPerIP)
+
+	if cfg.static() != s.cfg.static() {
+		l.Warn("some changed settings only take effect after a restart")
+	}
+	l.Info("configuration reloaded", "log_level", cfg.logLevel, "max_conns", cfg.maxConns, "max_conns_per_ip", cfg.maxConnsPerIP)
+	return nil
+}
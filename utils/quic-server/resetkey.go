@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// resetKeyEnv names the environment variable that may hold the stateless
+// reset key, hex-encoded, if no key file is given.
+const resetKeyEnv = "QUIC_STATELESS_RESET_KEY"
+
+// loadStatelessResetKey returns the stateless reset key read from file, or
+// from the environment if file is empty. The key is 32 hex-encoded bytes. It
+// returns nil if neither is set, in which case no stateless resets are sent.
+//
+// A key that survives restarts lets the server answer packets of connections
+// it lost in a restart with a stateless reset the peer can verify, so that
+// peers notice immediately instead of waiting for their idle timeout.
+func loadStatelessResetKey(file string) (*quic.StatelessResetKey, error) {
+	var s string
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		s = string(data)
+	case os.Getenv(resetKeyEnv) != "":
+		s = os.Getenv(resetKeyEnv)
+	default:
+		return nil, nil
+	}
+
+	key, err := parseHexKey(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return (*quic.StatelessResetKey)(&key), nil
+}
+
+// parseHexKey decodes a hex-encoded 32-byte key.
+func parseHexKey(s string) ([32]byte, error) {
+	var key [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return key, fmt.Errorf("want %d hex-encoded bytes", len(key))
+	}
+	copy(key[:], b)
+	return key, nil
+}
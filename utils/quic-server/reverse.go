@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// reverseTunnel implements the reverse tunnel protocol, for devices that
+// cannot accept inbound connections: the device connects out to the server,
+// and every TCP connection accepted on the server's reverse listener is
+// carried back to the device over a stream the server opens. The device
+// relays it to a local target of its choosing. If several devices are
+// connected, the one that connected last gets the new connections.
+type reverseTunnel struct {
+	mu      sync.Mutex
+	devices []*reverseDevice
+}
+
+// reverseDevice is a device connected for the reverse tunnel.
+type reverseDevice struct {
+	conn *quic.Conn
+	l    *slog.Logger
+	// relays tracks the connections carried to the device.
+	relays sync.WaitGroup
+}
+
+// listen accepts TCP connections on addr and forwards them to a connected
+// device until ctx is canceled.
+func (rt *reverseTunnel) listen(ctx context.Context, addr string, logger *slog.Logger) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger = logger.With("component", "reverse", "listen", ln.Addr().String())
+	logger.Info("reverse listener ready")
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warn("reverse listener stopped", "err", err)
+				}
+				return
+			}
+			d := rt.acquire()
+			if d == nil {
+				logger.Warn("no device connected, dropping connection", "remote", c.RemoteAddr().String())
+				_ = c.Close()
+				continue
+			}
+			go func() {
+				defer d.relays.Done()
+				rt.forward(d, c.(*net.TCPConn))
+			}()
+		}
+	}()
+	return nil
+}
+
+// forward carries c to d over a new stream.
+func (rt *reverseTunnel) forward(d *reverseDevice, c *net.TCPConn) {
+	defer func() { _ = c.Close() }()
+	l := d.l.With("remote", c.RemoteAddr().String())
+
+	st, err := d.conn.OpenStreamSync(d.conn.Context())
+	if err != nil {
+		l.Warn("open stream to device", "err", err)
+		return
+	}
+	l = l.With("quic_id", st.StreamID())
+	l.Debug("reverse connection opened")
+
+	start := time.Now()
+	n, err := relayTCP(st, c)
+	if err != nil {
+		st.CancelRead(errcode.TunnelError)
+		l.Warn("reverse relay failed", "err", err)
+		return
+	}
+	l.Info("reverse connection done", "down_bytes", n, "dur", time.Since(start))
+}
+
+// acquire returns the device that connected last, with a relay added to it
+// that the caller must mark done, or nil if there is none. A device that is
+// going away is no longer listed, so that no relay is added once ServeConn
+// waits for them.
+func (rt *reverseTunnel) acquire() *reverseDevice {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.devices) == 0 {
+		return nil
+	}
+	d := rt.devices[len(rt.devices)-1]
+	d.relays.Add(1)
+	return d
+}
+
+// ServeConn implements [streamserver.ConnHandler]. It makes conn available
+// for the reverse listener until conn is closed or the server shuts down,
+// and then waits for the connections carried over it.
+func (rt *reverseTunnel) ServeConn(ctx context.Context, conn *quic.Conn) error {
+	d := &reverseDevice{conn: conn, l: streamserver.Logger(ctx).With("component", "reverse")}
+	rt.mu.Lock()
+	rt.devices = append(rt.devices, d)
+	rt.mu.Unlock()
+	d.l.Info("device connected")
+
+	select {
+	case <-ctx.Done():
+	case <-conn.Context().Done():
+	}
+	rt.mu.Lock()
+	rt.devices = slices.DeleteFunc(rt.devices, func(x *reverseDevice) bool { return x == d })
+	rt.mu.Unlock()
+	d.relays.Wait()
+
+	if ctx.Err() == nil {
+		d.l.Info("device disconnected", "reason", context.Cause(conn.Context()))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+)
+
+// disableGSO stops quic-go from using generic segmentation offload on the UDP
+// sockets created from now on. quic-go only offers this through the
+// environment.
+func disableGSO() error {
+	return os.Setenv("QUIC_GO_DISABLE_GSO", "true")
+}
+
+// setSocketBuffers sets the receive and send buffer sizes of pc to rcvBuf and
+// sndBuf bytes, leaving a zero size alone. It warns if the kernel grants less
+// than requested, which on Linux is capped by net.core.rmem_max and
+// net.core.wmem_max. quic-go raises the sizes when a transport starts
+// listening, so this must be called afterwards for the sizes to stick.
+func setSocketBuffers(pc net.PacketConn, rcvBuf, sndBuf int, l *slog.Logger) error {
+	if rcvBuf == 0 && sndBuf == 0 {
+		return nil
+	}
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("set socket buffers: not a UDP socket: %T", pc)
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("set socket buffers: %w", err)
+	}
+	l = l.With("addr", pc.LocalAddr().String())
+
+	for _, b := range []struct {
+		name string
+		size int
+		set  func(int) error
+		opt  int
+	}{
+		{"receive", rcvBuf, uc.SetReadBuffer, syscall.SO_RCVBUF},
+		{"send", sndBuf, uc.SetWriteBuffer, syscall.SO_SNDBUF},
+	} {
+		if b.size == 0 {
+			continue
+		}
+		if err := b.set(b.size); err != nil {
+			return fmt.Errorf("set %s buffer: %w", b.name, err)
+		}
+		got, err := socketBuffer(rc, b.opt)
+		if errors.Is(err, errors.ErrUnsupported) {
+			l.Debug("socket buffer set, size not known", "buffer", b.name, "requested", b.size)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read back %s buffer: %w", b.name, err)
+		}
+		if got < b.size {
+			l.Warn("socket buffer clamped by the kernel", "buffer", b.name, "requested", b.size, "got", got)
+		} else {
+			l.Debug("socket buffer set", "buffer", b.name, "size", got)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// socketBuffer reports that the size of a socket buffer cannot be read back
+// on this platform.
+func socketBuffer(syscall.RawConn, int) (int, error) {
+	return 0, errors.ErrUnsupported
+}
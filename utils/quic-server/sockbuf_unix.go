@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// socketBuffer returns the size of the buffer selected by opt (SO_RCVBUF or
+// SO_SNDBUF) as granted by the kernel.
+func socketBuffer(rc syscall.RawConn, opt int) (int, error) {
+	var size int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	if runtime.GOOS == "linux" {
+		// Linux doubles the requested size to account for bookkeeping
+		// overhead and reports the doubled value.
+		size /= 2
+	}
+	return size, serr
+}
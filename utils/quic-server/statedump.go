@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/compress"
+)
+
+// dumpState logs one summary record followed by one record per connection.
+// The summary's transport stats are the totals over the open connections.
+func (s *server) dumpState(l *slog.Logger) {
+	l = l.With("component", "statedump")
+	now := time.Now()
+	conns := s.srv.Conns()
+	st := s.srv.Stats()
+
+	var total quic.ConnectionStats
+	for _, ci := range conns {
+		total.BytesSent += ci.Stats.BytesSent
+		total.BytesReceived += ci.Stats.BytesReceived
+		total.PacketsSent += ci.Stats.PacketsSent
+		total.PacketsReceived += ci.Stats.PacketsReceived
+		total.PacketsLost += ci.Stats.PacketsLost
+	}
+
+	l.Info("state dump",
+		"uptime", now.Sub(s.started).Round(time.Second),
+		"conns", len(conns),
+		"total_conns", st.TotalConns,
+		"streams", st.ActiveStreams,
+		"total_streams", st.TotalStreams,
+		"busy_workers", st.BusyWorkers,
+		"queued_streams", st.QueuedStreams,
+		"rejected_streams", st.RejectedStreams,
+		"echo_bytes_in_flight", s.echo.InFlight(),
+		compressionGroup(s.echo.Compression()),
+		s.handshakes.group(),
+		"goroutines", runtime.NumGoroutine(),
+		transportGroup(total),
+	)
+	if s.chat != nil {
+		l.Info("state dump chat", "members", s.chat.Members())
+	}
+	for _, ci := range conns {
+		l.Info("state dump conn",
+			"conn_id", ci.ID,
+			"remote", ci.Remote,
+			"alpn", ci.ALPN,
+			"age", now.Sub(ci.Since).Round(time.Second),
+			"streams", len(ci.Streams),
+			"total_streams", ci.TotalStreams,
+			"rtt", ci.Stats.SmoothedRTT,
+			"min_rtt", ci.Stats.MinRTT,
+			transportGroup(ci.Stats),
+		)
+	}
+}
+
+// transportGroup returns the byte and packet counters of st as a log group.
+func transportGroup(st quic.ConnectionStats) slog.Attr {
+	return slog.Group("transport",
+		"bytes_sent", st.BytesSent,
+		"bytes_received", st.BytesReceived,
+		"packets_sent", st.PacketsSent,
+		"packets_received", st.PacketsReceived,
+		"packets_lost", st.PacketsLost,
+	)
+}
+
+// compressionGroup returns the byte counters and ratio of the compressed
+// echo streams, s, as a log group.
+func compressionGroup(s compress.Stats) slog.Attr {
+	return slog.Group("compression",
+		"raw_bytes", s.RawSent+s.RawReceived,
+		"wire_bytes", s.WireSent+s.WireReceived,
+		"ratio", fmt.Sprintf("%.2f", s.Ratio()),
+	)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// dumpStateOnSignal does nothing on platforms without SIGUSR1: the state is
+// dumped through the admin socket only.
+func (s *server) dumpStateOnSignal(context.Context, *slog.Logger) {}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpStateOnSignal logs a snapshot of the server state every time the
+// process receives SIGUSR1, until ctx is canceled. The signal is handled from
+// the moment it returns.
+func (s *server) dumpStateOnSignal(ctx context.Context, l *slog.Logger) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				s.dumpState(l)
+			}
+		}
+	}()
+}
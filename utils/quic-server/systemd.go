@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// activatedPacketConns returns the UDP sockets passed by systemd socket
+// activation (LISTEN_PID/LISTEN_FDS), or nil if the process was not socket
+// activated.
+func activatedPacketConns() ([]net.PacketConn, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// Child processes must not inherit the activation environment.
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var pcs []net.PacketConn
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		pc, err := net.FilePacketConn(f)
+		_ = f.Close()
+		if err != nil {
+			for _, pc := range pcs {
+				_ = pc.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		pcs = append(pcs, pc)
+	}
+	return pcs, nil
+}
+
+// sdNotify sends state (e.g. "READY=1") to the service manager via
+// NOTIFY_SOCKET. It is a no-op when the process is not run by systemd.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// A leading '@' denotes a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write notify socket: %w", err)
+	}
+	return nil
+}
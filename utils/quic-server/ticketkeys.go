@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ticketLifetime is how long crypto/tls accepts a session ticket. Keys are
+// kept for that long after they are rotated out so that their tickets stay
+// usable.
+const ticketLifetime = 7 * 24 * time.Hour
+
+// maxTicketKeys bounds the number of session ticket keys kept.
+const maxTicketKeys = 64
+
+// ticketKeys rotates the session ticket keys of a TLS config. The newest key
+// encrypts new tickets; older keys only decrypt tickets issued before.
+//
+// Without a key file, keys live in memory and are lost on restart. With a
+// key file, the file holds the keys, one hex-encoded key per line with the
+// newest first, and its modification time is the time of the last rotation.
+// Instances sharing the file rotate it when it is due and otherwise pick up
+// each other's rotations, so they can resume each other's sessions, also
+// after a restart.
+type ticketKeys struct {
+	conf     *tls.Config
+	file     string
+	interval time.Duration
+	keep     int
+	l        *slog.Logger
+
+	// keys and rotated are the in-memory keys and their rotation time when
+	// there is no key file.
+	keys    [][32]byte
+	rotated time.Time
+}
+
+// newTicketKeys returns a key rotator for conf that rotates every interval,
+// storing the keys in file if it is not empty.
+func newTicketKeys(conf *tls.Config, file string, interval time.Duration, l *slog.Logger) (*ticketKeys, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("rotation interval must be positive, got %v", interval)
+	}
+	keep := min(int(ticketLifetime/interval)+2, maxTicketKeys)
+	return &ticketKeys{
+		conf:     conf,
+		file:     file,
+		interval: interval,
+		keep:     keep,
+		l:        l.With("component", "ticketkeys"),
+	}, nil
+}
+
+// start installs the current keys and then keeps rotating them until ctx is
+// canceled.
+func (tk *ticketKeys) start(ctx context.Context) error {
+	if err := tk.update(); err != nil {
+		return err
+	}
+
+	// Check well within the interval so that rotations by other instances
+	// sharing the key file are picked up promptly.
+	period := max(tk.interval/4, time.Second)
+	go func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := tk.update(); err != nil {
+					tk.l.Warn("update session ticket keys", "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// update rotates the keys if they are due and installs them.
+func (tk *ticketKeys) update() error {
+	if tk.file == "" {
+		if tk.keys == nil || time.Since(tk.rotated) >= tk.interval {
+			key, err := newTicketKey()
+			if err != nil {
+				return err
+			}
+			tk.keys = prependKey(key, tk.keys, tk.keep)
+			tk.rotated = time.Now()
+			tk.l.Info("session ticket key rotated", "keys", len(tk.keys))
+		}
+		tk.conf.SetSessionTicketKeys(tk.keys)
+		return nil
+	}
+
+	keys, modified, err := readTicketKeys(tk.file)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || time.Since(modified) >= tk.interval {
+		key, err := newTicketKey()
+		if err != nil {
+			return err
+		}
+		if err := writeTicketKeys(tk.file, prependKey(key, keys, tk.keep)); err != nil {
+			return err
+		}
+		// Read back what is on disk in case another instance rotated at the
+		// same time, so that all instances agree on the keys.
+		if keys, _, err = readTicketKeys(tk.file); err != nil {
+			return err
+		}
+		tk.l.Info("session ticket key rotated", "file", tk.file, "keys", len(keys))
+	}
+	if len(keys) == 0 {
+		return errors.New("no session ticket keys")
+	}
+	tk.conf.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// newTicketKey returns a random session ticket key.
+func newTicketKey() ([32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return key, fmt.Errorf("generate key: %w", err)
+	}
+	return key, nil
+}
+
+// prependKey returns key followed by the newest of keys, at most keep in all.
+func prependKey(key [32]byte, keys [][32]byte, keep int) [][32]byte {
+	out := append([][32]byte{key}, keys...)
+	return out[:min(len(out), keep)]
+}
+
+// readTicketKeys reads a key file and returns its keys and modification time.
+// A missing file has no keys.
+func readTicketKeys(path string) ([][32]byte, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var keys [][32]byte
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		key, err := parseHexKey(line)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, fi.ModTime(), nil
+}
+
+// writeTicketKeys atomically replaces the key file with keys.
+func writeTicketKeys(path string, keys [][32]byte) error {
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(hex.EncodeToString(key[:]))
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
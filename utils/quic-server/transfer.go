@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/romanov9617/usb-quic/pkg/errcode"
+	"github.com/romanov9617/usb-quic/pkg/transfer"
+)
+
+// transferStream serves one request of the transfer protocol on st: it
+// stores an uploaded file in the transfer directory or sends one from it.
+// Malformed requests reset the stream; failures the client can act on are
+// answered with an error reply.
+func (s *server) transferStream(st *quic.Stream, l *slog.Logger) error {
+	defer func() {
+		_ = st.Close()
+		l.Debug("closed")
+	}()
+
+	br := bufio.NewReader(st)
+	req, err := transfer.ReadRequest(br)
+	if err != nil {
+		st.CancelRead(errcode.StreamProtocolError)
+		st.CancelWrite(errcode.StreamProtocolError)
+		return fmt.Errorf("read request: %w", err)
+	}
+	l = l.With("op", req.Op, "name", req.Name)
+
+	start := time.Now()
+	var offset, n int64
+	switch {
+	case strings.HasPrefix(req.Name, "."):
+		// Hidden names are those of the parts of uploads.
+		st.CancelRead(0)
+		err = &transfer.RemoteError{Reason: "file names starting with a dot are reserved"}
+	case req.Op == transfer.OpPut:
+		offset, err = s.receiveFile(st, br, req, l)
+		n = req.Size - offset
+		st.CancelRead(0)
+	default:
+		st.CancelRead(0)
+		offset = req.Offset
+		n, err = s.sendFile(st, req.Name, req.Offset)
+	}
+	var rerr *transfer.RemoteError
+	if errors.As(err, &rerr) {
+		l.Warn("transfer refused", "reason", rerr.Reason)
+		if err := transfer.WriteReply(st, transfer.Reply{Err: rerr.Reason}); err != nil {
+			return fmt.Errorf("send reply: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		st.CancelWrite(errcode.FileError)
+		return err
+	}
+	if req.Op == transfer.OpPut {
+		if err := transfer.WriteReply(st, transfer.Reply{}); err != nil {
+			return fmt.Errorf("send reply: %w", err)
+		}
+	}
+	l.Info("transfer done", "bytes", n, "resumed_from", offset, "dur", time.Since(start))
+	return nil
+}
+
+// partName returns the name an upload is kept under in the transfer
+// directory until it is complete. It includes a prefix of the digest, so
+// that only an upload of the same content resumes it.
+func partName(req transfer.Request) string {
+	return "." + req.Name + "." + hex.EncodeToString(req.Sum[:8]) + partSuffix
+}
+
+// partSuffix ends the part names of uploads.
+const partSuffix = ".part"
+
+// reserveTransfer reserves room for an upload of size bytes replacing the
+// file name in the transfer directory, within -transfer-max-bytes, and
+// returns a function releasing the reservation once the upload is done.
+// The upload must be registered in s.uploads already. A full directory is
+// reported as a [*transfer.RemoteError].
+func (s *server) reserveTransfer(name string, size int64, l *slog.Logger) (func(), error) {
+	s.transferMu.Lock()
+	defer s.transferMu.Unlock()
+	used, err := s.transferUsage(l)
+	if err != nil {
+		return nil, fmt.Errorf("transfer directory usage: %w", err)
+	}
+	if fi, err := s.transferDir.Stat(name); err == nil && fi.Mode().IsRegular() {
+		used -= fi.Size()
+	}
+	if limit := s.cfg.transferMaxBytes; limit > 0 && used+s.transferPending+size > limit {
+		return nil, &transfer.RemoteError{Reason: fmt.Sprintf("transfer directory is limited to %d bytes", limit)}
+	}
+	s.transferPending += size
+	return func() {
+		s.transferMu.Lock()
+		s.transferPending -= size
+		s.transferMu.Unlock()
+	}, nil
+}
+
+// transferUsage returns the bytes taken up by the files in the transfer
+// directory, leaving out the parts of the uploads in progress, which are
+// reserved for in full instead. Parts not written to for -transfer-part-ttl
+// are removed first.
+func (s *server) transferUsage(l *slog.Logger) (int64, error) {
+	entries, err := fs.ReadDir(s.transferDir.FS(), ".")
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		name := e.Name()
+		if strings.HasPrefix(name, ".") && strings.HasSuffix(name, partSuffix) {
+			// Claimed like an upload, so that none starts on it while it
+			// is removed.
+			if _, busy := s.uploads.LoadOrStore(name, struct{}{}); busy {
+				continue
+			}
+			stale := s.cfg.transferPartTTL > 0 && time.Since(fi.ModTime()) > s.cfg.transferPartTTL
+			if stale && s.transferDir.Remove(name) == nil {
+				l.Info("stale upload part removed", "part", name, "bytes", fi.Size(), "modified", fi.ModTime())
+				s.uploads.Delete(name)
+				continue
+			}
+			s.uploads.Delete(name)
+		}
+		used += fi.Size()
+	}
+	return used, nil
+}
+
+// receiveFile stores the file of req read from br in the transfer directory,
+// after telling the client on w where to resume. The file is kept under its
+// part name, where an interrupted upload stays for the next attempt, and
+// only replaces a file of the same name once its size and digest are
+// verified. Uploads that would overfill the directory are refused. It
+// returns the offset the upload resumed from. Failures to report to the
+// client are returned as a [*transfer.RemoteError].
+func (s *server) receiveFile(w io.Writer, br *bufio.Reader, req transfer.Request, l *slog.Logger) (int64, error) {
+	if req.Size > s.cfg.transferMaxSize {
+		return 0, &transfer.RemoteError{Reason: fmt.Sprintf("file exceeds the limit of %d bytes", s.cfg.transferMaxSize)}
+	}
+	part := partName(req)
+	if _, busy := s.uploads.LoadOrStore(part, struct{}{}); busy {
+		return 0, &transfer.RemoteError{Reason: "an upload of this file is in progress"}
+	}
+	defer s.uploads.Delete(part)
+	release, err := s.reserveTransfer(req.Name, req.Size, l)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// Files may hold anything clients upload: only the server reads them.
+	f, err := s.transferDir.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	discard := false
+	defer func() {
+		_ = f.Close()
+		if discard {
+			_ = s.transferDir.Remove(part)
+		}
+	}()
+
+	// The digest covers the part kept from earlier attempts too.
+	h := sha256.New()
+	offset, err := io.Copy(h, io.LimitReader(f, req.Size))
+	if err != nil {
+		return 0, fmt.Errorf("read part: %w", err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("truncate part: %w", err)
+	}
+	if err := transfer.WriteReady(w, offset); err != nil {
+		return 0, fmt.Errorf("send reply: %w", err)
+	}
+
+	if _, err := io.CopyN(io.MultiWriter(f, h), br, req.Size-offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return offset, &transfer.RemoteError{Reason: "file shorter than announced"}
+		}
+		return offset, fmt.Errorf("receive file: %w", err)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, req.Sum) {
+		discard = true
+		return offset, &transfer.RemoteError{Reason: "sha256 mismatch, got " + hex.EncodeToString(sum)}
+	}
+	if err := f.Close(); err != nil {
+		return offset, fmt.Errorf("write file: %w", err)
+	}
+	if err := s.transferDir.Rename(part, req.Name); err != nil {
+		return offset, fmt.Errorf("store file: %w", err)
+	}
+	return offset, nil
+}
+
+// sendFile replies with the size and digest of the file name in the
+// transfer directory and sends its content from offset on on w, returning
+// the number of bytes sent. Failures to report to the client are returned
+// as a [*transfer.RemoteError].
+func (s *server) sendFile(w io.Writer, name string, offset int64) (int64, error) {
+	f, err := s.transferDir.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, &transfer.RemoteError{Reason: "no such file"}
+	}
+	if err != nil {
+		return 0, &transfer.RemoteError{Reason: "cannot open file"}
+	}
+	defer func() { _ = f.Close() }()
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return 0, &transfer.RemoteError{Reason: "not a regular file"}
+	}
+
+	// The digest goes before the content, so the file is read twice.
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, fmt.Errorf("hash file: %w", err)
+	}
+	if offset > size {
+		return 0, &transfer.RemoteError{Reason: fmt.Sprintf("offset %d beyond the end of the file", offset)}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek file: %w", err)
+	}
+	if err := transfer.WriteReply(w, transfer.Reply{Size: size, Sum: h.Sum(nil)}); err != nil {
+		return 0, fmt.Errorf("send reply: %w", err)
+	}
+	if _, err := io.CopyN(w, f, size-offset); err != nil {
+		return 0, fmt.Errorf("send file: %w", err)
+	}
+	return size - offset, nil
+}
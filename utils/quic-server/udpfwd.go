@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/romanov9617/usb-quic/pkg/streamserver"
+)
+
+// Limits of the UDP forwarding protocol, per connection.
+const (
+	// udpFlowIdle is how long a flow may go without traffic in either
+	// direction before its socket is closed.
+	udpFlowIdle = 2 * time.Minute
+	// maxUDPFlows bounds the number of flows of a connection.
+	maxUDPFlows = 256
+)
+
+// udpForwarder implements the UDP forwarding protocol: every QUIC datagram
+// carries a UDP payload prefixed with a flow ID (a QUIC variable-length
+// integer) chosen by the client for each of its local peers. The server
+// sends the payloads of each flow from a socket of its own to the target,
+// and the target's replies back in datagrams with the same flow ID. Streams
+// carry nothing; they only serve to authenticate.
+type udpForwarder struct {
+	target string
+}
+
+// Serve implements [streamserver.StreamHandler]. The protocol has no use for
+// streams, so st is closed right away.
+func (u *udpForwarder) Serve(_ context.Context, _ *quic.Conn, st *quic.Stream) error {
+	st.CancelRead(0)
+	return st.Close()
+}
+
+// udpFlow is a flow of a connection with its socket to the target.
+type udpFlow struct {
+	id   uint64
+	sock net.Conn
+	// last is the time of the last packet in either direction, in Unix
+	// nanoseconds.
+	last atomic.Int64
+}
+
+// ServeDatagrams implements [streamserver.DatagramHandler]. It forwards the
+// datagrams received on conn until conn is closed.
+func (u *udpForwarder) ServeDatagrams(ctx context.Context, conn *quic.Conn) error {
+	l := streamserver.Logger(ctx).With("component", "udp", "target", u.target)
+
+	flows := make(map[uint64]*udpFlow)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var up, down, dropped atomic.Int64
+	defer func() {
+		mu.Lock()
+		for _, f := range flows {
+			_ = f.sock.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+		l.Info("udp forwarding done", "up_datagrams", up.Load(), "down_datagrams", down.Load(), "dropped", dropped.Load())
+	}()
+
+	for {
+		p, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("receive datagram: %w", err)
+		}
+		id, n, err := quicvarint.Parse(p)
+		if err != nil {
+			dropped.Add(1)
+			continue
+		}
+
+		mu.Lock()
+		f := flows[id]
+		if f == nil {
+			if len(flows) >= maxUDPFlows {
+				mu.Unlock()
+				dropped.Add(1)
+				l.Debug("flow limit reached", "flow", id, "max", maxUDPFlows)
+				continue
+			}
+			sock, err := net.Dial("udp", u.target)
+			if err != nil {
+				mu.Unlock()
+				dropped.Add(1)
+				l.Warn("dial target", "flow", id, "err", err)
+				continue
+			}
+			f = &udpFlow{id: id, sock: sock}
+			// relayReplies reads the deadline from last right away.
+			f.last.Store(time.Now().UnixNano())
+			flows[id] = f
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u.relayReplies(conn, f, &down, &dropped)
+				mu.Lock()
+				delete(flows, id)
+				mu.Unlock()
+				_ = f.sock.Close()
+				l.Debug("flow ended", "flow", id)
+			}()
+			l.Debug("flow started", "flow", id, "local", sock.LocalAddr().String())
+		}
+		mu.Unlock()
+
+		f.last.Store(time.Now().UnixNano())
+		if _, err := f.sock.Write(p[n:]); err != nil {
+			dropped.Add(1)
+			continue
+		}
+		up.Add(1)
+	}
+}
+
+// relayReplies sends the packets the target sends to f back to conn until
+// f's socket is closed or the flow has been idle for udpFlowIdle.
+func (u *udpForwarder) relayReplies(conn *quic.Conn, f *udpFlow, down, dropped *atomic.Int64) {
+	hdr := quicvarint.Append(nil, f.id)
+	buf := make([]byte, len(hdr)+maxUDPPayload)
+	copy(buf, hdr)
+	for {
+		_ = f.sock.SetReadDeadline(time.Unix(0, f.last.Load()).Add(udpFlowIdle))
+		n, err := f.sock.Read(buf[len(hdr):])
+		if err != nil {
+			// Traffic to the target extends the deadline too.
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, f.last.Load())) < udpFlowIdle {
+				continue
+			}
+			return
+		}
+		f.last.Store(time.Now().UnixNano())
+		if err := conn.SendDatagram(buf[:len(hdr)+n]); err != nil {
+			dropped.Add(1)
+			continue
+		}
+		down.Add(1)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// wtSessionDone is the code WebTransport sessions are closed with once
+// the server is done with them.
+const wtSessionDone webtransport.SessionErrorCode = 0
+
+// serveWebTransport upgrades r to a WebTransport session and echoes
+// everything the client sends on it until the session ends: bidirectional
+// streams are echoed on themselves, every unidirectional stream on a new
+// unidirectional stream, and datagrams as datagrams. It returns once the
+// session has ended.
+func (h *http3Handler) serveWebTransport(w http.ResponseWriter, r *http.Request, l *slog.Logger) {
+	l = l.With("component", "webtransport", "remote", r.RemoteAddr, "path", r.URL.Path)
+	sess, err := h.wt.Upgrade(w, r)
+	if err != nil {
+		l.Warn("upgrade failed", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer func() { _ = sess.CloseWithError(wtSessionDone, "") }()
+	l.Info("session started")
+
+	start := time.Now()
+	var streams, uniStreams, datagrams atomic.Int64
+	var wg sync.WaitGroup
+	ctx := sess.Context()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			p, err := sess.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			if err := sess.SendDatagram(p); err != nil {
+				l.Debug("datagram dropped", "bytes", len(p), "err", err)
+				continue
+			}
+			datagrams.Add(1)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			st, err := sess.AcceptUniStream(ctx)
+			if err != nil {
+				return
+			}
+			uniStreams.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				echoUniStream(ctx, sess, st, l)
+			}()
+		}
+	}()
+
+	for {
+		st, err := sess.AcceptStream(ctx)
+		if err != nil {
+			break
+		}
+		streams.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := io.Copy(st, st); err != nil {
+				st.CancelRead(0)
+				st.CancelWrite(0)
+				l.Debug("stream echo failed", "id", st.StreamID(), "err", err)
+				return
+			}
+			_ = st.Close()
+		}()
+	}
+	wg.Wait()
+
+	attrs := []any{"streams", streams.Load(), "uni_streams", uniStreams.Load(), "datagrams", datagrams.Load(), "dur", time.Since(start)}
+	if err := context.Cause(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		attrs = append(attrs, "reason", err)
+	}
+	l.Info("session ended", attrs...)
+}
+
+// echoUniStream copies st to a new unidirectional stream of sess.
+func echoUniStream(ctx context.Context, sess *webtransport.Session, st *webtransport.ReceiveStream, l *slog.Logger) {
+	out, err := sess.OpenUniStreamSync(ctx)
+	if err != nil {
+		st.CancelRead(0)
+		return
+	}
+	if _, err := io.Copy(out, st); err != nil {
+		st.CancelRead(0)
+		out.CancelWrite(0)
+		l.Debug("unidirectional stream echo failed", "id", st.StreamID(), "err", err)
+		return
+	}
+	_ = out.Close()
+}
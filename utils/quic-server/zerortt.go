@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ticketTimePrefix marks the session state extra that records when a session
+// ticket was issued. quic-go keeps its own extras under a different prefix.
+var ticketTimePrefix = []byte("usb-quic/issued:")
+
+// maxReplayEntries bounds the anti-replay cache. While it is full, 0-RTT is
+// refused rather than risking a replay.
+const maxReplayEntries = 1 << 16
+
+// antiReplay guards 0-RTT against replays.
+//
+// Every session ticket carries the time it was issued. A ticket may carry
+// early data only while it is younger than the window, and only the first
+// time it is presented: the cache remembers each ticket used for 0-RTT until
+// it ages out of the window. Refused tickets still resume the session, but
+// with a full 1-RTT handshake that a replaying attacker cannot complete.
+//
+// 0-RTT is also only offered for the protocols in alpns, since early data
+// must be safe to process twice if the cache is ever bypassed, for example
+// after a restart with shared ticket keys.
+type antiReplay struct {
+	window time.Duration
+	alpns  []string
+	l      *slog.Logger
+
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]time.Time // ticket hash -> expiry
+}
+
+// newAntiReplay returns an anti-replay cache admitting 0-RTT for tickets
+// younger than window on the protocols in alpns.
+func newAntiReplay(window time.Duration, alpns []string, l *slog.Logger) (*antiReplay, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("0-RTT window must be positive, got %v", window)
+	}
+	return &antiReplay{
+		window: window,
+		alpns:  alpns,
+		l:      l.With("component", "0rtt"),
+		seen:   make(map[[sha256.Size]byte]time.Time),
+	}, nil
+}
+
+// install makes conf issue and check session tickets through ar.
+func (ar *antiReplay) install(conf *tls.Config) {
+	conf.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		if !slices.Contains(ar.alpns, cs.NegotiatedProtocol) {
+			ss.EarlyData = false
+		}
+		ss.Extra = append(ss.Extra, binary.BigEndian.AppendUint64(bytes.Clone(ticketTimePrefix), uint64(time.Now().Unix())))
+		return conf.EncryptTicket(cs, ss)
+	}
+	conf.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		ss, err := conf.DecryptTicket(identity, cs)
+		if err != nil || ss == nil || !ss.EarlyData {
+			return ss, err
+		}
+		if reason := ar.check(identity, ss, cs.NegotiatedProtocol); reason != "" {
+			ss.EarlyData = false
+			ar.l.Debug("0-RTT refused", "reason", reason, "alpn", cs.NegotiatedProtocol)
+		}
+		return ss, nil
+	}
+}
+
+// check decides whether the ticket identity with state ss may carry early
+// data for alpn. It returns the reason if not, and records the ticket as used
+// otherwise.
+func (ar *antiReplay) check(identity []byte, ss *tls.SessionState, alpn string) string {
+	if !slices.Contains(ar.alpns, alpn) {
+		return "protocol not allowed"
+	}
+	issued, ok := ticketIssued(ss)
+	if !ok {
+		return "ticket has no issue time"
+	}
+	now := time.Now()
+	expiry := issued.Add(ar.window)
+	if !now.Before(expiry) {
+		return "ticket too old"
+	}
+
+	key := sha256.Sum256(identity)
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if _, replayed := ar.seen[key]; replayed {
+		return "ticket already used"
+	}
+	if len(ar.seen) >= maxReplayEntries {
+		for k, exp := range ar.seen {
+			if !now.Before(exp) {
+				delete(ar.seen, k)
+			}
+		}
+		if len(ar.seen) >= maxReplayEntries {
+			return "replay cache full"
+		}
+	}
+	ar.seen[key] = expiry
+	return ""
+}
+
+// ticketIssued returns the issue time recorded in ss by WrapSession.
+func ticketIssued(ss *tls.SessionState) (time.Time, bool) {
+	for _, e := range ss.Extra {
+		if ts, ok := bytes.CutPrefix(e, ticketTimePrefix); ok && len(ts) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint64(ts)), 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// String returns a short description for logging.
+func (ar *antiReplay) String() string {
+	return fmt.Sprintf("window=%v protocols=%v", ar.window, ar.alpns)
+}